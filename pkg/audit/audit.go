@@ -0,0 +1,169 @@
+// Package audit records the mutating actions on repositories, e.g. who
+// published a file, as JSON lines.
+package audit
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Action is a mutating action on a repository.
+type Action string
+
+const (
+	// ActionPublish adds a new file.
+	ActionPublish Action = "publish"
+	// ActionOverwrite replaces a file with different content.
+	ActionOverwrite Action = "overwrite"
+	// ActionDelete deletes the files of a tag.
+	ActionDelete Action = "delete"
+	// ActionTag points a tag to a version, e.g. an npm dist tag or a ref tag.
+	ActionTag Action = "tag"
+	// ActionUntag removes a tag pointing to a version.
+	ActionUntag Action = "untag"
+)
+
+// contextKey is a private string type to prevent collisions in the context map.
+type contextKey string
+
+const (
+	// loggerKey points to the value in the context where the audit logger is stored.
+	loggerKey = contextKey("logger")
+	// requestKey points to the value in the context where the request is stored.
+	requestKey = contextKey("request")
+)
+
+// Request describes the request that caused the action.
+type Request struct {
+	RepoType     string
+	Identity     string // The authenticated caller, empty if anonymous.
+	ClientIP     string // The address of the connection.
+	ForwardedFor string // The X-Forwarded-For header, which is set by proxies but can be spoofed.
+	UserAgent    string
+	Method       string
+	Path         string
+}
+
+// Event is a mutating action.
+type Event struct {
+	Action Action
+	Repo   string // The backend repository, e.g. com/example/project.
+	Tag    string
+	File   string
+	Digest string // Digest of the file, if any.
+
+	// Manifest is the digest of the manifest the tag points to after the action.
+	Manifest string
+
+	// Attrs are additional details of the action, e.g. the version of a dist tag.
+	Attrs []slog.Attr
+}
+
+// Logger writes events as JSON lines.
+type Logger struct {
+	logger *slog.Logger
+	closer io.Closer
+}
+
+// NewLogger creates a logger that writes to w.
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{logger: slog.New(slog.NewJSONHandler(w, nil))}
+}
+
+// NewFileLogger creates a logger that writes to the file at path and rotates
+// it when it exceeds maxSizeMB, keeping at most maxBackups old files. The path
+// "-" writes to stdout.
+func NewFileLogger(path string, maxSizeMB, maxBackups int) *Logger {
+	if path == "-" {
+		return NewLogger(os.Stdout)
+	}
+	w := &lumberjack.Logger{Filename: path, MaxSize: maxSizeMB, MaxBackups: maxBackups}
+	l := NewLogger(w)
+	l.closer = w
+	return l
+}
+
+// Close closes the underlying file, if any.
+func (l *Logger) Close() error {
+	if l.closer == nil {
+		return nil
+	}
+	return l.closer.Close() //nolint:wrapcheck // Want passthrough error.
+}
+
+// Log writes the event together with the request in ctx.
+func (l *Logger) Log(ctx context.Context, e *Event) {
+	attrs := []slog.Attr{
+		slog.String("action", string(e.Action)),
+		slog.String("repo", e.Repo),
+	}
+	if e.Tag != "" {
+		attrs = append(attrs, slog.String("tag", e.Tag))
+	}
+	if e.File != "" {
+		attrs = append(attrs, slog.String("file", e.File))
+	}
+	if e.Digest != "" {
+		attrs = append(attrs, slog.String("digest", e.Digest))
+	}
+	if e.Manifest != "" {
+		attrs = append(attrs, slog.String("manifest", e.Manifest))
+	}
+	attrs = append(attrs, e.Attrs...)
+
+	if r, ok := RequestFromContext(ctx); ok {
+		attrs = append(attrs,
+			slog.String("repo_type", r.RepoType),
+			slog.String("identity", r.Identity),
+			slog.String("client_ip", r.ClientIP),
+			slog.String("user_agent", r.UserAgent),
+			slog.String("method", r.Method),
+			slog.String("path", r.Path),
+		)
+		if r.ForwardedFor != "" {
+			attrs = append(attrs, slog.String("forwarded_for", r.ForwardedFor))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+	}
+	l.logger.LogAttrs(ctx, slog.LevelInfo, "audit", attrs...)
+}
+
+// Middleware adds the logger to the request context, so actions deeper down
+// are recorded with Record.
+func (l *Logger) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithLogger(r.Context(), l)))
+	})
+}
+
+// WithLogger adds the logger to the context.
+func WithLogger(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// WithRequest adds the request to the context.
+func WithRequest(ctx context.Context, r *Request) context.Context {
+	return context.WithValue(ctx, requestKey, r)
+}
+
+// RequestFromContext extracts the request from the context.
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	r, ok := ctx.Value(requestKey).(*Request)
+	return r, ok
+}
+
+// Record logs the event with the logger in ctx. It does nothing if there is
+// no logger, e.g. when auditing is disabled.
+func Record(ctx context.Context, e *Event) {
+	if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+		l.Log(ctx, e)
+	}
+}
@@ -0,0 +1,127 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestRecord(t *testing.T) {
+	t.Parallel()
+
+	event := &Event{
+		Action:   ActionOverwrite,
+		Repo:     "com/example/project",
+		Tag:      "1.0.0",
+		File:     "project-1.0.0.jar",
+		Digest:   "sha256:file",
+		Manifest: "sha256:manifest",
+		Attrs:    []slog.Attr{slog.String("version", "1.0.0")},
+	}
+
+	cases := []struct {
+		name    string
+		request *Request
+		want    map[string]any
+	}{
+		{
+			name: "with request",
+			request: &Request{
+				RepoType:     "maven",
+				Identity:     "octo-org/octo-repo",
+				ClientIP:     "10.0.0.1",
+				ForwardedFor: "203.0.113.1",
+				UserAgent:    "Apache-Maven/3.9.6",
+				Method:       "PUT",
+				Path:         "/maven/com/example/project/1.0.0/project-1.0.0.jar",
+			},
+			want: map[string]any{
+				"level":         "INFO",
+				"msg":           "audit",
+				"action":        "overwrite",
+				"repo":          "com/example/project",
+				"tag":           "1.0.0",
+				"file":          "project-1.0.0.jar",
+				"digest":        "sha256:file",
+				"manifest":      "sha256:manifest",
+				"version":       "1.0.0",
+				"repo_type":     "maven",
+				"identity":      "octo-org/octo-repo",
+				"client_ip":     "10.0.0.1",
+				"forwarded_for": "203.0.113.1",
+				"user_agent":    "Apache-Maven/3.9.6",
+				"method":        "PUT",
+				"path":          "/maven/com/example/project/1.0.0/project-1.0.0.jar",
+			},
+		},
+		{
+			name: "without request",
+			want: map[string]any{
+				"level":    "INFO",
+				"msg":      "audit",
+				"action":   "overwrite",
+				"repo":     "com/example/project",
+				"tag":      "1.0.0",
+				"file":     "project-1.0.0.jar",
+				"digest":   "sha256:file",
+				"manifest": "sha256:manifest",
+				"version":  "1.0.0",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var buf bytes.Buffer
+			ctx := WithLogger(context.Background(), NewLogger(&buf))
+			if tc.request != nil {
+				ctx = WithRequest(ctx, tc.request)
+			}
+			Record(ctx, event)
+
+			var got map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("failed to parse audit log %q: %v", buf.String(), err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreMapEntries(func(k string, _ any) bool { return k == "time" })); diff != "" {
+				t.Errorf("audit log mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRecordWithoutLogger(t *testing.T) {
+	t.Parallel()
+
+	// Must not panic.
+	Record(context.Background(), &Event{Action: ActionPublish, Repo: "foo"})
+}
+
+func TestNewFileLogger(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := NewFileLogger(path, 1, 1)
+	l.Log(context.Background(), &Event{Action: ActionDelete, Repo: "foo", Tag: "v1"})
+	l.Log(context.Background(), &Event{Action: ActionPublish, Repo: "foo", Tag: "v2"})
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() returned error: %v", err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := bytes.Count(b, []byte("\n")), 2; got != want {
+		t.Errorf("audit log has %d lines, want %d:\n%s", got, want, b)
+	}
+}
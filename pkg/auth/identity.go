@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"context"
+	"slices"
+)
+
+// contextKey is a private string type to prevent collisions in the context map.
+type contextKey string
+
+// identityKey points to the value in the context where the identity is stored.
+const identityKey = contextKey("identity")
+
+// Privilege is an action that must be granted to an identity on top of
+// reading and writing.
+type Privilege string
+
+// PrivilegeDelete allows deleting versions and files.
+const PrivilegeDelete Privilege = "delete"
+
+// Identity represents the authenticated caller of a request.
+type Identity struct {
+	Subject    string         // The identity used by policies, e.g. the value of the "repository" claim.
+	Issuer     string         // The issuer that vouched for the identity.
+	Claims     map[string]any // All the claims in the verified token.
+	Privileges []Privilege    // The privileges granted to the identity.
+}
+
+// Allowed reports whether the caller in ctx may perform the privileged action.
+// Identities act with the shared backend credential, so they need the
+// privilege to be granted. Other callers act with their own credential and
+// the backend registry decides.
+func Allowed(ctx context.Context, p Privilege) bool {
+	id, ok := IdentityFromContext(ctx)
+	if !ok {
+		return true
+	}
+	return slices.Contains(id.Privileges, p)
+}
+
+// WithIdentity adds the identity to the context.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, id)
+}
+
+// IdentityFromContext extracts the identity from the context.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey).(*Identity)
+	return id, ok
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"context"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		id   *Identity
+		want bool
+	}{
+		{
+			name: "no identity",
+			want: true,
+		},
+		{
+			name: "granted",
+			id:   &Identity{Subject: "yolocs/ocifactory", Privileges: []Privilege{PrivilegeDelete}},
+			want: true,
+		},
+		{
+			name: "not granted",
+			id:   &Identity{Subject: "yolocs/ocifactory"},
+			want: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			if tc.id != nil {
+				ctx = WithIdentity(ctx, tc.id)
+			}
+			if got := Allowed(ctx, PrivilegeDelete); got != tc.want {
+				t.Errorf("Allowed() = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
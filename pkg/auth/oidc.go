@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/yolocs/ocifactory/pkg/cred"
+)
+
+const (
+	// DefaultIdentityClaim is the claim used as the identity subject if none is configured.
+	DefaultIdentityClaim = "sub"
+
+	// DefaultBasicUser is the basic auth user name that marks the password as an OIDC token.
+	// Clients like maven and twine only speak basic auth, so they can send the token this way.
+	DefaultBasicUser = "oidc"
+
+	// Allowed clock skew when validating the token expiry.
+	leeway = time.Minute
+
+	// Minimal interval between two JWKS refreshes triggered by unknown key IDs.
+	minRefreshInterval = time.Minute
+)
+
+var supportedAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// OIDCConfig configures how OIDC tokens are verified.
+type OIDCConfig struct {
+	Issuer        string   // Expected "iss" claim. Required.
+	JWKS          string   // Path or http(s) URL to the JWKS. Required.
+	Audiences     []string // Accepted "aud" claims. If empty, the audience is not checked.
+	IdentityClaim string   // Claim mapped to Identity.Subject. Defaults to "sub".
+	BasicUser     string   // Basic auth user name that carries a token as password. Defaults to "oidc".
+	Deleters      []string // Identities granted PrivilegeDelete.
+
+	// BackendCred is used to talk to the backend registry on behalf of verified callers.
+	// If nil, requests are sent to the backend anonymously.
+	BackendCred *cred.BasicCred
+}
+
+// OIDCVerifier verifies OIDC tokens issued by a single issuer.
+type OIDCVerifier struct {
+	cfg        *OIDCConfig
+	httpClient *http.Client
+
+	mu          sync.RWMutex
+	keys        *jose.JSONWebKeySet
+	lastRefresh time.Time // Time of the last refresh attempt, failed or not.
+
+	// refreshMu lets one refresh run at a time. Callers waiting for it get the
+	// refreshed keys instead of fetching again.
+	refreshMu sync.Mutex
+}
+
+// NewOIDCVerifier creates a new OIDCVerifier and loads the JWKS.
+func NewOIDCVerifier(ctx context.Context, cfg *OIDCConfig) (*OIDCVerifier, error) {
+	if cfg.Issuer == "" {
+		return nil, fmt.Errorf("oidc issuer is required")
+	}
+	if cfg.JWKS == "" {
+		return nil, fmt.Errorf("oidc jwks is required")
+	}
+
+	c := *cfg
+	if c.IdentityClaim == "" {
+		c.IdentityClaim = DefaultIdentityClaim
+	}
+	if c.BasicUser == "" {
+		c.BasicUser = DefaultBasicUser
+	}
+
+	v := &OIDCVerifier{
+		cfg:        &c,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	if err := v.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Verify verifies the raw token and returns the identity it represents.
+func (v *OIDCVerifier) Verify(ctx context.Context, raw string) (*Identity, error) {
+	tok, err := jwt.ParseSigned(raw, supportedAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token: %w", err)
+	}
+
+	var kid string
+	if len(tok.Headers) > 0 {
+		kid = tok.Headers[0].KeyID
+	}
+	keys, err := v.keySet(ctx, kid)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwt.Claims
+	allClaims := make(map[string]any)
+	if err := tok.Claims(keys, &claims, &allClaims); err != nil {
+		return nil, fmt.Errorf("failed to verify token: %w", err)
+	}
+
+	expected := jwt.Expected{Issuer: v.cfg.Issuer, Time: time.Now()}
+	if len(v.cfg.Audiences) > 0 {
+		expected.AnyAudience = v.cfg.Audiences
+	}
+	if err := claims.ValidateWithLeeway(expected, leeway); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %w", err)
+	}
+
+	subject, ok := allClaims[v.cfg.IdentityClaim].(string)
+	if !ok || subject == "" {
+		return nil, fmt.Errorf("token is missing identity claim %q", v.cfg.IdentityClaim)
+	}
+
+	id := &Identity{
+		Subject: subject,
+		Issuer:  claims.Issuer,
+		Claims:  allClaims,
+	}
+	if slices.Contains(v.cfg.Deleters, subject) {
+		id.Privileges = append(id.Privileges, PrivilegeDelete)
+	}
+	return id, nil
+}
+
+// Middleware verifies OIDC tokens sent either as bearer tokens or as the
+// password of the configured basic auth user. Requests without such a token
+// are passed through untouched. Requests with an invalid token are rejected.
+//
+// On success, the identity is added to the context and the backend credential
+// replaces the caller's token; without a backend credential the backend is
+// called anonymously. The authorization header is removed so the token is
+// never forwarded to the backend registry.
+func (v *OIDCVerifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := v.tokenFromRequest(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ctx := r.Context()
+		id, err := v.Verify(ctx, raw)
+		if err != nil {
+			logging.FromContext(ctx).DebugContext(ctx, "failed to verify oidc token", "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "invalid oidc token", http.StatusUnauthorized)
+			return
+		}
+
+		// Always replace the cred so a token sent as basic auth never reaches
+		// the backend, even if it was passed through by another middleware.
+		ctx = WithIdentity(ctx, id)
+		ctx = cred.WithCred(ctx, &cred.Cred{Basic: v.cfg.BackendCred})
+		r = r.WithContext(ctx)
+		r.Header.Del("Authorization")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (v *OIDCVerifier) tokenFromRequest(r *http.Request) (string, bool) {
+	if user, pwd, ok := r.BasicAuth(); ok {
+		return pwd, user == v.cfg.BasicUser && pwd != ""
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// keySet returns the current key set. If the key ID is unknown, the key set is
+// refreshed at most once per minRefreshInterval to pick up rotated keys. Failed
+// refreshes count too, so unknown key IDs can't hammer a failing JWKS endpoint.
+func (v *OIDCVerifier) keySet(ctx context.Context, kid string) (*jose.JSONWebKeySet, error) {
+	v.mu.RLock()
+	keys := v.keys
+	v.mu.RUnlock()
+
+	if kid == "" || len(keys.Key(kid)) > 0 {
+		return keys, nil
+	}
+
+	// Wait for a refresh in flight, its keys may have the key ID.
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+
+	v.mu.Lock()
+	if time.Since(v.lastRefresh) < minRefreshInterval {
+		keys := v.keys
+		v.mu.Unlock()
+		return keys, nil
+	}
+	v.lastRefresh = time.Now()
+	v.mu.Unlock()
+
+	if err := v.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.keys, nil
+}
+
+func (v *OIDCVerifier) refresh(ctx context.Context) error {
+	b, err := v.loadJWKS(ctx)
+	if err != nil {
+		return err
+	}
+
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return fmt.Errorf("failed to parse jwks: %w", err)
+	}
+	if len(keys.Keys) == 0 {
+		return errors.New("jwks has no keys")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = &keys
+	v.lastRefresh = time.Now()
+	return nil
+}
+
+func (v *OIDCVerifier) loadJWKS(ctx context.Context) ([]byte, error) {
+	src := v.cfg.JWKS
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read jwks file: %w", err)
+		}
+		return b, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create jwks request: %w", err)
+	}
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks: unexpected status %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks: %w", err)
+	}
+	return b, nil
+}
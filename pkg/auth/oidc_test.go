@@ -0,0 +1,407 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/google/go-cmp/cmp"
+	"github.com/yolocs/ocifactory/pkg/cred"
+)
+
+const testIssuer = "https://token.example.com"
+
+type testSigner struct {
+	signer jose.Signer
+	jwks   []byte
+}
+
+func newTestSigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", kid),
+	)
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: key.Public(), KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"},
+	}})
+	if err != nil {
+		t.Fatalf("failed to marshal jwks: %v", err)
+	}
+
+	return &testSigner{signer: signer, jwks: jwks}
+}
+
+func (s *testSigner) token(t *testing.T, claims map[string]any) string {
+	t.Helper()
+
+	raw, err := jwt.Signed(s.signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return raw
+}
+
+func (s *testSigner) jwksFile(t *testing.T) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(p, s.jwks, 0o600); err != nil {
+		t.Fatalf("failed to write jwks: %v", err)
+	}
+	return p
+}
+
+func validClaims() map[string]any {
+	now := time.Now()
+	return map[string]any{
+		"iss":        testIssuer,
+		"sub":        "repo:yolocs/ocifactory:ref:refs/heads/main",
+		"aud":        "ocifactory",
+		"repository": "yolocs/ocifactory",
+		"iat":        now.Unix(),
+		"exp":        now.Add(time.Hour).Unix(),
+	}
+}
+
+func TestOIDCVerifierVerify(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestSigner(t, "key-1")
+	otherSigner := newTestSigner(t, "key-1")
+
+	cases := []struct {
+		name           string
+		cfg            *OIDCConfig
+		token          func(t *testing.T) string
+		wantSubject    string
+		wantPrivileges []Privilege
+		wantErr        string
+	}{
+		{
+			name: "default identity claim",
+			cfg:  &OIDCConfig{Issuer: testIssuer},
+			token: func(t *testing.T) string {
+				return signer.token(t, validClaims())
+			},
+			wantSubject: "repo:yolocs/ocifactory:ref:refs/heads/main",
+		},
+		{
+			name: "custom identity claim",
+			cfg:  &OIDCConfig{Issuer: testIssuer, IdentityClaim: "repository", Audiences: []string{"ocifactory"}},
+			token: func(t *testing.T) string {
+				return signer.token(t, validClaims())
+			},
+			wantSubject: "yolocs/ocifactory",
+		},
+		{
+			name: "granted delete",
+			cfg:  &OIDCConfig{Issuer: testIssuer, IdentityClaim: "repository", Deleters: []string{"other/repo", "yolocs/ocifactory"}},
+			token: func(t *testing.T) string {
+				return signer.token(t, validClaims())
+			},
+			wantSubject:    "yolocs/ocifactory",
+			wantPrivileges: []Privilege{PrivilegeDelete},
+		},
+		{
+			name: "missing identity claim",
+			cfg:  &OIDCConfig{Issuer: testIssuer, IdentityClaim: "job_workflow_ref"},
+			token: func(t *testing.T) string {
+				return signer.token(t, validClaims())
+			},
+			wantErr: `missing identity claim "job_workflow_ref"`,
+		},
+		{
+			name: "wrong issuer",
+			cfg:  &OIDCConfig{Issuer: "https://other.example.com"},
+			token: func(t *testing.T) string {
+				return signer.token(t, validClaims())
+			},
+			wantErr: "invalid token claims",
+		},
+		{
+			name: "wrong audience",
+			cfg:  &OIDCConfig{Issuer: testIssuer, Audiences: []string{"other"}},
+			token: func(t *testing.T) string {
+				return signer.token(t, validClaims())
+			},
+			wantErr: "invalid token claims",
+		},
+		{
+			name: "expired",
+			cfg:  &OIDCConfig{Issuer: testIssuer},
+			token: func(t *testing.T) string {
+				c := validClaims()
+				c["exp"] = time.Now().Add(-time.Hour).Unix()
+				return signer.token(t, c)
+			},
+			wantErr: "invalid token claims",
+		},
+		{
+			name: "signed by unknown key",
+			cfg:  &OIDCConfig{Issuer: testIssuer},
+			token: func(t *testing.T) string {
+				return otherSigner.token(t, validClaims())
+			},
+			wantErr: "failed to verify token",
+		},
+		{
+			name: "not a jwt",
+			cfg:  &OIDCConfig{Issuer: testIssuer},
+			token: func(t *testing.T) string {
+				return "not-a-jwt"
+			},
+			wantErr: "failed to parse token",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			tc.cfg.JWKS = signer.jwksFile(t)
+			v, err := NewOIDCVerifier(context.Background(), tc.cfg)
+			if err != nil {
+				t.Fatalf("NewOIDCVerifier() unexpected error: %v", err)
+			}
+
+			id, err := v.Verify(context.Background(), tc.token(t))
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Fatalf("Verify() unexpected error: %s", diff)
+			}
+			if err != nil {
+				return
+			}
+			if got, want := id.Subject, tc.wantSubject; got != want {
+				t.Errorf("Verify() subject = %q, want %q", got, want)
+			}
+			if got, want := id.Issuer, testIssuer; got != want {
+				t.Errorf("Verify() issuer = %q, want %q", got, want)
+			}
+			if diff := cmp.Diff(tc.wantPrivileges, id.Privileges); diff != "" {
+				t.Errorf("Verify() privileges mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewOIDCVerifierJWKSURL(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestSigner(t, "key-1")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(signer.jwks) //nolint:errcheck // Test server.
+	}))
+	t.Cleanup(srv.Close)
+
+	v, err := NewOIDCVerifier(context.Background(), &OIDCConfig{Issuer: testIssuer, JWKS: srv.URL})
+	if err != nil {
+		t.Fatalf("NewOIDCVerifier() unexpected error: %v", err)
+	}
+	if _, err := v.Verify(context.Background(), signer.token(t, validClaims())); err != nil {
+		t.Errorf("Verify() unexpected error: %v", err)
+	}
+}
+
+func TestOIDCVerifierMiddleware(t *testing.T) {
+	t.Parallel()
+
+	signer := newTestSigner(t, "key-1")
+	backendCred := &cred.BasicCred{User: "robot", Password: "secret"}
+	v, err := NewOIDCVerifier(context.Background(), &OIDCConfig{
+		Issuer:        testIssuer,
+		JWKS:          signer.jwksFile(t),
+		IdentityClaim: "repository",
+		BackendCred:   backendCred,
+	})
+	if err != nil {
+		t.Fatalf("NewOIDCVerifier() unexpected error: %v", err)
+	}
+	token := signer.token(t, validClaims())
+
+	cases := []struct {
+		name         string
+		setAuth      func(r *http.Request)
+		wantStatus   int
+		wantIdentity string
+		wantCred     *cred.BasicCred
+		wantAuthHdr  bool
+	}{
+		{
+			name:       "no auth",
+			setAuth:    func(r *http.Request) {},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "unrelated basic auth",
+			setAuth: func(r *http.Request) {
+				r.SetBasicAuth("user", "pwd")
+			},
+			wantStatus:  http.StatusOK,
+			wantAuthHdr: true,
+		},
+		{
+			name: "bearer token",
+			setAuth: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer "+token)
+			},
+			wantStatus:   http.StatusOK,
+			wantIdentity: "yolocs/ocifactory",
+			wantCred:     backendCred,
+		},
+		{
+			name: "token as basic password",
+			setAuth: func(r *http.Request) {
+				r.SetBasicAuth(DefaultBasicUser, token)
+			},
+			wantStatus:   http.StatusOK,
+			wantIdentity: "yolocs/ocifactory",
+			wantCred:     backendCred,
+		},
+		{
+			name: "invalid bearer token",
+			setAuth: func(r *http.Request) {
+				r.Header.Set("Authorization", "Bearer "+token+"x")
+			},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var gotIdentity string
+			var gotCred *cred.BasicCred
+			var gotAuthHdr bool
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if id, ok := IdentityFromContext(r.Context()); ok {
+					gotIdentity = id.Subject
+				}
+				if c, ok := cred.FromContext(r.Context()); ok {
+					gotCred = c.Basic
+				}
+				gotAuthHdr = r.Header.Get("Authorization") != ""
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			tc.setAuth(req)
+			resp := httptest.NewRecorder()
+			v.Middleware(next).ServeHTTP(resp, req)
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+			if got, want := gotIdentity, tc.wantIdentity; got != want {
+				t.Errorf("Identity = %q, want %q", got, want)
+			}
+			if got, want := gotCred, tc.wantCred; got != want {
+				t.Errorf("Backend cred = %v, want %v", got, want)
+			}
+			if got, want := gotAuthHdr, tc.wantAuthHdr; got != want {
+				t.Errorf("Authorization header forwarded = %t, want %t", got, want)
+			}
+		})
+	}
+}
+
+func TestOIDCVerifierRefreshLimit(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		failRefresh bool
+		wantErr     bool
+	}{
+		{
+			name:        "failing jwks endpoint",
+			failRefresh: true,
+			wantErr:     true,
+		},
+		{
+			name: "rotated key",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			old := newTestSigner(t, "key-1")
+			rotated := newTestSigner(t, "key-2")
+
+			var hits atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := hits.Add(1)
+				switch {
+				case n == 1:
+					w.Write(old.jwks) //nolint:errcheck // Test server.
+				case tc.failRefresh:
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				default:
+					w.Write(rotated.jwks) //nolint:errcheck // Test server.
+				}
+			}))
+			t.Cleanup(srv.Close)
+
+			v, err := NewOIDCVerifier(context.Background(), &OIDCConfig{Issuer: testIssuer, JWKS: srv.URL})
+			if err != nil {
+				t.Fatalf("NewOIDCVerifier() unexpected error: %v", err)
+			}
+			v.mu.Lock()
+			v.lastRefresh = time.Now().Add(-2 * minRefreshInterval)
+			v.mu.Unlock()
+
+			// Concurrent and repeated tokens with the new key ID refresh once.
+			token := rotated.token(t, validClaims())
+			var wg sync.WaitGroup
+			errs := make([]error, 20)
+			for i := range errs {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, errs[i] = v.Verify(context.Background(), token)
+				}()
+			}
+			wg.Wait()
+			if _, err := v.Verify(context.Background(), token); (err != nil) != tc.wantErr {
+				t.Errorf("Verify() error = %v, want error %t", err, tc.wantErr)
+			}
+
+			if got, want := hits.Load(), int32(2); got != want {
+				t.Errorf("JWKS fetched %d times, want %d", got, want)
+			}
+			if !tc.wantErr {
+				for i, err := range errs {
+					if err != nil {
+						t.Errorf("Verify() %d unexpected error: %v", i, err)
+					}
+				}
+			}
+		})
+	}
+}
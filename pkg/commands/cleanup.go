@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yolocs/ocifactory/pkg/audit"
+	"github.com/yolocs/ocifactory/pkg/retention"
+)
+
+// cleanupIdentity is the identity of deletions made by the retention rules in
+// the audit log and events.
+const cleanupIdentity = "cleanup"
+
+// CleanupCommand enforces the retention rules once. It takes the serve flags,
+// so it can run with the same config file and environment as the server.
+type CleanupCommand struct {
+	ServeCommand
+}
+
+func (c *CleanupCommand) Desc() string {
+	return "Delete the versions selected by the retention rules of the repos once."
+}
+
+func (c *CleanupCommand) Help() string {
+	return `
+Usage: {{ COMMAND }} [options]
+
+  Takes the options of serve. Retention rules are set per repo in the config
+  file. Use -cleanup-dry-run to only report the versions that would be deleted.
+`
+}
+
+func (c *CleanupCommand) Run(ctx context.Context, args []string) error {
+	flags, err := c.parseFlagSet(c.Flags(), args)
+	if err != nil {
+		return err
+	}
+
+	targets, err := newRetentionTargets(flags)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no repo has retention rules, set them in the config file")
+	}
+
+	ctx = withBackendCred(ctx, flags)
+	if flags.auditLog != "" {
+		al := audit.NewFileLogger(flags.auditLog, flags.auditMaxSize, flags.auditBackups)
+		defer al.Close()
+		ctx = audit.WithLogger(ctx, al)
+	}
+
+	deletions, err := retention.Enforce(ctx, targets, flags.cleanupDryRun)
+	failed := c.printDeletions(deletions, flags.cleanupDryRun)
+	if failed > 0 {
+		err = errors.Join(err, fmt.Errorf("failed to delete %d of %d versions", failed, len(deletions)))
+	}
+	return err //nolint:wrapcheck // Already wrapped.
+}
+
+// printDeletions writes the deletions as a table to stdout and returns the
+// number of failed ones.
+func (c *CleanupCommand) printDeletions(deletions []*retention.Deletion, dryRun bool) int {
+	tw := tabwriter.NewWriter(c.Stdout(), 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tPACKAGE\tVERSION\tCREATED\tREASON\tRESULT")
+	failed := 0
+	for _, d := range deletions {
+		created := "unknown"
+		if !d.Created.IsZero() {
+			created = d.Created.UTC().Format(time.RFC3339)
+		}
+		result := "deleted"
+		switch {
+		case dryRun:
+			result = "dry run"
+		case d.Err != nil:
+			failed++
+			result = "failed: " + d.Err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.Target, d.Package, d.Version, created, d.Reason, result)
+	}
+	tw.Flush()
+	return failed
+}
@@ -0,0 +1,549 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yolocs/ocifactory/pkg/handler"
+	"github.com/yolocs/ocifactory/pkg/handler/npm"
+	"github.com/yolocs/ocifactory/pkg/retention"
+	"gopkg.in/yaml.v3"
+)
+
+// envVarRegExp matches ${NAME} references in the config file. Use $${NAME} to
+// keep a literal ${NAME}.
+var envVarRegExp = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// serveConfig is the declarative description of the server loaded from the
+// config file. Flags (and their environment variables) override it.
+type serveConfig struct {
+	Port            string        `yaml:"port"`
+	AdminPort       string        `yaml:"admin_port"`
+	TraceExporter   string        `yaml:"trace_exporter"`
+	BackendRegistry string        `yaml:"backend_registry"`
+	LandingDir      string        `yaml:"landing_dir"`
+	UploadChunkSize int64         `yaml:"upload_chunk_size"`
+	Repos           []*repoConfig `yaml:"repos"`
+	Auth            *authConfig   `yaml:"auth"`
+	AuditLog        *auditConfig  `yaml:"audit_log"`
+
+	// Webhooks receive an event when a package version is published,
+	// overwritten or deleted.
+	Webhooks []*webhookConfig `yaml:"webhooks"`
+
+	// Cleanup schedules the retention rules of the repos.
+	Cleanup *cleanupConfig `yaml:"cleanup"`
+}
+
+// cleanupConfig describes how the server enforces the retention rules.
+type cleanupConfig struct {
+	Interval time.Duration `yaml:"interval"` // 0 disables the background job.
+	DryRun   bool          `yaml:"dry_run"`  // Only log the versions that would be deleted.
+}
+
+// webhookConfig describes where events are posted.
+type webhookConfig struct {
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"` // Signs the requests with HMAC-SHA256 if set.
+}
+
+// auditConfig describes where the audit log is written.
+type auditConfig struct {
+	Path       string `yaml:"path"` // Use - for stdout.
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+// repoConfig describes a repository served under a path prefix.
+type repoConfig struct {
+	Type        string          `yaml:"type"`
+	Prefix      string          `yaml:"prefix"`
+	BackendPath string          `yaml:"backend_path"`
+	Upstream    *upstreamConfig `yaml:"upstream"`
+
+	// Members make the repo a group of several backends. Reads resolve in
+	// member order and index pages merge all members. Exactly one member takes
+	// the writes. Cannot be used with BackendPath. Members are OCI backends
+	// only; an upstream can't be a member and is only asked after all members
+	// missed.
+	Members []*memberConfig `yaml:"members"`
+
+	// Retention selects the versions the cleanup deletes. Groups only clean up
+	// the write member. The cleanup lists every repository under the backend
+	// path, so it must be set and not hold the repositories of other repos.
+	Retention []*retentionRuleConfig `yaml:"retention"`
+
+	// Verification checks that artifacts are signed by trusted keys.
+	Verification *verificationConfig `yaml:"verification"`
+
+	// SigningKey is the path of the PEM encoded ECDSA P-256 private key that
+	// signs the served versions for "npm audit signatures". It's read again
+	// on reload. Only used by npm.
+	SigningKey string `yaml:"signing_key"`
+}
+
+// verificationConfig describes how the artifacts of a repo are verified, see
+// handler.VerifyPolicy.
+type verificationConfig struct {
+	// PublicKeys are the paths of the PEM encoded ECDSA or RSA public keys to
+	// trust, e.g. cosign.pub. They are read again on reload.
+	PublicKeys []string `yaml:"public_keys"`
+
+	// Enforce rejects unverified artifacts on publish, download or both. If
+	// not set, the verification state is only reported on downloads. Files
+	// cached from the upstream skip the publish check. With download, the
+	// files to verify are never served from the upstream since it doesn't
+	// have their signatures.
+	Enforce string `yaml:"enforce"`
+
+	// Files are the glob patterns of the file names to verify. Defaults to the
+	// artifacts of the repo type.
+	Files []string `yaml:"files"`
+}
+
+// Allowed values of verificationConfig.Enforce.
+const (
+	enforcePublish  = "publish"
+	enforceDownload = "download"
+	enforceBoth     = "both"
+)
+
+func (v *verificationConfig) validate(i int) error {
+	var merr error
+	if len(v.PublicKeys) == 0 {
+		merr = errors.Join(merr, fmt.Errorf("repos[%d].verification.public_keys: is required", i))
+	}
+	switch v.Enforce {
+	case "", enforcePublish, enforceDownload, enforceBoth:
+	default:
+		merr = errors.Join(merr, fmt.Errorf("repos[%d].verification.enforce: %q is not supported, allowed: [%s, %s, %s]",
+			i, v.Enforce, enforcePublish, enforceDownload, enforceBoth))
+	}
+	for j, pattern := range v.Files {
+		if _, err := path.Match(pattern, ""); err != nil {
+			merr = errors.Join(merr, fmt.Errorf("repos[%d].verification.files[%d]: invalid pattern %q: %w", i, j, pattern, err))
+		}
+	}
+	return merr
+}
+
+// retentionRuleConfig describes a retention rule, see retention.Rule.
+type retentionRuleConfig struct {
+	Packages          string        `yaml:"packages"`
+	Versions          string        `yaml:"versions"`
+	KeepLast          int           `yaml:"keep_last"`
+	MaxAge            time.Duration `yaml:"max_age"`
+	ReleasedSnapshots bool          `yaml:"released_snapshots"`
+}
+
+func (r *retentionRuleConfig) rule() *retention.Rule {
+	return &retention.Rule{
+		Packages:          r.Packages,
+		Versions:          r.Versions,
+		KeepLast:          r.KeepLast,
+		MaxAge:            r.MaxAge,
+		ReleasedSnapshots: r.ReleasedSnapshots,
+	}
+}
+
+// memberConfig describes an OCI backend of a group repo. Remote repositories
+// like Maven Central can't be members, use the Upstream of the repo instead.
+type memberConfig struct {
+	// BackendRegistry defaults to the top level backend registry. Members on
+	// another registry never receive the caller's credential, they use
+	// Username and Password or anonymous access instead.
+	BackendRegistry string `yaml:"backend_registry"`
+	BackendPath     string `yaml:"backend_path"`
+	Write           bool   `yaml:"write"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+}
+
+// upstreamConfig describes the remote repository to proxy missing artifacts from.
+type upstreamConfig struct {
+	URL         string        `yaml:"url"`
+	MetadataTTL time.Duration `yaml:"metadata_ttl"`
+
+	// LocalShadowing makes local packages hide upstream packages with the same
+	// name to protect against dependency confusion. Only used by python.
+	LocalShadowing bool `yaml:"local_shadowing"`
+
+	// PrivateScopes are npm scopes, e.g. "@mycompany", that are never fetched
+	// from the upstream. Only used by npm.
+	PrivateScopes []string `yaml:"private_scopes"`
+}
+
+type authConfig struct {
+	OIDC            *oidcConfig `yaml:"oidc"`
+	BackendUsername string      `yaml:"backend_username"`
+	BackendPassword string      `yaml:"backend_password"`
+}
+
+type oidcConfig struct {
+	Issuer        string   `yaml:"issuer"`
+	JWKS          string   `yaml:"jwks"`
+	Audiences     []string `yaml:"audiences"`
+	IdentityClaim string   `yaml:"identity_claim"`
+	Deleters      []string `yaml:"deleters"` // Identities allowed to delete.
+}
+
+// loadServeConfig reads, interpolates and validates the config file.
+func loadServeConfig(path string) (*serveConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	cfg, err := parseServeConfig(b, os.LookupEnv)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func parseServeConfig(b []byte, lookupEnv func(string) (string, bool)) (*serveConfig, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse yaml: %w", err)
+	}
+	if err := interpolateEnv(&doc, lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := checkKnownFields(b); err != nil {
+		return nil, fmt.Errorf("failed to parse yaml: %w", err)
+	}
+
+	cfg := &serveConfig{}
+	if doc.Kind != 0 {
+		if err := doc.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse yaml: %w", err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// interpolateEnv replaces ${NAME} in the scalar values of the document with
+// the value of the environment variable. Keys and comments are left alone, and
+// the values are never parsed as YAML. Referencing an unset variable is an
+// error so that a missing secret doesn't silently become an empty string.
+func interpolateEnv(n *yaml.Node, lookupEnv func(string) (string, bool)) error {
+	var merr error
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		switch n.Kind {
+		case yaml.ScalarNode:
+			v := envVarRegExp.ReplaceAllStringFunc(n.Value, func(m string) string {
+				if strings.HasPrefix(m, "$$") {
+					return m[1:]
+				}
+				name := envVarRegExp.FindStringSubmatch(m)[1]
+				v, ok := lookupEnv(name)
+				if !ok {
+					merr = errors.Join(merr, fmt.Errorf("line %d: environment variable %q is not set", n.Line, name))
+				}
+				return v
+			})
+			if v != n.Value {
+				n.Value = v
+				// Resolve the type of plain values again, e.g. for ports.
+				if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+					n.Tag = ""
+				}
+			}
+		case yaml.MappingNode:
+			for i := 1; i < len(n.Content); i += 2 {
+				walk(n.Content[i])
+			}
+		case yaml.DocumentNode, yaml.SequenceNode:
+			for _, c := range n.Content {
+				walk(c)
+			}
+		}
+	}
+	walk(n)
+	return merr
+}
+
+// checkKnownFields returns an error for fields of the config file that don't
+// exist. Decoding a yaml.Node doesn't support the check, so the file is
+// decoded again only for it. Type errors are reported by the actual decoding.
+func checkKnownFields(b []byte) error {
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	err := dec.Decode(&serveConfig{})
+	var terr *yaml.TypeError
+	if !errors.As(err, &terr) {
+		return nil
+	}
+	var unknown []string
+	for _, e := range terr.Errors {
+		if strings.Contains(e, " not found in type ") {
+			unknown = append(unknown, e)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	return &yaml.TypeError{Errors: unknown}
+}
+
+// Validate checks the config file on its own. The result of merging it with
+// flags is validated again by serveFlags.Validate.
+func (c *serveConfig) Validate() error {
+	var merr error
+	prefixes := make(map[string]int)
+	for i, r := range c.Repos {
+		if r == nil {
+			merr = errors.Join(merr, fmt.Errorf("repos[%d]: must not be empty", i))
+			continue
+		}
+		if !isRepoTypeSupported(r.Type) {
+			merr = errors.Join(merr, fmt.Errorf("repos[%d].type: %q is not supported, allowed: [%s]",
+				i, r.Type, strings.Join(supportedRepoTypes, ", ")))
+		}
+		if r.Prefix == "" {
+			merr = errors.Join(merr, fmt.Errorf("repos[%d].prefix: is required", i))
+		} else if strings.Contains(r.Prefix, ":") {
+			merr = errors.Join(merr, fmt.Errorf("repos[%d].prefix: must not contain ':'", i))
+		} else if j, ok := prefixes[handler.NormalizePrefix(r.Prefix)]; ok {
+			merr = errors.Join(merr, fmt.Errorf("repos[%d].prefix: %q is already used by repos[%d]", i, r.Prefix, j))
+		} else {
+			prefixes[handler.NormalizePrefix(r.Prefix)] = i
+		}
+		if len(r.Members) > 0 {
+			merr = errors.Join(merr, r.validateMembers(i))
+		}
+		for j, rr := range r.Retention {
+			if rr == nil {
+				merr = errors.Join(merr, fmt.Errorf("repos[%d].retention[%d]: must not be empty", i, j))
+				continue
+			}
+			if err := rr.rule().Validate(); err != nil {
+				merr = errors.Join(merr, fmt.Errorf("repos[%d].retention[%d]: %w", i, j, err))
+			}
+		}
+		if v := r.Verification; v != nil {
+			merr = errors.Join(merr, v.validate(i))
+		}
+		if r.SigningKey != "" && r.Type != npm.RepoType {
+			merr = errors.Join(merr, fmt.Errorf("repos[%d].signing_key: is only supported by %s", i, npm.RepoType))
+		}
+		if u := r.Upstream; u != nil {
+			if u.URL == "" {
+				merr = errors.Join(merr, fmt.Errorf("repos[%d].upstream.url: is required", i))
+			} else if _, err := handler.NewUpstream(u.URL); err != nil {
+				merr = errors.Join(merr, fmt.Errorf("repos[%d].upstream.url: %w", i, err))
+			}
+			if u.MetadataTTL < 0 {
+				merr = errors.Join(merr, fmt.Errorf("repos[%d].upstream.metadata_ttl: must not be negative", i))
+			}
+			for j, s := range u.PrivateScopes {
+				if strings.Trim(s, "@/") == "" {
+					merr = errors.Join(merr, fmt.Errorf("repos[%d].upstream.private_scopes[%d]: must not be empty", i, j))
+				}
+			}
+		}
+	}
+
+	if a := c.AuditLog; a != nil {
+		if a.Path == "" {
+			merr = errors.Join(merr, fmt.Errorf("audit_log.path: is required"))
+		}
+		if a.MaxSizeMB < 0 {
+			merr = errors.Join(merr, fmt.Errorf("audit_log.max_size_mb: must not be negative"))
+		}
+		if a.MaxBackups < 0 {
+			merr = errors.Join(merr, fmt.Errorf("audit_log.max_backups: must not be negative"))
+		}
+	}
+
+	for i, r := range c.Repos {
+		if r != nil && len(r.Retention) > 0 {
+			merr = errors.Join(merr, c.validateCleanupPath(i))
+		}
+	}
+
+	if c.Cleanup != nil && c.Cleanup.Interval < 0 {
+		merr = errors.Join(merr, fmt.Errorf("cleanup.interval: must not be negative"))
+	}
+
+	for i, w := range c.Webhooks {
+		if w == nil {
+			merr = errors.Join(merr, fmt.Errorf("webhooks[%d]: must not be empty", i))
+			continue
+		}
+		if err := validateWebhookURL(w.URL); err != nil {
+			merr = errors.Join(merr, fmt.Errorf("webhooks[%d].url: %w", i, err))
+		}
+	}
+
+	if c.Auth != nil {
+		if o := c.Auth.OIDC; o != nil {
+			if o.Issuer == "" {
+				merr = errors.Join(merr, fmt.Errorf("auth.oidc.issuer: is required"))
+			}
+			if o.JWKS == "" {
+				merr = errors.Join(merr, fmt.Errorf("auth.oidc.jwks: is required"))
+			}
+		}
+		if (c.Auth.BackendUsername == "") != (c.Auth.BackendPassword == "") {
+			merr = errors.Join(merr, fmt.Errorf("auth: backend_username and backend_password must be set together"))
+		}
+	}
+	return merr
+}
+
+func (r *repoConfig) validateMembers(i int) error {
+	var merr error
+	if r.BackendPath != "" {
+		merr = errors.Join(merr, fmt.Errorf("repos[%d].backend_path: must not be set with members", i))
+	}
+	writes := 0
+	for j, m := range r.Members {
+		if m == nil {
+			merr = errors.Join(merr, fmt.Errorf("repos[%d].members[%d]: must not be empty", i, j))
+			continue
+		}
+		if m.Write {
+			writes++
+		}
+		if (m.Username == "") != (m.Password == "") {
+			merr = errors.Join(merr, fmt.Errorf("repos[%d].members[%d]: username and password must be set together", i, j))
+		}
+	}
+	if writes != 1 {
+		merr = errors.Join(merr, fmt.Errorf("repos[%d].members: exactly one member must have write set, got %d", i, writes))
+	}
+	return merr
+}
+
+// validateCleanupPath checks that the cleanup of the repo only sees its own
+// repositories. It deletes the versions of every repository under the backend
+// path, so the path must not hold the repositories of other repos.
+func (c *serveConfig) validateCleanupPath(i int) error {
+	r := c.Repos[i]
+	p, field, shared := cleanupPath(r.BackendPath, r.Members)
+	field = fmt.Sprintf("repos[%d].%s", i, field)
+	if p == "" {
+		return fmt.Errorf("%s: is required with retention", field)
+	}
+	if !shared {
+		return nil
+	}
+	var merr error
+	for j, o := range c.Repos {
+		if j == i || o == nil {
+			continue
+		}
+		for _, q := range backendPaths(o.BackendPath, o.Members) {
+			if q == p || strings.HasPrefix(q, p+"/") {
+				merr = errors.Join(merr, fmt.Errorf("%s: %q holds the repositories of repos[%d], use a distinct path with retention", field, p, j))
+				break
+			}
+		}
+	}
+	return merr
+}
+
+// cleanupPath returns the backend path the cleanup of a repo lists, the config
+// field that sets it, and whether it's on the top level backend registry.
+// Groups are cleaned up in the write member.
+func cleanupPath(backendPath string, members []*memberConfig) (string, string, bool) {
+	for k, m := range members {
+		if m != nil && m.Write {
+			return strings.Trim(m.BackendPath, "/"), fmt.Sprintf("members[%d].backend_path", k), m.BackendRegistry == ""
+		}
+	}
+	return strings.Trim(backendPath, "/"), "backend_path", true
+}
+
+// backendPaths returns the backend paths a repo stores its repositories under
+// on the top level backend registry.
+func backendPaths(backendPath string, members []*memberConfig) []string {
+	if len(members) == 0 {
+		return []string{strings.Trim(backendPath, "/")}
+	}
+	var paths []string
+	for _, m := range members {
+		if m != nil && m.BackendRegistry == "" {
+			paths = append(paths, strings.Trim(m.BackendPath, "/"))
+		}
+	}
+	return paths
+}
+
+// mergeConfig fills the flags that are not explicitly set with values from the
+// config file.
+func (f *serveFlags) mergeConfig(cfg *serveConfig, isSet func(name string) bool) {
+	setString := func(name string, target *string, v string) {
+		if !isSet(name) && v != "" {
+			*target = v
+		}
+	}
+
+	setString("port", &f.port, cfg.Port)
+	setString("admin-port", &f.adminPort, cfg.AdminPort)
+	setString("trace-exporter", &f.traceExporter, cfg.TraceExporter)
+	setString("backend-registry", &f.registryURLStr, cfg.BackendRegistry)
+	setString("landing-dir", &f.landingDir, cfg.LandingDir)
+	if !isSet("upload-chunk-size") && cfg.UploadChunkSize != 0 {
+		f.chunkSize = cfg.UploadChunkSize
+	}
+
+	if a := cfg.AuditLog; a != nil {
+		setString("audit-log", &f.auditLog, a.Path)
+		if !isSet("audit-log-max-size") && a.MaxSizeMB != 0 {
+			f.auditMaxSize = a.MaxSizeMB
+		}
+		if !isSet("audit-log-backups") && a.MaxBackups != 0 {
+			f.auditBackups = a.MaxBackups
+		}
+	}
+
+	if c := cfg.Cleanup; c != nil {
+		if !isSet("cleanup-interval") && c.Interval != 0 {
+			f.cleanupInterval = c.Interval
+		}
+		if !isSet("cleanup-dry-run") && c.DryRun {
+			f.cleanupDryRun = true
+		}
+	}
+
+	if !isSet("webhook") && len(cfg.Webhooks) > 0 {
+		f.webhookURLs = nil
+		f.configWebhooks = cfg.Webhooks
+	}
+
+	// Repos are replaced as a whole. Either repo-type or mount on the command
+	// line takes precedence over all repos in the config file.
+	if !isSet("repo-type") && !isSet("mount") && len(cfg.Repos) > 0 {
+		f.repoType = ""
+		f.mountStrs = nil
+		f.configRepos = cfg.Repos
+	}
+
+	if cfg.Auth != nil {
+		setString("backend-username", &f.backendUsername, cfg.Auth.BackendUsername)
+		setString("backend-password", &f.backendPassword, cfg.Auth.BackendPassword)
+		if o := cfg.Auth.OIDC; o != nil {
+			setString("oidc-issuer", &f.oidcIssuer, o.Issuer)
+			setString("oidc-jwks", &f.oidcJWKS, o.JWKS)
+			setString("oidc-identity-claim", &f.oidcIdentityClaim, o.IdentityClaim)
+			if !isSet("oidc-audience") && len(o.Audiences) > 0 {
+				f.oidcAudiences = o.Audiences
+			}
+			if !isSet("oidc-deleter") && len(o.Deleters) > 0 {
+				f.oidcDeleters = o.Deleters
+			}
+		}
+	}
+}
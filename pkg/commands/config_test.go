@@ -0,0 +1,532 @@
+package commands
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abcxyz/pkg/cli"
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/google/go-cmp/cmp"
+	"github.com/yolocs/ocifactory/pkg/retention"
+)
+
+func TestParseServeConfig(t *testing.T) {
+	t.Parallel()
+
+	env := map[string]string{
+		"ROBOT_USER":     "robot",
+		"ROBOT_PASSWORD": "secret",
+		"TRICKY_SECRET":  `s3cr: #t "' x`,
+		"AUDIT_SIZE":     "50",
+	}
+	lookupEnv := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+
+	cases := []struct {
+		name    string
+		in      string
+		want    *serveConfig
+		wantErr string
+	}{
+		{
+			name: "full config",
+			in: `
+port: "9090"
+admin_port: "9091"
+trace_exporter: otlp
+backend_registry: us-docker.pkg.dev/my-project
+landing_dir: /var/lib/ocifactory
+upload_chunk_size: 16777216
+repos:
+  - type: maven
+    prefix: /maven/
+    backend_path: team/maven
+    upstream:
+      url: https://repo.maven.apache.org/maven2
+      metadata_ttl: 10m
+    retention:
+      - versions: "*-SNAPSHOT"
+        keep_last: 5
+        max_age: 720h
+      - released_snapshots: true
+  - type: python
+    prefix: /pypi/
+    upstream:
+      url: https://pypi.org/simple
+      local_shadowing: true
+auth:
+  oidc:
+    issuer: https://token.actions.githubusercontent.com
+    jwks: /etc/ocifactory/jwks.json
+    audiences: [ocifactory]
+    identity_claim: repository
+    deleters: [yolocs/release-admin]
+  backend_username: ${ROBOT_USER}
+  backend_password: ${ROBOT_PASSWORD}
+audit_log:
+  path: /var/log/ocifactory/audit.log
+  max_size_mb: 50
+  max_backups: 3
+webhooks:
+  - url: https://deploy.example.com/hooks/ocifactory
+    secret: ${ROBOT_PASSWORD}
+  - url: http://cache-warmer:8080/events
+cleanup:
+  interval: 24h
+  dry_run: true
+`,
+			want: &serveConfig{
+				Port:            "9090",
+				AdminPort:       "9091",
+				TraceExporter:   "otlp",
+				BackendRegistry: "us-docker.pkg.dev/my-project",
+				LandingDir:      "/var/lib/ocifactory",
+				UploadChunkSize: 16 << 20,
+				Repos: []*repoConfig{
+					{
+						Type:        "maven",
+						Prefix:      "/maven/",
+						BackendPath: "team/maven",
+						Upstream: &upstreamConfig{
+							URL:         "https://repo.maven.apache.org/maven2",
+							MetadataTTL: 10 * time.Minute,
+						},
+						Retention: []*retentionRuleConfig{
+							{Versions: "*-SNAPSHOT", KeepLast: 5, MaxAge: 720 * time.Hour},
+							{ReleasedSnapshots: true},
+						},
+					},
+					{
+						Type:   "python",
+						Prefix: "/pypi/",
+						Upstream: &upstreamConfig{
+							URL:            "https://pypi.org/simple",
+							LocalShadowing: true,
+						},
+					},
+				},
+				Auth: &authConfig{
+					OIDC: &oidcConfig{
+						Issuer:        "https://token.actions.githubusercontent.com",
+						JWKS:          "/etc/ocifactory/jwks.json",
+						Audiences:     []string{"ocifactory"},
+						IdentityClaim: "repository",
+						Deleters:      []string{"yolocs/release-admin"},
+					},
+					BackendUsername: "robot",
+					BackendPassword: "secret",
+				},
+				AuditLog: &auditConfig{
+					Path:       "/var/log/ocifactory/audit.log",
+					MaxSizeMB:  50,
+					MaxBackups: 3,
+				},
+				Webhooks: []*webhookConfig{
+					{URL: "https://deploy.example.com/hooks/ocifactory", Secret: "secret"},
+					{URL: "http://cache-warmer:8080/events"},
+				},
+				Cleanup: &cleanupConfig{Interval: 24 * time.Hour, DryRun: true},
+			},
+		},
+		{
+			name: "empty config",
+			in:   "",
+			want: &serveConfig{},
+		},
+		{
+			name: "escaped env var",
+			in:   `landing_dir: /tmp/$${ROBOT_USER}`,
+			want: &serveConfig{LandingDir: "/tmp/${ROBOT_USER}"},
+		},
+		{
+			name: "env var values are not parsed as yaml",
+			in: `webhooks:
+  - url: https://example.com/hook
+    secret: ${TRICKY_SECRET}
+  - url: https://example.com/quoted
+    secret: "${TRICKY_SECRET}"
+audit_log:
+  path: /tmp/audit.log
+  max_size_mb: ${AUDIT_SIZE}`,
+			want: &serveConfig{
+				Webhooks: []*webhookConfig{
+					{URL: "https://example.com/hook", Secret: `s3cr: #t "' x`},
+					{URL: "https://example.com/quoted", Secret: `s3cr: #t "' x`},
+				},
+				AuditLog: &auditConfig{Path: "/tmp/audit.log", MaxSizeMB: 50},
+			},
+		},
+		{
+			name: "env var in comment",
+			in: `# backend_password: ${MISSING}
+landing_dir: /tmp # ${MISSING}`,
+			want: &serveConfig{LandingDir: "/tmp"},
+		},
+		{
+			name: "unset env var",
+			in: `port: "8080"
+backend_registry: ${MISSING}`,
+			wantErr: `line 2: environment variable "MISSING" is not set`,
+		},
+		{
+			name:    "unknown field",
+			in:      `prot: "8080"`,
+			wantErr: "line 1: field prot not found",
+		},
+		{
+			name: "invalid repos",
+			in: `
+repos:
+  - type: rubygems
+    prefix: /gems/
+  - type: maven
+  - type: python
+    prefix: gems
+`,
+			wantErr: `repos[0].type: "rubygems" is not supported`,
+		},
+		{
+			name: "missing repo prefix",
+			in: `
+repos:
+  - type: maven
+`,
+			wantErr: "repos[0].prefix: is required",
+		},
+		{
+			name: "duplicate repo prefix",
+			in: `
+repos:
+  - type: maven
+    prefix: /repo/
+  - type: python
+    prefix: repo
+`,
+			wantErr: `repos[1].prefix: "repo" is already used by repos[0]`,
+		},
+		{
+			name: "invalid upstream",
+			in: `
+repos:
+  - type: maven
+    prefix: /maven/
+    upstream:
+      url: ftp://example.com
+`,
+			wantErr: `repos[0].upstream.url: upstream URL "ftp://example.com" must be http or https`,
+		},
+		{
+			name: "npm private scopes",
+			in: `
+repos:
+  - type: npm
+    prefix: /npm/
+    upstream:
+      url: https://registry.npmjs.org
+      private_scopes: ["@mycompany"]
+`,
+			want: &serveConfig{
+				Repos: []*repoConfig{{
+					Type:   "npm",
+					Prefix: "/npm/",
+					Upstream: &upstreamConfig{
+						URL:           "https://registry.npmjs.org",
+						PrivateScopes: []string{"@mycompany"},
+					},
+				}},
+			},
+		},
+		{
+			name: "empty private scope",
+			in: `
+repos:
+  - type: npm
+    prefix: /npm/
+    upstream:
+      url: https://registry.npmjs.org
+      private_scopes: ["@"]
+`,
+			wantErr: "repos[0].upstream.private_scopes[0]: must not be empty",
+		},
+		{
+			name: "group repo",
+			in: `
+repos:
+  - type: python
+    prefix: /pypi/
+    members:
+      - backend_path: team-a/python
+        write: true
+      - backend_path: team-b/python
+      - backend_registry: other.example.com
+        backend_path: shared/python
+        username: reader
+        password: ${ROBOT_PASSWORD}
+    upstream:
+      url: https://pypi.org/simple
+`,
+			want: &serveConfig{
+				Repos: []*repoConfig{{
+					Type:   "python",
+					Prefix: "/pypi/",
+					Members: []*memberConfig{
+						{BackendPath: "team-a/python", Write: true},
+						{BackendPath: "team-b/python"},
+						{BackendRegistry: "other.example.com", BackendPath: "shared/python", Username: "reader", Password: "secret"},
+					},
+					Upstream: &upstreamConfig{URL: "https://pypi.org/simple"},
+				}},
+			},
+		},
+		{
+			name: "invalid group repo",
+			in: `
+repos:
+  - type: python
+    prefix: /pypi/
+    backend_path: team-a/python
+    members:
+      - backend_path: team-b/python
+        username: reader
+`,
+			wantErr: "repos[0].backend_path: must not be set with members\n" +
+				"repos[0].members[0]: username and password must be set together\n" +
+				"repos[0].members: exactly one member must have write set, got 0",
+		},
+		{
+			name: "incomplete oidc",
+			in: `
+auth:
+  oidc:
+    issuer: https://token.actions.githubusercontent.com
+`,
+			wantErr: "auth.oidc.jwks: is required",
+		},
+		{
+			name: "invalid webhooks",
+			in: `
+webhooks:
+  - secret: foo
+  - url: ftp://example.com
+`,
+			wantErr: "webhooks[0].url: is required\n" +
+				`webhooks[1].url: webhook URL "ftp://example.com" must be http or https`,
+		},
+		{
+			name: "invalid retention",
+			in: `
+repos:
+  - type: maven
+    prefix: /maven/
+    backend_path: team/maven
+    retention:
+      - versions: "*-SNAPSHOT"
+      - packages: "["
+        keep_last: 1
+cleanup:
+  interval: -1h
+`,
+			wantErr: "repos[0].retention[0]: one of keep_last, max_age or released_snapshots is required\n" +
+				`repos[0].retention[1]: packages: invalid pattern "[": syntax error in pattern` + "\n" +
+				"cleanup.interval: must not be negative",
+		},
+		{
+			name: "retention without backend path",
+			in: `
+repos:
+  - type: maven
+    prefix: /maven/
+    retention:
+      - keep_last: 1
+  - type: npm
+    prefix: /npm/
+    retention:
+      - keep_last: 1
+    members:
+      - backend_path: shared/npm
+      - backend_registry: other.example.com
+        backend_path: npm
+        write: true
+  - type: npm
+    prefix: /npm-team/
+    retention:
+      - keep_last: 1
+    members:
+      - backend_path: shared/npm
+      - write: true
+`,
+			wantErr: "repos[0].backend_path: is required with retention\n" +
+				"repos[2].members[1].backend_path: is required with retention",
+		},
+		{
+			name: "retention backend path shared",
+			in: `
+repos:
+  - type: maven
+    prefix: /maven/
+    backend_path: team
+    retention:
+      - keep_last: 1
+  - type: python
+    prefix: /pypi/
+    backend_path: team/pypi
+  - type: npm
+    prefix: /npm/
+    members:
+      - backend_path: team/
+        write: true
+  - type: python
+    prefix: /pypi-other/
+    backend_path: team-other
+`,
+			wantErr: `repos[0].backend_path: "team" holds the repositories of repos[1], use a distinct path with retention` + "\n" +
+				`repos[0].backend_path: "team" holds the repositories of repos[2], use a distinct path with retention`,
+		},
+		{
+			name: "invalid verification",
+			in: `
+repos:
+  - type: python
+    prefix: /pypi/
+    upstream:
+      url: https://pypi.org/simple/
+    verification:
+      enforce: always
+      files: ["["]
+`,
+			wantErr: "repos[0].verification.public_keys: is required\n" +
+				`repos[0].verification.enforce: "always" is not supported, allowed: [publish, download, both]` + "\n" +
+				`repos[0].verification.files[0]: invalid pattern "[": syntax error in pattern`,
+		},
+		{
+			name: "signing key of non-npm repo",
+			in: `
+repos:
+  - type: maven
+    prefix: /maven/
+    signing_key: /keys/npm.pem
+`,
+			wantErr: "repos[0].signing_key: is only supported by npm",
+		},
+		{
+			name: "invalid audit log",
+			in: `
+audit_log:
+  max_size_mb: -1
+`,
+			wantErr: "audit_log.path: is required\n" +
+				"audit_log.max_size_mb: must not be negative",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseServeConfig([]byte(tc.in), lookupEnv)
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Fatalf("parseServeConfig() returned unexpected error (-got, +want): %s", diff)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("parseServeConfig() mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestServeCommandParseFlags(t *testing.T) {
+	t.Parallel()
+
+	cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(cfgPath, []byte(`
+port: "9090"
+backend_registry: http://config.example.com
+landing_dir: /var/lib/ocifactory
+repos:
+  - type: maven
+    prefix: /maven/
+    backend_path: team/maven
+    retention:
+      - versions: "*-SNAPSHOT"
+        keep_last: 3
+  - type: python
+    prefix: /pypi/
+    backend_path: team/python
+`), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+
+	cases := []struct {
+		name            string
+		args            []string
+		env             map[string]string
+		wantPort        string
+		wantRegistryURL string
+		wantMounts      []*mount
+		wantErr         string
+	}{
+		{
+			name:            "config only",
+			args:            []string{"-config", cfgPath},
+			wantPort:        "9090",
+			wantRegistryURL: "http://config.example.com",
+			wantMounts: []*mount{
+				{repoType: "maven", prefix: "/maven/", backendPath: "team/maven", retention: []*retention.Rule{{Versions: "*-SNAPSHOT", KeepLast: 3}}},
+				{repoType: "python", prefix: "/pypi/", backendPath: "team/python"},
+			},
+		},
+		{
+			name:            "flags override config",
+			args:            []string{"-config", cfgPath, "-backend-registry", "http://flag.example.com", "-repo-type", "python"},
+			wantPort:        "9090",
+			wantRegistryURL: "http://flag.example.com",
+			wantMounts:      []*mount{{repoType: "python", prefix: "/"}},
+		},
+		{
+			name:            "env overrides config",
+			args:            []string{"-config", cfgPath},
+			env:             map[string]string{"PORT": "7070"},
+			wantPort:        "7070",
+			wantRegistryURL: "http://config.example.com",
+			wantMounts: []*mount{
+				{repoType: "maven", prefix: "/maven/", backendPath: "team/maven", retention: []*retention.Rule{{Versions: "*-SNAPSHOT", KeepLast: 3}}},
+				{repoType: "python", prefix: "/pypi/", backendPath: "team/python"},
+			},
+		},
+		{
+			name:    "missing config file",
+			args:    []string{"-config", filepath.Join(t.TempDir(), "missing.yaml")},
+			wantErr: "failed to read config file",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			c := &ServeCommand{}
+			c.SetLookupEnv(cli.MapLookuper(tc.env))
+
+			got, err := c.parseFlags(tc.args)
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Fatalf("parseFlags() returned unexpected error (-got, +want): %s", diff)
+			}
+			if err != nil {
+				return
+			}
+			if got.port != tc.wantPort {
+				t.Errorf("port = %q, want %q", got.port, tc.wantPort)
+			}
+			if got.registryURL.String() != tc.wantRegistryURL {
+				t.Errorf("registryURL = %q, want %q", got.registryURL, tc.wantRegistryURL)
+			}
+			if diff := cmp.Diff(tc.wantMounts, got.mounts, cmp.AllowUnexported(mount{})); diff != "" {
+				t.Errorf("mounts mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
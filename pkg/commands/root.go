@@ -11,7 +11,8 @@ var rootCmd = func() cli.Command {
 		Name:    "ocifactory",
 		Version: "dev",
 		Commands: map[string]cli.CommandFactory{
-			"serve": func() cli.Command { return &ServeCommand{} },
+			"serve":   func() cli.Command { return &ServeCommand{} },
+			"cleanup": func() cli.Command { return &CleanupCommand{} },
 		},
 	}
 }
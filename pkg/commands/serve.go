@@ -3,33 +3,176 @@ package commands
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/abcxyz/pkg/cli"
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/audit"
+	"github.com/yolocs/ocifactory/pkg/auth"
+	"github.com/yolocs/ocifactory/pkg/cred"
+	"github.com/yolocs/ocifactory/pkg/events"
 	"github.com/yolocs/ocifactory/pkg/handler"
 	"github.com/yolocs/ocifactory/pkg/handler/maven"
+	"github.com/yolocs/ocifactory/pkg/handler/npm"
 	"github.com/yolocs/ocifactory/pkg/handler/python"
+	"github.com/yolocs/ocifactory/pkg/metrics"
 	"github.com/yolocs/ocifactory/pkg/oci"
+	"github.com/yolocs/ocifactory/pkg/retention"
+	"github.com/yolocs/ocifactory/pkg/tracing"
+	"github.com/yolocs/ocifactory/pkg/verify"
 )
 
 var (
 	supportedRepoTypes = []string{
 		maven.RepoType,
 		python.RepoType,
+		npm.RepoType,
+	}
+
+	// serveFlagEnvVars maps flags to their environment variables. A flag set
+	// through its environment variable also overrides the config file.
+	serveFlagEnvVars = map[string]string{
+		"port":                "PORT",
+		"admin-port":          "OCIFACTORY_ADMIN_PORT",
+		"trace-exporter":      "OCIFACTORY_TRACE_EXPORTER",
+		"audit-log":           "OCIFACTORY_AUDIT_LOG",
+		"audit-log-max-size":  "OCIFACTORY_AUDIT_LOG_MAX_SIZE",
+		"audit-log-backups":   "OCIFACTORY_AUDIT_LOG_BACKUPS",
+		"webhook":             "OCIFACTORY_WEBHOOKS",
+		"webhook-secret":      "OCIFACTORY_WEBHOOK_SECRET",
+		"cleanup-interval":    "OCIFACTORY_CLEANUP_INTERVAL",
+		"cleanup-dry-run":     "OCIFACTORY_CLEANUP_DRY_RUN",
+		"repo-type":           "OCIFACTORY_REPO_TYPE",
+		"backend-registry":    "OCIFACTORY_BACKEND_REGISTRY",
+		"landing-dir":         "OCIFACTORY_LANDING_DIR",
+		"upload-chunk-size":   "OCIFACTORY_UPLOAD_CHUNK_SIZE",
+		"mount":               "OCIFACTORY_MOUNTS",
+		"upstream":            "OCIFACTORY_UPSTREAM",
+		"oidc-issuer":         "OCIFACTORY_OIDC_ISSUER",
+		"oidc-jwks":           "OCIFACTORY_OIDC_JWKS",
+		"oidc-audience":       "OCIFACTORY_OIDC_AUDIENCE",
+		"oidc-identity-claim": "OCIFACTORY_OIDC_IDENTITY_CLAIM",
+		"oidc-deleter":        "OCIFACTORY_OIDC_DELETERS",
+		"backend-username":    "OCIFACTORY_BACKEND_USERNAME",
+		"backend-password":    "OCIFACTORY_BACKEND_PASSWORD",
 	}
 )
 
 type serveFlags struct {
-	port           string
-	repoType       string
-	registryURLStr string
-	landingDir     string
+	configPath      string
+	port            string
+	adminPort       string
+	traceExporter   string
+	auditLog        string
+	auditMaxSize    int
+	auditBackups    int
+	webhookURLs     []string
+	webhookSecret   string
+	cleanupInterval time.Duration
+	cleanupDryRun   bool
+	repoType        string
+	registryURLStr  string
+	landingDir      string
+	chunkSize       int64
+	mountStrs       []string
+	upstream        string
+
+	oidcIssuer        string
+	oidcJWKS          string
+	oidcAudiences     []string
+	oidcIdentityClaim string
+	oidcDeleters      []string
+	backendUsername   string
+	backendPassword   string
 
 	registryURL *url.URL
+	mounts      []*mount
+	configRepos []*repoConfig // Repos from the config file, used if neither repo-type nor mount is set.
+
+	webhooks       []*webhookConfig
+	configWebhooks []*webhookConfig // Webhooks from the config file, used if webhook is not set.
+}
+
+// mount describes a repository served under a path prefix.
+type mount struct {
+	repoType    string
+	prefix      string
+	backendPath string // Path appended to the backend registry URL. Could be empty.
+	upstream    string // URL of the upstream repository to proxy from. Could be empty.
+	metadataTTL time.Duration
+
+	localShadowing bool
+	privateScopes  []string
+
+	members []*memberConfig // Makes the mount a group repo. Could be empty.
+
+	retention []*retention.Rule // Only set from the config file.
+
+	verification *handler.VerifyPolicy // Only set from the config file. Could be nil.
+
+	signer *npm.Signer // Only set from the config file. Could be nil.
+}
+
+// parseMount parses a mount in the form of TYPE:PREFIX[:BACKEND_PATH].
+func parseMount(s string) (*mount, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("mount %q must be in the form of TYPE:PREFIX[:BACKEND_PATH]", s)
+	}
+	m := &mount{
+		repoType: parts[0],
+		prefix:   handler.NormalizePrefix(parts[1]),
+	}
+	if len(parts) == 3 {
+		m.backendPath = strings.Trim(parts[2], "/")
+	}
+	return m, nil
+}
+
+// parseRegistryURL parses the URL of an OCI registry. The scheme defaults to https.
+func parseRegistryURL(s string) (*url.URL, error) {
+	if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse registry URL: %w", err)
+	}
+	return u, nil
+}
+
+// validateWebhookURL checks that events can be posted to the URL.
+func validateWebhookURL(s string) error {
+	if s == "" {
+		return fmt.Errorf("is required")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("failed to parse webhook URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL %q must be http or https", s)
+	}
+	return nil
+}
+
+func isRepoTypeSupported(repoType string) bool {
+	for _, t := range supportedRepoTypes {
+		if t == repoType {
+			return true
+		}
+	}
+	return false
 }
 
 func (f *serveFlags) Validate() error {
@@ -37,29 +180,122 @@ func (f *serveFlags) Validate() error {
 	if f.port == "" {
 		merr = errors.Join(merr, fmt.Errorf("port is required"))
 	}
-	repoSupported := false
-	for _, repoType := range supportedRepoTypes {
-		if repoType == f.repoType {
-			repoSupported = true
-			break
-		}
+	if f.adminPort != "" && f.adminPort == f.port {
+		merr = errors.Join(merr, fmt.Errorf("admin-port must be different from port"))
 	}
-	if !repoSupported {
-		merr = errors.Join(merr, fmt.Errorf("repo-type %q is not supported", f.repoType))
+	switch {
+	case len(f.mountStrs) > 0:
+		if f.repoType != "" {
+			merr = errors.Join(merr, fmt.Errorf("repo-type and mount cannot be set together"))
+		}
+		if f.upstream != "" {
+			merr = errors.Join(merr, fmt.Errorf("upstream can only be set with repo-type, use the config file to set upstreams for mounts"))
+		}
+		f.mounts = nil
+		prefixes := make(map[string]bool)
+		for _, s := range f.mountStrs {
+			m, err := parseMount(s)
+			if err != nil {
+				merr = errors.Join(merr, err)
+				continue
+			}
+			if !isRepoTypeSupported(m.repoType) {
+				merr = errors.Join(merr, fmt.Errorf("mount %q: repo type %q is not supported", s, m.repoType))
+			}
+			if prefixes[m.prefix] {
+				merr = errors.Join(merr, fmt.Errorf("mount %q: prefix %q is already mounted", s, m.prefix))
+			}
+			prefixes[m.prefix] = true
+			f.mounts = append(f.mounts, m)
+		}
+	case f.repoType == "" && len(f.configRepos) > 0:
+		// The config file is validated when it's loaded.
+		f.mounts = nil
+		for _, r := range f.configRepos {
+			m := &mount{
+				repoType:    r.Type,
+				prefix:      handler.NormalizePrefix(r.Prefix),
+				backendPath: strings.Trim(r.BackendPath, "/"),
+				members:     r.Members,
+			}
+			for _, rr := range r.Retention {
+				m.retention = append(m.retention, rr.rule())
+			}
+			if r.Verification != nil {
+				p, err := newVerifyPolicy(r.Type, r.Verification)
+				if err != nil {
+					merr = errors.Join(merr, fmt.Errorf("repo %s: %w", m.prefix, err))
+				}
+				m.verification = p
+			}
+			if r.SigningKey != "" {
+				s, err := npm.LoadSigner(r.SigningKey)
+				if err != nil {
+					merr = errors.Join(merr, fmt.Errorf("repo %s: %w", m.prefix, err))
+				}
+				m.signer = s
+			}
+			if r.Upstream != nil {
+				m.upstream = r.Upstream.URL
+				m.metadataTTL = r.Upstream.MetadataTTL
+				m.localShadowing = r.Upstream.LocalShadowing
+				m.privateScopes = r.Upstream.PrivateScopes
+			}
+			f.mounts = append(f.mounts, m)
+		}
+	default:
+		if !isRepoTypeSupported(f.repoType) {
+			merr = errors.Join(merr, fmt.Errorf("repo-type %q is not supported", f.repoType))
+		}
+		f.mounts = []*mount{{repoType: f.repoType, prefix: "/", upstream: f.upstream}}
 	}
 	if f.registryURLStr == "" {
 		merr = errors.Join(merr, fmt.Errorf("backend-registry is required"))
-	}
-	if !strings.HasPrefix(f.registryURLStr, "http://") && !strings.HasPrefix(f.registryURLStr, "https://") {
-		// Default to https.
-		f.registryURLStr = "https://" + f.registryURLStr
-		u, err := url.Parse(f.registryURLStr)
+	} else {
+		u, err := parseRegistryURL(f.registryURLStr)
 		if err != nil {
 			merr = errors.Join(merr, fmt.Errorf("failed to parse backend-registry URL: %w", err))
 		} else {
+			f.registryURLStr = u.String()
 			f.registryURL = u
 		}
 	}
+	if f.oidcIssuer != "" && f.oidcJWKS == "" {
+		merr = errors.Join(merr, fmt.Errorf("oidc-jwks is required when oidc-issuer is set"))
+	}
+	if f.oidcIssuer == "" && f.oidcJWKS != "" {
+		merr = errors.Join(merr, fmt.Errorf("oidc-issuer is required when oidc-jwks is set"))
+	}
+	if (f.backendUsername == "") != (f.backendPassword == "") {
+		merr = errors.Join(merr, fmt.Errorf("backend-username and backend-password must be set together"))
+	}
+	if f.traceExporter != "" && !slices.Contains(tracing.Exporters, f.traceExporter) {
+		merr = errors.Join(merr, fmt.Errorf("trace-exporter %q is not supported, allowed: [%s]", f.traceExporter, strings.Join(tracing.Exporters, ", ")))
+	}
+	if f.auditMaxSize < 0 {
+		merr = errors.Join(merr, fmt.Errorf("audit-log-max-size must not be negative"))
+	}
+	if f.auditBackups < 0 {
+		merr = errors.Join(merr, fmt.Errorf("audit-log-backups must not be negative"))
+	}
+	if len(f.webhookURLs) > 0 || len(f.configWebhooks) == 0 {
+		f.webhooks = nil
+		for _, u := range f.webhookURLs {
+			if err := validateWebhookURL(u); err != nil {
+				merr = errors.Join(merr, fmt.Errorf("webhook: %w", err))
+			}
+			f.webhooks = append(f.webhooks, &webhookConfig{URL: u, Secret: f.webhookSecret})
+		}
+	} else {
+		// The config file is validated when it's loaded.
+		f.webhooks = f.configWebhooks
+	}
+	if f.chunkSize < 0 {
+		merr = errors.Join(merr, fmt.Errorf("upload-chunk-size must not be negative"))
+	}
+	if f.cleanupInterval < 0 {
+		merr = errors.Join(merr, fmt.Errorf("cleanup-interval must not be negative"))
+	}
 	// This default is implicit because temp dir will be different each time.
 	if f.landingDir == "" {
 		f.landingDir = os.TempDir()
@@ -74,7 +310,7 @@ type ServeCommand struct {
 }
 
 func (c *ServeCommand) Desc() string {
-	return "Run the server to serve a specific artifact type."
+	return "Run the server to serve one or more artifact repositories."
 }
 
 func (c *ServeCommand) Help() string {
@@ -88,6 +324,13 @@ func (c *ServeCommand) Flags() *cli.FlagSet {
 	set := c.NewFlagSet()
 	sec := set.NewSection("OPTIONS")
 
+	sec.StringVar(&cli.StringVar{
+		Name:   "config",
+		Usage:  "The path to the YAML config file. Flags override values in the config file. Send SIGHUP to reload it.",
+		EnvVar: "OCIFACTORY_CONFIG",
+		Target: &c.flags.configPath,
+	})
+
 	sec.StringVar(&cli.StringVar{
 		Name:    "port",
 		Target:  &c.flags.port,
@@ -96,10 +339,25 @@ func (c *ServeCommand) Flags() *cli.FlagSet {
 		Usage:   `The port the server listens to.`,
 	})
 
+	sec.StringVar(&cli.StringVar{
+		Name:   "admin-port",
+		Usage:  "The port that serves /metrics for Prometheus. If not set, metrics are not exposed.",
+		EnvVar: "OCIFACTORY_ADMIN_PORT",
+		Target: &c.flags.adminPort,
+	})
+
+	sec.StringVar(&cli.StringVar{
+		Name:    "trace-exporter",
+		Usage:   "Where to export OpenTelemetry traces. Allowed: [none, stdout, otlp]. The otlp exporter is configured with the standard OTEL_EXPORTER_OTLP_* environment variables. Changes require a restart.",
+		EnvVar:  "OCIFACTORY_TRACE_EXPORTER",
+		Default: tracing.ExporterNone,
+		Target:  &c.flags.traceExporter,
+	})
+
 	sec.StringVar(&cli.StringVar{
 		Name:    "repo-type",
 		Aliases: []string{"t"},
-		Usage:   "Type of repository to serve. Allowed: [maven, python]",
+		Usage:   "Type of repository to serve. Allowed: [maven, python, npm]",
 		EnvVar:  "OCIFACTORY_REPO_TYPE",
 		Target:  &c.flags.repoType,
 	})
@@ -118,56 +376,646 @@ func (c *ServeCommand) Flags() *cli.FlagSet {
 		Target: &c.flags.landingDir,
 	})
 
+	sec.Int64Var(&cli.Int64Var{
+		Name:   "upload-chunk-size",
+		Usage:  "If set, uploads are streamed to the backend registry in chunks of this many bytes instead of being stored in landing-dir first. Falls back to landing-dir if the backend registry doesn't support chunked uploads.",
+		EnvVar: "OCIFACTORY_UPLOAD_CHUNK_SIZE",
+		Target: &c.flags.chunkSize,
+	})
+
+	sec.StringSliceVar(&cli.StringSliceVar{
+		Name:    "mount",
+		Usage:   "Serve a repository under a path prefix in the form of TYPE:PREFIX[:BACKEND_PATH]. BACKEND_PATH is appended to the backend registry URL. Repeat to serve multiple repositories. Cannot be used with repo-type.",
+		Example: "python:/pypi/:team-a/python",
+		EnvVar:  "OCIFACTORY_MOUNTS",
+		Target:  &c.flags.mountStrs,
+	})
+
+	sec.StringVar(&cli.StringVar{
+		Name:   "upstream",
+		Usage:  "The URL of the upstream repository to proxy artifacts that are not found in the backend registry. Only used with repo-type.",
+		EnvVar: "OCIFACTORY_UPSTREAM",
+		Target: &c.flags.upstream,
+	})
+
+	auditSec := set.NewSection("AUDIT OPTIONS")
+
+	auditSec.StringVar(&cli.StringVar{
+		Name:   "audit-log",
+		Usage:  "The file to write the audit log of publishes, overwrites, deletes and tag changes to as JSON lines. Use - for stdout. If not set, actions are not audited.",
+		EnvVar: "OCIFACTORY_AUDIT_LOG",
+		Target: &c.flags.auditLog,
+	})
+
+	auditSec.IntVar(&cli.IntVar{
+		Name:    "audit-log-max-size",
+		Usage:   "The size in megabytes at which the audit log file is rotated.",
+		EnvVar:  "OCIFACTORY_AUDIT_LOG_MAX_SIZE",
+		Default: 100,
+		Target:  &c.flags.auditMaxSize,
+	})
+
+	auditSec.IntVar(&cli.IntVar{
+		Name:    "audit-log-backups",
+		Usage:   "The number of rotated audit log files to keep. 0 keeps all of them.",
+		EnvVar:  "OCIFACTORY_AUDIT_LOG_BACKUPS",
+		Default: 10,
+		Target:  &c.flags.auditBackups,
+	})
+
+	eventsSec := set.NewSection("EVENT OPTIONS")
+
+	eventsSec.StringSliceVar(&cli.StringSliceVar{
+		Name:   "webhook",
+		Usage:  "The URL to post an event to when a package version is published, overwritten or deleted. Repeat for multiple webhooks. Failed deliveries are retried with backoff. The events are also streamed from /events on admin-port. Changes require a restart.",
+		EnvVar: "OCIFACTORY_WEBHOOKS",
+		Target: &c.flags.webhookURLs,
+	})
+
+	eventsSec.StringVar(&cli.StringVar{
+		Name:   "webhook-secret",
+		Usage:  "The secret to sign webhook requests with. The hex encoded HMAC-SHA256 of the body is sent in the X-Ocifactory-Signature header as sha256=HEX.",
+		EnvVar: "OCIFACTORY_WEBHOOK_SECRET",
+		Target: &c.flags.webhookSecret,
+	})
+
+	cleanupSec := set.NewSection("CLEANUP OPTIONS")
+
+	cleanupSec.DurationVar(&cli.DurationVar{
+		Name:   "cleanup-interval",
+		Usage:  "How often to delete the versions selected by the retention rules of the repos in the config file. If not set, versions are only deleted by the cleanup command. Changes require a restart.",
+		EnvVar: "OCIFACTORY_CLEANUP_INTERVAL",
+		Target: &c.flags.cleanupInterval,
+	})
+
+	cleanupSec.BoolVar(&cli.BoolVar{
+		Name:   "cleanup-dry-run",
+		Usage:  "Only report the versions the retention rules select instead of deleting them.",
+		EnvVar: "OCIFACTORY_CLEANUP_DRY_RUN",
+		Target: &c.flags.cleanupDryRun,
+	})
+
+	authSec := set.NewSection("AUTH OPTIONS")
+
+	authSec.StringVar(&cli.StringVar{
+		Name:   "oidc-issuer",
+		Usage:  "The issuer of OIDC tokens to accept, e.g. https://token.actions.githubusercontent.com. If not set, OIDC auth is disabled.",
+		EnvVar: "OCIFACTORY_OIDC_ISSUER",
+		Target: &c.flags.oidcIssuer,
+	})
+
+	authSec.StringVar(&cli.StringVar{
+		Name:   "oidc-jwks",
+		Usage:  "The path or URL to the JWKS used to verify OIDC tokens.",
+		EnvVar: "OCIFACTORY_OIDC_JWKS",
+		Target: &c.flags.oidcJWKS,
+	})
+
+	authSec.StringSliceVar(&cli.StringSliceVar{
+		Name:   "oidc-audience",
+		Usage:  "The accepted audiences of OIDC tokens. If not set, the audience is not checked.",
+		EnvVar: "OCIFACTORY_OIDC_AUDIENCE",
+		Target: &c.flags.oidcAudiences,
+	})
+
+	authSec.StringVar(&cli.StringVar{
+		Name:    "oidc-identity-claim",
+		Usage:   "The OIDC token claim used as the caller identity, e.g. repository.",
+		EnvVar:  "OCIFACTORY_OIDC_IDENTITY_CLAIM",
+		Default: auth.DefaultIdentityClaim,
+		Target:  &c.flags.oidcIdentityClaim,
+	})
+
+	authSec.StringSliceVar(&cli.StringSliceVar{
+		Name:   "oidc-deleter",
+		Usage:  "An OIDC identity allowed to delete versions and files. Repeat for multiple identities. Other OIDC callers can't delete. Callers with their own backend credential are checked by the backend registry.",
+		EnvVar: "OCIFACTORY_OIDC_DELETERS",
+		Target: &c.flags.oidcDeleters,
+	})
+
+	authSec.StringVar(&cli.StringVar{
+		Name:   "backend-username",
+		Usage:  "The user name for the backend registry used on behalf of OIDC authenticated callers.",
+		EnvVar: "OCIFACTORY_BACKEND_USERNAME",
+		Target: &c.flags.backendUsername,
+	})
+
+	authSec.StringVar(&cli.StringVar{
+		Name:   "backend-password",
+		Usage:  "The password for the backend registry used on behalf of OIDC authenticated callers.",
+		EnvVar: "OCIFACTORY_BACKEND_PASSWORD",
+		Target: &c.flags.backendPassword,
+	})
+
 	return set
 }
 
 func (c *ServeCommand) Run(ctx context.Context, args []string) error {
-	f := c.Flags()
+	flags, err := c.parseFlags(args)
+	if err != nil {
+		return err
+	}
+
+	exp, err := tracing.NewExporter(ctx, flags.traceExporter, c.Stdout())
+	if err != nil {
+		return err //nolint:wrapcheck // Already wrapped.
+	}
+	shutdownTracing := tracing.Setup(exp)
+	defer func() {
+		if err := shutdownTracing(context.WithoutCancel(ctx)); err != nil {
+			logging.FromContext(ctx).ErrorContext(ctx, "failed to flush traces", "error", err)
+		}
+	}()
+
+	h, checks, err := newServeHandler(ctx, flags)
+	if err != nil {
+		return err
+	}
+	sh := handler.NewSwappableHandler(h)
+	health := handler.NewHealth(checks...)
+
+	middlewares := []handler.Middleware{handler.Metrics, handler.Tracing, handler.PassThroughAuth, handler.Loggeer, handler.AccessLog}
+	var al *audit.Logger
+	if flags.auditLog != "" {
+		al = audit.NewFileLogger(flags.auditLog, flags.auditMaxSize, flags.auditBackups)
+		defer al.Close()
+		middlewares = append(middlewares, al.Middleware)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The dispatcher is only needed if someone can receive the events.
+	var dispatcher *events.Dispatcher
+	if len(flags.webhooks) > 0 || flags.adminPort != "" {
+		hooks := make([]*events.Webhook, 0, len(flags.webhooks))
+		for _, w := range flags.webhooks {
+			var opts []events.WebhookOption
+			if w.Secret != "" {
+				opts = append(opts, events.WithSecret(w.Secret))
+			}
+			hooks = append(hooks, events.NewWebhook(w.URL, opts...))
+		}
+		dispatcher = events.NewDispatcher(hooks...)
+		dispatcher.Start(ctx)
+		middlewares = append(middlewares, dispatcher.Middleware)
+	}
+
+	if flags.cleanupInterval > 0 {
+		targets, err := newRetentionTargets(flags)
+		if err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			logging.FromContext(ctx).WarnContext(ctx, "cleanup-interval is set but no repo has retention rules")
+		} else {
+			// Deletions of the cleanup are audited and published like the
+			// ones of requests.
+			jobCtx := withBackendCred(ctx, flags)
+			if al != nil {
+				jobCtx = audit.WithLogger(jobCtx, al)
+			}
+			if dispatcher != nil {
+				jobCtx = events.WithPublisher(jobCtx, dispatcher)
+			}
+			go retention.Schedule(jobCtx, flags.cleanupInterval, flags.cleanupDryRun, targets)
+		}
+	}
+	srv, err := handler.NewServer(flags.port, middlewares...)
+	if err != nil {
+		return fmt.Errorf("failed to create server: %w", err)
+	}
+	srv.SetHealth(health)
+
+	adminErrCh := make(chan error, 1)
+	if flags.adminPort != "" {
+		adminSrv, err := handler.NewServer(flags.adminPort)
+		if err != nil {
+			return fmt.Errorf("failed to create admin server: %w", err)
+		}
+		go func() {
+			// Stop serving artifacts if metrics can't be served either.
+			defer cancel()
+			adminErrCh <- adminSrv.Start(ctx, newAdminHandler(dispatcher))
+		}()
+	} else {
+		adminErrCh <- nil
+	}
+
+	if flags.configPath != "" {
+		go c.reloadOnSignal(ctx, args, flags, sh, health)
+	}
+
+	err = srv.Start(ctx, sh)
+	cancel()
+	if adminErr := <-adminErrCh; adminErr != nil {
+		err = errors.Join(err, fmt.Errorf("admin server: %w", adminErr))
+	}
+	return err
+}
+
+// newAdminHandler creates the handler of the admin port, which is not exposed
+// to artifact clients. The event stream is served if dispatcher is not nil.
+func newAdminHandler(dispatcher *events.Dispatcher) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	if dispatcher != nil {
+		mux.Handle("GET /events", dispatcher)
+	}
+	return mux
+}
+
+// parseFlags parses the args, merges the config file if one is provided and
+// validates the result.
+func (c *ServeCommand) parseFlags(args []string) (*serveFlags, error) {
+	return c.parseFlagSet(c.Flags(), args)
+}
+
+// parseFlagSet is parseFlags with a flag set that has the serve flags and
+// possibly more, e.g. the ones of the cleanup command.
+func (c *ServeCommand) parseFlagSet(f *cli.FlagSet, args []string) (*serveFlags, error) {
 	if err := f.Parse(args); err != nil {
-		return fmt.Errorf("failed to parse flags: %w", err)
+		return nil, fmt.Errorf("failed to parse flags: %w", err)
 	}
-	if err := c.flags.Validate(); err != nil {
-		return fmt.Errorf("invalid flags: %w", err)
+	flags := c.flags
+
+	if flags.configPath != "" {
+		cfg, err := loadServeConfig(flags.configPath)
+		if err != nil {
+			return nil, err
+		}
+
+		explicit := make(map[string]bool)
+		f.Visit(func(fl *flag.Flag) { explicit[fl.Name] = true })
+		flags.mergeConfig(cfg, func(name string) bool {
+			if explicit[name] {
+				return true
+			}
+			_, ok := c.LookupEnv(serveFlagEnvVars[name])
+			return ok
+		})
 	}
 
-	var h http.Handler
-	switch c.flags.repoType {
-	case maven.RepoType:
-		reg, err := oci.NewRegistry(
-			c.flags.registryURL,
-			oci.WithLandingDir(c.flags.landingDir),
-			oci.WithArtifactType(maven.ArtifactType),
-		)
+	if err := flags.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid flags: %w", err)
+	}
+	return flags, nil
+}
+
+// reloadOnSignal reloads the config file on SIGHUP and swaps the handler and
+// the readiness checks. In-flight requests finish with the handler they
+// started with. Changes to the port require a restart.
+func (c *ServeCommand) reloadOnSignal(ctx context.Context, args []string, current *serveFlags, sh *handler.SwappableHandler, health *handler.Health) {
+	logger := logging.FromContext(ctx)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+		}
+
+		logger.InfoContext(ctx, "reloading config", "path", current.configPath)
+		flags, err := c.parseFlags(args)
 		if err != nil {
-			return fmt.Errorf("failed to create registry: %w", err)
+			logger.ErrorContext(ctx, "failed to reload config, keeping the current one", "error", err)
+			continue
 		}
-		mh, err := maven.NewHandler(reg)
+		if flags.port != current.port || flags.adminPort != current.adminPort {
+			logger.WarnContext(ctx, "port change requires a restart, ignoring it", "port", flags.port, "admin_port", flags.adminPort)
+		}
+
+		h, checks, err := newServeHandler(ctx, flags)
 		if err != nil {
-			return fmt.Errorf("failed to create maven handler: %w", err)
+			logger.ErrorContext(ctx, "failed to reload config, keeping the current one", "error", err)
+			continue
 		}
-		h = mh.Mux()
-	case python.RepoType:
-		reg, err := oci.NewRegistry(
-			c.flags.registryURL,
-			oci.WithLandingDir(c.flags.landingDir),
-			oci.WithArtifactType(python.ArtifactType),
-		)
+		sh.Swap(h)
+		health.SetChecks(checks...)
+		current = flags
+		logger.InfoContext(ctx, "reloaded config", "path", current.configPath)
+	}
+}
+
+// newServeHandler creates the handler for everything that can be reloaded:
+// the mounted repositories and the auth middleware. Returns the readiness
+// checks of the handler too.
+func newServeHandler(ctx context.Context, flags *serveFlags) (http.Handler, []handler.ReadinessCheck, error) {
+	h, regs, err := newMountsHandler(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Backends are pinged with the credential used for OIDC callers, if any.
+	// Otherwise callers bring their own credential and the backend only needs
+	// to be reachable.
+	backendCred := flags.backendCred()
+	checks := []handler.ReadinessCheck{{
+		Name:  "landing_dir",
+		Check: func(context.Context) error { return oci.CheckLandingDir(flags.landingDir) },
+	}}
+	for i, m := range flags.mounts {
+		p, ok := regs[i].(handler.Pinger)
+		if !ok {
+			continue
+		}
+		checks = append(checks, handler.ReadinessCheck{
+			Name: "backend " + m.prefix,
+			Check: func(ctx context.Context) error {
+				return p.Ping(withBackendCred(ctx, flags)) //nolint:wrapcheck // Want passthrough error.
+			},
+		})
+	}
+
+	if flags.oidcIssuer != "" {
+		cfg := &auth.OIDCConfig{
+			Issuer:        flags.oidcIssuer,
+			JWKS:          flags.oidcJWKS,
+			Audiences:     flags.oidcAudiences,
+			IdentityClaim: flags.oidcIdentityClaim,
+			Deleters:      flags.oidcDeleters,
+		}
+		cfg.BackendCred = backendCred
+		v, err := auth.NewOIDCVerifier(ctx, cfg)
 		if err != nil {
-			return fmt.Errorf("failed to create registry: %w", err)
+			return nil, nil, fmt.Errorf("failed to create oidc verifier: %w", err)
 		}
-		ph, err := python.NewHandler(reg)
+		h = v.Middleware(h)
+	}
+
+	return h, checks, nil
+}
+
+// backendCred returns the credential for the backend registry used on behalf
+// of OIDC callers and by the cleanup. Could be nil.
+func (f *serveFlags) backendCred() *cred.BasicCred {
+	if f.backendUsername == "" {
+		return nil
+	}
+	return &cred.BasicCred{User: f.backendUsername, Password: f.backendPassword}
+}
+
+// withBackendCred adds the backend credential to ctx, if there is one.
+func withBackendCred(ctx context.Context, f *serveFlags) context.Context {
+	if c := f.backendCred(); c != nil {
+		return cred.WithCred(ctx, &cred.Cred{Basic: c})
+	}
+	return ctx
+}
+
+// newMountsHandler creates a handler that serves every mount under its prefix.
+// Each mount has its own registry so artifacts of different types don't mix.
+// Returns the registries in the order of the mounts.
+func newMountsHandler(f *serveFlags) (http.Handler, []handler.Registry, error) {
+	mux := http.NewServeMux()
+	regs := make([]handler.Registry, 0, len(f.mounts))
+	for _, m := range f.mounts {
+		reg, err := newMountRegistry(m, f.registryURL, f.landingDir, f.chunkSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Downloads are verified by the handler's registry. Uploads are
+		// verified by the registry itself before they are committed.
+		handlerReg := reg
+		if m.verification != nil {
+			handlerReg = m.verification.Registry(reg)
+		}
+		h, err := newRepoHandler(m, handlerReg)
 		if err != nil {
-			return fmt.Errorf("failed to create python handler: %w", err)
+			return nil, nil, err
 		}
-		h = ph.Mux()
+		if m.verification != nil {
+			ew := handler.TextError
+			if m.repoType == npm.RepoType {
+				ew = handler.JSONError
+			}
+			h = m.verification.Middleware(ew)(h)
+		}
+		mux.Handle(m.prefix, handler.Mount(m.prefix, handler.WithRepoType(m.repoType, h)))
+		regs = append(regs, reg)
+	}
+	return mux, regs, nil
+}
+
+// newMountRegistry creates the registry that backs the mount. A mount with
+// members is backed by a group of registries.
+func newMountRegistry(m *mount, registryURL *url.URL, landingDir string, chunkSize int64) (handler.Registry, error) {
+	var artifactType string
+	var packageVersion oci.PackageVersionFunc
+	switch m.repoType {
+	case maven.RepoType:
+		artifactType, packageVersion = maven.ArtifactType, maven.PackageVersion
+	case python.RepoType:
+		artifactType, packageVersion = python.ArtifactType, python.PackageVersion
+	case npm.RepoType:
+		artifactType, packageVersion = npm.ArtifactType, npm.PackageVersion
 	default:
-		return fmt.Errorf("repo-type %q is not supported", c.flags.repoType)
+		return nil, fmt.Errorf("repo-type %q is not supported", m.repoType)
 	}
 
-	srv, err := handler.NewServer(c.flags.port, handler.PassThroughAuth, handler.Loggeer)
+	newRegistry := func(base *url.URL, backendPath string, opts ...oci.RegistryOption) (*oci.Registry, error) {
+		u := *base
+		if backendPath != "" {
+			u.Path = path.Join("/", u.Path, backendPath)
+		}
+		opts = append(opts, oci.WithLandingDir(landingDir), oci.WithArtifactType(artifactType), oci.WithPackageVersions(packageVersion))
+		if m.verification != nil {
+			opts = append(opts, oci.WithUploadCheck(m.verification.CheckUpload))
+		}
+		if chunkSize > 0 {
+			opts = append(opts, oci.WithChunkedUpload(chunkSize))
+		}
+		reg, err := oci.NewRegistry(&u, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create registry: %w", err)
+		}
+		return reg, nil
+	}
+
+	if len(m.members) == 0 {
+		return newRegistry(registryURL, m.backendPath)
+	}
+
+	members := make([]handler.Registry, 0, len(m.members))
+	write := -1
+	for i, mc := range m.members {
+		base := registryURL
+		var opts []oci.RegistryOption
+		if mc.BackendRegistry != "" {
+			u, err := parseRegistryURL(mc.BackendRegistry)
+			if err != nil {
+				return nil, fmt.Errorf("member %d of %s: %w", i, m.prefix, err)
+			}
+			base = u
+			opts = append(opts, oci.WithCredential(nil))
+		}
+		if mc.Username != "" {
+			opts = append(opts, oci.WithCredential(&cred.BasicCred{User: mc.Username, Password: mc.Password}))
+		}
+		reg, err := newRegistry(base, strings.Trim(mc.BackendPath, "/"), opts...)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, reg)
+		if mc.Write {
+			write = i
+		}
+	}
+	g, err := handler.NewGroupRegistry(members, write)
 	if err != nil {
-		return fmt.Errorf("failed to create server: %w", err)
+		return nil, fmt.Errorf("failed to create group for %s: %w", m.prefix, err)
+	}
+	return g, nil
+}
+
+// newVerifyPolicy loads the keys of the verification config of a repo. The
+// files default to the artifacts of the repo type.
+func newVerifyPolicy(repoType string, v *verificationConfig) (*handler.VerifyPolicy, error) {
+	verifier, err := verify.LoadVerifier(v.PublicKeys...)
+	if err != nil {
+		return nil, err //nolint:wrapcheck // Already wrapped.
+	}
+	p := &handler.VerifyPolicy{
+		Verifier:   verifier,
+		Files:      v.Files,
+		OnPublish:  v.Enforce == enforcePublish || v.Enforce == enforceBoth,
+		OnDownload: v.Enforce == enforceDownload || v.Enforce == enforceBoth,
+	}
+	if len(p.Files) == 0 {
+		switch repoType {
+		case maven.RepoType:
+			p.Files = maven.SignedFiles
+		case python.RepoType:
+			p.Files = python.SignedFiles
+		case npm.RepoType:
+			p.Files = npm.SignedFiles
+		}
+	}
+	return p, nil
+}
+
+// newRetentionTargets creates the retention targets of the mounts with
+// retention rules. The targets have their own registries, so they keep
+// working when the handlers are reloaded. Groups are cleaned up in the write
+// member. Deletions are audited as the cleanup identity.
+func newRetentionTargets(f *serveFlags) ([]*retention.Target, error) {
+	var targets []*retention.Target
+	for _, m := range f.mounts {
+		if len(m.retention) == 0 {
+			continue
+		}
+
+		var packageVersion oci.PackageVersionFunc
+		var deleteVersion func(context.Context, handler.Registry, string, string) error
+		switch m.repoType {
+		case maven.RepoType:
+			packageVersion, deleteVersion = maven.PackageVersion, maven.DeleteVersion
+		case python.RepoType:
+			packageVersion, deleteVersion = python.PackageVersion, python.DeleteVersion
+		case npm.RepoType:
+			packageVersion, deleteVersion = npm.PackageVersion, npm.DeleteVersion
+		default:
+			return nil, fmt.Errorf("repo-type %q is not supported", m.repoType)
+		}
+
+		reg, err := newMountRegistry(m, f.registryURL, f.landingDir, f.chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		var store any = reg
+		if g, ok := reg.(*handler.GroupRegistry); ok {
+			store = g.Writer()
+		}
+		s, ok := store.(retention.Store)
+		if !ok {
+			return nil, fmt.Errorf("registry of %s can't list versions", m.prefix)
+		}
+
+		// Other mounts stored under the backend path are never cleaned up,
+		// even if the config didn't catch them.
+		var exclude []string
+		if p, _, shared := cleanupPath(m.backendPath, m.members); shared {
+			for _, o := range f.mounts {
+				if o == m {
+					continue
+				}
+				for _, q := range backendPaths(o.backendPath, o.members) {
+					if rel, ok := strings.CutPrefix(q, p+"/"); ok {
+						exclude = append(exclude, rel)
+					} else if p == "" && q != "" {
+						exclude = append(exclude, q)
+					}
+				}
+			}
+		}
+
+		repoType := m.repoType
+		targets = append(targets, &retention.Target{
+			Name:           m.prefix,
+			Store:          s,
+			PackageVersion: packageVersion,
+			Delete: func(ctx context.Context, repo, tag string) error {
+				ctx = audit.WithRequest(ctx, &audit.Request{RepoType: repoType, Identity: cleanupIdentity})
+				return deleteVersion(ctx, reg, repo, tag)
+			},
+			Rules:   m.retention,
+			Exclude: exclude,
+		})
 	}
+	return targets, nil
+}
 
-	return srv.Start(ctx, h)
+// newRepoHandler creates the handler for the mount.
+func newRepoHandler(m *mount, reg handler.Registry) (http.Handler, error) {
+	var upstream *handler.Upstream
+	if m.upstream != "" {
+		var err error
+		upstream, err = handler.NewUpstream(m.upstream)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create upstream for %s: %w", m.prefix, err)
+		}
+	}
+
+	switch m.repoType {
+	case maven.RepoType:
+		var opts []maven.Option
+		if upstream != nil {
+			opts = append(opts, maven.WithUpstream(upstream, m.metadataTTL))
+		}
+		mh, err := maven.NewHandler(reg, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create maven handler: %w", err)
+		}
+		return mh.Mux(), nil
+	case npm.RepoType:
+		var opts []npm.Option
+		if upstream != nil {
+			opts = append(opts, npm.WithUpstream(upstream, m.metadataTTL), npm.WithPrivateScopes(m.privateScopes...))
+		}
+		if m.signer != nil {
+			opts = append(opts, npm.WithSigner(m.signer))
+		}
+		nh, err := npm.NewHandler(reg, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create npm handler: %w", err)
+		}
+		return nh.Mux(), nil
+	default:
+		var opts []python.Option
+		if upstream != nil {
+			opts = append(opts, python.WithUpstream(upstream, m.metadataTTL))
+			if m.localShadowing {
+				opts = append(opts, python.WithLocalShadowing())
+			}
+		}
+		ph, err := python.NewHandler(reg, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create python handler: %w", err)
+		}
+		return ph.Mux(), nil
+	}
 }
@@ -1,9 +1,26 @@
 package commands
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/abcxyz/pkg/testutil"
+	"github.com/google/go-cmp/cmp"
+	"github.com/yolocs/ocifactory/pkg/handler"
+	"github.com/yolocs/ocifactory/pkg/handler/maven"
+	"github.com/yolocs/ocifactory/pkg/handler/npm"
+	"github.com/yolocs/ocifactory/pkg/oci"
 )
 
 func TestServeFlagsValidate(t *testing.T) {
@@ -64,6 +81,134 @@ func TestServeFlagsValidate(t *testing.T) {
 			},
 			wantErr: "",
 		},
+		{
+			name: "mounts",
+			flags: serveFlags{
+				port:           "8080",
+				registryURLStr: "http://example.com",
+				mountStrs:      []string{"maven:/maven/", "python:/pypi/:team/python"},
+			},
+			wantErr: "",
+		},
+		{
+			name: "mounts with repo type",
+			flags: serveFlags{
+				port:           "8080",
+				repoType:       "maven",
+				registryURLStr: "http://example.com",
+				mountStrs:      []string{"maven:/maven/"},
+			},
+			wantErr: "repo-type and mount cannot be set together",
+		},
+		{
+			name: "mount with unsupported repo type",
+			flags: serveFlags{
+				port:           "8080",
+				registryURLStr: "http://example.com",
+				mountStrs:      []string{"invalid:/invalid/"},
+			},
+			wantErr: `mount "invalid:/invalid/": repo type "invalid" is not supported`,
+		},
+		{
+			name: "mounts with duplicate prefix",
+			flags: serveFlags{
+				port:           "8080",
+				registryURLStr: "http://example.com",
+				mountStrs:      []string{"maven:/repo/", "python:repo"},
+			},
+			wantErr: `mount "python:repo": prefix "/repo/" is already mounted`,
+		},
+		{
+			name: "invalid mount",
+			flags: serveFlags{
+				port:           "8080",
+				registryURLStr: "http://example.com",
+				mountStrs:      []string{"maven"},
+			},
+			wantErr: `mount "maven" must be in the form of TYPE:PREFIX[:BACKEND_PATH]`,
+		},
+		{
+			name: "oidc issuer without jwks",
+			flags: serveFlags{
+				port:           "8080",
+				repoType:       "maven",
+				registryURLStr: "http://example.com",
+				oidcIssuer:     "https://token.actions.githubusercontent.com",
+			},
+			wantErr: "oidc-jwks is required when oidc-issuer is set",
+		},
+		{
+			name: "oidc jwks without issuer",
+			flags: serveFlags{
+				port:           "8080",
+				repoType:       "maven",
+				registryURLStr: "http://example.com",
+				oidcJWKS:       "/tmp/jwks.json",
+			},
+			wantErr: "oidc-issuer is required when oidc-jwks is set",
+		},
+		{
+			name: "backend username without password",
+			flags: serveFlags{
+				port:            "8080",
+				repoType:        "maven",
+				registryURLStr:  "http://example.com",
+				backendUsername: "robot",
+			},
+			wantErr: "backend-username and backend-password must be set together",
+		},
+		{
+			name: "admin port same as port",
+			flags: serveFlags{
+				port:           "8080",
+				adminPort:      "8080",
+				repoType:       "maven",
+				registryURLStr: "http://example.com",
+			},
+			wantErr: "admin-port must be different from port",
+		},
+		{
+			name: "unsupported trace exporter",
+			flags: serveFlags{
+				port:           "8080",
+				repoType:       "maven",
+				registryURLStr: "http://example.com",
+				traceExporter:  "zipkin",
+			},
+			wantErr: `trace-exporter "zipkin" is not supported`,
+		},
+		{
+			name: "invalid webhook",
+			flags: serveFlags{
+				port:           "8080",
+				repoType:       "maven",
+				registryURLStr: "http://example.com",
+				webhookURLs:    []string{"https://example.com/hook", "example.com/hook"},
+			},
+			wantErr: `webhook: webhook URL "example.com/hook" must be http or https`,
+		},
+		{
+			name: "negative cleanup interval",
+			flags: serveFlags{
+				port:            "8080",
+				repoType:        "maven",
+				registryURLStr:  "http://example.com",
+				cleanupInterval: -time.Hour,
+			},
+			wantErr: "cleanup-interval must not be negative",
+		},
+		{
+			name: "negative audit log rotation",
+			flags: serveFlags{
+				port:           "8080",
+				repoType:       "maven",
+				registryURLStr: "http://example.com",
+				auditLog:       "-",
+				auditMaxSize:   -1,
+				auditBackups:   -1,
+			},
+			wantErr: "audit-log-max-size must not be negative\naudit-log-backups must not be negative",
+		},
 	}
 
 	for _, tc := range cases {
@@ -76,3 +221,291 @@ func TestServeFlagsValidate(t *testing.T) {
 		})
 	}
 }
+
+func TestParseMount(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		in      string
+		want    *mount
+		wantErr string
+	}{
+		{
+			name: "type and prefix",
+			in:   "maven:/maven/",
+			want: &mount{repoType: "maven", prefix: "/maven/"},
+		},
+		{
+			name: "prefix without slashes",
+			in:   "python:pypi",
+			want: &mount{repoType: "python", prefix: "/pypi/"},
+		},
+		{
+			name: "with backend path",
+			in:   "python:/pypi/:/team-a/python/",
+			want: &mount{repoType: "python", prefix: "/pypi/", backendPath: "team-a/python"},
+		},
+		{
+			name: "root prefix",
+			in:   "maven:/",
+			want: &mount{repoType: "maven", prefix: "/"},
+		},
+		{
+			name:    "missing prefix",
+			in:      "maven:",
+			wantErr: "must be in the form of TYPE:PREFIX[:BACKEND_PATH]",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := parseMount(tc.in)
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Fatalf("parseMount() returned unexpected error (-got, +want): %s", diff)
+			}
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(mount{})); diff != "" {
+				t.Errorf("parseMount() mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewMountRegistry(t *testing.T) {
+	t.Parallel()
+
+	registryURL, err := url.Parse("https://example.com/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		m         *mount
+		wantGroup bool
+		wantErr   string
+	}{
+		{
+			name: "single backend",
+			m:    &mount{repoType: "python", prefix: "/pypi/", backendPath: "team/python"},
+		},
+		{
+			name: "group",
+			m: &mount{repoType: "npm", prefix: "/npm/", members: []*memberConfig{
+				{BackendPath: "team-a/npm", Write: true},
+				{BackendRegistry: "other.example.com", BackendPath: "shared/npm"},
+			}},
+			wantGroup: true,
+		},
+		{
+			name: "group without write member",
+			m: &mount{repoType: "npm", prefix: "/npm/", members: []*memberConfig{
+				{BackendPath: "team-a/npm"},
+			}},
+			wantErr: "failed to create group for /npm/",
+		},
+		{
+			name:    "unsupported type",
+			m:       &mount{repoType: "rubygems", prefix: "/"},
+			wantErr: `repo-type "rubygems" is not supported`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := newMountRegistry(tc.m, registryURL, t.TempDir(), 8<<20)
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Fatalf("newMountRegistry() returned unexpected error (-got, +want): %s", diff)
+			}
+			if err != nil {
+				return
+			}
+			if _, isGroup := got.(*handler.GroupRegistry); isGroup != tc.wantGroup {
+				t.Errorf("newMountRegistry() returned %T, want group %t", got, tc.wantGroup)
+			}
+		})
+	}
+}
+
+func TestNewRetentionTargets(t *testing.T) {
+	t.Parallel()
+
+	flags := &serveFlags{
+		port:           "8080",
+		registryURLStr: "http://example.com",
+		landingDir:     t.TempDir(),
+		configRepos: []*repoConfig{
+			{Type: "maven", Prefix: "/maven/", BackendPath: "team/maven", Retention: []*retentionRuleConfig{{Versions: "*-SNAPSHOT", KeepLast: 3}}},
+			// Not allowed by the config file, still never cleaned up.
+			{Type: "python", Prefix: "/pypi/", BackendPath: "team/maven/pypi"},
+			{Type: "npm", Prefix: "/npm/", Retention: []*retentionRuleConfig{{MaxAge: time.Hour}}, Members: []*memberConfig{
+				{BackendPath: "team-a/npm", Write: true},
+				{BackendPath: "shared/npm"},
+			}},
+		},
+	}
+	if err := flags.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := newRetentionTargets(flags)
+	if err != nil {
+		t.Fatalf("newRetentionTargets() returned error: %v", err)
+	}
+	var got []string
+	for _, target := range targets {
+		got = append(got, target.Name)
+	}
+	if diff := cmp.Diff([]string{"/maven/", "/npm/"}, got); diff != "" {
+		t.Errorf("targets mismatch (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"pypi"}, targets[0].Exclude); diff != "" {
+		t.Errorf("excluded repositories mismatch (-want, +got):\n%s", diff)
+	}
+	if _, ok := targets[1].Store.(*oci.Registry); !ok {
+		t.Errorf("group target store is %T, want the write member", targets[1].Store)
+	}
+}
+
+func TestNewServeHandlerReadinessChecks(t *testing.T) {
+	t.Parallel()
+
+	flags := &serveFlags{
+		port:           "8080",
+		registryURLStr: "http://example.com",
+		landingDir:     t.TempDir(),
+		mountStrs:      []string{"maven:/maven/", "python:/pypi/"},
+	}
+	if err := flags.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, checks, err := newServeHandler(context.Background(), flags)
+	if err != nil {
+		t.Fatalf("newServeHandler() returned error: %v", err)
+	}
+	var got []string
+	for _, c := range checks {
+		got = append(got, c.Name)
+	}
+	want := []string{"landing_dir", "backend /maven/", "backend /pypi/"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("readiness checks mismatch (-want, +got):\n%s", diff)
+	}
+	if err := checks[0].Check(context.Background()); err != nil {
+		t.Errorf("landing_dir check returned error: %v", err)
+	}
+}
+
+func TestNewVerifyPolicy(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() error = %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "cosign.pub")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	flags := &serveFlags{
+		port:           "8080",
+		registryURLStr: "http://example.com",
+		landingDir:     t.TempDir(),
+		configRepos: []*repoConfig{
+			{Type: "maven", Prefix: "/maven/", Verification: &verificationConfig{PublicKeys: []string{keyPath}, Enforce: enforceBoth}},
+			{Type: "python", Prefix: "/pypi/", Verification: &verificationConfig{PublicKeys: []string{keyPath}, Enforce: enforceDownload, Files: []string{"*.whl"}}},
+			{Type: "npm", Prefix: "/npm/", Verification: &verificationConfig{PublicKeys: []string{keyPath}}},
+			{Type: "npm", Prefix: "/plain/"},
+		},
+	}
+	if err := flags.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	type policy struct {
+		Files      []string
+		OnPublish  bool
+		OnDownload bool
+	}
+	var got []*policy
+	for _, m := range flags.mounts {
+		if m.verification == nil {
+			got = append(got, nil)
+			continue
+		}
+		got = append(got, &policy{Files: m.verification.Files, OnPublish: m.verification.OnPublish, OnDownload: m.verification.OnDownload})
+	}
+	want := []*policy{
+		{Files: maven.SignedFiles, OnPublish: true, OnDownload: true},
+		{Files: []string{"*.whl"}, OnDownload: true},
+		{Files: npm.SignedFiles},
+		nil,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("verification policies mismatch (-want, +got):\n%s", diff)
+	}
+	if _, _, err := newServeHandler(context.Background(), flags); err != nil {
+		t.Errorf("newServeHandler() returned error: %v", err)
+	}
+
+	flags.configRepos[0].Verification.PublicKeys = []string{filepath.Join(t.TempDir(), "missing.pub")}
+	if diff := testutil.DiffErrString(flags.Validate(), "repo /maven/: failed to read public key"); diff != "" {
+		t.Errorf("Validate() error diff: %s", diff)
+	}
+}
+
+func TestNpmSigningKey(t *testing.T) {
+	t.Parallel()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "npm.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	flags := &serveFlags{
+		port:           "8080",
+		registryURLStr: "http://example.com",
+		landingDir:     t.TempDir(),
+		configRepos: []*repoConfig{
+			{Type: "npm", Prefix: "/npm/", SigningKey: keyPath},
+		},
+	}
+	if err := flags.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if flags.mounts[0].signer == nil {
+		t.Fatal("npm mount has no signer")
+	}
+	h, _, err := newServeHandler(context.Background(), flags)
+	if err != nil {
+		t.Fatalf("newServeHandler() returned error: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/npm/-/npm/v1/keys", nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("Keys status code = %d, want %d, body: %s", got, want, resp.Body.String())
+	}
+
+	flags.configRepos[0].SigningKey = filepath.Join(t.TempDir(), "missing.pem")
+	if diff := testutil.DiffErrString(flags.Validate(), "repo /npm/: failed to read signing key"); diff != "" {
+		t.Errorf("Validate() error diff: %s", diff)
+	}
+}
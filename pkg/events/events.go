@@ -0,0 +1,271 @@
+// Package events notifies downstream systems, e.g. deploy triggers or cache
+// warmers, when package versions are published or deleted. Events are sent to
+// webhooks and streamed as server-sent events.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/audit"
+)
+
+// Type is the type of change to a package version.
+type Type string
+
+const (
+	// TypePublished is sent when files are added to a version.
+	TypePublished Type = "version.published"
+	// TypeOverwritten is sent when files of a version are replaced with
+	// different content.
+	TypeOverwritten Type = "version.overwritten"
+	// TypeDeleted is sent when a version or some of its files are deleted.
+	// The manifest is empty if the whole version is gone.
+	TypeDeleted Type = "version.deleted"
+)
+
+const (
+	// historySize is the number of recent events kept for stream clients that
+	// reconnect with Last-Event-ID.
+	historySize = 256
+	// subscriberBuffer is the number of events a stream client can fall behind
+	// before it's disconnected. It catches up after reconnecting.
+	subscriberBuffer = 64
+	// keepAliveInterval is how often an idle stream sends a comment so proxies
+	// don't close it.
+	keepAliveInterval = 30 * time.Second
+)
+
+// contextKey is a private string type to prevent collisions in the context map.
+type contextKey string
+
+// publisherKey points to the value in the context where the publisher is stored.
+const publisherKey = contextKey("publisher")
+
+// File is a file of the version that changed.
+type File struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// Event is a change to a package version.
+type Event struct {
+	ID      string    `json:"id"`
+	Type    Type      `json:"type"`
+	Time    time.Time `json:"time"`
+	Format  string    `json:"format,omitempty"` // The repo type, e.g. maven.
+	Repo    string    `json:"repo"`             // The backend repository, e.g. com/example/project.
+	Package string    `json:"package"`
+	Version string    `json:"version"`
+	Files   []*File   `json:"files,omitempty"`
+
+	// Manifest is the digest of the manifest of the version after the change.
+	Manifest string `json:"manifest,omitempty"`
+
+	// Actor is the authenticated caller, empty if anonymous.
+	Actor string `json:"actor,omitempty"`
+}
+
+// Publisher sends events.
+type Publisher interface {
+	Publish(ctx context.Context, e *Event)
+}
+
+// Dispatcher sends events to the webhooks and the stream clients.
+type Dispatcher struct {
+	webhooks []*Webhook
+
+	// prefix makes event IDs unique across restarts.
+	prefix string
+
+	mu      sync.Mutex
+	seq     uint64
+	history []*Event
+	subs    map[chan *Event]struct{}
+	closed  bool
+}
+
+// NewDispatcher creates a dispatcher that sends events to the webhooks once
+// it's started.
+func NewDispatcher(webhooks ...*Webhook) *Dispatcher {
+	return &Dispatcher{
+		webhooks: webhooks,
+		prefix:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		subs:     make(map[chan *Event]struct{}),
+	}
+}
+
+// Start delivers events to the webhooks until ctx is done. Stream clients are
+// disconnected when ctx is done.
+func (d *Dispatcher) Start(ctx context.Context) {
+	for _, w := range d.webhooks {
+		go w.run(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.closed = true
+		for ch := range d.subs {
+			close(ch)
+			delete(d.subs, ch)
+		}
+	}()
+}
+
+// Publish assigns an ID to the event and sends it. The format and actor are
+// taken from the request in ctx, if any. It never blocks on slow receivers.
+func (d *Dispatcher) Publish(ctx context.Context, e *Event) {
+	if r, ok := audit.RequestFromContext(ctx); ok {
+		e.Format, e.Actor = r.RepoType, r.Identity
+	}
+	e.Time = time.Now().UTC()
+
+	d.mu.Lock()
+	d.seq++
+	e.ID = d.prefix + "-" + strconv.FormatUint(d.seq, 10)
+	d.history = append(d.history, e)
+	if len(d.history) > historySize {
+		d.history = d.history[len(d.history)-historySize:]
+	}
+	for ch := range d.subs {
+		select {
+		case ch <- e:
+		default:
+			// Disconnect the client rather than silently skipping events.
+			close(ch)
+			delete(d.subs, ch)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, w := range d.webhooks {
+		w.enqueue(ctx, e)
+	}
+}
+
+// subscribe returns a channel of the events after lastID. Events after lastID
+// are replayed if they are still in the history.
+func (d *Dispatcher) subscribe(lastID string) (chan *Event, []*Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var replay []*Event
+	if lastID != "" {
+		for i, e := range d.history {
+			if e.ID == lastID {
+				replay = append(replay, d.history[i+1:]...)
+				break
+			}
+		}
+	}
+	ch := make(chan *Event, subscriberBuffer)
+	if d.closed {
+		close(ch)
+		return ch, replay
+	}
+	d.subs[ch] = struct{}{}
+	return ch, replay
+}
+
+func (d *Dispatcher) unsubscribe(ch chan *Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.subs[ch]; ok {
+		close(ch)
+		delete(d.subs, ch)
+	}
+}
+
+// ServeHTTP streams the events as server-sent events. Clients that reconnect
+// with the Last-Event-ID header get the events they missed, as long as they
+// are still in the recent history. The format and type query parameters
+// filter the events, e.g. ?format=npm&type=version.published.
+func (d *Dispatcher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+	// Streams outlive the write timeout of the server.
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		logging.FromContext(ctx).DebugContext(ctx, "failed to clear write deadline", "error", err)
+	}
+
+	format, typ := r.URL.Query().Get("format"), Type(r.URL.Query().Get("type"))
+	ch, replay := d.subscribe(r.Header.Get("Last-Event-ID"))
+	defer d.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(e *Event) error {
+		if (format != "" && e.Format != format) || (typ != "" && e.Type != typ) {
+			return nil
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			return fmt.Errorf("failed to marshal event: %w", err)
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, b); err != nil {
+			return fmt.Errorf("failed to write event: %w", err)
+		}
+		return nil
+	}
+	for _, e := range replay {
+		if err := write(e); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := write(e); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// Middleware adds the dispatcher to the request context, so changes deeper
+// down are published with Publish.
+func (d *Dispatcher) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithPublisher(r.Context(), d)))
+	})
+}
+
+// WithPublisher adds the publisher to the context.
+func WithPublisher(ctx context.Context, p Publisher) context.Context {
+	return context.WithValue(ctx, publisherKey, p)
+}
+
+// Publish sends the event with the publisher in ctx. It does nothing if there
+// is no publisher, e.g. when events are disabled.
+func Publish(ctx context.Context, e *Event) {
+	if p, ok := ctx.Value(publisherKey).(Publisher); ok {
+		p.Publish(ctx, e)
+	}
+}
@@ -0,0 +1,149 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/yolocs/ocifactory/pkg/audit"
+)
+
+func TestPublish(t *testing.T) {
+	t.Parallel()
+
+	d := NewDispatcher()
+	ctx := WithPublisher(context.Background(), d)
+	ctx = audit.WithRequest(ctx, &audit.Request{RepoType: "npm", Identity: "octo-org/octo-repo"})
+
+	Publish(ctx, &Event{Type: TypePublished, Repo: "packages/foo", Package: "foo", Version: "1.0.0"})
+	Publish(ctx, &Event{Type: TypeDeleted, Repo: "packages/foo", Package: "foo", Version: "1.0.0"})
+
+	want := []*Event{
+		{Type: TypePublished, Format: "npm", Repo: "packages/foo", Package: "foo", Version: "1.0.0", Actor: "octo-org/octo-repo"},
+		{Type: TypeDeleted, Format: "npm", Repo: "packages/foo", Package: "foo", Version: "1.0.0", Actor: "octo-org/octo-repo"},
+	}
+	if diff := cmp.Diff(want, d.history, cmpopts.IgnoreFields(Event{}, "ID", "Time")); diff != "" {
+		t.Errorf("published events mismatch (-want, +got):\n%s", diff)
+	}
+	if d.history[0].ID == d.history[1].ID {
+		t.Errorf("events have the same ID %q", d.history[0].ID)
+	}
+}
+
+func TestPublishWithoutPublisher(t *testing.T) {
+	t.Parallel()
+
+	// Must not panic.
+	Publish(context.Background(), &Event{Type: TypePublished, Repo: "foo"})
+}
+
+// readEvent reads the next server-sent event and returns its ID and data.
+func readEvent(t *testing.T, r *bufio.Reader) (string, *Event) {
+	t.Helper()
+
+	var id string
+	var e *Event
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if e != nil {
+				return id, e
+			}
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			e = &Event{}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), e); err != nil {
+				t.Fatalf("failed to parse event %q: %v", line, err)
+			}
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	d := NewDispatcher()
+	d.Start(ctx)
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+
+	npmCtx := audit.WithRequest(ctx, &audit.Request{RepoType: "npm"})
+	mavenCtx := audit.WithRequest(ctx, &audit.Request{RepoType: "maven"})
+	d.Publish(npmCtx, &Event{Type: TypePublished, Package: "missed", Version: "1.0.0"})
+	lastID := d.history[0].ID
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?format=npm", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", lastID)
+	d.Publish(npmCtx, &Event{Type: TypePublished, Package: "replayed", Version: "1.0.0"})
+
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("failed to open event stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+
+	d.Publish(mavenCtx, &Event{Type: TypePublished, Package: "filtered", Version: "1.0.0"})
+	d.Publish(npmCtx, &Event{Type: TypeOverwritten, Package: "live", Version: "1.0.0"})
+
+	r := bufio.NewReader(resp.Body)
+	var got []string
+	for range 2 {
+		id, e := readEvent(t, r)
+		if id != e.ID {
+			t.Errorf("event id = %q, want %q", id, e.ID)
+		}
+		got = append(got, string(e.Type)+" "+e.Package)
+	}
+	want := []string{"version.published replayed", "version.overwritten live"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("streamed events mismatch (-want, +got):\n%s", diff)
+	}
+
+	// Stopping the dispatcher ends the stream.
+	cancel()
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Errorf("event stream is still open after the dispatcher stopped")
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	t.Parallel()
+
+	d := NewDispatcher()
+	ch, _ := d.subscribe("")
+	for range subscriberBuffer + 1 {
+		d.Publish(context.Background(), &Event{Type: TypePublished})
+	}
+
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("received %d events before disconnect, want %d", n, subscriberBuffer)
+	}
+	if len(d.subs) != 0 {
+		t.Errorf("slow subscriber is still subscribed")
+	}
+}
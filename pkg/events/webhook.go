@@ -0,0 +1,181 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/metrics"
+)
+
+const (
+	// SignatureHeader has the hex encoded HMAC-SHA256 of the request body with
+	// the webhook secret, prefixed with "sha256=".
+	SignatureHeader = "X-Ocifactory-Signature"
+	// EventHeader has the event type.
+	EventHeader = "X-Ocifactory-Event"
+	// DeliveryHeader has the event ID. Retries of the same event have the same
+	// ID, so receivers can deduplicate them.
+	DeliveryHeader = "X-Ocifactory-Delivery"
+
+	defaultMaxAttempts = 5
+	defaultBackoff     = time.Second
+	maxBackoff         = time.Minute
+	queueSize          = 1024
+	deliveryTimeout    = 30 * time.Second
+)
+
+// Webhook posts events as JSON to a URL.
+type Webhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+
+	maxAttempts int
+	backoff     time.Duration
+
+	queue chan *Event
+}
+
+// WebhookOption configures the webhook.
+type WebhookOption func(*Webhook)
+
+// WithSecret signs the requests with the secret in the X-Ocifactory-Signature
+// header.
+func WithSecret(secret string) WebhookOption {
+	return func(w *Webhook) {
+		w.secret = []byte(secret)
+	}
+}
+
+// WithRetry makes at most maxAttempts deliveries of an event, doubling the
+// delay between them starting at backoff.
+func WithRetry(maxAttempts int, backoff time.Duration) WebhookOption {
+	return func(w *Webhook) {
+		w.maxAttempts = maxAttempts
+		w.backoff = backoff
+	}
+}
+
+// WithHTTPClient sets the client used to post the events.
+func WithHTTPClient(c *http.Client) WebhookOption {
+	return func(w *Webhook) {
+		w.client = c
+	}
+}
+
+// NewWebhook creates a webhook that posts to url.
+func NewWebhook(url string, opts ...WebhookOption) *Webhook {
+	w := &Webhook{
+		url:         url,
+		client:      &http.Client{Timeout: deliveryTimeout},
+		maxAttempts: defaultMaxAttempts,
+		backoff:     defaultBackoff,
+		queue:       make(chan *Event, queueSize),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// Sign returns the value of the signature header of the body.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// enqueue queues the event for delivery. The event is dropped if the receiver
+// is too far behind.
+func (w *Webhook) enqueue(ctx context.Context, e *Event) {
+	select {
+	case w.queue <- e:
+	default:
+		metrics.WebhookDeliveries.WithLabelValues("dropped").Inc()
+		logging.FromContext(ctx).WarnContext(ctx, "webhook queue is full, dropping event",
+			"url", w.url, "event_id", e.ID)
+	}
+}
+
+// run delivers the queued events one by one, in the order they were
+// published, until ctx is done.
+func (w *Webhook) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-w.queue:
+			result := "success"
+			if err := w.deliver(ctx, e); err != nil {
+				result = "failure"
+				logging.FromContext(ctx).ErrorContext(ctx, "failed to deliver event to webhook",
+					"url", w.url, "event_id", e.ID, "error", err)
+			}
+			metrics.WebhookDeliveries.WithLabelValues(result).Inc()
+		}
+	}
+}
+
+// deliver posts the event and retries with exponential backoff on network
+// errors, 429 and 5xx responses.
+func (w *Webhook) deliver(ctx context.Context, e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	delay := w.backoff
+	for attempt := 1; ; attempt++ {
+		retryable, err := w.post(ctx, e, body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= w.maxAttempts {
+			return fmt.Errorf("attempt %d: %w", attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("attempt %d: %w", attempt, ctx.Err())
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxBackoff)
+	}
+}
+
+// post makes a single delivery. Returns whether a failed delivery should be
+// retried.
+func (w *Webhook) post(ctx context.Context, e *Event, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(e.Type))
+	req.Header.Set(DeliveryHeader, e.ID)
+	if len(w.secret) > 0 {
+		req.Header.Set(SignatureHeader, Sign(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to post event: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("webhook responded with %s", resp.Status)
+}
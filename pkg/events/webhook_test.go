@@ -0,0 +1,154 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeReceiver responds to the deliveries with the statuses in order and
+// records the requests.
+type fakeReceiver struct {
+	statuses []int
+
+	mu       sync.Mutex
+	bodies   [][]byte
+	headers  []http.Header
+	received chan struct{}
+}
+
+func (f *fakeReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+
+	f.mu.Lock()
+	status := http.StatusOK
+	if n := len(f.bodies); n < len(f.statuses) {
+		status = f.statuses[n]
+	}
+	f.bodies = append(f.bodies, b)
+	f.headers = append(f.headers, r.Header.Clone())
+	f.mu.Unlock()
+
+	w.WriteHeader(status)
+	if f.received != nil {
+		f.received <- struct{}{}
+	}
+}
+
+func TestWebhookDeliver(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int
+		wantErr      string
+	}{
+		{
+			name:         "success",
+			wantAttempts: 1,
+		},
+		{
+			name:         "retried",
+			statuses:     []int{http.StatusInternalServerError, http.StatusTooManyRequests},
+			wantAttempts: 3,
+		},
+		{
+			name:         "gives up",
+			statuses:     []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			wantAttempts: 3,
+			wantErr:      "attempt 3: webhook responded with 502 Bad Gateway",
+		},
+		{
+			name:         "not retried",
+			statuses:     []int{http.StatusBadRequest},
+			wantAttempts: 1,
+			wantErr:      "attempt 1: webhook responded with 400 Bad Request",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			recv := &fakeReceiver{statuses: tc.statuses}
+			srv := httptest.NewServer(recv)
+			t.Cleanup(srv.Close)
+
+			w := NewWebhook(srv.URL, WithSecret("s3cret"), WithRetry(3, time.Millisecond))
+			e := &Event{ID: "abc-1", Type: TypePublished, Repo: "packages/foo", Package: "foo", Version: "1.0.0"}
+			err := w.deliver(context.Background(), e)
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Fatalf("deliver() returned unexpected error (-got, +want): %s", diff)
+			}
+			if got := len(recv.bodies); got != tc.wantAttempts {
+				t.Fatalf("webhook received %d requests, want %d", got, tc.wantAttempts)
+			}
+
+			for i, b := range recv.bodies {
+				h := recv.headers[i]
+				if got, want := h.Get(SignatureHeader), Sign([]byte("s3cret"), b); got != want {
+					t.Errorf("request %d signature = %q, want %q", i, got, want)
+				}
+				if got, want := h.Get(DeliveryHeader), "abc-1"; got != want {
+					t.Errorf("request %d delivery = %q, want %q", i, got, want)
+				}
+				if got, want := h.Get(EventHeader), "version.published"; got != want {
+					t.Errorf("request %d event = %q, want %q", i, got, want)
+				}
+				var got Event
+				if err := json.Unmarshal(b, &got); err != nil {
+					t.Fatalf("failed to parse request body: %v", err)
+				}
+				if diff := cmp.Diff(e, &got); diff != "" {
+					t.Errorf("request %d body mismatch (-want, +got):\n%s", i, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookWithoutSecret(t *testing.T) {
+	t.Parallel()
+
+	recv := &fakeReceiver{received: make(chan struct{}, 1)}
+	srv := httptest.NewServer(recv)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	d := NewDispatcher(NewWebhook(srv.URL))
+	d.Start(ctx)
+	d.Publish(ctx, &Event{Type: TypeDeleted, Package: "foo", Version: "1.0.0"})
+
+	select {
+	case <-recv.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook didn't receive the event")
+	}
+	recv.mu.Lock()
+	defer recv.mu.Unlock()
+	if got := recv.headers[0].Get(SignatureHeader); got != "" {
+		t.Errorf("unsigned webhook sent signature %q", got)
+	}
+}
+
+func TestSign(t *testing.T) {
+	t.Parallel()
+
+	// echo -n '{}' | openssl dgst -sha256 -hmac key
+	got := Sign([]byte("key"), []byte("{}"))
+	want := "sha256=a777724d943eb48dc69bca8a4a6d57a04db3f9ec7e1de4e581e860265bdf3032"
+	if got != want {
+		t.Errorf("Sign() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/auth"
+	"github.com/yolocs/ocifactory/pkg/cred"
+)
+
+// AccessLog is a middleware that logs every request once it's served, with
+// the status, the response size, the duration and the caller. It uses the
+// logger in the request context, so it must run after Loggeer.
+func AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", rw.status),
+			slog.Int64("request_bytes", body.n),
+			slog.Int64("response_bytes", rw.n),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("identity", info.identity),
+			slog.String("client_ip", ClientIP(r)),
+			slog.String("user_agent", r.UserAgent()),
+		}
+		if info.repoType != "" {
+			attrs = append(attrs, slog.String("repo_type", info.repoType))
+		}
+		if ff := r.Header.Get("X-Forwarded-For"); ff != "" {
+			attrs = append(attrs, slog.String("forwarded_for", ff))
+		}
+		logging.FromContext(r.Context()).LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+	})
+}
+
+// Identity returns the caller of the request: the subject of a verified OIDC
+// token, or else the basic auth user name. Basic auth credentials are verified
+// by the backend registry, so the user name is only trustworthy for requests
+// the backend accepted. Returns an empty string for anonymous requests.
+func Identity(ctx context.Context) string {
+	if id, ok := auth.IdentityFromContext(ctx); ok {
+		return id.Subject
+	}
+	if c, ok := cred.FromContext(ctx); ok && c.Basic != nil {
+		return c.Basic.User
+	}
+	return ""
+}
+
+// ClientIP returns the IP of the connection. Forwarded headers are not used
+// since they can be set by the client.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
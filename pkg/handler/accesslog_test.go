@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/google/go-cmp/cmp"
+	"github.com/yolocs/ocifactory/pkg/audit"
+	"github.com/yolocs/ocifactory/pkg/auth"
+	"github.com/yolocs/ocifactory/pkg/cred"
+)
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	var gotRequest *audit.Request
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body) //nolint:errcheck // Test handler.
+		gotRequest, _ = audit.RequestFromContext(r.Context())
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created")) //nolint:errcheck // Test handler.
+	})
+	h := AccessLog(PassThroughAuth(Mount("/maven/", WithRepoType("maven", inner))))
+
+	var buf bytes.Buffer
+	req := httptest.NewRequest(http.MethodPut, "/maven/com/example/project/1.0.0/project-1.0.0.jar", strings.NewReader("content"))
+	req = req.WithContext(logging.WithLogger(req.Context(), slog.New(slog.NewJSONHandler(&buf, nil))))
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.SetBasicAuth("robot", "secret")
+	req.Header.Set("User-Agent", "Apache-Maven/3.9.6")
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	var got map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("failed to parse access log %q: %v", buf.String(), err)
+	}
+	delete(got, "time")
+	delete(got, "duration")
+	want := map[string]any{
+		"level":          "INFO",
+		"msg":            "access",
+		"method":         "PUT",
+		"path":           "/maven/com/example/project/1.0.0/project-1.0.0.jar",
+		"status":         float64(http.StatusCreated),
+		"request_bytes":  float64(len("content")),
+		"response_bytes": float64(len("created")),
+		"identity":       "robot",
+		"client_ip":      "10.0.0.1",
+		"user_agent":     "Apache-Maven/3.9.6",
+		"repo_type":      "maven",
+		"forwarded_for":  "203.0.113.1",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("access log mismatch (-want, +got):\n%s", diff)
+	}
+
+	wantRequest := &audit.Request{
+		RepoType:     "maven",
+		Identity:     "robot",
+		ClientIP:     "10.0.0.1",
+		ForwardedFor: "203.0.113.1",
+		UserAgent:    "Apache-Maven/3.9.6",
+		Method:       "PUT",
+		Path:         "/maven/com/example/project/1.0.0/project-1.0.0.jar",
+	}
+	if diff := cmp.Diff(wantRequest, gotRequest); diff != "" {
+		t.Errorf("audit request mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name string
+		ctx  context.Context //nolint:containedctx // Test input.
+		want string
+	}{
+		{
+			name: "anonymous",
+			ctx:  context.Background(),
+		},
+		{
+			name: "basic auth",
+			ctx:  cred.WithCred(context.Background(), &cred.Cred{Basic: &cred.BasicCred{User: "robot", Password: "secret"}}),
+			want: "robot",
+		},
+		{
+			name: "oidc over backend cred",
+			ctx: auth.WithIdentity(
+				cred.WithCred(context.Background(), &cred.Cred{Basic: &cred.BasicCred{User: "backend-robot", Password: "secret"}}),
+				&auth.Identity{Subject: "octo-org/octo-repo"}),
+			want: "octo-org/octo-repo",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := Identity(tc.ctx); got != tc.want {
+				t.Errorf("Identity() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -10,13 +10,18 @@ import (
 	"github.com/abcxyz/pkg/serving"
 	"github.com/yolocs/ocifactory/pkg/cred"
 	"github.com/yolocs/ocifactory/pkg/oci"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Registry interface {
 	AddFile(ctx context.Context, f *oci.RepoFile, ro io.Reader) (*oci.FileDescriptor, error)
+	AddFiles(ctx context.Context, uploads []*oci.FileUpload) ([]*oci.FileDescriptor, error)
 	ReadFile(ctx context.Context, f *oci.RepoFile) (*oci.FileDescriptor, io.ReadCloser, error)
 	ListTags(ctx context.Context, repo string) ([]string, error)
 	ListFiles(ctx context.Context, repo string) ([]*oci.RepoFile, error)
+	DeleteFile(ctx context.Context, f *oci.RepoFile) error
+	DeleteTagFiles(ctx context.Context, repo, tag string) error
+	DeleteRepoFiles(ctx context.Context, repo string) error
 }
 
 type Middleware func(next http.Handler) http.Handler
@@ -25,6 +30,7 @@ type Middleware func(next http.Handler) http.Handler
 type Server struct {
 	svr         *serving.Server
 	middlewares []Middleware
+	health      *Health
 }
 
 func NewServer(port string, middlewares ...Middleware) (*Server, error) {
@@ -35,16 +41,35 @@ func NewServer(port string, middlewares ...Middleware) (*Server, error) {
 	return &Server{svr: svr, middlewares: middlewares}, nil
 }
 
+// SetHealth makes the server answer /healthz and /readyz with h. The health
+// endpoints bypass the middlewares, so probes are neither authenticated nor
+// logged.
+func (s *Server) SetHealth(h *Health) {
+	s.health = h
+}
+
 // Start starts the server with the given handler and middlewares and blocks
 // until the provided context is closed. When the provided context is closed,
 // the HTTP server is gracefully stopped with a timeout of 10 seconds; once a
 // server has been stopped, it is NOT safe for reuse.
 func (s *Server) Start(ctx context.Context, handler http.Handler) error {
+	return s.svr.StartHTTPHandler(ctx, s.handler(handler))
+}
+
+func (s *Server) handler(handler http.Handler) http.Handler {
 	h := handler
 	for i := len(s.middlewares) - 1; i >= 0; i-- {
 		h = s.middlewares[i](h)
 	}
-	return s.svr.StartHTTPHandler(ctx, h)
+	if s.health == nil {
+		return h
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.health.ServeHealthz)
+	mux.HandleFunc("GET /readyz", s.health.ServeReadyz)
+	mux.Handle("/", h)
+	return mux
 }
 
 // PassThroughAuth is a middleware that passes through basic auth credentials
@@ -63,14 +88,19 @@ func PassThroughAuth(next http.Handler) http.Handler {
 	})
 }
 
-// Logger is a middleware that adds a logger to the request context.
+// Logger is a middleware that adds a logger to the request context. Logs of
+// traced requests have the trace ID.
 // Use OCIFACTORY_LOG_LEVEL, OCIFACTORY_LOG_FORMAT, and OCIFACTORY_LOG_DEBUG to
 // configure the logger.
 func Loggeer(next http.Handler) http.Handler {
 	logger := logging.NewFromEnv("OCIFACTORY_")
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger.DebugContext(r.Context(), "request", "method", r.Method, "url", r.URL.String())
-		r = r.WithContext(logging.WithLogger(r.Context(), logger))
+		l := logger
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			l = logger.With("trace_id", sc.TraceID().String())
+		}
+		l.DebugContext(r.Context(), "request", "method", r.Method, "url", r.URL.String())
+		r = r.WithContext(logging.WithLogger(r.Context(), l))
 		next.ServeHTTP(w, r)
 	})
 }
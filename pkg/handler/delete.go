@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/auth"
+)
+
+// DeleteFiles checks that the caller may delete, runs del and responds with
+// 204. Callers without auth.PrivilegeDelete get 403 and errors of del are
+// written with ew.
+func DeleteFiles(w http.ResponseWriter, req *http.Request, ew ErrorWriter, del func(ctx context.Context) error) {
+	ctx := req.Context()
+	if !auth.Allowed(ctx, auth.PrivilegeDelete) {
+		logging.FromContext(ctx).DebugContext(ctx, "caller is not allowed to delete", "path", req.URL.Path)
+		ew(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if err := del(ctx); err != nil {
+		WriteError(w, req, err, ew)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
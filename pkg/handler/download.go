@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/oci"
+)
+
+// GetFile reads the file from the registry and serves it with ServeFile. If
+// the file is not found and notFound is set, notFound serves the request
+// instead, e.g. from an upstream, unless the registry doesn't allow it for the
+// file, see AllowsUpstream. Other errors are written with ew.
+func GetFile(w http.ResponseWriter, req *http.Request, reg Registry, f *oci.RepoFile, ew ErrorWriter, notFound func(http.ResponseWriter, *http.Request, *oci.RepoFile)) {
+	desc, r, err := reg.ReadFile(req.Context(), f)
+	if err != nil {
+		if IsNotFound(err) && notFound != nil && AllowsUpstream(reg, f.Name) {
+			logging.FromContext(req.Context()).DebugContext(req.Context(), "file not found in registry", "file", f.Name, "error", err)
+			notFound(w, req, f)
+			return
+		}
+		WriteError(w, req, err, ew)
+		return
+	}
+	ServeFile(w, req, f, desc, r)
+}
+
+// ServeFile writes the file read from the registry to the response and closes
+// the reader. The layer digest is the strong ETag of the file, so conditional
+// requests are answered with 304. The upload time of the file, if recorded, is
+// its Last-Modified and the verification state of a VerifyPolicy, if any, is
+// sent in VerificationHeader. Range requests are fetched from the backend
+// with ranged reads if the reader is seekable, which is the case for registries
+// that support them. Otherwise the reader skips ahead to the range.
+func ServeFile(w http.ResponseWriter, req *http.Request, f *oci.RepoFile, desc *oci.FileDescriptor, r io.ReadCloser) {
+	defer r.Close()
+	logging.FromContext(req.Context()).DebugContext(req.Context(), "read file", "descriptor", desc)
+
+	mediaType := f.MediaType
+	if mediaType == "" {
+		mediaType = desc.File.MediaType
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("ETag", `"`+desc.File.Digest.String()+`"`)
+	w.Header().Set("X-Checksum-Sha256", desc.File.Digest.String())
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if state := desc.File.Annotations[verificationAnnotation]; state != "" {
+		w.Header().Set(VerificationHeader, state)
+	}
+
+	http.ServeContent(w, req, f.Name, oci.CreatedTime(desc.File), &lazySeeker{r: r, size: desc.File.Size})
+}
+
+// lazySeeker defers seeks until the next read, so probing the size or seeking
+// back to the start doesn't cost a backend request. Readers that can't seek are
+// only able to skip ahead.
+type lazySeeker struct {
+	r    io.Reader
+	size int64
+	pos  int64 // Position of the next read.
+	rpos int64 // Position of the underlying reader.
+}
+
+func (s *lazySeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+func (s *lazySeeker) Read(p []byte) (int, error) {
+	if s.pos != s.rpos {
+		if rs, ok := s.r.(io.Seeker); ok {
+			if _, err := rs.Seek(s.pos, io.SeekStart); err != nil {
+				return 0, fmt.Errorf("failed to seek file: %w", err)
+			}
+		} else {
+			if s.pos < s.rpos {
+				return 0, errors.New("seek: file can only be read forward")
+			}
+			if _, err := io.CopyN(io.Discard, s.r, s.pos-s.rpos); err != nil {
+				return 0, fmt.Errorf("failed to skip file content: %w", err)
+			}
+		}
+		s.rpos = s.pos
+	}
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.rpos = s.pos
+	return n, err //nolint:wrapcheck // Want passthrough io.EOF.
+}
@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/oci"
+)
+
+// seekCounter is a seekable reader that counts the seeks as ranged backend fetches.
+type seekCounter struct {
+	*strings.Reader
+	seeks int
+}
+
+func (s *seekCounter) Seek(offset int64, whence int) (int64, error) {
+	s.seeks++
+	return s.Reader.Seek(offset, whence) //nolint:wrapcheck // Test reader.
+}
+
+func (s *seekCounter) Close() error { return nil }
+
+func TestServeFile(t *testing.T) {
+	t.Parallel()
+
+	content := "0123456789"
+	etag := `"` + digest.FromString(content).String() + `"`
+
+	cases := []struct {
+		name       string
+		method     string
+		headers    map[string]string
+		seekable   bool
+		wantStatus int
+		wantBody   string
+		wantHeader map[string]string
+		wantSeeks  int
+	}{
+		{
+			name:       "full download",
+			method:     http.MethodGet,
+			seekable:   true,
+			wantStatus: http.StatusOK,
+			wantBody:   content,
+			wantHeader: map[string]string{
+				"ETag":           etag,
+				"Content-Length": "10",
+				"Content-Type":   "application/java-archive",
+				"Accept-Ranges":  "bytes",
+				"Last-Modified":  "Thu, 02 Jan 2025 03:04:05 GMT",
+			},
+		},
+		{
+			name:       "head",
+			method:     http.MethodHead,
+			seekable:   true,
+			wantStatus: http.StatusOK,
+			wantHeader: map[string]string{"ETag": etag, "Content-Length": "10"},
+		},
+		{
+			name:       "etag matches",
+			method:     http.MethodGet,
+			headers:    map[string]string{"If-None-Match": `"sha256:other", ` + etag},
+			seekable:   true,
+			wantStatus: http.StatusNotModified,
+			wantHeader: map[string]string{"ETag": etag},
+		},
+		{
+			name:       "not modified since upload",
+			method:     http.MethodGet,
+			headers:    map[string]string{"If-Modified-Since": "Fri, 03 Jan 2025 00:00:00 GMT"},
+			seekable:   true,
+			wantStatus: http.StatusNotModified,
+		},
+		{
+			name:       "etag differs",
+			method:     http.MethodGet,
+			headers:    map[string]string{"If-None-Match": `"sha256:other"`},
+			seekable:   true,
+			wantStatus: http.StatusOK,
+			wantBody:   content,
+		},
+		{
+			name:       "range",
+			method:     http.MethodGet,
+			headers:    map[string]string{"Range": "bytes=2-5"},
+			seekable:   true,
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "2345",
+			wantHeader: map[string]string{"Content-Range": "bytes 2-5/10", "Content-Length": "4"},
+			wantSeeks:  1,
+		},
+		{
+			name:       "range of unseekable file",
+			method:     http.MethodGet,
+			headers:    map[string]string{"Range": "bytes=7-"},
+			wantStatus: http.StatusPartialContent,
+			wantBody:   "789",
+			wantHeader: map[string]string{"Content-Range": "bytes 7-9/10"},
+		},
+		{
+			name:       "range not satisfiable",
+			method:     http.MethodGet,
+			headers:    map[string]string{"Range": "bytes=20-"},
+			seekable:   true,
+			wantStatus: http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name:       "if-range with stale etag",
+			method:     http.MethodGet,
+			headers:    map[string]string{"Range": "bytes=2-5", "If-Range": `"sha256:other"`},
+			seekable:   true,
+			wantStatus: http.StatusOK,
+			wantBody:   content,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			f := &oci.RepoFile{OwningRepo: "com/example/project", OwningTag: "1.0.0", Name: "project-1.0.0.jar", MediaType: "application/java-archive"}
+			desc := &oci.FileDescriptor{File: ocispec.Descriptor{
+				Digest:      digest.FromString(content),
+				Size:        int64(len(content)),
+				Annotations: map[string]string{ocispec.AnnotationCreated: "2025-01-02T03:04:05Z"},
+			}}
+			sc := &seekCounter{Reader: strings.NewReader(content)}
+			var r io.ReadCloser = sc
+			if !tc.seekable {
+				r = io.NopCloser(strings.NewReader(content))
+			}
+
+			req := httptest.NewRequest(tc.method, "/file", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			resp := httptest.NewRecorder()
+			ServeFile(resp, req, f, desc, r)
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+			if tc.wantStatus != http.StatusRequestedRangeNotSatisfiable {
+				if diff := cmp.Diff(tc.wantBody, resp.Body.String()); diff != "" {
+					t.Errorf("Body mismatch (-want, +got):\n%s", diff)
+				}
+			}
+			for k, want := range tc.wantHeader {
+				if got := resp.Header().Get(k); got != want {
+					t.Errorf("Header %q = %q, want %q", k, got, want)
+				}
+			}
+			if sc.seeks != tc.wantSeeks {
+				t.Errorf("Backend seeks = %d, want %d", sc.seeks, tc.wantSeeks)
+			}
+		})
+	}
+}
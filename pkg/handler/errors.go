@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"github.com/yolocs/ocifactory/pkg/verify"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// retryAfterSeconds is the delay suggested to clients for retryable errors.
+const retryAfterSeconds = "5"
+
+// ErrorWriter writes an error response in the format the client expects. It
+// has the same signature as http.Error.
+type ErrorWriter func(w http.ResponseWriter, message string, status int)
+
+// TextError writes the error as plain text, which Maven and pip clients show as is.
+func TextError(w http.ResponseWriter, message string, status int) {
+	http.Error(w, message, status)
+}
+
+// JSONError writes the error as {"error": message}, which npm clients show.
+func JSONError(w http.ResponseWriter, message string, status int) {
+	b, err := json.Marshal(map[string]string{"error": message})
+	if err != nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b) //nolint:errcheck // Nothing to do if the client is gone.
+}
+
+// ErrorStatus maps the error of a registry request to the HTTP status and a
+// message that is safe to show to clients. Backend error details are never
+// part of the message.
+func ErrorStatus(err error) (int, string) {
+	var ue *UpstreamError
+	switch {
+	case IsNotFound(err):
+		return http.StatusNotFound, "not found"
+	case errors.Is(err, oci.ErrDigestMismatch):
+		return http.StatusBadRequest, "file digest mismatch"
+	case errors.Is(err, verify.ErrUnsigned):
+		return http.StatusForbidden, "artifact is not signed by a trusted key"
+	case errors.Is(err, verify.ErrInvalid):
+		return http.StatusForbidden, "artifact signature is not valid for any trusted key"
+	case oci.HasCode(err, http.StatusBadRequest):
+		return http.StatusBadRequest, "invalid request"
+	case oci.HasCode(err, http.StatusUnauthorized):
+		return http.StatusUnauthorized, "unauthorized"
+	case oci.HasCode(err, http.StatusForbidden):
+		return http.StatusForbidden, "forbidden"
+	case oci.HasCode(err, http.StatusRequestedRangeNotSatisfiable):
+		return http.StatusRequestedRangeNotSatisfiable, "requested range not satisfiable"
+	case oci.HasCode(err, http.StatusTooManyRequests):
+		return http.StatusTooManyRequests, "too many requests"
+	case errors.As(err, &ue):
+		return http.StatusBadGateway, "failed to fetch from upstream"
+	case isUnavailable(err):
+		return http.StatusServiceUnavailable, "backend registry is unavailable"
+	default:
+		return http.StatusInternalServerError, "internal error"
+	}
+}
+
+// IsNotFound returns true if the registry doesn't have the file, tag or
+// repository.
+func IsNotFound(err error) bool {
+	return errors.Is(err, errdef.ErrNotFound) || oci.HasCode(err, http.StatusNotFound)
+}
+
+// isUnavailable returns true if the backend failed in a way that is likely to
+// go away, so the request can be retried.
+func isUnavailable(err error) bool {
+	if oci.HasCode(err, http.StatusBadGateway) ||
+		oci.HasCode(err, http.StatusServiceUnavailable) ||
+		oci.HasCode(err, http.StatusGatewayTimeout) {
+		return true
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// WriteError maps the error of a registry request to the HTTP status and
+// writes it with ew. The error itself is only logged. Retryable errors have a
+// Retry-After header and 401 responses challenge the client for credentials.
+func WriteError(w http.ResponseWriter, req *http.Request, err error, ew ErrorWriter) {
+	status, msg := ErrorStatus(err)
+	logging.FromContext(req.Context()).DebugContext(req.Context(), "registry request failed", "status", status, "error", err)
+
+	switch status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		w.Header().Set("Retry-After", retryAfterSeconds)
+	case http.StatusUnauthorized:
+		if w.Header().Get("WWW-Authenticate") == "" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ocifactory"`)
+		}
+	}
+	ew(w, msg, status)
+}
+
+// WriteUpstreamError writes the error of an upstream request with ew. Any
+// failure other than a missing artifact is reported as a bad gateway.
+func WriteUpstreamError(w http.ResponseWriter, req *http.Request, err error, ew ErrorWriter) {
+	logging.FromContext(req.Context()).DebugContext(req.Context(), "failed to fetch from upstream", "error", err)
+	if errors.Is(err, errdef.ErrNotFound) {
+		ew(w, "not found", http.StatusNotFound)
+		return
+	}
+	ew(w, "failed to fetch from upstream", http.StatusBadGateway)
+}
@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"github.com/yolocs/ocifactory/pkg/verify"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+func TestErrorStatus(t *testing.T) {
+	t.Parallel()
+
+	backendErr := func(code int) error {
+		return fmt.Errorf("failed to resolve manifest: %w", &errcode.ErrorResponse{StatusCode: code, Errors: errcode.Errors{{Message: "secret backend detail"}}})
+	}
+
+	cases := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantMsg    string
+	}{
+		{
+			name:       "not found",
+			err:        fmt.Errorf("file not found: %w", errdef.ErrNotFound),
+			wantStatus: http.StatusNotFound,
+			wantMsg:    "not found",
+		},
+		{
+			name:       "digest mismatch",
+			err:        fmt.Errorf("%w: a != b", oci.ErrDigestMismatch),
+			wantStatus: http.StatusBadRequest,
+			wantMsg:    "file digest mismatch",
+		},
+		{
+			name:       "unsigned",
+			err:        fmt.Errorf("file \"a.whl\" is rejected: %w", verify.ErrUnsigned),
+			wantStatus: http.StatusForbidden,
+			wantMsg:    "artifact is not signed by a trusted key",
+		},
+		{
+			name:       "invalid signature",
+			err:        fmt.Errorf("failed to verify \"a.whl\": %w", verify.ErrInvalid),
+			wantStatus: http.StatusForbidden,
+			wantMsg:    "artifact signature is not valid for any trusted key",
+		},
+		{
+			name:       "bad request",
+			err:        backendErr(http.StatusBadRequest),
+			wantStatus: http.StatusBadRequest,
+			wantMsg:    "invalid request",
+		},
+		{
+			name:       "unauthorized",
+			err:        backendErr(http.StatusUnauthorized),
+			wantStatus: http.StatusUnauthorized,
+			wantMsg:    "unauthorized",
+		},
+		{
+			name:       "forbidden",
+			err:        backendErr(http.StatusForbidden),
+			wantStatus: http.StatusForbidden,
+			wantMsg:    "forbidden",
+		},
+		{
+			name:       "range not satisfiable",
+			err:        backendErr(http.StatusRequestedRangeNotSatisfiable),
+			wantStatus: http.StatusRequestedRangeNotSatisfiable,
+			wantMsg:    "requested range not satisfiable",
+		},
+		{
+			name:       "too many requests",
+			err:        backendErr(http.StatusTooManyRequests),
+			wantStatus: http.StatusTooManyRequests,
+			wantMsg:    "too many requests",
+		},
+		{
+			name:       "backend unavailable",
+			err:        backendErr(http.StatusServiceUnavailable),
+			wantStatus: http.StatusServiceUnavailable,
+			wantMsg:    "backend registry is unavailable",
+		},
+		{
+			name:       "connection refused",
+			err:        fmt.Errorf("failed to fetch: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}),
+			wantStatus: http.StatusServiceUnavailable,
+			wantMsg:    "backend registry is unavailable",
+		},
+		{
+			name:       "deadline exceeded",
+			err:        fmt.Errorf("failed to fetch: %w", context.DeadlineExceeded),
+			wantStatus: http.StatusServiceUnavailable,
+			wantMsg:    "backend registry is unavailable",
+		},
+		{
+			name:       "upstream failure",
+			err:        &UpstreamError{URL: "https://example.com/file", StatusCode: http.StatusInternalServerError},
+			wantStatus: http.StatusBadGateway,
+			wantMsg:    "failed to fetch from upstream",
+		},
+		{
+			name:       "unknown",
+			err:        errors.New("secret backend detail"),
+			wantStatus: http.StatusInternalServerError,
+			wantMsg:    "internal error",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			status, msg := ErrorStatus(tc.err)
+			if status != tc.wantStatus || msg != tc.wantMsg {
+				t.Errorf("ErrorStatus() = (%d, %q), want (%d, %q)", status, msg, tc.wantStatus, tc.wantMsg)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		err         error
+		ew          ErrorWriter
+		wantStatus  int
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{
+			name:       "text",
+			err:        errdef.ErrNotFound,
+			ew:         TextError,
+			wantStatus: http.StatusNotFound,
+			wantBody:   "not found\n",
+			wantHeaders: map[string]string{
+				"Content-Type": "text/plain; charset=utf-8",
+			},
+		},
+		{
+			name:       "json",
+			err:        errdef.ErrNotFound,
+			ew:         JSONError,
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":"not found"}`,
+			wantHeaders: map[string]string{
+				"Content-Type": "application/json",
+			},
+		},
+		{
+			name:       "retryable",
+			err:        &errcode.ErrorResponse{StatusCode: http.StatusServiceUnavailable},
+			ew:         TextError,
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   "backend registry is unavailable\n",
+			wantHeaders: map[string]string{
+				"Retry-After": retryAfterSeconds,
+			},
+		},
+		{
+			name:       "unauthorized",
+			err:        &errcode.ErrorResponse{StatusCode: http.StatusUnauthorized},
+			ew:         TextError,
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "unauthorized\n",
+			wantHeaders: map[string]string{
+				"WWW-Authenticate": `Basic realm="ocifactory"`,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := httptest.NewRecorder()
+			WriteError(resp, httptest.NewRequest(http.MethodGet, "/", nil), tc.err, tc.ew)
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+			if got, want := resp.Body.String(), tc.wantBody; got != want {
+				t.Errorf("Body = %q, want %q", got, want)
+			}
+			for k, want := range tc.wantHeaders {
+				if got := resp.Header().Get(k); got != want {
+					t.Errorf("Header %q = %q, want %q", k, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// GroupRegistry federates several registries of the same format into one
+// virtual registry. Reads resolve in member order and listings are merged, so
+// index pages show the packages of all members. Writes go to a single
+// designated member.
+type GroupRegistry struct {
+	members []Registry
+	write   Registry
+}
+
+// NewGroupRegistry creates a new GroupRegistry. Members are given in priority
+// order and write is the index of the member that receives all writes.
+func NewGroupRegistry(members []Registry, write int) (*GroupRegistry, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("group must have at least one member")
+	}
+	if write < 0 || write >= len(members) {
+		return nil, fmt.Errorf("write member %d is out of range [0, %d)", write, len(members))
+	}
+	return &GroupRegistry{members: members, write: members[write]}, nil
+}
+
+// Writer returns the member that receives all writes.
+func (g *GroupRegistry) Writer() Registry {
+	return g.write
+}
+
+// AddFile adds the file to the write member.
+func (g *GroupRegistry) AddFile(ctx context.Context, f *oci.RepoFile, ro io.Reader) (*oci.FileDescriptor, error) {
+	return g.write.AddFile(ctx, f, ro)
+}
+
+// AddFiles adds the files to the write member.
+func (g *GroupRegistry) AddFiles(ctx context.Context, uploads []*oci.FileUpload) ([]*oci.FileDescriptor, error) {
+	return g.write.AddFiles(ctx, uploads)
+}
+
+// DeleteFile deletes the file from the write member. Copies in other members
+// are kept and become visible if they were shadowed.
+func (g *GroupRegistry) DeleteFile(ctx context.Context, f *oci.RepoFile) error {
+	return g.write.DeleteFile(ctx, f)
+}
+
+// DeleteTagFiles deletes the tag from the write member.
+func (g *GroupRegistry) DeleteTagFiles(ctx context.Context, repo, tag string) error {
+	return g.write.DeleteTagFiles(ctx, repo, tag)
+}
+
+// DeleteRepoFiles deletes the repository from the write member.
+func (g *GroupRegistry) DeleteRepoFiles(ctx context.Context, repo string) error {
+	return g.write.DeleteRepoFiles(ctx, repo)
+}
+
+// ReadFile reads the file from the first member that has it. Any error other
+// than not found stops the lookup, so an unavailable member never lets a
+// lower priority member serve a file it would have shadowed.
+func (g *GroupRegistry) ReadFile(ctx context.Context, f *oci.RepoFile) (*oci.FileDescriptor, io.ReadCloser, error) {
+	for i, m := range g.members {
+		desc, r, err := m.ReadFile(ctx, f)
+		if err == nil {
+			return desc, r, nil
+		}
+		if !IsNotFound(err) {
+			return nil, nil, fmt.Errorf("failed to read file from group member %d: %w", i, err)
+		}
+	}
+	return nil, nil, fmt.Errorf("file %q not found in any group member: %w", f.Name, errdef.ErrNotFound)
+}
+
+// ListTags lists the tags of the repository across all members without duplicates.
+func (g *GroupRegistry) ListTags(ctx context.Context, repo string) ([]string, error) {
+	var tags []string
+	seen := make(map[string]bool)
+	found := false
+	for i, m := range g.members {
+		ts, err := m.ListTags(ctx, repo)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list tags from group member %d: %w", i, err)
+		}
+		found = true
+		for _, t := range ts {
+			if !seen[t] {
+				seen[t] = true
+				tags = append(tags, t)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("repository %q not found in any group member: %w", repo, errdef.ErrNotFound)
+	}
+	return tags, nil
+}
+
+// ListFiles lists the files of the repository across all members. If several
+// members have a file with the same tag and name, the first one wins.
+func (g *GroupRegistry) ListFiles(ctx context.Context, repo string) ([]*oci.RepoFile, error) {
+	var files []*oci.RepoFile
+	seen := make(map[string]bool)
+	found := false
+	for i, m := range g.members {
+		fs, err := m.ListFiles(ctx, repo)
+		if err != nil {
+			if IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list files from group member %d: %w", i, err)
+		}
+		found = true
+		for _, f := range fs {
+			key := f.OwningTag + "/" + f.Name
+			if !seen[key] {
+				seen[key] = true
+				files = append(files, f)
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("repository %q not found in any group member: %w", repo, errdef.ErrNotFound)
+	}
+	return files, nil
+}
+
+// AddReferrer attaches the referrer in the write member.
+func (g *GroupRegistry) AddReferrer(ctx context.Context, f *oci.RepoFile, artifactType string, ro io.Reader) (*oci.FileDescriptor, error) {
+	rr, ok := g.write.(ReferrerRegistry)
+	if !ok {
+		return nil, fmt.Errorf("write member doesn't support referrers")
+	}
+	return rr.AddReferrer(ctx, f, artifactType, ro)
+}
+
+// ListReferrers lists the referrers of the version in the first member that
+// has it, like ReadFile.
+func (g *GroupRegistry) ListReferrers(ctx context.Context, repo, tag, artifactType string) ([]ocispec.Descriptor, error) {
+	for i, m := range g.members {
+		rr, ok := m.(ReferrerRegistry)
+		if !ok {
+			continue
+		}
+		refs, err := rr.ListReferrers(ctx, repo, tag, artifactType)
+		if err == nil {
+			return refs, nil
+		}
+		if !IsNotFound(err) {
+			return nil, fmt.Errorf("failed to list referrers from group member %d: %w", i, err)
+		}
+	}
+	return nil, fmt.Errorf("tag %q not found in any group member: %w", tag, errdef.ErrNotFound)
+}
+
+// ReadReferrer reads the referrer from the first member that has it.
+func (g *GroupRegistry) ReadReferrer(ctx context.Context, repo, tag, referrer string) (*oci.FileDescriptor, io.ReadCloser, error) {
+	for i, m := range g.members {
+		rr, ok := m.(ReferrerRegistry)
+		if !ok {
+			continue
+		}
+		desc, r, err := rr.ReadReferrer(ctx, repo, tag, referrer)
+		if err == nil {
+			return desc, r, nil
+		}
+		if !IsNotFound(err) {
+			return nil, nil, fmt.Errorf("failed to read referrer from group member %d: %w", i, err)
+		}
+	}
+	return nil, nil, fmt.Errorf("referrer %q not found in any group member: %w", referrer, errdef.ErrNotFound)
+}
+
+// Ping pings every member that supports it. Since a failing member fails
+// reads of files it doesn't have, the group is only ready if all members are.
+func (g *GroupRegistry) Ping(ctx context.Context) error {
+	var merr error
+	for i, m := range g.members {
+		if p, ok := m.(Pinger); ok {
+			if err := p.Ping(ctx); err != nil {
+				merr = errors.Join(merr, fmt.Errorf("group member %d: %w", i, err))
+			}
+		}
+	}
+	return merr
+}
@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/google/go-cmp/cmp"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// failingRegistry fails every call as an unavailable backend would.
+type failingRegistry struct{}
+
+func (failingRegistry) AddFile(context.Context, *oci.RepoFile, io.Reader) (*oci.FileDescriptor, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func (failingRegistry) AddFiles(context.Context, []*oci.FileUpload) ([]*oci.FileDescriptor, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func (failingRegistry) ReadFile(context.Context, *oci.RepoFile) (*oci.FileDescriptor, io.ReadCloser, error) {
+	return nil, nil, errors.New("backend unavailable")
+}
+
+func (failingRegistry) ListTags(context.Context, string) ([]string, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func (failingRegistry) ListFiles(context.Context, string) ([]*oci.RepoFile, error) {
+	return nil, errors.New("backend unavailable")
+}
+
+func (failingRegistry) DeleteFile(context.Context, *oci.RepoFile) error {
+	return errors.New("backend unavailable")
+}
+
+func (failingRegistry) DeleteTagFiles(context.Context, string, string) error {
+	return errors.New("backend unavailable")
+}
+
+func (failingRegistry) DeleteRepoFiles(context.Context, string) error {
+	return errors.New("backend unavailable")
+}
+
+func (failingRegistry) Ping(context.Context) error {
+	return errors.New("backend unavailable")
+}
+
+// emptyRemoteRegistry has no repository and fails like a remote registry does
+// for a missing one, with a 404 error response.
+type emptyRemoteRegistry struct {
+	failingRegistry
+}
+
+func (emptyRemoteRegistry) ReadFile(context.Context, *oci.RepoFile) (*oci.FileDescriptor, io.ReadCloser, error) {
+	return nil, nil, &errcode.ErrorResponse{StatusCode: http.StatusNotFound}
+}
+
+func (emptyRemoteRegistry) ListTags(context.Context, string) ([]string, error) {
+	return nil, &errcode.ErrorResponse{StatusCode: http.StatusNotFound}
+}
+
+func (emptyRemoteRegistry) ListFiles(context.Context, string) ([]*oci.RepoFile, error) {
+	return nil, &errcode.ErrorResponse{StatusCode: http.StatusNotFound}
+}
+
+func TestGroupRegistry(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	newMember := func(t *testing.T, files map[string]string) *oci.FakeRegistry {
+		t.Helper()
+		r := oci.NewFakeRegistry()
+		for k, v := range files {
+			parts := strings.SplitN(k, ":", 3)
+			if _, err := r.AddFile(ctx, &oci.RepoFile{OwningRepo: parts[0], OwningTag: parts[1], Name: parts[2]}, strings.NewReader(v)); err != nil {
+				t.Fatalf("Failed to set up file: %v", err)
+			}
+		}
+		return r
+	}
+
+	t.Run("read resolves in member order", func(t *testing.T) {
+		t.Parallel()
+
+		first := newMember(t, map[string]string{"packages/foo:1.0.0:foo-1.0.0.whl": "first"})
+		second := newMember(t, map[string]string{
+			"packages/foo:1.0.0:foo-1.0.0.whl": "second",
+			"packages/foo:2.0.0:foo-2.0.0.whl": "second",
+		})
+		g, err := NewGroupRegistry([]Registry{first, second}, 0)
+		if err != nil {
+			t.Fatalf("NewGroupRegistry() unexpected error: %v", err)
+		}
+
+		for name, want := range map[string]string{"foo-1.0.0.whl": "first", "foo-2.0.0.whl": "second"} {
+			f := &oci.RepoFile{OwningRepo: "packages/foo", OwningTag: strings.TrimSuffix(strings.TrimPrefix(name, "foo-"), ".whl"), Name: name}
+			_, r, err := g.ReadFile(ctx, f)
+			if err != nil {
+				t.Fatalf("ReadFile(%q) unexpected error: %v", name, err)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(b); got != want {
+				t.Errorf("ReadFile(%q) = %q, want %q", name, got, want)
+			}
+		}
+
+		_, _, err = g.ReadFile(ctx, &oci.RepoFile{OwningRepo: "packages/foo", OwningTag: "3.0.0", Name: "foo-3.0.0.whl"})
+		if diff := testutil.DiffErrString(err, "not found in any group member"); diff != "" {
+			t.Errorf("ReadFile() unexpected error: %s", diff)
+		}
+	})
+
+	t.Run("listings are merged", func(t *testing.T) {
+		t.Parallel()
+
+		first := newMember(t, map[string]string{"packages/foo:1.0.0:foo-1.0.0.whl": "first"})
+		second := newMember(t, map[string]string{
+			"packages/foo:1.0.0:foo-1.0.0.whl": "second",
+			"packages/foo:2.0.0:foo-2.0.0.whl": "second",
+		})
+		g, err := NewGroupRegistry([]Registry{first, second}, 0)
+		if err != nil {
+			t.Fatalf("NewGroupRegistry() unexpected error: %v", err)
+		}
+
+		tags, err := g.ListTags(ctx, "packages/foo")
+		if err != nil {
+			t.Fatalf("ListTags() unexpected error: %v", err)
+		}
+		sort.Strings(tags)
+		if diff := cmp.Diff([]string{"1.0.0", "2.0.0"}, tags); diff != "" {
+			t.Errorf("ListTags() mismatch (-want, +got):\n%s", diff)
+		}
+
+		files, err := g.ListFiles(ctx, "packages/foo")
+		if err != nil {
+			t.Fatalf("ListFiles() unexpected error: %v", err)
+		}
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name)
+		}
+		sort.Strings(names)
+		if diff := cmp.Diff([]string{"foo-1.0.0.whl", "foo-2.0.0.whl"}, names); diff != "" {
+			t.Errorf("ListFiles() mismatch (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("remote member without the repository is skipped", func(t *testing.T) {
+		t.Parallel()
+
+		second := newMember(t, map[string]string{"packages/foo:1.0.0:foo-1.0.0.whl": "second"})
+		g, err := NewGroupRegistry([]Registry{emptyRemoteRegistry{}, second}, 1)
+		if err != nil {
+			t.Fatalf("NewGroupRegistry() unexpected error: %v", err)
+		}
+
+		if _, _, err := g.ReadFile(ctx, &oci.RepoFile{OwningRepo: "packages/foo", OwningTag: "1.0.0", Name: "foo-1.0.0.whl"}); err != nil {
+			t.Errorf("ReadFile() unexpected error: %v", err)
+		}
+		tags, err := g.ListTags(ctx, "packages/foo")
+		if err != nil {
+			t.Fatalf("ListTags() unexpected error: %v", err)
+		}
+		if diff := cmp.Diff([]string{"1.0.0"}, tags); diff != "" {
+			t.Errorf("ListTags() mismatch (-want, +got):\n%s", diff)
+		}
+		files, err := g.ListFiles(ctx, "packages/foo")
+		if err != nil {
+			t.Fatalf("ListFiles() unexpected error: %v", err)
+		}
+		if got, want := len(files), 1; got != want {
+			t.Errorf("ListFiles() got %d files, want %d", got, want)
+		}
+	})
+
+	t.Run("writes go to the write member", func(t *testing.T) {
+		t.Parallel()
+
+		first, second := oci.NewFakeRegistry(), oci.NewFakeRegistry()
+		g, err := NewGroupRegistry([]Registry{first, second}, 1)
+		if err != nil {
+			t.Fatalf("NewGroupRegistry() unexpected error: %v", err)
+		}
+		if _, err := g.AddFile(ctx, &oci.RepoFile{OwningRepo: "packages/foo", OwningTag: "1.0.0", Name: "foo-1.0.0.whl"}, strings.NewReader("content")); err != nil {
+			t.Fatalf("AddFile() unexpected error: %v", err)
+		}
+		if len(first.Files) != 0 {
+			t.Errorf("Files written to the read member: %v", first.Files)
+		}
+		if _, ok := second.Files["packages/foo/1.0.0/foo-1.0.0.whl"]; !ok {
+			t.Errorf("File not written to the write member, got: %v", second.Files)
+		}
+	})
+
+	t.Run("failing member stops the lookup", func(t *testing.T) {
+		t.Parallel()
+
+		second := newMember(t, map[string]string{"packages/foo:1.0.0:foo-1.0.0.whl": "second"})
+		g, err := NewGroupRegistry([]Registry{failingRegistry{}, second}, 1)
+		if err != nil {
+			t.Fatalf("NewGroupRegistry() unexpected error: %v", err)
+		}
+
+		_, _, err = g.ReadFile(ctx, &oci.RepoFile{OwningRepo: "packages/foo", OwningTag: "1.0.0", Name: "foo-1.0.0.whl"})
+		if diff := testutil.DiffErrString(err, "backend unavailable"); diff != "" {
+			t.Errorf("ReadFile() unexpected error: %s", diff)
+		}
+		_, err = g.ListFiles(ctx, "packages/foo")
+		if diff := testutil.DiffErrString(err, "backend unavailable"); diff != "" {
+			t.Errorf("ListFiles() unexpected error: %s", diff)
+		}
+	})
+
+	t.Run("invalid write member", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := NewGroupRegistry([]Registry{oci.NewFakeRegistry()}, 1)
+		if diff := testutil.DiffErrString(err, "write member 1 is out of range"); diff != "" {
+			t.Errorf("NewGroupRegistry() unexpected error: %s", diff)
+		}
+	})
+}
+
+func TestGroupRegistryPing(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		members []Registry
+		wantErr string
+	}{
+		{
+			name:    "members without ping",
+			members: []Registry{oci.NewFakeRegistry(), oci.NewFakeRegistry()},
+		},
+		{
+			name:    "failing member",
+			members: []Registry{oci.NewFakeRegistry(), failingRegistry{}},
+			wantErr: "group member 1: backend unavailable",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			g, err := NewGroupRegistry(tc.members, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := testutil.DiffErrString(g.Ping(context.Background()), tc.wantErr); diff != "" {
+				t.Errorf("Ping() returned unexpected error (-got, +want): %s", diff)
+			}
+		})
+	}
+}
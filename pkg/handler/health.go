@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/abcxyz/pkg/logging"
+)
+
+const (
+	// readinessCacheTTL is how long readiness results are reused, so frequent
+	// probes don't hammer the backend registry.
+	readinessCacheTTL = 5 * time.Second
+
+	// readinessCheckTimeout bounds each readiness check.
+	readinessCheckTimeout = 5 * time.Second
+)
+
+// ReadinessCheck checks a dependency the server needs to serve requests, e.g.
+// the backend registry.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// Pinger is implemented by registries that can check their backend.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Health serves /healthz, which only reports that the process is up, and
+// /readyz, which runs the readiness checks. Readiness results are cached
+// briefly. Failed checks are logged but their errors are not part of the
+// response.
+type Health struct {
+	mu        sync.Mutex
+	checks    []ReadinessCheck
+	checkedAt time.Time
+	results   map[string]string
+	ready     bool
+}
+
+// NewHealth creates the health endpoints with the readiness checks.
+func NewHealth(checks ...ReadinessCheck) *Health {
+	return &Health{checks: checks}
+}
+
+// SetChecks replaces the readiness checks, e.g. when the config is reloaded.
+func (h *Health) SetChecks(checks ...ReadinessCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks = checks
+	h.checkedAt = time.Time{}
+}
+
+// ServeHealthz always answers 200 while the process is able to serve.
+func (h *Health) ServeHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n")) //nolint:errcheck // Nothing to do if the client is gone.
+}
+
+// ServeReadyz answers 200 if all readiness checks pass and 503 otherwise,
+// with the result of each check.
+func (h *Health) ServeReadyz(w http.ResponseWriter, req *http.Request) {
+	ready, results := h.check(req.Context())
+
+	status, resp := http.StatusOK, map[string]any{"status": "ok", "checks": results}
+	if !ready {
+		status, resp["status"] = http.StatusServiceUnavailable, "unavailable"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp) //nolint:errcheck // Nothing to do if the client is gone.
+}
+
+// check runs the checks concurrently unless the last results are fresh.
+// Concurrent probes wait for the same run.
+func (h *Health) check(ctx context.Context) (bool, map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Since(h.checkedAt) < readinessCacheTTL {
+		return h.ready, h.results
+	}
+
+	// The results are shared, so they must not depend on this probe going away.
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), readinessCheckTimeout)
+	defer cancel()
+
+	errs := make([]error, len(h.checks))
+	var wg sync.WaitGroup
+	for i, c := range h.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = c.Check(ctx)
+		}()
+	}
+	wg.Wait()
+
+	results, ready := make(map[string]string, len(h.checks)), true
+	for i, c := range h.checks {
+		if errs[i] != nil {
+			logging.FromContext(ctx).WarnContext(ctx, "readiness check failed", "check", c.Name, "error", errs[i])
+			results[c.Name], ready = "failed", false
+			continue
+		}
+		results[c.Name] = "ok"
+	}
+	h.checkedAt, h.results, h.ready = time.Now(), results, ready
+	return ready, results
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+
+	ok := ReadinessCheck{Name: "ok", Check: func(context.Context) error { return nil }}
+	failed := ReadinessCheck{Name: "failed", Check: func(context.Context) error { return errors.New("secret backend detail") }}
+
+	cases := []struct {
+		name       string
+		checks     []ReadinessCheck
+		wantStatus int
+		wantBody   map[string]any
+	}{
+		{
+			name:       "no checks",
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"status": "ok", "checks": map[string]any{}},
+		},
+		{
+			name:       "all ok",
+			checks:     []ReadinessCheck{ok},
+			wantStatus: http.StatusOK,
+			wantBody:   map[string]any{"status": "ok", "checks": map[string]any{"ok": "ok"}},
+		},
+		{
+			name:       "one failed",
+			checks:     []ReadinessCheck{ok, failed},
+			wantStatus: http.StatusServiceUnavailable,
+			wantBody:   map[string]any{"status": "unavailable", "checks": map[string]any{"ok": "ok", "failed": "failed"}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := NewHealth(tc.checks...)
+			resp := httptest.NewRecorder()
+			h.ServeReadyz(resp, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(resp.Body.Bytes(), &got); err != nil {
+				t.Fatalf("failed to parse body %q: %v", resp.Body.String(), err)
+			}
+			if diff := cmp.Diff(tc.wantBody, got); diff != "" {
+				t.Errorf("Body mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHealthCache(t *testing.T) {
+	t.Parallel()
+
+	var calls atomic.Int32
+	counting := ReadinessCheck{Name: "counting", Check: func(context.Context) error {
+		calls.Add(1)
+		return nil
+	}}
+	h := NewHealth(counting)
+
+	for range 3 {
+		h.ServeReadyz(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("check called %d times, want 1 while cached", got)
+	}
+
+	// New checks are run right away.
+	h.SetChecks(counting)
+	h.ServeReadyz(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if got := calls.Load(); got != 2 {
+		t.Errorf("check called %d times, want 2 after SetChecks", got)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	t.Parallel()
+
+	var middlewareCalls atomic.Int32
+	counting := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			middlewareCalls.Add(1)
+			next.ServeHTTP(w, r)
+		})
+	}
+	s := &Server{middlewares: []Middleware{counting}}
+	s.SetHealth(NewHealth())
+	h := s.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	cases := []struct {
+		path       string
+		wantStatus int
+	}{
+		{path: "/healthz", wantStatus: http.StatusOK},
+		{path: "/readyz", wantStatus: http.StatusOK},
+		{path: "/simple/", wantStatus: http.StatusTeapot},
+	}
+	for _, tc := range cases {
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if got, want := resp.Code, tc.wantStatus; got != want {
+			t.Errorf("GET %s: status code = %d, want %d", tc.path, got, want)
+		}
+	}
+	if got := middlewareCalls.Load(); got != 1 {
+		t.Errorf("middleware called %d times, want 1 since health endpoints bypass middlewares", got)
+	}
+}
@@ -1,18 +1,20 @@
 package maven
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"path"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/abcxyz/pkg/cache"
 	"github.com/abcxyz/pkg/logging"
 	"github.com/gorilla/mux"
 	"github.com/yolocs/ocifactory/pkg/handler"
 	"github.com/yolocs/ocifactory/pkg/oci"
-	"oras.land/oras-go/v2/errdef"
 )
 
 const (
@@ -21,6 +23,14 @@ const (
 )
 
 var (
+	// SignedFiles are the files a handler.VerifyPolicy covers by default: the
+	// artifacts, not their checksums and metadata.
+	SignedFiles = []string{"*.jar", "*.war", "*.ear", "*.aar", "*.zip", "*.tar.gz"}
+
+	// foreignRepoPrefixes are where the Python and npm repo types store their
+	// packages, in case they share the backend path of a Maven repo.
+	foreignRepoPrefixes = []string{"packages/", "upstream/"}
+
 	mimeTypes = map[string]string{
 		"xml":    "text/xml",
 		"pom":    "text/xml",
@@ -45,16 +55,63 @@ var (
 	}
 )
 
+const (
+	defaultMetadataTTL = 5 * time.Minute
+	maxMetadataSize    = 16 << 20
+)
+
 type Handler struct {
 	registry handler.Registry
+
+	upstream      *handler.Upstream
+	metadataCache *cache.Cache[[]byte]
 }
 
-func NewHandler(registry handler.Registry) (*Handler, error) {
-	return &Handler{registry: registry}, nil
+// Option configures the Handler.
+type Option func(*Handler) error
+
+// WithUpstream proxies files that are not found in the backend from the
+// upstream Maven repository, e.g. Maven Central. Artifacts are persisted in
+// the backend on first download. Metadata files change over time, so they are
+// only cached in memory for metadataTTL. The default TTL is 5 minutes.
+func WithUpstream(upstream *handler.Upstream, metadataTTL time.Duration) Option {
+	return func(h *Handler) error {
+		if metadataTTL <= 0 {
+			metadataTTL = defaultMetadataTTL
+		}
+		h.upstream = upstream
+		h.metadataCache = cache.New[[]byte](metadataTTL)
+		return nil
+	}
+}
+
+func NewHandler(registry handler.Registry, opts ...Option) (*Handler, error) {
+	h := &Handler{registry: registry}
+	for _, o := range opts {
+		if err := o(h); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
 }
 
 func (h *Handler) Mux() http.Handler {
 	router := mux.NewRouter()
+	router.Use(handler.RecordRoute)
+
+	// 0. Deletion of a version directory or a whole artifact. Only directories
+	// can be deleted, so the path must end with a slash.
+	// Example: /{groupId}/{artifactId}/{version}/ or /{groupId}/{artifactId}/
+	// Matching the method with a MatcherFunc keeps other methods on directories at 404 instead of 405.
+	router.HandleFunc("/{path:.+}/", h.handleDelete).MatcherFunc(func(req *http.Request, _ *mux.RouteMatch) bool {
+		return req.Method == http.MethodDelete
+	})
+
+	// Referrers of a version, e.g. signatures and SBOMs. They must be before
+	// the regular artifact files, which would match them otherwise.
+	// Example: /{groupId}/{artifactId}/{version}/-/referrers
+	router.HandleFunc("/{repoParts:.+}/{version}"+handler.ReferrersPath, h.handleReferrers).Methods(http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost)
+	router.HandleFunc("/{repoParts:.+}/{version}"+handler.ReferrersPath+"/{digest}", h.handleReferrerGet).Methods(http.MethodGet, http.MethodHead)
 
 	// 1. Archetype Catalog
 	// Handles GET, HEAD, PUT, POST for /archetype-catalog.xml
@@ -113,6 +170,10 @@ func (h *Handler) handleSnapshotMetadata(w http.ResponseWriter, req *http.Reques
 }
 
 // handleArtifactMetadata handles requests for non-snapshot maven-metadata.xml files.
+// Maven metadata is written by the client and served as uploaded, so its
+// lastUpdated is the client's. It isn't rewritten with the recorded upload
+// times since that would break the checksum files the client uploads with it.
+// The recorded upload time is its Last-Modified like for every file.
 func (h *Handler) handleArtifactMetadata(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
 	repoParts := vars["repoParts"] // This is groupId/artifactId or groupId/artifactId/version for versioned metadata
@@ -150,65 +211,179 @@ func (h *Handler) handleRegularArtifact(w http.ResponseWriter, req *http.Request
 	}
 }
 
-// handlePut processes PUT/POST requests to add a file.
-func (h *Handler) handlePut(w http.ResponseWriter, req *http.Request, f *oci.RepoFile) {
-	logger := logging.FromContext(req.Context())
+// handleReferrers lists or attaches the referrers of a version.
+func (h *Handler) handleReferrers(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	handler.ServeReferrers(w, req, h.registry, vars["repoParts"], vars["version"], handler.TextError)
+}
 
-	defer req.Body.Close()
-	desc, err := h.registry.AddFile(req.Context(), f, req.Body)
-	if err != nil {
-		logger.DebugContext(req.Context(), "failed to add file", "error", err)
-		if oci.HasCode(err, http.StatusUnauthorized) {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
+// handleReferrerGet serves the content of a referrer of a version.
+func (h *Handler) handleReferrerGet(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	handler.GetReferrer(w, req, h.registry, vars["repoParts"], vars["version"], vars["digest"], handler.TextError)
+}
+
+// handleDelete deletes a version directory or a whole artifact. The path is a
+// version if the parent artifact has it, including the snapshot and version
+// metadata. maven-metadata.xml of the artifact is maintained by clients, so it
+// still lists a deleted version until it's uploaded again.
+func (h *Handler) handleDelete(w http.ResponseWriter, req *http.Request) {
+	p := strings.Trim(mux.Vars(req)["path"], "/")
+	handler.DeleteFiles(w, req, handler.TextError, func(ctx context.Context) error {
+		artifact, version := path.Split(p)
+		artifact = strings.TrimSuffix(artifact, "/")
+		if artifact == "" {
+			return h.registry.DeleteRepoFiles(ctx, p)
 		}
-		if oci.HasCode(err, http.StatusForbidden) {
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
+
+		tags, err := h.registry.ListTags(ctx, artifact)
+		if err != nil && !handler.IsNotFound(err) {
+			return err
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		if !slices.Contains(tags, version) {
+			return h.registry.DeleteRepoFiles(ctx, p)
+		}
+
+		if err := DeleteVersion(ctx, h.registry, artifact, version); err != nil {
+			return err
+		}
+		if err := h.registry.DeleteRepoFiles(ctx, p); err != nil && !handler.IsNotFound(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// DeleteVersion deletes the files of the version stored under the repository
+// and tag, together with the snapshot metadata of the version.
+func DeleteVersion(ctx context.Context, reg handler.Registry, repo, tag string) error {
+	if err := reg.DeleteTagFiles(ctx, repo, tag); err != nil {
+		return err
 	}
-	logger.DebugContext(req.Context(), "added file", "descriptor", desc)
-	w.WriteHeader(http.StatusCreated)
+	if err := reg.DeleteTagFiles(ctx, repo, tag+"-metadata"); err != nil && !handler.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// handlePut processes PUT/POST requests to add a file.
+func (h *Handler) handlePut(w http.ResponseWriter, req *http.Request, f *oci.RepoFile) {
+	defer req.Body.Close()
+	handler.PutFiles(w, req, h.registry, handler.TextError, &oci.FileUpload{RepoFile: f, Content: req.Body})
 }
 
+// handleGet processes GET/HEAD requests to read a file. Files missing in the
+// backend are served from the upstream if there is one.
 func (h *Handler) handleGet(w http.ResponseWriter, req *http.Request, f *oci.RepoFile) {
-	logger := logging.FromContext(req.Context())
+	var notFound func(http.ResponseWriter, *http.Request, *oci.RepoFile)
+	if h.upstream != nil {
+		notFound = h.handleUpstreamGet
+	}
+	handler.GetFile(w, req, h.registry, f, handler.TextError, notFound)
+}
+
+// handleUpstreamGet serves a file missing in the backend from the upstream.
+func (h *Handler) handleUpstreamGet(w http.ResponseWriter, req *http.Request, f *oci.RepoFile) {
+	if isMetadata(f.Name) {
+		h.handleUpstreamMetadata(w, req, f)
+		return
+	}
 
-	desc, r, err := h.registry.ReadFile(req.Context(), f)
+	ctx := req.Context()
+	logger := logging.FromContext(ctx)
+
+	// Keep downloading and persisting even if the client goes away so the
+	// next request is served from the backend.
+	dlCtx, cancel := handler.DetachedContext(ctx)
+	defer cancel()
+	resp, err := h.upstream.Get(dlCtx, req.Method, req.URL.Path)
 	if err != nil {
-		logger.DebugContext(req.Context(), "failed to read file", "error", err)
-		if errors.Is(err, errdef.ErrNotFound) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
+		handler.WriteUpstreamError(w, req, err, handler.TextError)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", f.MediaType)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	}
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	copyErr, persistErr := handler.CopyAndPersist(w, resp.Body, func(r io.Reader) error {
+		desc, err := h.registry.AddFile(handler.WithUpstreamCache(dlCtx), f, r)
+		if err == nil {
+			logger.DebugContext(ctx, "cached upstream file", "descriptor", desc)
 		}
-		if oci.HasCode(err, http.StatusUnauthorized) {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
+		return err
+	})
+	if copyErr != nil {
+		logger.ErrorContext(ctx, "failed to copy upstream file", "url", req.URL.Path, "error", copyErr)
+	}
+	if persistErr != nil {
+		logger.ErrorContext(ctx, "failed to cache upstream file", "url", req.URL.Path, "error", persistErr)
+	}
+}
+
+// handleUpstreamMetadata serves metadata from the upstream through the
+// in-memory cache. Metadata is never persisted in the backend because it
+// changes whenever a new version is published upstream.
+func (h *Handler) handleUpstreamMetadata(w http.ResponseWriter, req *http.Request, f *oci.RepoFile) {
+	ctx := req.Context()
+
+	b, err := h.metadataCache.WriteThruLookup(req.URL.Path, func() ([]byte, error) {
+		resp, err := h.upstream.Get(ctx, http.MethodGet, req.URL.Path)
+		if err != nil {
+			return nil, err
 		}
-		if oci.HasCode(err, http.StatusForbidden) {
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxMetadataSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream metadata: %w", err)
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return b, nil
+	})
+	if err != nil {
+		handler.WriteUpstreamError(w, req, err, handler.TextError)
 		return
 	}
-	defer r.Close()
-	logger.DebugContext(req.Context(), "read file", "descriptor", desc)
 
 	w.Header().Set("Content-Type", f.MediaType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", desc.File.Size))
-	w.Header().Set("X-Checksum-Sha256", desc.File.Digest.String())
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
 	if req.Method == http.MethodHead {
 		return
 	}
+	if _, err := w.Write(b); err != nil {
+		logging.FromContext(ctx).DebugContext(ctx, "failed to write response", "error", err)
+	}
+}
 
-	if _, err := io.Copy(w, r); err != nil {
-		logger.DebugContext(req.Context(), "failed to write response", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// PackageVersion returns the coordinates, e.g. com.example:project, and the
+// version stored under the repository and tag. Metadata and the archetype
+// catalog are not versions. Coordinates always have a group, so repositories
+// without one, or laid out like the other repo types, are not Maven.
+func PackageVersion(repo, tag string) (string, string, bool) {
+	if tag == "metadata" || strings.HasSuffix(tag, "-metadata") {
+		return "", "", false
+	}
+	group, artifact := path.Split(repo)
+	if group == "" || artifact == "" {
+		return "", "", false
 	}
+	for _, p := range foreignRepoPrefixes {
+		if strings.HasPrefix(repo, p) {
+			return "", "", false
+		}
+	}
+	return strings.ReplaceAll(strings.TrimSuffix(group, "/"), "/", ".") + ":" + artifact, tag, true
+}
+
+// isMetadata returns true for files that describe other files and change when
+// new versions are published, including their checksums.
+func isMetadata(filename string) bool {
+	return strings.HasPrefix(filename, "maven-metadata.xml") || strings.HasPrefix(filename, "archetype-catalog.xml")
 }
 
 func detectMediaType(filename string) string {
@@ -2,11 +2,19 @@ package maven
 
 import (
 	"context"
+	"encoding/json"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/auth"
+	"github.com/yolocs/ocifactory/pkg/handler"
 	"github.com/yolocs/ocifactory/pkg/oci"
 )
 
@@ -322,3 +330,348 @@ func pathToRepoFile(t *testing.T, p string) *oci.RepoFile {
 		MediaType:  detectMediaType(fn),
 	}
 }
+
+func TestHandleGetUpstream(t *testing.T) {
+	t.Parallel()
+
+	upstreamFiles := map[string]string{
+		"/com/example/project/1.0.0/project-1.0.0.jar": "upstream jar",
+		"/com/example/project/maven-metadata.xml":      "<metadata>v1</metadata>",
+	}
+
+	cases := []struct {
+		name             string
+		path             string
+		method           string
+		wantStatus       int
+		wantBody         string
+		wantCached       string // Registry key of the file persisted from the upstream.
+		wantNotCached    string
+		wantUpstreamHits int
+	}{
+		{
+			name:             "artifact is persisted",
+			path:             "/com/example/project/1.0.0/project-1.0.0.jar",
+			method:           http.MethodGet,
+			wantStatus:       http.StatusOK,
+			wantBody:         "upstream jar",
+			wantCached:       "com/example/project/1.0.0/project-1.0.0.jar",
+			wantUpstreamHits: 1,
+		},
+		{
+			name:             "head artifact is not persisted",
+			path:             "/com/example/project/1.0.0/project-1.0.0.jar",
+			method:           http.MethodHead,
+			wantStatus:       http.StatusOK,
+			wantNotCached:    "com/example/project/1.0.0/project-1.0.0.jar",
+			wantUpstreamHits: 1,
+		},
+		{
+			name:             "metadata is cached in memory only",
+			path:             "/com/example/project/maven-metadata.xml",
+			method:           http.MethodGet,
+			wantStatus:       http.StatusOK,
+			wantBody:         "<metadata>v1</metadata>",
+			wantNotCached:    "com/example/project/metadata/maven-metadata.xml",
+			wantUpstreamHits: 1,
+		},
+		{
+			name:             "not found upstream",
+			path:             "/com/example/project/2.0.0/project-2.0.0.jar",
+			method:           http.MethodGet,
+			wantStatus:       http.StatusNotFound,
+			wantUpstreamHits: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var upstreamHits int
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamHits++
+				content, ok := upstreamFiles[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				w.Write([]byte(content)) //nolint:errcheck // Test server.
+			}))
+			t.Cleanup(srv.Close)
+
+			upstream, err := handler.NewUpstream(srv.URL)
+			if err != nil {
+				t.Fatalf("NewUpstream() unexpected error: %v", err)
+			}
+
+			registry := oci.NewFakeRegistry()
+			h, err := NewHandler(registry, WithUpstream(upstream, time.Minute))
+			if err != nil {
+				t.Fatalf("NewHandler() unexpected error: %v", err)
+			}
+
+			// Request twice, the second request must not hit the upstream.
+			for i := 0; i < 2; i++ {
+				resp := httptest.NewRecorder()
+				h.Mux().ServeHTTP(resp, httptest.NewRequest(tc.method, tc.path, nil))
+
+				if got, want := resp.Code, tc.wantStatus; got != want {
+					t.Errorf("Status code = %d, want %d", got, want)
+				}
+				if got, want := resp.Body.String(), tc.wantBody; tc.wantStatus == http.StatusOK && got != want {
+					t.Errorf("Body = %q, want %q", got, want)
+				}
+				if tc.method == http.MethodHead || tc.wantStatus != http.StatusOK {
+					break
+				}
+			}
+
+			if got, want := upstreamHits, tc.wantUpstreamHits; got != want {
+				t.Errorf("Upstream hits = %d, want %d", got, want)
+			}
+			if tc.wantCached != "" {
+				if got, ok := registry.Files[tc.wantCached]; !ok || string(got) != tc.wantBody {
+					t.Errorf("Cached file %q = %q, want %q", tc.wantCached, got, tc.wantBody)
+				}
+			}
+			if tc.wantNotCached != "" {
+				if _, ok := registry.Files[tc.wantNotCached]; ok {
+					t.Errorf("File %q is cached in the registry, want not cached", tc.wantNotCached)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleGetUpstreamClientGone(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream jar")) //nolint:errcheck // Test server.
+	}))
+	t.Cleanup(srv.Close)
+
+	upstream, err := handler.NewUpstream(srv.URL)
+	if err != nil {
+		t.Fatalf("NewUpstream() unexpected error: %v", err)
+	}
+	registry := oci.NewFakeRegistry()
+	h, err := NewHandler(registry, WithUpstream(upstream, time.Minute))
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/com/example/project/1.0.0/project-1.0.0.jar", nil)
+	h.Mux().ServeHTTP(httptest.NewRecorder(), req)
+
+	if got, want := string(registry.Files["com/example/project/1.0.0/project-1.0.0.jar"]), "upstream jar"; got != want {
+		t.Errorf("Cached file = %q, want %q", got, want)
+	}
+}
+
+func TestPackageVersion(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		repo        string
+		tag         string
+		wantPackage string
+		wantVersion string
+		wantOK      bool
+	}{
+		{name: "version", repo: "com/example/project", tag: "1.0.0", wantPackage: "com.example:project", wantVersion: "1.0.0", wantOK: true},
+		{name: "snapshot", repo: "com/example/project", tag: "1.0-SNAPSHOT", wantPackage: "com.example:project", wantVersion: "1.0-SNAPSHOT", wantOK: true},
+		{name: "artifact metadata", repo: "com/example/project", tag: "metadata"},
+		{name: "snapshot metadata", repo: "com/example/project", tag: "1.0-SNAPSHOT-metadata"},
+		{name: "archetype catalog", repo: "archetype", tag: "latest"},
+		{name: "no group", repo: "project", tag: "1.0.0"},
+		{name: "python index", repo: "index", tag: "foo"},
+		{name: "python package", repo: "packages/foo", tag: "1.0.0"},
+		{name: "npm scoped package", repo: "packages/scope/foo", tag: "1.0.0"},
+		{name: "upstream cache", repo: "upstream/foo", tag: "1.0.0"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			pkg, version, ok := PackageVersion(tc.repo, tc.tag)
+			if pkg != tc.wantPackage || version != tc.wantVersion || ok != tc.wantOK {
+				t.Errorf("PackageVersion(%q, %q) = (%q, %q, %t), want (%q, %q, %t)",
+					tc.repo, tc.tag, pkg, version, ok, tc.wantPackage, tc.wantVersion, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestHandleDelete(t *testing.T) {
+	t.Parallel()
+
+	files := []*oci.RepoFile{
+		{OwningRepo: "com/example/project", OwningTag: "1.0.0", Name: "project-1.0.0.jar"},
+		{OwningRepo: "com/example/project", OwningTag: "1.0.0", Name: "project-1.0.0.pom"},
+		{OwningRepo: "com/example/project", OwningTag: "2.0-SNAPSHOT", Name: "project-2.0-20240101.120000-1.jar"},
+		{OwningRepo: "com/example/project", OwningTag: "2.0-SNAPSHOT-metadata", Name: "maven-metadata.xml"},
+		{OwningRepo: "com/example/project", OwningTag: "metadata", Name: "maven-metadata.xml"},
+		{OwningRepo: "com/example/other", OwningTag: "1.0.0", Name: "other-1.0.0.jar"},
+	}
+
+	cases := []struct {
+		name       string
+		path       string
+		identity   *auth.Identity
+		wantStatus int
+		wantFiles  []string
+	}{
+		{
+			name:       "version",
+			path:       "/com/example/project/1.0.0/",
+			wantStatus: http.StatusNoContent,
+			wantFiles: []string{
+				"com/example/other/1.0.0/other-1.0.0.jar",
+				"com/example/project/2.0-SNAPSHOT-metadata/maven-metadata.xml",
+				"com/example/project/2.0-SNAPSHOT/project-2.0-20240101.120000-1.jar",
+				"com/example/project/metadata/maven-metadata.xml",
+			},
+		},
+		{
+			name:       "snapshot version with metadata",
+			path:       "/com/example/project/2.0-SNAPSHOT/",
+			wantStatus: http.StatusNoContent,
+			wantFiles: []string{
+				"com/example/other/1.0.0/other-1.0.0.jar",
+				"com/example/project/1.0.0/project-1.0.0.jar",
+				"com/example/project/1.0.0/project-1.0.0.pom",
+				"com/example/project/metadata/maven-metadata.xml",
+			},
+		},
+		{
+			name:       "artifact",
+			path:       "/com/example/project/",
+			wantStatus: http.StatusNoContent,
+			wantFiles:  []string{"com/example/other/1.0.0/other-1.0.0.jar"},
+		},
+		{
+			name:       "missing",
+			path:       "/com/example/missing/",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "identity without delete privilege",
+			path:       "/com/example/other/",
+			identity:   &auth.Identity{Subject: "yolocs/ocifactory"},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "identity with delete privilege",
+			path:       "/com/example/other/",
+			identity:   &auth.Identity{Subject: "yolocs/ocifactory", Privileges: []auth.Privilege{auth.PrivilegeDelete}},
+			wantStatus: http.StatusNoContent,
+			wantFiles: []string{
+				"com/example/project/1.0.0/project-1.0.0.jar",
+				"com/example/project/1.0.0/project-1.0.0.pom",
+				"com/example/project/2.0-SNAPSHOT-metadata/maven-metadata.xml",
+				"com/example/project/2.0-SNAPSHOT/project-2.0-20240101.120000-1.jar",
+				"com/example/project/metadata/maven-metadata.xml",
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := oci.NewFakeRegistry()
+			var all []string
+			for _, f := range files {
+				if _, err := registry.AddFile(context.Background(), f, strings.NewReader("content")); err != nil {
+					t.Fatalf("Failed to set up file: %v", err)
+				}
+				all = append(all, f.OwningRepo+"/"+f.OwningTag+"/"+f.Name)
+			}
+			wantFiles := tc.wantFiles
+			if wantFiles == nil {
+				wantFiles = slices.Sorted(slices.Values(all))
+			}
+
+			h, err := NewHandler(registry)
+			if err != nil {
+				t.Fatalf("NewHandler() unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodDelete, tc.path, nil)
+			if tc.identity != nil {
+				req = req.WithContext(auth.WithIdentity(req.Context(), tc.identity))
+			}
+			w := httptest.NewRecorder()
+			h.Mux().ServeHTTP(w, req)
+
+			if got, want := w.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+			if diff := cmp.Diff(wantFiles, slices.Sorted(maps.Keys(registry.Files))); diff != "" {
+				t.Errorf("remaining files mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestHandleGetDirectory(t *testing.T) {
+	t.Parallel()
+
+	h, err := NewHandler(oci.NewFakeRegistry())
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+	w := httptest.NewRecorder()
+	h.Mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/com/example/project/", nil))
+	if got, want := w.Code, http.StatusNotFound; got != want {
+		t.Errorf("Status code = %d, want %d", got, want)
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	t.Parallel()
+
+	registry := oci.NewFakeRegistry()
+	if _, err := registry.AddFile(context.Background(), &oci.RepoFile{OwningRepo: "com/example/project", OwningTag: "1.0.0", Name: "project-1.0.0.jar"}, strings.NewReader("content")); err != nil {
+		t.Fatalf("Failed to set up file: %v", err)
+	}
+	h, err := NewHandler(registry)
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+	router := h.Mux()
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/com/example/project/1.0.0/-/referrers"+"?artifactType=application/vnd.dev.sigstore.bundle.v0.3%2Bjson", strings.NewReader("bundle")))
+	if got, want := resp.Code, http.StatusCreated; got != want {
+		t.Fatalf("Add status code = %d, want %d, body: %s", got, want, resp.Body.String())
+	}
+	var desc ocispec.Descriptor
+	if err := json.Unmarshal(resp.Body.Bytes(), &desc); err != nil {
+		t.Fatalf("Failed to decode descriptor: %v", err)
+	}
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/com/example/project/1.0.0/-/referrers", nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("List status code = %d, want %d", got, want)
+	}
+	if !strings.Contains(resp.Body.String(), desc.Digest.String()) {
+		t.Errorf("List body = %s, want the referrer %s", resp.Body.String(), desc.Digest)
+	}
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/com/example/project/1.0.0/-/referrers"+"/"+desc.Digest.String(), nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("Read status code = %d, want %d", got, want)
+	}
+	if got, want := resp.Body.String(), "bundle"; got != want {
+		t.Errorf("Read body = %q, want %q", got, want)
+	}
+}
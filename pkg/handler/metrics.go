@@ -0,0 +1,153 @@
+package handler
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/yolocs/ocifactory/pkg/audit"
+	"github.com/yolocs/ocifactory/pkg/metrics"
+)
+
+// requestInfoKey points to the value in the context where the request info is stored.
+const requestInfoKey = contextKey("requestInfo")
+
+// requestInfo describes the request for metrics and access logs. It's filled
+// in by the handlers down the chain, so it's only complete after the request
+// is served.
+type requestInfo struct {
+	repoType string
+	route    string
+	identity string
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// withRequestInfo returns the request info of the request, adding it to the
+// request context first if it's missing.
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	if info := requestInfoFrom(r.Context()); info != nil {
+		return r, info
+	}
+	info := &requestInfo{}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)), info
+}
+
+// Metrics is a middleware that records the request count, latency and body
+// sizes. The repo type and route labels are set with WithRepoType and
+// RecordRoute further down the chain.
+func Metrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, info := withRequestInfo(r)
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+
+		route := info.route
+		if route == "" {
+			route = "other"
+		}
+		status := strconv.Itoa(rw.status)
+		metrics.Requests.WithLabelValues(info.repoType, route, r.Method, status).Inc()
+		metrics.RequestDuration.WithLabelValues(info.repoType, route, r.Method, status).Observe(time.Since(start).Seconds())
+		metrics.UploadedBytes.WithLabelValues(info.repoType).Add(float64(body.n))
+		metrics.DownloadedBytes.WithLabelValues(info.repoType).Add(float64(rw.n))
+	})
+}
+
+// WithRepoType labels the metrics and logs of the requests served by next
+// with the repo type and the caller. It must run after authentication, and
+// adds the request to the context for audit.Record.
+func WithRepoType(repoType string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := Identity(r.Context())
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.repoType = repoType
+			info.identity = identity
+		}
+		r = r.WithContext(audit.WithRequest(r.Context(), &audit.Request{
+			RepoType:     repoType,
+			Identity:     identity,
+			ClientIP:     ClientIP(r),
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+			UserAgent:    r.UserAgent(),
+			Method:       r.Method,
+			Path:         MountPrefix(r.Context()) + r.URL.Path,
+		}))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RecordRoute is a mux middleware that labels the metrics of the request with
+// the path template of the matched route, so paths of different artifacts are
+// aggregated.
+func RecordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := requestInfoFrom(r.Context()); info != nil {
+			if route := mux.CurrentRoute(r); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					info.route = tmpl
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder records the status and the number of bytes written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	n           int64
+	wroteHeader bool
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if !s.wroteHeader {
+		s.status = status
+		s.wroteHeader = true
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	s.wroteHeader = true
+	n, err := s.ResponseWriter.Write(p)
+	s.n += int64(n)
+	return n, err //nolint:wrapcheck // Want passthrough error.
+}
+
+// Flush supports streamed responses.
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err //nolint:wrapcheck // Want passthrough io.EOF.
+}
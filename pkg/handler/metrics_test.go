@@ -0,0 +1,102 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/yolocs/ocifactory/pkg/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	// Each case has its own repo type since the metrics are global.
+	cases := []struct {
+		name         string
+		repoType     string
+		method       string
+		path         string
+		body         string
+		wantRoute    string
+		wantStatus   string
+		wantUploaded float64
+		wantDownload float64
+	}{
+		{
+			name:         "upload",
+			repoType:     "test-upload",
+			method:       http.MethodPut,
+			path:         "/packages/foo/1.0.0",
+			body:         "content",
+			wantRoute:    "/packages/{name}/{version}",
+			wantStatus:   "201",
+			wantUploaded: 7,
+		},
+		{
+			name:         "download",
+			repoType:     "test-download",
+			method:       http.MethodGet,
+			path:         "/packages/foo/1.0.0",
+			wantRoute:    "/packages/{name}/{version}",
+			wantStatus:   "200",
+			wantDownload: 5,
+		},
+		{
+			name:         "unmatched route",
+			repoType:     "test-unmatched",
+			method:       http.MethodGet,
+			path:         "/unknown",
+			wantRoute:    "other",
+			wantStatus:   "404",
+			wantDownload: float64(len("404 page not found\n")),
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			router := mux.NewRouter()
+			router.Use(RecordRoute)
+			router.HandleFunc("/packages/{name}/{version}", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodPut {
+					io.Copy(io.Discard, r.Body) //nolint:errcheck // Test handler.
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+				w.Write([]byte("hello")) //nolint:errcheck // Test handler.
+			})
+			h := Metrics(WithRepoType(tc.repoType, router))
+
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tc.method, tc.path, body))
+
+			if got := testutil.ToFloat64(metrics.Requests.WithLabelValues(tc.repoType, tc.wantRoute, tc.method, tc.wantStatus)); got != 1 {
+				t.Errorf("Requests = %v, want 1", got)
+			}
+			var m dto.Metric
+			if err := metrics.RequestDuration.WithLabelValues(tc.repoType, tc.wantRoute, tc.method, tc.wantStatus).(prometheus.Histogram).Write(&m); err != nil {
+				t.Fatalf("failed to read RequestDuration: %v", err)
+			}
+			if got := m.GetHistogram().GetSampleCount(); got != 1 {
+				t.Errorf("RequestDuration samples = %d, want 1", got)
+			}
+			if got := testutil.ToFloat64(metrics.UploadedBytes.WithLabelValues(tc.repoType)); got != tc.wantUploaded {
+				t.Errorf("UploadedBytes = %v, want %v", got, tc.wantUploaded)
+			}
+			if got := testutil.ToFloat64(metrics.DownloadedBytes.WithLabelValues(tc.repoType)); got != tc.wantDownload {
+				t.Errorf("DownloadedBytes = %v, want %v", got, tc.wantDownload)
+			}
+		})
+	}
+}
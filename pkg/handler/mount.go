@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// contextKey is a private string type to prevent collisions in the context map.
+type contextKey string
+
+// mountPrefixKey points to the value in the context where the mount prefix is stored.
+const mountPrefixKey = contextKey("mountPrefix")
+
+// Mount serves the handler under the given path prefix, e.g. "/maven/".
+// The prefix is stripped before the request reaches the handler so handlers
+// can keep routing on absolute paths. Handlers that render URLs should prepend
+// MountPrefix to them.
+func Mount(prefix string, h http.Handler) http.Handler {
+	prefix = NormalizePrefix(prefix)
+	strip := strings.TrimSuffix(prefix, "/")
+	return http.StripPrefix(strip, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), mountPrefixKey, strip))
+		h.ServeHTTP(w, r)
+	}))
+}
+
+// MountPrefix returns the prefix the current handler is mounted under without
+// the trailing slash. It's empty if the handler is served at the root.
+func MountPrefix(ctx context.Context) string {
+	p, _ := ctx.Value(mountPrefixKey).(string)
+	return p
+}
+
+// NormalizePrefix makes sure the prefix starts and ends with a slash.
+func NormalizePrefix(prefix string) string {
+	prefix = "/" + strings.Trim(prefix, "/") + "/"
+	if prefix == "//" {
+		return "/"
+	}
+	return prefix
+}
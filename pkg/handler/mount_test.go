@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMount(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		prefix     string
+		path       string
+		wantPath   string
+		wantPrefix string
+	}{
+		{
+			name:       "root",
+			prefix:     "/",
+			path:       "/simple/foo/",
+			wantPath:   "/simple/foo/",
+			wantPrefix: "",
+		},
+		{
+			name:       "prefix",
+			prefix:     "/pypi/",
+			path:       "/pypi/simple/foo/",
+			wantPath:   "/simple/foo/",
+			wantPrefix: "/pypi",
+		},
+		{
+			name:       "nested prefix without slashes",
+			prefix:     "team/pypi",
+			path:       "/team/pypi/simple/",
+			wantPath:   "/simple/",
+			wantPrefix: "/team/pypi",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var gotPath, gotPrefix string
+			h := Mount(tc.prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+				gotPrefix = MountPrefix(r.Context())
+			}))
+
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if gotPath != tc.wantPath {
+				t.Errorf("path = %q, want %q", gotPath, tc.wantPath)
+			}
+			if gotPrefix != tc.wantPrefix {
+				t.Errorf("MountPrefix() = %q, want %q", gotPrefix, tc.wantPrefix)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package npm
 
+import "encoding/json"
+
 // Placeholder for package metadata
 type PackageMetadata struct {
 	Name           string                    `json:"name"`
@@ -55,6 +57,51 @@ type Dist struct {
 	FileCount    int    `json:"fileCount,omitempty"`
 	UnpackedSize int    `json:"unpackedSize,omitempty"`
 	NpmSignature string `json:"npm-signature,omitempty"` // Signature of the tarball
+
+	Signatures   []Signature       `json:"signatures,omitempty"`   // Registry signatures of the integrity
+	Attestations *DistAttestations `json:"attestations,omitempty"` // Provenance published with the version
+}
+
+// Signature is a registry signature of "name@version:integrity".
+type Signature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// DistAttestations links a version to its attestations.
+type DistAttestations struct {
+	URL        string                 `json:"url,omitempty"`
+	Provenance *ProvenanceAttestation `json:"provenance,omitempty"`
+}
+
+// ProvenanceAttestation describes the provenance of a version.
+type ProvenanceAttestation struct {
+	PredicateType string `json:"predicateType"`
+}
+
+// RegistryKey is a public key of the registry signatures.
+type RegistryKey struct {
+	Expires *string `json:"expires"` // Never set, the keys don't expire.
+	KeyID   string  `json:"keyid"`
+	KeyType string  `json:"keytype"`
+	Scheme  string  `json:"scheme"`
+	Key     string  `json:"key"` // Base64 encoded DER public key.
+}
+
+// KeysResponse is served by the keys endpoint.
+type KeysResponse struct {
+	Keys []*RegistryKey `json:"keys"`
+}
+
+// Attestation is a Sigstore bundle with the predicate type of its statement.
+type Attestation struct {
+	PredicateType string          `json:"predicateType"`
+	Bundle        json.RawMessage `json:"bundle"`
+}
+
+// AttestationsResponse is served by the attestations endpoint.
+type AttestationsResponse struct {
+	Attestations []*Attestation `json:"attestations"`
 }
 
 // Placeholder for maintainer information
@@ -134,3 +181,18 @@ type AbbreviatedVersionInfo struct {
 	Shasum               string            `json:"_shasum"`
 	Resolved             string            `json:"_resolved,omitempty"`
 }
+
+// Packument is the package document stored and served by ocifactory. Version
+// documents are kept raw so fields ocifactory doesn't know about, e.g. bin or
+// peerDependencies, survive the round trip.
+type Packument struct {
+	ID          string                     `json:"_id,omitempty"`
+	Name        string                     `json:"name"`
+	DistTags    map[string]string          `json:"dist-tags"`
+	Versions    map[string]json.RawMessage `json:"versions"`
+	Attachments map[string]AttachmentStub  `json:"_attachments,omitempty"` // For publish
+
+	// Time has the publish time of each version, and the "created" and
+	// "modified" times of the package.
+	Time map[string]string `json:"time,omitempty"`
+}
@@ -1,43 +1,162 @@
 package npm
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // npm shasums are sha1.
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"maps"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
 
+	"github.com/abcxyz/pkg/cache"
+	"github.com/abcxyz/pkg/logging"
 	"github.com/gorilla/mux"
+	"github.com/yolocs/ocifactory/pkg/audit"
 	"github.com/yolocs/ocifactory/pkg/handler"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"oras.land/oras-go/v2/errdef"
 )
 
 const (
 	RepoType     = "npm"
 	ArtifactType = "application/vnd.ocifactory.npm"
+
+	maxPackageLength = 214
+	maxPublishSize   = 256 << 20
+
+	// Every version is stored as a tag with the tarball and its version document.
+	manifestFile = "package.json"
+
+	// Dist tags are stored as a single file under their own tag.
+	distTagsTag  = "dist-tags"
+	distTagsFile = "dist-tags.json"
+
+	tarballMediaType = "application/octet-stream"
+
+	// timeFormat is the format of the times in packuments.
+	timeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var (
+	// SignedFiles are the files a handler.VerifyPolicy covers by default: the
+	// tarballs, not the version documents.
+	SignedFiles = []string{"*.tgz"}
+
+	// pkgNameRegExp is the regex matcher for package names.
+	// Reference: https://github.com/npm/validate-npm-package-name.
+	pkgNameRegExp = regexp.MustCompile(`^(?:@[a-z0-9-*~][a-z0-9-*._~]*/)?[a-z0-9-~][a-z0-9-._~]*$`)
+
+	// ErrDistTagged is returned when deleting a version a dist tag points to.
+	ErrDistTagged = errors.New("version is pointed to by a dist tag")
 )
 
 type Handler struct {
 	registry handler.Registry
+
+	upstream       *handler.Upstream
+	packumentCache *cache.Cache[[]byte]
+	privateScopes  map[string]bool
+
+	signer *Signer
+}
+
+// Option configures the Handler.
+type Option func(*Handler) error
+
+// WithUpstream merges packuments with the upstream registry, e.g.
+// https://registry.npmjs.org. Upstream tarballs are downloaded and cached in
+// the backend on first download. Upstream packuments are cached in memory for
+// packumentTTL. The default TTL is 5 minutes.
+func WithUpstream(upstream *handler.Upstream, packumentTTL time.Duration) Option {
+	return func(h *Handler) error {
+		if packumentTTL <= 0 {
+			packumentTTL = defaultPackumentTTL
+		}
+		h.upstream = upstream
+		h.packumentCache = cache.New[[]byte](packumentTTL)
+		return nil
+	}
+}
+
+// WithPrivateScopes sets the scopes, e.g. "@mycompany", that are never looked
+// up in the upstream. It protects against dependency confusion where a
+// malicious package with the same name is published upstream.
+func WithPrivateScopes(scopes ...string) Option {
+	return func(h *Handler) error {
+		if h.privateScopes == nil {
+			h.privateScopes = make(map[string]bool)
+		}
+		for _, s := range scopes {
+			s = "@" + strings.Trim(s, "@/")
+			if s == "@" {
+				return fmt.Errorf("private scope must not be empty")
+			}
+			h.privateScopes[s] = true
+		}
+		return nil
+	}
 }
 
-func NewHandler(registry handler.Registry) (*Handler, error) {
-	return &Handler{registry: registry}, nil
+// WithSigner signs the integrity of the local versions when they are served
+// and serves the public key at /-/npm/v1/keys, so "npm audit signatures" can
+// verify them.
+func WithSigner(s *Signer) Option {
+	return func(h *Handler) error {
+		h.signer = s
+		return nil
+	}
 }
 
+// NewHandler creates a new Handler.
+func NewHandler(registry handler.Registry, opts ...Option) (*Handler, error) {
+	h := &Handler{registry: registry}
+	for _, o := range opts {
+		if err := o(h); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// Mux returns a new ServeMux that handles the npm handler's routes.
 func (h *Handler) Mux() http.Handler {
 	r := mux.NewRouter()
+	r.Use(handler.RecordRoute)
 
-	// Package Read APIs
-	// GET /{package}/{versionOrTag} - Must be specific, order matters with mux
-	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}/{versionOrTag}", getPackageVersionMetadataHandler).Methods(http.MethodGet, http.MethodHead)
-	// GET /{package} - General package info (full metadata)
-	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}", getPackageMetadataHandler).Methods(http.MethodGet, http.MethodHead)
+	// Ping. Must be before the package routes, otherwise "-" matches as a package.
+	r.HandleFunc("/-/ping", pingHandler).Methods(http.MethodGet)
+	r.HandleFunc("/", pingHandler).Methods(http.MethodGet)
+
+	// Registry signatures and provenance (npm audit signatures).
+	// GET /-/npm/v1/keys
+	// GET /-/npm/v1/attestations/@scope/package@version
+	r.HandleFunc(keysPath, h.handleKeys).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc(attestationsPath+"/{package:(?:@[^/]+/)?[^/@][^/]*}@{version}", h.handleAttestations).Methods(http.MethodGet, http.MethodHead)
+
+	// Dist Tags (npm dist-tag add/rm/ls)
+	// PUT /-/package/@scope/pkg/dist-tags/latest (body: "1.0.0")
+	r.HandleFunc("/-/package/{package:(?:@[^/]+/)?[^/@][^/]*}/dist-tags/{tag}", h.handleDistTagAdd).Methods(http.MethodPut, http.MethodPost)
+	r.HandleFunc("/-/package/{package:(?:@[^/]+/)?[^/@][^/]*}/dist-tags/{tag}", h.handleDistTagRm).Methods(http.MethodDelete)
+	r.HandleFunc("/-/package/{package:(?:@[^/]+/)?[^/@][^/]*}/dist-tags", h.handleDistTagLs).Methods(http.MethodGet, http.MethodHead)
 
 	// Tarball Download
 	// GET /@scope/package/-/package-version.tgz
 	// GET /package/-/package-version.tgz
-	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}/-/{filename:.+\\.tgz}", downloadTarballHandler).Methods(http.MethodGet, http.MethodHead)
-
-	// Package Write APIs (Publish, Unpublish)
-	// PUT /@scope/package
-	// PUT /package
-	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}", publishPackageHandler).Methods(http.MethodPut)
+	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}/-/{filename:.+\\.tgz}", h.handleTarballGet).Methods(http.MethodGet, http.MethodHead)
 
 	// Unpublish specific version: DELETE /@scope/package/-/filename.tgz/-rev/revision
 	// Unpublish specific version: DELETE /package/-/filename.tgz/-rev/revision
@@ -46,6 +165,20 @@ func (h *Handler) Mux() http.Handler {
 	// Unpublish entire package: DELETE /package/-rev/revision
 	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}/-rev/{revision}", unpublishPackageHandler).Methods(http.MethodDelete)
 
+	// Package Read APIs
+	// GET /{package}/{versionOrTag} - Must be specific, order matters with mux
+	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}/{version}"+handler.ReferrersPath, h.handleReferrers).Methods(http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost)
+	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}/{version}"+handler.ReferrersPath+"/{digest}", h.handleReferrerGet).Methods(http.MethodGet, http.MethodHead)
+
+	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}/{versionOrTag}", h.handleVersionGet).Methods(http.MethodGet, http.MethodHead)
+	// GET /{package} - General package info (full metadata)
+	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}", h.handlePackumentGet).Methods(http.MethodGet, http.MethodHead)
+
+	// Package Write APIs (Publish)
+	// PUT /@scope/package
+	// PUT /package
+	r.HandleFunc("/{package:(?:@[^/]+/)?[^/@][^/]*}", h.handlePublish).Methods(http.MethodPut)
+
 	// User Management & Authentication not supported.
 	// PUT /-/user/org.couchdb.user:{username}
 	// r.HandleFunc("/-/user/{username:org\\.couchdb\\.user:[^/]+}", UserLoginHandler).Methods(http.MethodPut)
@@ -53,65 +186,730 @@ func (h *Handler) Mux() http.Handler {
 	// r.HandleFunc("/-/whoami", WhoamiHandler).Methods(http.MethodGet, http.MethodHead)
 	// r.HandleFunc("/-/npm/v1/user", WhoamiHandler).Methods(http.MethodGet, http.MethodHead) // Newer endpoint
 
-	// Dist Tags (npm dist-tag add/rm/ls)
-	// The npm client often modifies dist-tags by PUTting the whole package document.
-	// However, a more direct API might look like this:
-	// PUT /-/package/@scope/pkg/dist-tags/latest (body: "1.0.0")
-	// These are examples and might vary based on exact npm client behavior with different registry versions.
-	// A common way npm CLI handles this is to GET the package doc, modify dist-tags, then PUT the package doc.
-	// The following are more explicit/granular endpoints if you want to implement them directly.
-	r.HandleFunc("/-/package/{package:(?:@[^/]+/)?[^/@][^/]*}/dist-tags/{tag}", distTagAddHandler).Methods(http.MethodPut, http.MethodPost)
-	r.HandleFunc("/-/package/{package:(?:@[^/]+/)?[^/@][^/]*}/dist-tags/{tag}", distTagRmHandler).Methods(http.MethodDelete)
-	r.HandleFunc("/-/package/{package:(?:@[^/]+/)?[^/@][^/]*}/dist-tags", distTagLsHandler).Methods(http.MethodGet, http.MethodHead)
-
-	// Ping.
-	r.HandleFunc("/-/ping", pingHandler).Methods(http.MethodGet)
-	r.HandleFunc("/", pingHandler).Methods(http.MethodGet)
-
 	return r
 }
 
-func getPackageVersionMetadataHandler(w http.ResponseWriter, req *http.Request) {
-	// TODO: Implement package version metadata handler
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+// handlePackumentGet serves the package document with all versions.
+func (h *Handler) handlePackumentGet(w http.ResponseWriter, req *http.Request) {
+	name := mux.Vars(req)["package"]
+	p, ok := h.resolvePackument(w, req, name)
+	if !ok {
+		return
+	}
+	writeJSON(w, req, http.StatusOK, p)
+}
+
+// handleReferrers lists or attaches the signatures, attestations and SBOMs of
+// a version.
+func (h *Handler) handleReferrers(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	handler.ServeReferrers(w, req, h.registry, packageRepo(vars["package"]), versionTag(vars["version"]), handler.JSONError)
+}
+
+// handleReferrerGet serves the content of a referrer of a version.
+func (h *Handler) handleReferrerGet(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	handler.GetReferrer(w, req, h.registry, packageRepo(vars["package"]), versionTag(vars["version"]), vars["digest"], handler.JSONError)
+}
+
+// handleVersionGet serves the document of a single version. The version could
+// also be a dist tag, e.g. "latest".
+func (h *Handler) handleVersionGet(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name, versionOrTag := vars["package"], vars["versionOrTag"]
+
+	p, ok := h.resolvePackument(w, req, name)
+	if !ok {
+		return
+	}
+	version := versionOrTag
+	if v, ok := p.DistTags[versionOrTag]; ok {
+		version = v
+	}
+	raw, ok := p.Versions[version]
+	if !ok {
+		handler.JSONError(w, fmt.Sprintf("version %q of package %q not found", versionOrTag, name), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, raw)
+}
+
+// resolvePackument returns the local packument merged with the upstream one,
+// with tarball URLs pointing to this server. Errors are written to the response.
+func (h *Handler) resolvePackument(w http.ResponseWriter, req *http.Request, name string) (*Packument, bool) {
+	ctx := req.Context()
+	useUpstream := h.useUpstream(name)
+
+	p, err := h.localPackument(ctx, name)
+	if err != nil && !(handler.IsNotFound(err) && useUpstream) {
+		writeError(w, req, err)
+		return nil, false
+	}
+	local := make(map[string]bool)
+	if p != nil {
+		for v := range p.Versions {
+			local[v] = true
+		}
+	}
+
+	if useUpstream {
+		up, err := h.upstreamPackument(ctx, name)
+		switch {
+		case err == nil:
+			p = mergePackuments(p, up)
+		case p == nil:
+			handler.WriteUpstreamError(w, req, err, handler.JSONError)
+			return nil, false
+		default:
+			// Still serve the local versions if the upstream is flaky.
+			logging.FromContext(ctx).WarnContext(ctx, "failed to fetch upstream packument", "package", name, "error", err)
+		}
+	}
+
+	for v, raw := range p.Versions {
+		rewritten, err := updateDist(raw, func(dist map[string]json.RawMessage) error {
+			if err := setDist(dist, "tarball", tarballURL(req, name, v)); err != nil {
+				return err
+			}
+			// Upstream versions keep the signatures and attestations of
+			// the upstream.
+			if !local[v] {
+				return nil
+			}
+			return h.localDist(req, name, v, dist)
+		})
+		if err != nil {
+			writeError(w, req, fmt.Errorf("invalid document for version %q: %w", v, err))
+			return nil, false
+		}
+		p.Versions[v] = rewritten
+	}
+	p.ID = name
+	return p, true
+}
+
+// localPackument assembles the packument from the versions published locally.
+func (h *Handler) localPackument(ctx context.Context, name string) (*Packument, error) {
+	repo := packageRepo(name)
+	tags, err := h.registry.ListTags(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Packument{Name: name, DistTags: map[string]string{}, Versions: map[string]json.RawMessage{}, Time: map[string]string{}}
+	var created, modified time.Time
+	for _, tag := range tags {
+		if tag == distTagsTag {
+			continue
+		}
+		desc, raw, err := readJSONFile(ctx, h.registry, &oci.RepoFile{OwningRepo: repo, OwningTag: tag, Name: manifestFile})
+		if err != nil {
+			if handler.IsNotFound(err) {
+				continue // A version without document is not fully published.
+			}
+			return nil, err
+		}
+		var v VersionInfo
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("failed to parse document of tag %q: %w", tag, err)
+		}
+		p.Versions[v.Version] = raw
+
+		// The document is uploaded with the tarball, so its upload time is
+		// when the version was published.
+		if t := oci.CreatedTime(desc.File); !t.IsZero() {
+			p.Time[v.Version] = t.UTC().Format(timeFormat)
+			if created.IsZero() || t.Before(created) {
+				created = t
+			}
+			if t.After(modified) {
+				modified = t
+			}
+		}
+	}
+	if !created.IsZero() {
+		p.Time["created"] = created.UTC().Format(timeFormat)
+		p.Time["modified"] = modified.UTC().Format(timeFormat)
+	}
+	if len(p.Versions) == 0 {
+		return nil, fmt.Errorf("package %q not found: %w", name, errdef.ErrNotFound)
+	}
+
+	if p.DistTags, err = readDistTags(ctx, h.registry, name); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// handlePublish handles "npm publish". The request body is the packument with
+// the new version and its tarball attached.
+func (h *Handler) handlePublish(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	logger := logging.FromContext(ctx)
+	name := mux.Vars(req)["package"]
+
+	if len(name) > maxPackageLength || !pkgNameRegExp.MatchString(name) {
+		logger.DebugContext(ctx, "invalid package name", "name", name)
+		handler.JSONError(w, "invalid package name", http.StatusBadRequest)
+		return
+	}
+
+	var doc Packument
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, maxPublishSize)).Decode(&doc); err != nil {
+		logger.DebugContext(ctx, "failed to decode publish request", "error", err)
+		handler.JSONError(w, "request body is not a valid package document", http.StatusBadRequest)
+		return
+	}
+	if doc.Name != name {
+		handler.JSONError(w, fmt.Sprintf("package name %q doesn't match the path %q", doc.Name, name), http.StatusBadRequest)
+		return
+	}
+	if len(doc.Versions) == 0 {
+		handler.JSONError(w, "no version to publish", http.StatusBadRequest)
+		return
+	}
+
+	repo := packageRepo(name)
+	for version, raw := range doc.Versions {
+		tarball, err := publishedTarball(&doc, version, raw)
+		if err != nil {
+			logger.DebugContext(ctx, "invalid version to publish", "version", version, "error", err)
+			handler.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		bundle, bundleType, predicateType, err := publishedProvenance(&doc, version, tarball)
+		if err != nil {
+			logger.DebugContext(ctx, "invalid provenance to publish", "version", version, "error", err)
+			handler.JSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		raw, err = updateDist(raw, func(dist map[string]json.RawMessage) error {
+			// Signatures and attestations are set by the registry only.
+			delete(dist, "signatures")
+			delete(dist, "attestations")
+			if bundle == nil {
+				return nil
+			}
+			return setDist(dist, "attestations", &DistAttestations{Provenance: &ProvenanceAttestation{PredicateType: predicateType}})
+		})
+		if err != nil {
+			handler.JSONError(w, fmt.Sprintf("invalid document for version %q: %v", version, err), http.StatusBadRequest)
+			return
+		}
+
+		manifest := &oci.RepoFile{OwningRepo: repo, OwningTag: versionTag(version), Name: manifestFile, MediaType: "application/json"}
+		if _, err := readJSON(ctx, h.registry, manifest); err == nil {
+			handler.JSONError(w, fmt.Sprintf("cannot publish over previously published version %q", version), http.StatusForbidden)
+			return
+		} else if !handler.IsNotFound(err) {
+			writeError(w, req, err)
+			return
+		}
+
+		// The tarball, its provenance and the document are added at once so
+		// a version is never listed without them.
+		uploads := []*oci.FileUpload{{
+			RepoFile: &oci.RepoFile{OwningRepo: repo, OwningTag: versionTag(version), Name: tarballName(name, version), MediaType: tarballMediaType},
+			Content:  bytes.NewReader(tarball),
+		}}
+		if bundle != nil {
+			uploads = append(uploads, &oci.FileUpload{
+				RepoFile: &oci.RepoFile{OwningRepo: repo, OwningTag: versionTag(version), Name: provenanceName(name, version), MediaType: bundleType},
+				Content:  bytes.NewReader(bundle),
+			})
+		}
+		uploads = append(uploads, &oci.FileUpload{RepoFile: manifest, Content: bytes.NewReader(raw)})
+		descs, err := h.registry.AddFiles(ctx, uploads)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		logger.DebugContext(ctx, "added files", "descriptors", descs)
+	}
+
+	if len(doc.DistTags) > 0 {
+		old, err := readDistTags(ctx, h.registry, name)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		tags := maps.Clone(old)
+		for t, v := range doc.DistTags {
+			tags[t] = v
+		}
+		if err := h.writeDistTags(ctx, name, old, tags); err != nil {
+			writeError(w, req, err)
+			return
+		}
+	}
+
+	writeJSON(w, req, http.StatusCreated, &ModifyResponse{Ok: true, ID: name, Success: true})
+}
+
+// publishedTarball returns the decoded tarball attached for the version and
+// checks it against the shasum in the version document.
+func publishedTarball(doc *Packument, version string, raw json.RawMessage) ([]byte, error) {
+	var v VersionInfo
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, fmt.Errorf("invalid document for version %q: %w", version, err)
+	}
+	if v.Version != version {
+		return nil, fmt.Errorf("version %q doesn't match the document version %q", version, v.Version)
+	}
+
+	// npm names the attachment after the full package name, including the scope.
+	att, ok := doc.Attachments[doc.Name+"-"+version+".tgz"]
+	if !ok {
+		att, ok = doc.Attachments[tarballName(doc.Name, version)]
+	}
+	if !ok {
+		return nil, fmt.Errorf("missing tarball for version %q", version)
+	}
+	b, err := base64.StdEncoding.DecodeString(att.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tarball for version %q: %w", version, err)
+	}
+	if v.Dist.Shasum != "" {
+		sum := sha1.Sum(b) //nolint:gosec // npm shasums are sha1.
+		if got := hex.EncodeToString(sum[:]); got != v.Dist.Shasum {
+			return nil, fmt.Errorf("tarball shasum mismatch for version %q: %q != %q", version, got, v.Dist.Shasum)
+		}
+	}
+	// The integrity is what the registry signs, so it must be right too.
+	if err := checkIntegrity(v.Dist.Integrity, b); err != nil {
+		return nil, fmt.Errorf("tarball integrity mismatch for version %q: %w", version, err)
+	}
+	return b, nil
+}
+
+// checkIntegrity checks the tarball against the subresource integrity string,
+// e.g. "sha512-<base64>". Hashes of unknown algorithms are ignored.
+func checkIntegrity(integrity string, tarball []byte) error {
+	c := newIntegrityChecker(integrity, "")
+	c.Write(tarball) //nolint:errcheck // Hashes never fail to write.
+	return c.check()
+}
+
+// integrityChecker hashes a tarball while it's written and checks it against
+// the subresource integrity string and the legacy sha1 shasum of its dist.
+type integrityChecker struct {
+	integrity string
+	shasum    string
+	hashes    map[string]hash.Hash
+}
+
+func newIntegrityChecker(integrity, shasum string) *integrityChecker {
+	c := &integrityChecker{
+		integrity: integrity,
+		shasum:    shasum,
+		hashes:    make(map[string]hash.Hash),
+	}
+	for _, h := range strings.Fields(integrity) {
+		alg, _, _ := strings.Cut(h, "-")
+		switch alg {
+		case "sha512":
+			c.hashes[alg] = sha512.New()
+		case "sha384":
+			c.hashes[alg] = sha512.New384()
+		case "sha256":
+			c.hashes[alg] = sha256.New()
+		}
+	}
+	if _, ok := c.hashes["sha1"]; !ok && (shasum != "" || strings.Contains(integrity, "sha1-")) {
+		c.hashes["sha1"] = sha1.New() //nolint:gosec // npm shasums are sha1.
+	}
+	return c
+}
+
+func (c *integrityChecker) Write(p []byte) (int, error) {
+	for _, h := range c.hashes {
+		h.Write(p)
+	}
+	return len(p), nil
+}
+
+// check returns an error if a digest of the written tarball doesn't match.
+func (c *integrityChecker) check() error {
+	if c.shasum != "" {
+		if got := hex.EncodeToString(c.hashes["sha1"].Sum(nil)); got != c.shasum {
+			return fmt.Errorf("shasum doesn't match: %q != %q", got, c.shasum)
+		}
+	}
+	for _, h := range strings.Fields(c.integrity) {
+		alg, sum, ok := strings.Cut(h, "-")
+		if !ok {
+			return fmt.Errorf("invalid integrity %q", h)
+		}
+		sum, _, _ = strings.Cut(sum, "?") // Options are not part of the hash.
+
+		hh, ok := c.hashes[alg]
+		if !ok {
+			continue
+		}
+		if base64.StdEncoding.EncodeToString(hh.Sum(nil)) != sum {
+			return fmt.Errorf("%s digest doesn't match", alg)
+		}
+	}
+	return nil
+}
+
+// handleTarballGet serves the tarball of a version.
+func (h *Handler) handleTarballGet(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name := vars["package"]
+	version := versionFromTarball(name, vars["filename"])
+	if version == "" {
+		handler.JSONError(w, fmt.Sprintf("tarball %q not found", vars["filename"]), http.StatusNotFound)
+		return
+	}
+
+	f := &oci.RepoFile{
+		OwningRepo: packageRepo(name),
+		OwningTag:  versionTag(version),
+		Name:       tarballName(name, version),
+		MediaType:  tarballMediaType,
+	}
+	desc, r, err := h.registry.ReadFile(req.Context(), f)
+	if err != nil {
+		logging.FromContext(req.Context()).DebugContext(req.Context(), "failed to read file", "error", err)
+		if handler.IsNotFound(err) && h.useUpstream(name) && handler.AllowsUpstream(h.registry, f.Name) {
+			h.handleUpstreamTarball(w, req, name, version, f)
+			return
+		}
+		writeError(w, req, err)
+		return
+	}
+	handler.ServeFile(w, req, f, desc, r)
 }
 
-func getPackageMetadataHandler(w http.ResponseWriter, req *http.Request) {
-	// TODO: Implement package metadata handler
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+// handleDistTagLs handles "npm dist-tag ls".
+func (h *Handler) handleDistTagLs(w http.ResponseWriter, req *http.Request) {
+	p, ok := h.resolvePackument(w, req, mux.Vars(req)["package"])
+	if !ok {
+		return
+	}
+	writeJSON(w, req, http.StatusOK, p.DistTags)
 }
 
-func downloadTarballHandler(w http.ResponseWriter, req *http.Request) {
-	// TODO: Implement tarball download handler
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+// handleDistTagAdd handles "npm dist-tag add". The body is the JSON encoded
+// version the tag points to. Only local versions can be tagged.
+func (h *Handler) handleDistTagAdd(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	vars := mux.Vars(req)
+	name, tag := vars["package"], vars["tag"]
+
+	var version string
+	if err := json.NewDecoder(io.LimitReader(req.Body, 1024)).Decode(&version); err != nil || version == "" {
+		handler.JSONError(w, "request body must be a JSON string of the version", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := readJSON(ctx, h.registry, &oci.RepoFile{OwningRepo: packageRepo(name), OwningTag: versionTag(version), Name: manifestFile}); err != nil {
+		writeError(w, req, err)
+		return
+	}
+
+	old, err := readDistTags(ctx, h.registry, name)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	tags := maps.Clone(old)
+	tags[tag] = version
+	if err := h.writeDistTags(ctx, name, old, tags); err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusCreated, tags)
 }
 
-func publishPackageHandler(w http.ResponseWriter, req *http.Request) {
-	// TODO: Implement package publish handler
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+// handleDistTagRm handles "npm dist-tag rm". The latest tag can't be removed.
+func (h *Handler) handleDistTagRm(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	vars := mux.Vars(req)
+	name, tag := vars["package"], vars["tag"]
+
+	if tag == "latest" {
+		handler.JSONError(w, "the latest tag cannot be removed", http.StatusBadRequest)
+		return
+	}
+
+	old, err := readDistTags(ctx, h.registry, name)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	if _, ok := old[tag]; !ok {
+		handler.JSONError(w, fmt.Sprintf("dist tag %q not found", tag), http.StatusNotFound)
+		return
+	}
+	tags := maps.Clone(old)
+	delete(tags, tag)
+	if err := h.writeDistTags(ctx, name, old, tags); err != nil {
+		writeError(w, req, err)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, tags)
 }
 
 func unpublishPackageHandler(w http.ResponseWriter, req *http.Request) {
 	// TODO: Implement package unpublish handler
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+	handler.JSONError(w, "not implemented", http.StatusNotImplemented)
 }
 
-func distTagAddHandler(w http.ResponseWriter, req *http.Request) {
-	// TODO: Implement dist-tag add handler
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+func pingHandler(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, req, http.StatusOK, struct{}{})
 }
 
-func distTagRmHandler(w http.ResponseWriter, req *http.Request) {
-	// TODO: Implement dist-tag remove handler
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+// readDistTags reads the local dist tags of the package. Returns an empty map
+// if there is none.
+func readDistTags(ctx context.Context, reg handler.Registry, name string) (map[string]string, error) {
+	tags := make(map[string]string)
+	raw, err := readJSON(ctx, reg, &oci.RepoFile{OwningRepo: packageRepo(name), OwningTag: distTagsTag, Name: distTagsFile})
+	if err != nil {
+		if handler.IsNotFound(err) {
+			return tags, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &tags); err != nil {
+		return nil, fmt.Errorf("failed to parse dist tags: %w", err)
+	}
+	return tags, nil
 }
 
-func distTagLsHandler(w http.ResponseWriter, req *http.Request) {
-	// TODO: Implement dist-tag list handler
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+// writeDistTags replaces the local dist tags of the package. The changes from
+// old are recorded in the audit log.
+func (h *Handler) writeDistTags(ctx context.Context, name string, old, tags map[string]string) error {
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dist tags: %w", err)
+	}
+	f := &oci.RepoFile{OwningRepo: packageRepo(name), OwningTag: distTagsTag, Name: distTagsFile, MediaType: "application/json"}
+	desc, err := h.registry.AddFile(ctx, f, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to write dist tags: %w", err)
+	}
+
+	record := func(action audit.Action, tag, version string) {
+		audit.Record(ctx, &audit.Event{
+			Action:   action,
+			Repo:     packageRepo(name),
+			Tag:      versionTag(version),
+			Manifest: desc.Manifest.Digest.String(),
+			Attrs:    []slog.Attr{slog.String("package", name), slog.String("dist_tag", tag), slog.String("version", version)},
+		})
+	}
+	for t, v := range tags {
+		if old[t] != v {
+			record(audit.ActionTag, t, v)
+		}
+	}
+	for t, v := range old {
+		if _, ok := tags[t]; !ok {
+			record(audit.ActionUntag, t, v)
+		}
+	}
+	return nil
 }
 
-func pingHandler(w http.ResponseWriter, req *http.Request) {
-	// TODO: Implement ping handler
-	http.Error(w, "not implemented", http.StatusNotImplemented)
+// DeleteVersion deletes the files of the version stored under the repository
+// and tag. Versions a dist tag points to are kept and ErrDistTagged is
+// returned, so that installing the dist tag keeps working.
+func DeleteVersion(ctx context.Context, reg handler.Registry, repo, tag string) error {
+	name, version, ok := PackageVersion(repo, tag)
+	if !ok {
+		return fmt.Errorf("tag %q of %s is not a version", tag, repo)
+	}
+	distTags, err := readDistTags(ctx, reg, name)
+	if err != nil {
+		return err
+	}
+	for t, v := range distTags {
+		if v == version {
+			return fmt.Errorf("failed to delete %s@%s: %w: %s", name, version, ErrDistTagged, t)
+		}
+	}
+	return reg.DeleteTagFiles(ctx, repo, tag)
+}
+
+// readJSON reads a small JSON file from the registry.
+func readJSON(ctx context.Context, reg handler.Registry, f *oci.RepoFile) (json.RawMessage, error) {
+	_, b, err := readJSONFile(ctx, reg, f)
+	return b, err
+}
+
+// readJSONFile is readJSON that also returns the descriptor of the file.
+func readJSONFile(ctx context.Context, reg handler.Registry, f *oci.RepoFile) (*oci.FileDescriptor, json.RawMessage, error) {
+	desc, r, err := reg.ReadFile(ctx, f)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", f.Name, err)
+	}
+	return desc, b, nil
+}
+
+func writeJSON(w http.ResponseWriter, req *http.Request, status int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, req, fmt.Errorf("failed to marshal response: %w", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(b)))
+	w.WriteHeader(status)
+	if req.Method == http.MethodHead {
+		return
+	}
+	if _, err := w.Write(b); err != nil {
+		logging.FromContext(req.Context()).DebugContext(req.Context(), "failed to write response", "error", err)
+	}
+}
+
+// writeError maps the registry error to the HTTP status.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	handler.WriteError(w, req, err, handler.JSONError)
+}
+
+// packageRepo returns the repository that stores the published versions of
+// the package. OCI repository names can't contain '@', so the scope marker is
+// dropped, e.g. "@scope/pkg" is stored in "packages/scope/pkg".
+func packageRepo(name string) string {
+	return "packages/" + strings.TrimPrefix(name, "@")
+}
+
+// versionTag returns the tag that stores the version. Semver build metadata is
+// separated with '+', which is not allowed in OCI tags.
+func versionTag(version string) string {
+	return strings.ReplaceAll(version, "+", "_")
+}
+
+// PackageVersion returns the package and version stored under the repository
+// and tag. It reverses packageRepo and versionTag. The dist tags are not a
+// version.
+func PackageVersion(repo, tag string) (string, string, bool) {
+	name, ok := strings.CutPrefix(repo, "packages/")
+	if !ok || tag == distTagsTag {
+		return "", "", false
+	}
+	if strings.Contains(name, "/") {
+		name = "@" + name
+	}
+	// Semver identifiers never contain '_', so it can only come from '+'.
+	return name, strings.ReplaceAll(tag, "_", "+"), true
+}
+
+// tarballName returns the tarball file name without scope, e.g. "pkg-1.0.0.tgz".
+func tarballName(name, version string) string {
+	return path.Base(name) + "-" + version + ".tgz"
+}
+
+// versionFromTarball extracts the version from the tarball file name. Both the
+// registry form "pkg-1.0.0.tgz" and the form "@scope/pkg-1.0.0.tgz" used by
+// the npm CLI are accepted. Returns empty string if the name doesn't match.
+func versionFromTarball(name, filename string) string {
+	v, ok := strings.CutPrefix(path.Base(filename), path.Base(name)+"-")
+	if !ok {
+		return ""
+	}
+	v, _ = strings.CutSuffix(v, ".tgz")
+	return v
+}
+
+// tarballURL returns the URL of the tarball on this server.
+func tarballURL(req *http.Request, name, version string) string {
+	return serverURL(req, fmt.Sprintf("/%s/-/%s", name, tarballName(name, version)))
+}
+
+// attestationsURL returns the URL of the attestations of a version on this
+// server.
+func attestationsURL(req *http.Request, name, version string) string {
+	return serverURL(req, fmt.Sprintf("%s/%s@%s", attestationsPath, name, version))
+}
+
+// serverURL returns the URL of the path under the mount on this server.
+func serverURL(req *http.Request, p string) string {
+	u := &url.URL{
+		Scheme: "http",
+		Host:   req.Host,
+		Path:   handler.MountPrefix(req.Context()) + p,
+	}
+	if req.TLS != nil || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") {
+		u.Scheme = "https"
+	}
+	return u.String()
+}
+
+// localDist adds the registry signature and the attestations URL of a local
+// version to its dist. Versions without integrity, e.g. published by old
+// clients, are not signed.
+func (h *Handler) localDist(req *http.Request, name, version string, dist map[string]json.RawMessage) error {
+	if raw, ok := dist["attestations"]; ok {
+		var a DistAttestations
+		if err := json.Unmarshal(raw, &a); err != nil {
+			return fmt.Errorf("failed to parse attestations: %w", err)
+		}
+		a.URL = attestationsURL(req, name, version)
+		if err := setDist(dist, "attestations", &a); err != nil {
+			return err
+		}
+	}
+
+	if h.signer == nil {
+		return nil
+	}
+	var integrity string
+	if raw, ok := dist["integrity"]; ok {
+		if err := json.Unmarshal(raw, &integrity); err != nil {
+			return fmt.Errorf("failed to parse integrity: %w", err)
+		}
+	}
+	if integrity == "" {
+		return nil
+	}
+	sig, err := h.signer.Sign(name, version, integrity)
+	if err != nil {
+		return err
+	}
+	return setDist(dist, "signatures", []*Signature{sig})
+}
+
+// updateDist changes the dist of the version document with fn. Other fields
+// are kept as is.
+func updateDist(raw json.RawMessage, fn func(dist map[string]json.RawMessage) error) (json.RawMessage, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse version document: %w", err)
+	}
+	dist := make(map[string]json.RawMessage)
+	if d, ok := doc["dist"]; ok {
+		if err := json.Unmarshal(d, &dist); err != nil {
+			return nil, fmt.Errorf("failed to parse dist: %w", err)
+		}
+	}
+	if err := fn(dist); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if doc["dist"], err = json.Marshal(dist); err != nil {
+		return nil, fmt.Errorf("failed to marshal dist: %w", err)
+	}
+	return json.Marshal(doc)
+}
+
+// setDist sets the field of the dist to v.
+func setDist(dist map[string]json.RawMessage, field string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", field, err)
+	}
+	dist[field] = b
+	return nil
 }
@@ -0,0 +1,754 @@
+package npm
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" //nolint:gosec // npm shasums are sha1.
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/audit"
+	"github.com/yolocs/ocifactory/pkg/handler"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+// publishBody returns the request body "npm publish" sends for the version.
+func publishBody(t *testing.T, name, version, tarball, shasum string) string {
+	t.Helper()
+
+	if shasum == "" {
+		sum := sha1.Sum([]byte(tarball)) //nolint:gosec // npm shasums are sha1.
+		shasum = hex.EncodeToString(sum[:])
+	}
+	doc := map[string]any{
+		"_id":       name,
+		"name":      name,
+		"dist-tags": map[string]string{"latest": version},
+		"versions": map[string]any{
+			version: map[string]any{
+				"name":    name,
+				"version": version,
+				"bin":     map[string]string{"cli": "bin/cli.js"},
+				"dist": map[string]string{
+					"shasum":  shasum,
+					"tarball": fmt.Sprintf("http://localhost/%s/-/%s-%s.tgz", name, name, version),
+				},
+			},
+		},
+		"_attachments": map[string]any{
+			name + "-" + version + ".tgz": map[string]any{
+				"content_type": "application/octet-stream",
+				"data":         base64.StdEncoding.EncodeToString([]byte(tarball)),
+				"length":       len(tarball),
+			},
+		},
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestHandlePublish(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		path       string
+		body       string
+		existing   bool
+		wantStatus int
+		wantFiles  []string
+	}{
+		{
+			name:       "unscoped package",
+			path:       "/left-pad",
+			body:       publishBody(t, "left-pad", "1.0.0", "tarball", ""),
+			wantStatus: http.StatusCreated,
+			wantFiles: []string{
+				"packages/left-pad/1.0.0/left-pad-1.0.0.tgz",
+				"packages/left-pad/1.0.0/package.json",
+				"packages/left-pad/dist-tags/dist-tags.json",
+			},
+		},
+		{
+			name:       "scoped package",
+			path:       "/@scope/left-pad",
+			body:       publishBody(t, "@scope/left-pad", "1.0.0+build.1", "tarball", ""),
+			wantStatus: http.StatusCreated,
+			wantFiles: []string{
+				"packages/scope/left-pad/1.0.0_build.1/left-pad-1.0.0+build.1.tgz",
+				"packages/scope/left-pad/1.0.0_build.1/package.json",
+				"packages/scope/left-pad/dist-tags/dist-tags.json",
+			},
+		},
+		{
+			name:       "invalid package name",
+			path:       "/Left-Pad",
+			body:       publishBody(t, "Left-Pad", "1.0.0", "tarball", ""),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "name mismatch",
+			path:       "/right-pad",
+			body:       publishBody(t, "left-pad", "1.0.0", "tarball", ""),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "shasum mismatch",
+			path:       "/left-pad",
+			body:       publishBody(t, "left-pad", "1.0.0", "tarball", "0000"),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "integrity mismatch",
+			path:       "/left-pad",
+			body:       withIntegrity(t, publishBody(t, "left-pad", "1.0.0", "tarball", ""), "left-pad", "1.0.0", integrity("other tarball"), ""),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing tarball",
+			path:       "/left-pad",
+			body:       `{"name":"left-pad","versions":{"1.0.0":{"name":"left-pad","version":"1.0.0"}}}`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid body",
+			path:       "/left-pad",
+			body:       `not json`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "republish version",
+			path:       "/left-pad",
+			body:       publishBody(t, "left-pad", "1.0.0", "tarball", ""),
+			existing:   true,
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := oci.NewFakeRegistry()
+			if tc.existing {
+				if _, err := registry.AddFile(context.Background(), &oci.RepoFile{
+					OwningRepo: "packages/left-pad",
+					OwningTag:  "1.0.0",
+					Name:       "package.json",
+				}, strings.NewReader(`{"name":"left-pad","version":"1.0.0"}`)); err != nil {
+					t.Fatalf("Failed to set up file: %v", err)
+				}
+			}
+			h, err := NewHandler(registry)
+			if err != nil {
+				t.Fatalf("NewHandler() unexpected error: %v", err)
+			}
+
+			resp := httptest.NewRecorder()
+			h.Mux().ServeHTTP(resp, httptest.NewRequest(http.MethodPut, tc.path, strings.NewReader(tc.body)))
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d, body: %s", got, want, resp.Body.String())
+			}
+			for _, f := range tc.wantFiles {
+				if _, ok := registry.Files[f]; !ok {
+					t.Errorf("File %q not found in registry", f)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleRead(t *testing.T) {
+	t.Parallel()
+
+	registry := oci.NewFakeRegistry()
+	h, err := NewHandler(registry)
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+	router := h.Mux()
+
+	for _, body := range []string{
+		publishBody(t, "@scope/left-pad", "1.0.0", "tarball 1", ""),
+		publishBody(t, "@scope/left-pad", "1.1.0", "tarball 2", ""),
+	} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/@scope/left-pad", strings.NewReader(body)))
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("Failed to publish: %d %s", resp.Code, resp.Body.String())
+		}
+	}
+	registry.Created["packages/scope/left-pad/1.0.0/package.json"] = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	registry.Created["packages/scope/left-pad/1.1.0/package.json"] = time.Date(2025, 2, 3, 4, 5, 6, 0, time.UTC)
+
+	cases := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+		wantJSON   string
+	}{
+		{
+			name:       "packument",
+			method:     http.MethodGet,
+			path:       "/@scope/left-pad",
+			wantStatus: http.StatusOK,
+			wantJSON: `{
+				"_id": "@scope/left-pad",
+				"name": "@scope/left-pad",
+				"dist-tags": {"latest": "1.1.0"},
+				"time": {
+					"created": "2025-01-02T03:04:05.000Z",
+					"modified": "2025-02-03T04:05:06.000Z",
+					"1.0.0": "2025-01-02T03:04:05.000Z",
+					"1.1.0": "2025-02-03T04:05:06.000Z"
+				},
+				"versions": {
+					"1.0.0": {
+						"name": "@scope/left-pad", "version": "1.0.0", "bin": {"cli": "bin/cli.js"},
+						"dist": {"shasum": "` + sha1Hex("tarball 1") + `", "tarball": "http://example.com/@scope/left-pad/-/left-pad-1.0.0.tgz"}
+					},
+					"1.1.0": {
+						"name": "@scope/left-pad", "version": "1.1.0", "bin": {"cli": "bin/cli.js"},
+						"dist": {"shasum": "` + sha1Hex("tarball 2") + `", "tarball": "http://example.com/@scope/left-pad/-/left-pad-1.1.0.tgz"}
+					}
+				}
+			}`,
+		},
+		{
+			name:       "version by dist tag",
+			method:     http.MethodGet,
+			path:       "/@scope/left-pad/latest",
+			wantStatus: http.StatusOK,
+			wantJSON: `{
+				"name": "@scope/left-pad", "version": "1.1.0", "bin": {"cli": "bin/cli.js"},
+				"dist": {"shasum": "` + sha1Hex("tarball 2") + `", "tarball": "http://example.com/@scope/left-pad/-/left-pad-1.1.0.tgz"}
+			}`,
+		},
+		{
+			name:       "unknown version",
+			method:     http.MethodGet,
+			path:       "/@scope/left-pad/2.0.0",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unknown package",
+			method:     http.MethodGet,
+			path:       "/right-pad",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "tarball",
+			method:     http.MethodGet,
+			path:       "/@scope/left-pad/-/left-pad-1.0.0.tgz",
+			wantStatus: http.StatusOK,
+			wantBody:   "tarball 1",
+		},
+		{
+			name:       "tarball with scope in file name",
+			method:     http.MethodGet,
+			path:       "/@scope/left-pad/-/@scope/left-pad-1.1.0.tgz",
+			wantStatus: http.StatusOK,
+			wantBody:   "tarball 2",
+		},
+		{
+			name:       "unknown tarball",
+			method:     http.MethodGet,
+			path:       "/@scope/left-pad/-/right-pad-1.0.0.tgz",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "dist tag ls",
+			method:     http.MethodGet,
+			path:       "/-/package/@scope/left-pad/dist-tags",
+			wantStatus: http.StatusOK,
+			wantJSON:   `{"latest": "1.1.0"}`,
+		},
+		{
+			name:       "dist tag add unknown version",
+			method:     http.MethodPut,
+			path:       "/-/package/@scope/left-pad/dist-tags/beta",
+			body:       `"2.0.0"`,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "dist tag rm latest",
+			method:     http.MethodDelete,
+			path:       "/-/package/@scope/left-pad/dist-tags/latest",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "ping",
+			method:     http.MethodGet,
+			path:       "/-/ping",
+			wantStatus: http.StatusOK,
+			wantJSON:   `{}`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Not parallel since some cases write to the shared fake registry.
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d, body: %s", got, want, resp.Body.String())
+			}
+			if tc.wantBody != "" && resp.Body.String() != tc.wantBody {
+				t.Errorf("Body = %q, want %q", resp.Body.String(), tc.wantBody)
+			}
+			if tc.wantJSON != "" {
+				if diff := diffJSON(tc.wantJSON, resp.Body.String()); diff != "" {
+					t.Errorf("Body mismatch (-want, +got):\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestDistTags(t *testing.T) {
+	t.Parallel()
+
+	registry := oci.NewFakeRegistry()
+	h, err := NewHandler(registry)
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+	router := h.Mux()
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/left-pad", strings.NewReader(publishBody(t, "left-pad", "1.0.0", "tarball", ""))))
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("Failed to publish: %d %s", resp.Code, resp.Body.String())
+	}
+
+	steps := []struct {
+		method    string
+		path      string
+		body      string
+		wantTags  string
+		wantAudit []string
+	}{
+		{method: http.MethodPut, path: "/-/package/left-pad/dist-tags/beta", body: `"1.0.0"`, wantTags: `{"latest":"1.0.0","beta":"1.0.0"}`, wantAudit: []string{"tag beta 1.0.0"}},
+		{method: http.MethodGet, path: "/-/package/left-pad/dist-tags", wantTags: `{"latest":"1.0.0","beta":"1.0.0"}`},
+		{method: http.MethodDelete, path: "/-/package/left-pad/dist-tags/beta", wantTags: `{"latest":"1.0.0"}`, wantAudit: []string{"untag beta 1.0.0"}},
+		{method: http.MethodGet, path: "/-/package/left-pad/dist-tags", wantTags: `{"latest":"1.0.0"}`},
+	}
+	for _, s := range steps {
+		var buf bytes.Buffer
+		req := httptest.NewRequest(s.method, s.path, strings.NewReader(s.body))
+		req = req.WithContext(audit.WithLogger(req.Context(), audit.NewLogger(&buf)))
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		if resp.Code >= 300 {
+			t.Fatalf("%s %s: status code = %d, body: %s", s.method, s.path, resp.Code, resp.Body.String())
+		}
+		if diff := diffJSON(s.wantTags, resp.Body.String()); diff != "" {
+			t.Errorf("%s %s: tags mismatch (-want, +got):\n%s", s.method, s.path, diff)
+		}
+
+		var gotAudit []string
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var e struct {
+				Action  string `json:"action"`
+				DistTag string `json:"dist_tag"`
+				Version string `json:"version"`
+			}
+			if err := dec.Decode(&e); err != nil {
+				t.Fatalf("failed to parse audit log: %v", err)
+			}
+			gotAudit = append(gotAudit, e.Action+" "+e.DistTag+" "+e.Version)
+		}
+		if diff := cmp.Diff(s.wantAudit, gotAudit); diff != "" {
+			t.Errorf("%s %s: audit log mismatch (-want, +got):\n%s", s.method, s.path, diff)
+		}
+	}
+}
+
+func TestDeleteVersion(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	registry := oci.NewFakeRegistry()
+	h, err := NewHandler(registry)
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+	router := h.Mux()
+	for _, v := range []string{"1.0.0", "2.0.0"} {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/@scope/left-pad", strings.NewReader(publishBody(t, "@scope/left-pad", v, "tarball "+v, ""))))
+		if resp.Code != http.StatusCreated {
+			t.Fatalf("Failed to publish %s: %d %s", v, resp.Code, resp.Body.String())
+		}
+	}
+
+	if err := DeleteVersion(ctx, registry, "packages/scope/left-pad", "2.0.0"); !errors.Is(err, ErrDistTagged) {
+		t.Errorf("DeleteVersion() of latest error = %v, want %v", err, ErrDistTagged)
+	}
+	if err := DeleteVersion(ctx, registry, "packages/scope/left-pad", "1.0.0"); err != nil {
+		t.Fatalf("DeleteVersion() unexpected error: %v", err)
+	}
+
+	tags, err := registry.ListTags(ctx, "packages/scope/left-pad")
+	if err != nil {
+		t.Fatalf("ListTags() unexpected error: %v", err)
+	}
+	if slices.Contains(tags, "1.0.0") || !slices.Contains(tags, "2.0.0") {
+		t.Errorf("ListTags() = %v, want 2.0.0 without 1.0.0", tags)
+	}
+}
+
+func TestVersionFromTarball(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name     string
+		pkg      string
+		filename string
+		want     string
+	}{
+		{name: "unscoped", pkg: "left-pad", filename: "left-pad-1.0.0.tgz", want: "1.0.0"},
+		{name: "scoped", pkg: "@scope/left-pad", filename: "left-pad-1.0.0-rc.1.tgz", want: "1.0.0-rc.1"},
+		{name: "scoped with scope in file name", pkg: "@scope/left-pad", filename: "@scope/left-pad-1.0.0.tgz", want: "1.0.0"},
+		{name: "other package", pkg: "left-pad", filename: "right-pad-1.0.0.tgz", want: ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := versionFromTarball(tc.pkg, tc.filename); got != tc.want {
+				t.Errorf("versionFromTarball(%q, %q) = %q, want %q", tc.pkg, tc.filename, got, tc.want)
+			}
+		})
+	}
+}
+
+// remoteRegistry fails like a remote registry does for a missing repository,
+// with a 404 error response instead of errdef.ErrNotFound.
+type remoteRegistry struct {
+	*oci.FakeRegistry
+}
+
+func (r *remoteRegistry) ListTags(ctx context.Context, repo string) ([]string, error) {
+	tags, err := r.FakeRegistry.ListTags(ctx, repo)
+	if err == nil && len(tags) == 0 {
+		return nil, &errcode.ErrorResponse{StatusCode: http.StatusNotFound}
+	}
+	return tags, err //nolint:wrapcheck // Want passthrough error.
+}
+
+func TestUpstream(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name          string
+		privateScopes []string
+		withLocal     bool
+		remote        bool
+		path          string
+		wantStatus    int
+		wantJSON      string
+		wantBody      string
+		wantCached    string
+		wantNotCached string
+	}{
+		{
+			name:       "packument merges local and upstream",
+			withLocal:  true,
+			path:       "/@scope/left-pad",
+			wantStatus: http.StatusOK,
+			wantJSON: `{
+				"_id": "@scope/left-pad",
+				"name": "@scope/left-pad",
+				"dist-tags": {"latest": "1.0.0", "next": "2.0.0"},
+				"time": {
+					"created": "2020-01-01T00:00:00.000Z",
+					"modified": "2025-01-02T03:04:05.000Z",
+					"1.0.0": "2025-01-02T03:04:05.000Z",
+					"2.0.0": "2021-01-01T00:00:00.000Z"
+				},
+				"versions": {
+					"1.0.0": {
+						"name": "@scope/left-pad", "version": "1.0.0", "bin": {"cli": "bin/cli.js"},
+						"dist": {"shasum": "` + sha1Hex("local") + `", "tarball": "http://example.com/@scope/left-pad/-/left-pad-1.0.0.tgz"}
+					},
+					"2.0.0": {
+						"name": "@scope/left-pad", "version": "2.0.0",
+						"dist": {"tarball": "http://example.com/@scope/left-pad/-/left-pad-2.0.0.tgz"}
+					}
+				}
+			}`,
+		},
+		{
+			name:       "upstream only package",
+			path:       "/@scope/left-pad/latest",
+			wantStatus: http.StatusOK,
+			wantJSON: `{
+				"name": "@scope/left-pad", "version": "2.0.0",
+				"dist": {"tarball": "http://example.com/@scope/left-pad/-/left-pad-2.0.0.tgz"}
+			}`,
+		},
+		{
+			name:       "upstream only package on remote registry",
+			remote:     true,
+			path:       "/@scope/left-pad/latest",
+			wantStatus: http.StatusOK,
+			wantJSON: `{
+				"name": "@scope/left-pad", "version": "2.0.0",
+				"dist": {"tarball": "http://example.com/@scope/left-pad/-/left-pad-2.0.0.tgz"}
+			}`,
+		},
+		{
+			name:       "unknown package",
+			path:       "/right-pad",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "download caches upstream tarball",
+			path:       "/@scope/left-pad/-/left-pad-2.0.0.tgz",
+			wantStatus: http.StatusOK,
+			wantBody:   "upstream tarball",
+			wantCached: "upstream/scope/left-pad/2.0.0/left-pad-2.0.0.tgz",
+		},
+		{
+			name:       "upstream tarball matches dist",
+			path:       "/up-pad/-/up-pad-1.0.0.tgz",
+			wantStatus: http.StatusOK,
+			wantBody:   "up tarball",
+			wantCached: "upstream/up-pad/1.0.0/up-pad-1.0.0.tgz",
+		},
+		{
+			name:          "upstream tarball integrity mismatch is not cached",
+			path:          "/up-pad/-/up-pad-2.0.0.tgz",
+			wantStatus:    http.StatusOK,
+			wantBody:      "corrupt tarball",
+			wantNotCached: "upstream/up-pad/2.0.0/up-pad-2.0.0.tgz",
+		},
+		{
+			name:          "upstream tarball shasum mismatch is not cached",
+			path:          "/up-pad/-/up-pad-3.0.0.tgz",
+			wantStatus:    http.StatusOK,
+			wantBody:      "corrupt tarball",
+			wantNotCached: "upstream/up-pad/3.0.0/up-pad-3.0.0.tgz",
+		},
+		{
+			name:          "private scope never goes upstream",
+			privateScopes: []string{"scope"},
+			withLocal:     true,
+			path:          "/@scope/left-pad/2.0.0",
+			wantStatus:    http.StatusNotFound,
+		},
+		{
+			name:          "private scope tarball",
+			privateScopes: []string{"@scope"},
+			path:          "/@scope/left-pad/-/left-pad-2.0.0.tgz",
+			wantStatus:    http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var srv *httptest.Server
+			srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/@scope/left-pad":
+					fmt.Fprintf(w, `{
+						"name": "@scope/left-pad",
+						"dist-tags": {"latest": "2.0.0", "next": "2.0.0"},
+						"time": {
+							"created": "2020-01-01T00:00:00.000Z",
+							"modified": "2021-01-01T00:00:00.000Z",
+							"1.0.0": "2020-01-01T00:00:00.000Z",
+							"2.0.0": "2021-01-01T00:00:00.000Z"
+						},
+						"versions": {
+							"1.0.0": {"name": "@scope/left-pad", "version": "1.0.0", "dist": {"tarball": "%[1]s/files/left-pad-1.0.0.tgz"}},
+							"2.0.0": {"name": "@scope/left-pad", "version": "2.0.0", "dist": {"tarball": "%[1]s/files/left-pad-2.0.0.tgz"}}
+						}
+					}`, srv.URL)
+				case "/up-pad":
+					fmt.Fprintf(w, `{
+						"name": "up-pad",
+						"dist-tags": {"latest": "1.0.0"},
+						"versions": {
+							"1.0.0": {"name": "up-pad", "version": "1.0.0", "dist": {"tarball": "%[1]s/files/up-pad-1.0.0.tgz", "shasum": %[2]q, "integrity": %[3]q}},
+							"2.0.0": {"name": "up-pad", "version": "2.0.0", "dist": {"tarball": "%[1]s/files/corrupt.tgz", "integrity": %[3]q}},
+							"3.0.0": {"name": "up-pad", "version": "3.0.0", "dist": {"tarball": "%[1]s/files/corrupt.tgz", "shasum": %[2]q}}
+						}
+					}`, srv.URL, sha1Hex("up tarball"), integrity("up tarball"))
+				case "/files/left-pad-2.0.0.tgz":
+					fmt.Fprint(w, "upstream tarball")
+				case "/files/up-pad-1.0.0.tgz":
+					fmt.Fprint(w, "up tarball")
+				case "/files/corrupt.tgz":
+					fmt.Fprint(w, "corrupt tarball")
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			t.Cleanup(srv.Close)
+
+			upstream, err := handler.NewUpstream(srv.URL)
+			if err != nil {
+				t.Fatalf("NewUpstream() unexpected error: %v", err)
+			}
+
+			registry := oci.NewFakeRegistry()
+			var backend handler.Registry = registry
+			if tc.remote {
+				backend = &remoteRegistry{FakeRegistry: registry}
+			}
+			h, err := NewHandler(backend, WithUpstream(upstream, time.Minute), WithPrivateScopes(tc.privateScopes...))
+			if err != nil {
+				t.Fatalf("NewHandler() unexpected error: %v", err)
+			}
+			router := h.Mux()
+
+			if tc.withLocal {
+				resp := httptest.NewRecorder()
+				router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/@scope/left-pad", strings.NewReader(publishBody(t, "@scope/left-pad", "1.0.0", "local", ""))))
+				if resp.Code != http.StatusCreated {
+					t.Fatalf("Failed to publish: %d %s", resp.Code, resp.Body.String())
+				}
+				registry.Created["packages/scope/left-pad/1.0.0/package.json"] = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+			}
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d, body: %s", got, want, resp.Body.String())
+			}
+			if tc.wantJSON != "" {
+				if diff := diffJSON(tc.wantJSON, resp.Body.String()); diff != "" {
+					t.Errorf("Body mismatch (-want, +got):\n%s", diff)
+				}
+			}
+			if tc.wantBody != "" && resp.Body.String() != tc.wantBody {
+				t.Errorf("Body = %q, want %q", resp.Body.String(), tc.wantBody)
+			}
+			if tc.wantCached != "" {
+				if got, ok := registry.Files[tc.wantCached]; !ok || string(got) != tc.wantBody {
+					t.Errorf("Cached file %q = %q, want %q", tc.wantCached, got, tc.wantBody)
+				}
+			}
+			if tc.wantNotCached != "" {
+				if _, ok := registry.Files[tc.wantNotCached]; ok {
+					t.Errorf("File %q is cached in the registry, want not cached", tc.wantNotCached)
+				}
+			}
+		})
+	}
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s)) //nolint:gosec // npm shasums are sha1.
+	return hex.EncodeToString(sum[:])
+}
+
+func diffJSON(want, got string) string {
+	var w, g any
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		return fmt.Sprintf("invalid want JSON: %v", err)
+	}
+	if err := json.Unmarshal([]byte(got), &g); err != nil {
+		return fmt.Sprintf("invalid got JSON %q: %v", got, err)
+	}
+	return cmp.Diff(w, g)
+}
+
+func TestPackageVersion(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		repo        string
+		tag         string
+		wantPackage string
+		wantVersion string
+		wantOK      bool
+	}{
+		{name: "unscoped", repo: "packages/foo", tag: "1.0.0", wantPackage: "foo", wantVersion: "1.0.0", wantOK: true},
+		{name: "scoped", repo: "packages/scope/foo", tag: "1.0.0", wantPackage: "@scope/foo", wantVersion: "1.0.0", wantOK: true},
+		{name: "build metadata", repo: "packages/foo", tag: "1.0.0_build.1", wantPackage: "foo", wantVersion: "1.0.0+build.1", wantOK: true},
+		{name: "dist tags", repo: "packages/foo", tag: "dist-tags"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			pkg, version, ok := PackageVersion(tc.repo, tc.tag)
+			if pkg != tc.wantPackage || version != tc.wantVersion || ok != tc.wantOK {
+				t.Errorf("PackageVersion(%q, %q) = (%q, %q, %t), want (%q, %q, %t)",
+					tc.repo, tc.tag, pkg, version, ok, tc.wantPackage, tc.wantVersion, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	t.Parallel()
+
+	registry := oci.NewFakeRegistry()
+	if _, err := registry.AddFile(context.Background(), &oci.RepoFile{OwningRepo: "packages/scope/left-pad", OwningTag: "1.0.0", Name: "left-pad-1.0.0.tgz"}, strings.NewReader("content")); err != nil {
+		t.Fatalf("Failed to set up file: %v", err)
+	}
+	h, err := NewHandler(registry)
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+	router := h.Mux()
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/@scope/left-pad/1.0.0/-/referrers"+"?artifactType=application/vnd.dev.sigstore.bundle.v0.3%2Bjson", strings.NewReader("bundle")))
+	if got, want := resp.Code, http.StatusCreated; got != want {
+		t.Fatalf("Add status code = %d, want %d, body: %s", got, want, resp.Body.String())
+	}
+	var desc ocispec.Descriptor
+	if err := json.Unmarshal(resp.Body.Bytes(), &desc); err != nil {
+		t.Fatalf("Failed to decode descriptor: %v", err)
+	}
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/@scope/left-pad/1.0.0/-/referrers", nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("List status code = %d, want %d", got, want)
+	}
+	if !strings.Contains(resp.Body.String(), desc.Digest.String()) {
+		t.Errorf("List body = %s, want the referrer %s", resp.Body.String(), desc.Digest)
+	}
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/@scope/left-pad/1.0.0/-/referrers"+"/"+desc.Digest.String(), nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("Read status code = %d, want %d", got, want)
+	}
+	if got, want := resp.Body.String(), "bundle"; got != want {
+		t.Errorf("Read body = %q, want %q", got, want)
+	}
+}
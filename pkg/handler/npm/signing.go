@@ -0,0 +1,295 @@
+package npm
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/gorilla/mux"
+	"github.com/yolocs/ocifactory/pkg/handler"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"github.com/yolocs/ocifactory/pkg/verify"
+	"oras.land/oras-go/v2/errdef"
+)
+
+const (
+	// keysPath serves the public keys of the registry signatures, see
+	// https://docs.npmjs.com/about-registry-signatures.
+	keysPath = "/-/npm/v1/keys"
+
+	// attestationsPath serves the provenance of a version, see
+	// https://docs.npmjs.com/generating-provenance-statements.
+	attestationsPath = "/-/npm/v1/attestations"
+
+	// keyScheme is the only signature scheme of npm registry keys.
+	keyScheme = "ecdsa-sha2-nistp256"
+
+	// dsseInTotoType is the payload type of the DSSE envelope of provenance.
+	dsseInTotoType = "application/vnd.in-toto+json"
+
+	// upstreamKeysCacheKey caches the upstream keys with the packuments. It
+	// can't collide with a package name.
+	upstreamKeysCacheKey = "-/npm/v1/keys"
+)
+
+// Signer signs the integrity of the versions served by the registry like
+// registry.npmjs.org does, so "npm audit signatures" can verify them.
+type Signer struct {
+	key   *ecdsa.PrivateKey
+	keyID string
+	pub   string
+}
+
+// NewSigner creates a Signer with the ECDSA P-256 key.
+func NewSigner(key *ecdsa.PrivateKey) (*Signer, error) {
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("signing key must be ECDSA P-256 for %s", keyScheme)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return &Signer{
+		key:   key,
+		keyID: "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]),
+		pub:   base64.StdEncoding.EncodeToString(der),
+	}, nil
+}
+
+// LoadSigner reads the PEM encoded ECDSA P-256 private key at path, in SEC 1
+// or PKCS #8 form.
+func LoadSigner(path string) (*Signer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s: no PEM block found", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", path, err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s: unsupported key type %T", path, key)
+	}
+	return NewSigner(ecKey)
+}
+
+// Sign signs "name@version:integrity", the message npm verifies.
+func (s *Signer) Sign(name, version, integrity string) (*Signature, error) {
+	sum := sha256.Sum256([]byte(name + "@" + version + ":" + integrity))
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, sum[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign %s@%s: %w", name, version, err)
+	}
+	return &Signature{KeyID: s.keyID, Sig: base64.StdEncoding.EncodeToString(sig)}, nil
+}
+
+// Key returns the public key of the signer as served by the keys endpoint.
+func (s *Signer) Key() *RegistryKey {
+	return &RegistryKey{KeyID: s.keyID, KeyType: keyScheme, Scheme: keyScheme, Key: s.pub}
+}
+
+// handleKeys serves the public keys of the registry signatures. With an
+// upstream, its keys are served too so the signatures of the upstream
+// versions still verify. Not found if there is no key at all, which tells npm
+// the registry doesn't sign.
+func (h *Handler) handleKeys(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	resp := &KeysResponse{Keys: []*RegistryKey{}}
+	if h.signer != nil {
+		resp.Keys = append(resp.Keys, h.signer.Key())
+	}
+	if h.upstream != nil {
+		keys, err := h.upstreamKeys(ctx)
+		if err != nil && !errors.Is(err, errdef.ErrNotFound) {
+			// Still serve the local key if the upstream is flaky.
+			logging.FromContext(ctx).WarnContext(ctx, "failed to fetch upstream keys", "error", err)
+		}
+		for _, k := range keys {
+			if h.signer == nil || k.KeyID != h.signer.keyID {
+				resp.Keys = append(resp.Keys, k)
+			}
+		}
+	}
+	if len(resp.Keys) == 0 {
+		handler.JSONError(w, "registry signatures are not enabled", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, req, http.StatusOK, resp)
+}
+
+// upstreamKeys returns the keys of the upstream registry. They are cached like
+// the packuments.
+func (h *Handler) upstreamKeys(ctx context.Context) ([]*RegistryKey, error) {
+	b, err := h.packumentCache.WriteThruLookup(upstreamKeysCacheKey, func() ([]byte, error) {
+		resp, err := h.upstream.Get(ctx, http.MethodGet, keysPath)
+		if err != nil {
+			return nil, err //nolint:wrapcheck // Want passthrough error.
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxPackumentSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream keys: %w", err)
+		}
+		return b, nil
+	})
+	if err != nil {
+		return nil, err //nolint:wrapcheck // Want passthrough error.
+	}
+
+	var keys KeysResponse
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse upstream keys: %w", err)
+	}
+	return keys.Keys, nil
+}
+
+// handleAttestations serves the provenance published with a local version.
+// Upstream versions link to the attestations of the upstream.
+func (h *Handler) handleAttestations(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	name, version := vars["package"], vars["version"]
+
+	bundle, err := readJSON(req.Context(), h.registry, &oci.RepoFile{
+		OwningRepo: packageRepo(name),
+		OwningTag:  versionTag(version),
+		Name:       provenanceName(name, version),
+	})
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	predicateType, err := provenancePredicateType(bundle)
+	if err != nil {
+		writeError(w, req, fmt.Errorf("invalid provenance of %s@%s: %w", name, version, err))
+		return
+	}
+	writeJSON(w, req, http.StatusOK, &AttestationsResponse{
+		Attestations: []*Attestation{{PredicateType: predicateType, Bundle: bundle}},
+	})
+}
+
+// provenanceName returns the name of the provenance file stored next to the
+// tarball, e.g. "pkg-1.0.0.sigstore". It's the attachment name npm uses
+// without the scope.
+func provenanceName(name, version string) string {
+	return strings.TrimSuffix(tarballName(name, version), ".tgz") + ".sigstore"
+}
+
+// publishedProvenance returns the provenance bundle "npm publish --provenance"
+// attached for the version, or nil if there is none. The bundle must attest
+// to the tarball. Its Sigstore signature is verified by the clients, not
+// here. Also returns the media type of the bundle and its predicate type.
+func publishedProvenance(doc *Packument, version string, tarball []byte) ([]byte, string, string, error) {
+	att, ok := doc.Attachments[doc.Name+"-"+version+".sigstore"]
+	if !ok {
+		return nil, "", "", nil
+	}
+	// npm attaches the bundle as JSON, not base64 like the tarball.
+	bundle := []byte(att.Data)
+	if !strings.HasPrefix(strings.TrimSpace(att.Data), "{") {
+		b, err := base64.StdEncoding.DecodeString(att.Data)
+		if err != nil {
+			return nil, "", "", fmt.Errorf("invalid provenance for version %q: %w", version, err)
+		}
+		bundle = b
+	}
+
+	stmt, err := parseProvenance(bundle)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("invalid provenance for version %q: %w", version, err)
+	}
+	sum := sha512.Sum512(tarball)
+	attested := false
+	for _, s := range stmt.Subject {
+		if strings.EqualFold(s.Digest["sha512"], hex.EncodeToString(sum[:])) {
+			attested = true
+		}
+	}
+	if !attested {
+		return nil, "", "", fmt.Errorf("provenance for version %q doesn't attest to the tarball", version)
+	}
+
+	mediaType := att.ContentType
+	if !strings.HasPrefix(mediaType, verify.BundleTypePrefix) {
+		mediaType = verify.BundleTypePrefix + "+json"
+	}
+	return bundle, mediaType, stmt.PredicateType, nil
+}
+
+// provenanceStatement is the part of the in-toto statement of a provenance
+// bundle that is checked.
+type provenanceStatement struct {
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string `json:"predicateType"`
+}
+
+// parseProvenance returns the in-toto statement in the DSSE envelope of the
+// Sigstore bundle.
+func parseProvenance(bundle []byte) (*provenanceStatement, error) {
+	var b struct {
+		MediaType    string `json:"mediaType"`
+		DSSEEnvelope *struct {
+			Payload     []byte `json:"payload"`
+			PayloadType string `json:"payloadType"`
+		} `json:"dsseEnvelope"`
+	}
+	if err := json.Unmarshal(bundle, &b); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle: %w", err)
+	}
+	if !strings.HasPrefix(b.MediaType, verify.BundleTypePrefix) {
+		return nil, fmt.Errorf("unsupported bundle media type %q", b.MediaType)
+	}
+	if b.DSSEEnvelope == nil || b.DSSEEnvelope.PayloadType != dsseInTotoType {
+		return nil, fmt.Errorf("bundle has no in-toto statement")
+	}
+
+	var stmt provenanceStatement
+	if err := json.Unmarshal(b.DSSEEnvelope.Payload, &stmt); err != nil {
+		return nil, fmt.Errorf("failed to parse statement: %w", err)
+	}
+	if stmt.PredicateType == "" {
+		return nil, fmt.Errorf("statement has no predicate type")
+	}
+	return &stmt, nil
+}
+
+// provenancePredicateType returns the predicate type of the stored bundle.
+func provenancePredicateType(bundle []byte) (string, error) {
+	stmt, err := parseProvenance(bundle)
+	if err != nil {
+		return "", err
+	}
+	return stmt.PredicateType, nil
+}
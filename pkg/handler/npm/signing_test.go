@@ -0,0 +1,462 @@
+package npm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/yolocs/ocifactory/pkg/handler"
+	"github.com/yolocs/ocifactory/pkg/oci"
+)
+
+func newTestSigner(t *testing.T) *Signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	s, err := NewSigner(key)
+	if err != nil {
+		t.Fatalf("NewSigner() error = %v", err)
+	}
+	return s
+}
+
+// integrity returns the integrity string npm sends for the tarball.
+func integrity(tarball string) string {
+	sum := sha512.Sum512([]byte(tarball))
+	return "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// provenanceBundle returns a Sigstore bundle like "npm publish --provenance"
+// attaches. The signature is not real, it's not verified.
+func provenanceBundle(t *testing.T, name, version, tarball string) string {
+	t.Helper()
+	sum := sha512.Sum512([]byte(tarball))
+	stmt, err := json.Marshal(map[string]any{
+		"_type": "https://in-toto.io/Statement/v1",
+		"subject": []any{map[string]any{
+			"name":   "pkg:npm/" + strings.ReplaceAll(name, "@", "%40") + "@" + version,
+			"digest": map[string]string{"sha512": hex.EncodeToString(sum[:])},
+		}},
+		"predicateType": "https://slsa.dev/provenance/v1",
+	})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	b, err := json.Marshal(map[string]any{
+		"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+		"dsseEnvelope": map[string]any{
+			"payload":     stmt,
+			"payloadType": dsseInTotoType,
+			"signatures":  []any{map[string]string{"sig": "c2ln"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return string(b)
+}
+
+// withIntegrity adds the integrity to the version in the publish body. The
+// provenance bundle is attached if it's not empty.
+func withIntegrity(t *testing.T, body, name, version, integrity, bundle string) string {
+	t.Helper()
+	var doc map[string]any
+	if err := json.Unmarshal([]byte(body), &doc); err != nil {
+		t.Fatal(err)
+	}
+	v := doc["versions"].(map[string]any)[version].(map[string]any)
+	v["dist"].(map[string]any)["integrity"] = integrity
+	// Clients must not be able to set these.
+	v["dist"].(map[string]any)["signatures"] = []any{map[string]string{"keyid": "fake", "sig": "fake"}}
+	if bundle != "" {
+		doc["_attachments"].(map[string]any)[name+"-"+version+".sigstore"] = map[string]any{
+			"content_type": "application/vnd.dev.sigstore.bundle.v0.3+json",
+			"data":         bundle,
+			"length":       len(bundle),
+		}
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// verifyNpmSignature verifies the signature like npm does with the key served
+// by the keys endpoint.
+func verifyNpmSignature(t *testing.T, key *RegistryKey, sig *Signature, name, version, integrity string) bool {
+	t.Helper()
+	der, err := base64.StdEncoding.DecodeString(key.Key)
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		t.Fatalf("ParsePKIXPublicKey() error = %v", err)
+	}
+	b, err := base64.StdEncoding.DecodeString(sig.Sig)
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	sum := sha256.Sum256([]byte(name + "@" + version + ":" + integrity))
+	return sig.KeyID == key.KeyID && ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), sum[:], b)
+}
+
+func TestSignatures(t *testing.T) {
+	t.Parallel()
+
+	const name, version = "@scope/left-pad", "1.0.0"
+	body := withIntegrity(t, publishBody(t, name, version, "tarball", ""), name, version, integrity("tarball"), "")
+
+	cases := []struct {
+		name           string
+		signer         *Signer
+		wantKeysStatus int
+	}{
+		{
+			name:           "signed",
+			signer:         newTestSigner(t),
+			wantKeysStatus: http.StatusOK,
+		},
+		{
+			name:           "not signed",
+			wantKeysStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			var opts []Option
+			if tc.signer != nil {
+				opts = append(opts, WithSigner(tc.signer))
+			}
+			h, err := NewHandler(oci.NewFakeRegistry(), opts...)
+			if err != nil {
+				t.Fatalf("NewHandler() unexpected error: %v", err)
+			}
+			router := h.Mux()
+
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/"+name, strings.NewReader(body)))
+			if resp.Code != http.StatusCreated {
+				t.Fatalf("Failed to publish: %d %s", resp.Code, resp.Body.String())
+			}
+
+			resp = httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/"+name+"/"+version, nil))
+			var v VersionInfo
+			if err := json.Unmarshal(resp.Body.Bytes(), &v); err != nil {
+				t.Fatalf("Failed to decode version %s: %v", resp.Body.String(), err)
+			}
+
+			resp = httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, keysPath, nil))
+			if got, want := resp.Code, tc.wantKeysStatus; got != want {
+				t.Fatalf("Keys status code = %d, want %d, body: %s", got, want, resp.Body.String())
+			}
+
+			if tc.signer == nil {
+				if len(v.Dist.Signatures) != 0 {
+					t.Errorf("Signatures = %v, want none", v.Dist.Signatures)
+				}
+				return
+			}
+			var keys KeysResponse
+			if err := json.Unmarshal(resp.Body.Bytes(), &keys); err != nil {
+				t.Fatalf("Failed to decode keys %s: %v", resp.Body.String(), err)
+			}
+			if len(keys.Keys) != 1 || keys.Keys[0].Scheme != keyScheme || keys.Keys[0].Expires != nil {
+				t.Fatalf("Keys = %s, want the key of the signer", resp.Body.String())
+			}
+			if len(v.Dist.Signatures) != 1 {
+				t.Fatalf("Signatures = %v, want one", v.Dist.Signatures)
+			}
+			if !verifyNpmSignature(t, keys.Keys[0], &v.Dist.Signatures[0], name, version, integrity("tarball")) {
+				t.Errorf("Signature %v doesn't verify", v.Dist.Signatures[0])
+			}
+		})
+	}
+}
+
+func TestUpstreamKeys(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != keysPath {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"keys":[{"expires":null,"keyid":"SHA256:upstream","keytype":"ecdsa-sha2-nistp256","scheme":"ecdsa-sha2-nistp256","key":"dXBzdHJlYW0="}]}`)
+	}))
+	t.Cleanup(srv.Close)
+	upstream, err := handler.NewUpstream(srv.URL)
+	if err != nil {
+		t.Fatalf("NewUpstream() unexpected error: %v", err)
+	}
+
+	s := newTestSigner(t)
+	h, err := NewHandler(oci.NewFakeRegistry(), WithUpstream(upstream, time.Minute), WithSigner(s))
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+	resp := httptest.NewRecorder()
+	h.Mux().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, keysPath, nil))
+
+	want := `{"keys":[
+		{"expires":null,"keyid":"` + s.keyID + `","keytype":"ecdsa-sha2-nistp256","scheme":"ecdsa-sha2-nistp256","key":"` + s.pub + `"},
+		{"expires":null,"keyid":"SHA256:upstream","keytype":"ecdsa-sha2-nistp256","scheme":"ecdsa-sha2-nistp256","key":"dXBzdHJlYW0="}
+	]}`
+	if diff := diffJSON(want, resp.Body.String()); diff != "" {
+		t.Errorf("Keys mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	t.Parallel()
+
+	const name, version = "@scope/left-pad", "1.0.0"
+
+	cases := []struct {
+		name           string
+		bundle         string
+		wantStatus     int
+		wantProvenance bool
+	}{
+		{
+			name:           "provenance",
+			bundle:         provenanceBundle(t, name, version, "tarball"),
+			wantStatus:     http.StatusCreated,
+			wantProvenance: true,
+		},
+		{
+			name:       "without provenance",
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "provenance of other tarball",
+			bundle:     provenanceBundle(t, name, version, "other tarball"),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "not a bundle",
+			bundle:     `{"mediaType":"application/json"}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := oci.NewFakeRegistry()
+			h, err := NewHandler(registry)
+			if err != nil {
+				t.Fatalf("NewHandler() unexpected error: %v", err)
+			}
+			router := h.Mux()
+
+			body := withIntegrity(t, publishBody(t, name, version, "tarball", ""), name, version, integrity("tarball"), tc.bundle)
+			resp := httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/"+name, strings.NewReader(body)))
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Fatalf("Status code = %d, want %d, body: %s", got, want, resp.Body.String())
+			}
+			if tc.wantStatus != http.StatusCreated {
+				if len(registry.Files) != 0 {
+					t.Errorf("Files unexpectedly added: %v", registry.Files)
+				}
+				return
+			}
+
+			if _, ok := registry.Files["packages/scope/left-pad/1.0.0/left-pad-1.0.0.sigstore"]; ok != tc.wantProvenance {
+				t.Errorf("Provenance stored = %t, want %t", ok, tc.wantProvenance)
+			}
+
+			resp = httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/"+name+"/"+version, nil))
+			var v VersionInfo
+			if err := json.Unmarshal(resp.Body.Bytes(), &v); err != nil {
+				t.Fatalf("Failed to decode version %s: %v", resp.Body.String(), err)
+			}
+			if len(v.Dist.Signatures) != 0 {
+				t.Errorf("Signatures = %v, want none from the client", v.Dist.Signatures)
+			}
+
+			attURL := "http://example.com/-/npm/v1/attestations/@scope/left-pad@1.0.0"
+			resp = httptest.NewRecorder()
+			router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, attURL, nil))
+			if !tc.wantProvenance {
+				if v.Dist.Attestations != nil {
+					t.Errorf("Attestations = %v, want none", v.Dist.Attestations)
+				}
+				if got, want := resp.Code, http.StatusNotFound; got != want {
+					t.Errorf("Attestations status code = %d, want %d", got, want)
+				}
+				return
+			}
+
+			wantDist := `{"url":"` + attURL + `","provenance":{"predicateType":"https://slsa.dev/provenance/v1"}}`
+			gotDist, err := json.Marshal(v.Dist.Attestations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := diffJSON(wantDist, string(gotDist)); diff != "" {
+				t.Errorf("Attestations mismatch (-want, +got):\n%s", diff)
+			}
+			wantAtt := `{"attestations":[{"predicateType":"https://slsa.dev/provenance/v1","bundle":` + tc.bundle + `}]}`
+			if diff := diffJSON(wantAtt, resp.Body.String()); diff != "" {
+				t.Errorf("Attestations response mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	t.Parallel()
+
+	sha1Sum := func(s string) string {
+		b, _ := hex.DecodeString(sha1Hex(s))
+		return "sha1-" + base64.StdEncoding.EncodeToString(b)
+	}
+
+	cases := []struct {
+		name      string
+		integrity string
+		wantErr   string
+	}{
+		{
+			name:      "sha512",
+			integrity: integrity("tarball"),
+		},
+		{
+			name:      "several hashes",
+			integrity: sha1Sum("tarball") + " " + integrity("tarball") + "?opt",
+		},
+		{
+			name: "empty",
+		},
+		{
+			name:      "unknown algorithm",
+			integrity: "md5-abc",
+		},
+		{
+			name:      "mismatch",
+			integrity: integrity("other tarball"),
+			wantErr:   "sha512 digest doesn't match",
+		},
+		{
+			name:      "invalid",
+			integrity: "sha512",
+			wantErr:   `invalid integrity "sha512"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := checkIntegrity(tc.integrity, []byte("tarball"))
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Errorf("checkIntegrity() error diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadSigner(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() error = %v", err)
+	}
+	p384, err := x509.MarshalPKCS8PrivateKey(p384Key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	write := func(name, typ string, b []byte) string {
+		p := filepath.Join(dir, name)
+		if typ != "" {
+			b = pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b})
+		}
+		if err := os.WriteFile(p, b, 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		return p
+	}
+
+	cases := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{
+			name: "sec1",
+			path: write("sec1.pem", "EC PRIVATE KEY", sec1),
+		},
+		{
+			name: "pkcs8",
+			path: write("pkcs8.pem", "PRIVATE KEY", pkcs8),
+		},
+		{
+			name:    "p384",
+			path:    write("p384.pem", "PRIVATE KEY", p384),
+			wantErr: "signing key must be ECDSA P-256",
+		},
+		{
+			name:    "not pem",
+			path:    write("garbage.pem", "", []byte("garbage")),
+			wantErr: "no PEM block found",
+		},
+		{
+			name:    "missing file",
+			path:    filepath.Join(dir, "missing.pem"),
+			wantErr: "failed to read signing key",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := LoadSigner(tc.path)
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Errorf("LoadSigner() error diff: %s", diff)
+			}
+		})
+	}
+}
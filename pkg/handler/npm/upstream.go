@@ -0,0 +1,208 @@
+package npm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/handler"
+	"github.com/yolocs/ocifactory/pkg/oci"
+)
+
+const (
+	defaultPackumentTTL = 5 * time.Minute
+	maxPackumentSize    = 128 << 20
+)
+
+// upstreamRepo returns the repository that caches tarballs fetched from the
+// upstream. It's separate from the published packages so cached tarballs
+// never show up as local versions.
+func upstreamRepo(name string) string {
+	return "upstream/" + strings.TrimPrefix(name, "@")
+}
+
+// useUpstream returns true if the upstream may be consulted for the package.
+// Packages in private scopes never go to the upstream.
+func (h *Handler) useUpstream(name string) bool {
+	if h.upstream == nil {
+		return false
+	}
+	scope, _, ok := strings.Cut(name, "/")
+	return !ok || !h.privateScopes[scope]
+}
+
+// upstreamPackument returns the package document from the upstream. A new
+// copy is returned every time so callers are free to modify it.
+func (h *Handler) upstreamPackument(ctx context.Context, name string) (*Packument, error) {
+	b, err := h.packumentCache.WriteThruLookup(name, func() ([]byte, error) {
+		resp, err := h.upstream.Do(ctx, http.MethodGet, h.upstream.URL(name).String(), http.Header{"Accept": []string{"application/json"}})
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		b, err := io.ReadAll(io.LimitReader(resp.Body, maxPackumentSize))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream packument: %w", err)
+		}
+		return b, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var p Packument
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse upstream packument: %w", err)
+	}
+	return &p, nil
+}
+
+// mergePackuments adds the upstream versions and dist tags that don't exist
+// locally. Local versions and dist tags win. The local packument could be nil.
+func mergePackuments(local, up *Packument) *Packument {
+	if local == nil {
+		local = &Packument{Name: up.Name}
+	}
+	if local.DistTags == nil {
+		local.DistTags = make(map[string]string)
+	}
+	if local.Versions == nil {
+		local.Versions = make(map[string]json.RawMessage)
+	}
+	for v, raw := range up.Versions {
+		if _, ok := local.Versions[v]; !ok {
+			local.Versions[v] = raw
+		}
+	}
+	for t, v := range up.DistTags {
+		if _, ok := local.DistTags[t]; !ok {
+			local.DistTags[t] = v
+		}
+	}
+	mergeTimes(local, up)
+	return local
+}
+
+// mergeTimes adds the publish times of the upstream versions that don't exist
+// locally, and widens the created and modified times of the package to cover
+// both.
+func mergeTimes(local, up *Packument) {
+	if len(up.Time) == 0 {
+		return
+	}
+	if local.Time == nil {
+		local.Time = make(map[string]string)
+	}
+	for v, t := range up.Time {
+		if _, ok := up.Versions[v]; ok {
+			if _, ok := local.Time[v]; !ok {
+				local.Time[v] = t
+			}
+		}
+	}
+	for key, later := range map[string]bool{"created": false, "modified": true} {
+		upT, err := time.Parse(time.RFC3339, up.Time[key])
+		if err != nil {
+			continue
+		}
+		localT, err := time.Parse(time.RFC3339, local.Time[key])
+		if err != nil || upT.After(localT) == later {
+			local.Time[key] = up.Time[key]
+		}
+	}
+}
+
+// handleUpstreamTarball serves a tarball missing in the backend from the
+// upstream cache, or downloads it from the upstream and caches it on the way.
+func (h *Handler) handleUpstreamTarball(w http.ResponseWriter, req *http.Request, name, version string, f *oci.RepoFile) {
+	ctx := req.Context()
+	logger := logging.FromContext(ctx)
+
+	cached := *f
+	cached.OwningRepo = upstreamRepo(name)
+	desc, r, err := h.registry.ReadFile(ctx, &cached)
+	if err == nil {
+		handler.ServeFile(w, req, &cached, desc, r)
+		return
+	}
+	if !handler.IsNotFound(err) {
+		writeError(w, req, err)
+		return
+	}
+
+	p, err := h.upstreamPackument(ctx, name)
+	if err != nil {
+		handler.WriteUpstreamError(w, req, err, handler.JSONError)
+		return
+	}
+	raw, ok := p.Versions[version]
+	if !ok {
+		handler.JSONError(w, fmt.Sprintf("version %q of package %q not found", version, name), http.StatusNotFound)
+		return
+	}
+	var v VersionInfo
+	if err := json.Unmarshal(raw, &v); err != nil || v.Dist.Tarball == "" {
+		logger.WarnContext(ctx, "upstream version has no tarball", "package", name, "version", version, "error", err)
+		handler.JSONError(w, "failed to fetch from upstream", http.StatusBadGateway)
+		return
+	}
+
+	// Keep downloading and persisting even if the client goes away so the
+	// next request is served from the backend.
+	dlCtx, cancel := handler.DetachedContext(ctx)
+	defer cancel()
+	resp, err := h.upstream.Do(dlCtx, req.Method, v.Dist.Tarball, nil)
+	if err != nil {
+		handler.WriteUpstreamError(w, req, err, handler.JSONError)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", f.MediaType)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	}
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	copyErr, persistErr := handler.CopyAndPersist(w, resp.Body, func(r io.Reader) error {
+		r = &verifiedReader{r: r, c: newIntegrityChecker(v.Dist.Integrity, v.Dist.Shasum)}
+		desc, err := h.registry.AddFile(handler.WithUpstreamCache(dlCtx), &cached, r)
+		if err == nil {
+			logger.DebugContext(ctx, "cached upstream file", "descriptor", desc)
+		}
+		return err
+	})
+	if copyErr != nil {
+		logger.ErrorContext(ctx, "failed to copy upstream file", "url", v.Dist.Tarball, "error", copyErr)
+	}
+	if persistErr != nil {
+		logger.ErrorContext(ctx, "failed to cache upstream file", "url", v.Dist.Tarball, "error", persistErr)
+	}
+}
+
+// verifiedReader fails at the end of an upstream tarball that doesn't match
+// its dist, so it's never cached.
+type verifiedReader struct {
+	r io.Reader
+	c *integrityChecker
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.c.Write(p[:n]) //nolint:errcheck // Hashes never fail to write.
+	if errors.Is(err, io.EOF) {
+		if cerr := v.c.check(); cerr != nil {
+			return n, fmt.Errorf("upstream tarball mismatch: %w", cerr)
+		}
+	}
+	return n, err //nolint:wrapcheck // Want passthrough error.
+}
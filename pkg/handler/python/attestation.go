@@ -0,0 +1,132 @@
+package python
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	// provenanceSuffix is appended to the name of a distribution to store its
+	// PEP 740 provenance next to it.
+	provenanceSuffix = ".provenance"
+
+	// provenanceMediaType is the media type of PEP 740 provenance objects.
+	provenanceMediaType = "application/vnd.pypi.integrity.v1+json"
+
+	// maxAttestationsSize limits the attestations form field.
+	maxAttestationsSize = 1 << 20
+
+	// inTotoStatementType is the only statement type PEP 740 allows.
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+
+	// publisherKind identifies the uploaders of this server in provenance
+	// objects. They are not trusted publishers of PyPI.
+	publisherKind = "ocifactory"
+)
+
+// attestation is the part of a PEP 740 attestation object that is checked on
+// upload. The attestation is stored as sent.
+type attestation struct {
+	Version              int             `json:"version"`
+	VerificationMaterial json.RawMessage `json:"verification_material"`
+	Envelope             struct {
+		Statement []byte `json:"statement"`
+		Signature []byte `json:"signature"`
+	} `json:"envelope"`
+}
+
+type statement struct {
+	Type    string `json:"_type"`
+	Subject []struct {
+		Name   string            `json:"name"`
+		Digest map[string]string `json:"digest"`
+	} `json:"subject"`
+	PredicateType string `json:"predicateType"`
+}
+
+type publisher struct {
+	Kind   string            `json:"kind"`
+	Claims map[string]string `json:"claims,omitempty"`
+}
+
+type attestationBundle struct {
+	Publisher    *publisher        `json:"publisher"`
+	Attestations []json.RawMessage `json:"attestations"`
+}
+
+// provenance is the PEP 740 provenance object served from the provenance URL
+// of a distribution.
+type provenance struct {
+	Version            int                  `json:"version"`
+	AttestationBundles []*attestationBundle `json:"attestation_bundles"`
+}
+
+// parseAttestations checks the attestations form field of the upload of a
+// distribution: a JSON array of PEP 740 attestations whose statements all
+// attest to the distribution. Returns the attestations and the hex encoded
+// sha256 digest they attest to. The Sigstore signatures are not verified, that
+// is left to the consumers of the provenance.
+func parseAttestations(b []byte, filename string) ([]json.RawMessage, string, error) {
+	var raws []json.RawMessage
+	if err := json.Unmarshal(b, &raws); err != nil {
+		return nil, "", fmt.Errorf("attestations must be a JSON array: %w", err)
+	}
+	if len(raws) == 0 {
+		return nil, "", fmt.Errorf("attestations must not be empty")
+	}
+
+	var sha256Digest string
+	for i, raw := range raws {
+		var a attestation
+		if err := json.Unmarshal(raw, &a); err != nil {
+			return nil, "", fmt.Errorf("attestation %d is invalid: %w", i, err)
+		}
+		if a.Version != 1 {
+			return nil, "", fmt.Errorf("attestation %d has unsupported version %d", i, a.Version)
+		}
+		if !strings.HasPrefix(strings.TrimSpace(string(a.VerificationMaterial)), "{") {
+			return nil, "", fmt.Errorf("attestation %d has no verification material", i)
+		}
+		if len(a.Envelope.Statement) == 0 || len(a.Envelope.Signature) == 0 {
+			return nil, "", fmt.Errorf("attestation %d has no signed statement", i)
+		}
+
+		var s statement
+		if err := json.Unmarshal(a.Envelope.Statement, &s); err != nil {
+			return nil, "", fmt.Errorf("attestation %d has an invalid statement: %w", i, err)
+		}
+		if s.Type != inTotoStatementType || s.PredicateType == "" {
+			return nil, "", fmt.Errorf("attestation %d is not an in-toto v1 statement", i)
+		}
+		if len(s.Subject) != 1 || s.Subject[0].Name != filename {
+			return nil, "", fmt.Errorf("attestation %d is not for %q", i, filename)
+		}
+		d := strings.ToLower(s.Subject[0].Digest["sha256"])
+		if !sha256RegExp.MatchString(d) {
+			return nil, "", fmt.Errorf("attestation %d has no valid sha256 digest", i)
+		}
+		if sha256Digest != "" && d != sha256Digest {
+			return nil, "", fmt.Errorf("attestation %d is for another digest of %q", i, filename)
+		}
+		sha256Digest = d
+	}
+	return raws, sha256Digest, nil
+}
+
+// newProvenance creates the provenance object of the attestations uploaded by
+// the identity. The identity is empty for anonymous uploads.
+func newProvenance(attestations []json.RawMessage, identity string) ([]byte, error) {
+	pub := &publisher{Kind: publisherKind}
+	if identity != "" {
+		pub.Claims = map[string]string{"identity": identity}
+	}
+	b, err := json.Marshal(&provenance{
+		Version:            1,
+		AttestationBundles: []*attestationBundle{{Publisher: pub, Attestations: attestations}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal provenance: %w", err)
+	}
+	return b, nil
+}
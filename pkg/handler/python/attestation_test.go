@@ -0,0 +1,170 @@
+package python
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/google/go-cmp/cmp"
+)
+
+// testAttestation returns a PEP 740 attestation of the file with the content.
+// The signature is not real, it's not verified.
+func testAttestation(t *testing.T, filename, content string) map[string]any {
+	t.Helper()
+	stmt, err := json.Marshal(map[string]any{
+		"_type": inTotoStatementType,
+		"subject": []any{map[string]any{
+			"name":   filename,
+			"digest": map[string]string{"sha256": fmt.Sprintf("%x", sha256.Sum256([]byte(content)))},
+		}},
+		"predicateType": "https://docs.pypi.org/attestations/publish/v1",
+	})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return map[string]any{
+		"version":               1,
+		"verification_material": map[string]any{"certificate": "cert", "transparency_entries": []any{}},
+		"envelope":              map[string]any{"statement": stmt, "signature": []byte("sig")},
+	}
+}
+
+func testAttestations(t *testing.T, atts ...any) string {
+	t.Helper()
+	b, err := json.Marshal(atts)
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return string(b)
+}
+
+func TestParseAttestations(t *testing.T) {
+	t.Parallel()
+
+	const filename = "foo-1.0.0-py3-none-any.whl"
+	valid := testAttestation(t, filename, "wheel")
+	wrongVersion := testAttestation(t, filename, "wheel")
+	wrongVersion["version"] = 2
+	noMaterial := testAttestation(t, filename, "wheel")
+	delete(noMaterial, "verification_material")
+	unsigned := testAttestation(t, filename, "wheel")
+	unsigned["envelope"] = map[string]any{"statement": []byte("{}")}
+	notInToto := testAttestation(t, filename, "wheel")
+	notInToto["envelope"] = map[string]any{"statement": []byte(`{"_type":"https://in-toto.io/Statement/v0.1"}`), "signature": []byte("sig")}
+
+	cases := []struct {
+		name       string
+		in         string
+		wantDigest string
+		wantCount  int
+		wantErr    string
+	}{
+		{
+			name:       "single attestation",
+			in:         testAttestations(t, valid),
+			wantDigest: fmt.Sprintf("%x", sha256.Sum256([]byte("wheel"))),
+			wantCount:  1,
+		},
+		{
+			name:       "several attestations",
+			in:         testAttestations(t, valid, valid),
+			wantDigest: fmt.Sprintf("%x", sha256.Sum256([]byte("wheel"))),
+			wantCount:  2,
+		},
+		{
+			name:    "not an array",
+			in:      `{"version":1}`,
+			wantErr: "attestations must be a JSON array",
+		},
+		{
+			name:    "empty",
+			in:      `[]`,
+			wantErr: "attestations must not be empty",
+		},
+		{
+			name:    "unsupported version",
+			in:      testAttestations(t, wrongVersion),
+			wantErr: "attestation 0 has unsupported version 2",
+		},
+		{
+			name:    "no verification material",
+			in:      testAttestations(t, noMaterial),
+			wantErr: "attestation 0 has no verification material",
+		},
+		{
+			name:    "no signature",
+			in:      testAttestations(t, unsigned),
+			wantErr: "attestation 0 has no signed statement",
+		},
+		{
+			name:    "not in-toto v1",
+			in:      testAttestations(t, notInToto),
+			wantErr: "attestation 0 is not an in-toto v1 statement",
+		},
+		{
+			name:    "other file",
+			in:      testAttestations(t, testAttestation(t, "foo-1.0.0.tar.gz", "wheel")),
+			wantErr: `attestation 0 is not for "foo-1.0.0-py3-none-any.whl"`,
+		},
+		{
+			name:    "other digests",
+			in:      testAttestations(t, valid, testAttestation(t, filename, "other")),
+			wantErr: `attestation 1 is for another digest of "foo-1.0.0-py3-none-any.whl"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			atts, gotDigest, err := parseAttestations([]byte(tc.in), filename)
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Errorf("parseAttestations() error diff: %s", diff)
+			}
+			if got, want := gotDigest, tc.wantDigest; got != want {
+				t.Errorf("parseAttestations() digest = %q, want %q", got, want)
+			}
+			if got, want := len(atts), tc.wantCount; got != want {
+				t.Errorf("parseAttestations() got %d attestations, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestNewProvenance(t *testing.T) {
+	t.Parallel()
+
+	atts := []json.RawMessage{json.RawMessage(`{"version":1}`)}
+	cases := []struct {
+		name     string
+		identity string
+		want     string
+	}{
+		{
+			name:     "identity",
+			identity: "yolocs/ocifactory",
+			want:     `{"version":1,"attestation_bundles":[{"publisher":{"kind":"ocifactory","claims":{"identity":"yolocs/ocifactory"}},"attestations":[{"version":1}]}]}`,
+		},
+		{
+			name: "anonymous",
+			want: `{"version":1,"attestation_bundles":[{"publisher":{"kind":"ocifactory"},"attestations":[{"version":1}]}]}`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := newProvenance(atts, tc.identity)
+			if err != nil {
+				t.Fatalf("newProvenance() unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); diff != "" {
+				t.Errorf("newProvenance() mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
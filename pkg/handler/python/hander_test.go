@@ -3,13 +3,26 @@ package python
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/yolocs/ocifactory/pkg/auth"
+	"github.com/yolocs/ocifactory/pkg/handler"
 	"github.com/yolocs/ocifactory/pkg/oci"
+	"oras.land/oras-go/v2/registry/remote/errcode"
 )
 
 func TestDetectMediaType(t *testing.T) {
@@ -60,9 +73,11 @@ func TestHandlePut(t *testing.T) {
 	cases := []struct {
 		name       string
 		pkgName    string
+		storedName string // Defaults to pkgName.
 		version    string
 		filename   string
 		content    string
+		sha256     string
 		wantStatus int
 		wantFile   bool
 		wantIndex  bool
@@ -87,6 +102,50 @@ func TestHandlePut(t *testing.T) {
 			wantFile:   true,
 			wantIndex:  true,
 		},
+		{
+			name:       "matching sha256 digest",
+			pkgName:    "example-pkg",
+			version:    "1.0.0",
+			filename:   "example-pkg-1.0.0.whl",
+			content:    "wheel content",
+			sha256:     fmt.Sprintf("%x", sha256.Sum256([]byte("wheel content"))),
+			wantStatus: http.StatusCreated,
+			wantFile:   true,
+			wantIndex:  true,
+		},
+		{
+			name:       "mismatched sha256 digest",
+			pkgName:    "example-pkg",
+			version:    "1.0.0",
+			filename:   "example-pkg-1.0.0.whl",
+			content:    "wheel content",
+			sha256:     fmt.Sprintf("%x", sha256.Sum256([]byte("other content"))),
+			wantStatus: http.StatusBadRequest,
+			wantFile:   false,
+			wantIndex:  false,
+		},
+		{
+			name:       "invalid sha256 digest",
+			pkgName:    "example-pkg",
+			version:    "1.0.0",
+			filename:   "example-pkg-1.0.0.whl",
+			content:    "wheel content",
+			sha256:     "not-a-digest",
+			wantStatus: http.StatusBadRequest,
+			wantFile:   false,
+			wantIndex:  false,
+		},
+		{
+			name:       "stored under normalized name",
+			pkgName:    "Example_Pkg.Internal",
+			storedName: "example-pkg-internal",
+			version:    "1.0.0",
+			filename:   "Example_Pkg.Internal-1.0.0.whl",
+			content:    "wheel content",
+			wantStatus: http.StatusCreated,
+			wantFile:   true,
+			wantIndex:  true,
+		},
 		{
 			name:       "invalid package name",
 			pkgName:    "invalid/pkg",
@@ -148,6 +207,13 @@ func TestHandlePut(t *testing.T) {
 				}
 			}
 
+			// Add sha256 digest field
+			if tc.sha256 != "" {
+				if err := w.WriteField("sha256_digest", tc.sha256); err != nil {
+					t.Fatalf("Failed to write sha256 digest field: %v", err)
+				}
+			}
+
 			// Add content file
 			if tc.filename != "" && tc.content != "" {
 				fw, err := w.CreateFormFile("content", tc.filename)
@@ -175,9 +241,19 @@ func TestHandlePut(t *testing.T) {
 				t.Errorf("Status code = %d, want %d", got, want)
 			}
 
+			storedName := tc.storedName
+			if storedName == "" {
+				storedName = tc.pkgName
+			}
+			if !tc.wantFile {
+				if _, ok := registry.Files["packages/"+storedName+"/"+tc.version+"/"+tc.filename]; ok {
+					t.Errorf("Package file unexpectedly added to registry")
+				}
+			}
+
 			if tc.wantFile {
 				// Verify package file was created
-				key := "packages/" + tc.pkgName + "/" + tc.version + "/" + tc.filename
+				key := "packages/" + storedName + "/" + tc.version + "/" + tc.filename
 				content, ok := registry.Files[key]
 				if !ok {
 					t.Errorf("Package file not found in registry: %s", key)
@@ -188,7 +264,7 @@ func TestHandlePut(t *testing.T) {
 
 			if tc.wantIndex {
 				// Verify index file was created
-				indexKey := "index/" + tc.pkgName + "/" + tc.version
+				indexKey := "index/" + storedName + "/" + tc.version
 				indexContent, ok := registry.Files[indexKey]
 				if !ok {
 					t.Errorf("Index file not found in registry: %s", indexKey)
@@ -200,6 +276,187 @@ func TestHandlePut(t *testing.T) {
 	}
 }
 
+func TestHandlePutAttestations(t *testing.T) {
+	t.Parallel()
+
+	const (
+		filename = "example_pkg-1.0.0-py3-none-any.whl"
+		content  = "wheel content"
+	)
+
+	cases := []struct {
+		name           string
+		attested       bool // The file is already uploaded with attestations.
+		contentName    string
+		attestations   string
+		sha256         string
+		wantStatus     int
+		wantProvenance bool
+	}{
+		{
+			name:           "valid attestations",
+			attestations:   testAttestations(t, testAttestation(t, filename, content)),
+			wantStatus:     http.StatusCreated,
+			wantProvenance: true,
+		},
+		{
+			name:         "attestations of other content",
+			attestations: testAttestations(t, testAttestation(t, filename, "other content")),
+			wantStatus:   http.StatusBadRequest,
+		},
+		{
+			name:         "attestations of other digest",
+			attestations: testAttestations(t, testAttestation(t, filename, content)),
+			sha256:       fmt.Sprintf("%x", sha256.Sum256([]byte("other content"))),
+			wantStatus:   http.StatusBadRequest,
+		},
+		{
+			name:         "invalid attestations",
+			attestations: `[]`,
+			wantStatus:   http.StatusBadRequest,
+		},
+		{
+			name:        "provenance file name",
+			contentName: filename + provenanceSuffix,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:           "replace attested file with attestations",
+			attested:       true,
+			attestations:   testAttestations(t, testAttestation(t, filename, content)),
+			wantStatus:     http.StatusCreated,
+			wantProvenance: true,
+		},
+		{
+			name:           "replace attested file without attestations",
+			attested:       true,
+			wantStatus:     http.StatusConflict,
+			wantProvenance: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := oci.NewFakeRegistry()
+			h, err := NewHandler(registry)
+			if err != nil {
+				t.Fatalf("NewHandler() unexpected error: %v", err)
+			}
+
+			put := func(contentName, attestations, digest string) *httptest.ResponseRecorder {
+				var b bytes.Buffer
+				w := multipart.NewWriter(&b)
+				fields := [][2]string{{"name", "example-pkg"}, {"version", "1.0.0"}}
+				if attestations != "" {
+					fields = append(fields, [2]string{"attestations", attestations})
+				}
+				if digest != "" {
+					fields = append(fields, [2]string{"sha256_digest", digest})
+				}
+				for _, f := range fields {
+					if err := w.WriteField(f[0], f[1]); err != nil {
+						t.Fatalf("Failed to write field %q: %v", f[0], err)
+					}
+				}
+				fw, err := w.CreateFormFile("content", contentName)
+				if err != nil {
+					t.Fatalf("Failed to create form file: %v", err)
+				}
+				if _, err := fw.Write([]byte(content)); err != nil {
+					t.Fatalf("Failed to write content: %v", err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("Failed to close multipart writer: %v", err)
+				}
+
+				req := httptest.NewRequest(http.MethodPut, "/", &b)
+				req.Header.Set("Content-Type", w.FormDataContentType())
+				req = req.WithContext(auth.WithIdentity(req.Context(), &auth.Identity{Subject: "yolocs/ocifactory"}))
+				resp := httptest.NewRecorder()
+				h.Mux().ServeHTTP(resp, req)
+				return resp
+			}
+
+			if tc.attested {
+				if resp := put(filename, testAttestations(t, testAttestation(t, filename, content)), ""); resp.Code != http.StatusCreated {
+					t.Fatalf("Failed to upload attested file: %d %s", resp.Code, resp.Body.String())
+				}
+			}
+			contentName := tc.contentName
+			if contentName == "" {
+				contentName = filename
+			}
+			resp := put(contentName, tc.attestations, tc.sha256)
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d, body: %s", got, want, resp.Body.String())
+			}
+
+			provKey := "packages/example-pkg/1.0.0/" + filename + provenanceSuffix
+			prov, ok := registry.Files[provKey]
+			if ok != tc.wantProvenance {
+				t.Fatalf("Provenance stored = %t, want %t", ok, tc.wantProvenance)
+			}
+			if !tc.wantProvenance {
+				if _, ok := registry.Files["packages/example-pkg/1.0.0/"+contentName]; ok {
+					t.Errorf("Package file unexpectedly added to registry")
+				}
+				return
+			}
+
+			var gotProv provenance
+			if err := json.Unmarshal(prov, &gotProv); err != nil {
+				t.Fatalf("Failed to decode provenance %s: %v", prov, err)
+			}
+			if got, want := len(gotProv.AttestationBundles), 1; got != want {
+				t.Fatalf("Provenance has %d attestation bundles, want %d", got, want)
+			}
+			wantPub := &publisher{Kind: publisherKind, Claims: map[string]string{"identity": "yolocs/ocifactory"}}
+			if diff := cmp.Diff(wantPub, gotProv.AttestationBundles[0].Publisher); diff != "" {
+				t.Errorf("Provenance publisher mismatch (-want, +got):\n%s", diff)
+			}
+
+			// The provenance is linked from the index instead of listed.
+			wantURL := "/packages/example-pkg/1.0.0/" + filename + provenanceSuffix
+			htmlResp := httptest.NewRecorder()
+			h.Mux().ServeHTTP(htmlResp, httptest.NewRequest(http.MethodGet, "/simple/example-pkg/", nil))
+			html := htmlResp.Body.String()
+			if want := `data-provenance="` + wantURL + `"`; !strings.Contains(html, want) {
+				t.Errorf("Index does not contain %q, got: %s", want, html)
+			}
+			if strings.Contains(html, ">"+filename+provenanceSuffix+"<") {
+				t.Errorf("Index lists the provenance file, got: %s", html)
+			}
+
+			jsonReq := httptest.NewRequest(http.MethodGet, "/simple/example-pkg/", nil)
+			jsonReq.Header.Set("Accept", simpleJSONType)
+			jsonResp := httptest.NewRecorder()
+			h.Mux().ServeHTTP(jsonResp, jsonReq)
+			var page simplePage
+			if err := json.Unmarshal(jsonResp.Body.Bytes(), &page); err != nil {
+				t.Fatalf("Failed to decode response %s: %v", jsonResp.Body.String(), err)
+			}
+			if got, want := len(page.Files), 1; got != want {
+				t.Fatalf("Project page has %d files, want %d", got, want)
+			}
+			if got := page.Files[0].Provenance; got == nil || *got != wantURL {
+				t.Errorf("Provenance URL = %v, want %q", got, wantURL)
+			}
+
+			provResp := httptest.NewRecorder()
+			h.Mux().ServeHTTP(provResp, httptest.NewRequest(http.MethodGet, wantURL, nil))
+			if got, want := provResp.Code, http.StatusOK; got != want {
+				t.Errorf("Provenance status code = %d, want %d", got, want)
+			}
+			if got, want := provResp.Header().Get("Content-Type"), provenanceMediaType; got != want {
+				t.Errorf("Provenance Content-Type = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
 func TestHandleGet(t *testing.T) {
 	t.Parallel()
 
@@ -382,3 +639,620 @@ func TestHandleSimpleIndex(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleIndexMounted(t *testing.T) {
+	t.Parallel()
+
+	registry := oci.NewFakeRegistry()
+	registry.Tags["index"] = []string{"example-pkg"}
+	if _, err := registry.AddFile(context.Background(), &oci.RepoFile{
+		OwningRepo: "packages/example-pkg",
+		OwningTag:  "1.0.0",
+		Name:       "example-pkg-1.0.0.whl",
+	}, strings.NewReader("wheel content")); err != nil {
+		t.Fatalf("Failed to set up file: %v", err)
+	}
+
+	h, err := NewHandler(registry)
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+	mounted := handler.Mount("/pypi/", h.Mux())
+
+	cases := []struct {
+		name         string
+		path         string
+		wantContains string
+	}{
+		{
+			name:         "simple index",
+			path:         "/pypi/simple/",
+			wantContains: `href="/pypi/simple/example-pkg/"`,
+		},
+		{
+			name:         "package index",
+			path:         "/pypi/simple/example-pkg/",
+			wantContains: `href="/pypi/packages/example-pkg/1.0.0/example-pkg-1.0.0.whl#sha256=`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := httptest.NewRecorder()
+			mounted.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if got, want := resp.Code, http.StatusOK; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+			if body := resp.Body.String(); !strings.Contains(body, tc.wantContains) {
+				t.Errorf("Response body does not contain %q, got: %s", tc.wantContains, body)
+			}
+		})
+	}
+}
+
+func TestSimpleJSON(t *testing.T) {
+	t.Parallel()
+
+	registry := oci.NewFakeRegistry()
+	registry.Tags["index"] = []string{"example-pkg"}
+	for _, f := range []*oci.RepoFile{
+		{OwningRepo: "packages/example-pkg", OwningTag: "1.0.0", Name: "example_pkg-1.0.0-py3-none-any.whl"},
+		{OwningRepo: "packages/example-pkg", OwningTag: "1.1.0", Name: "example_pkg-1.1.0.tar.gz"},
+	} {
+		if _, err := registry.AddFile(context.Background(), f, strings.NewReader("content")); err != nil {
+			t.Fatalf("Failed to set up file: %v", err)
+		}
+		registry.Created[f.OwningRepo+"/"+f.OwningTag+"/"+f.Name] = time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	h, err := NewHandler(registry)
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		path     string
+		accept   string
+		wantType string
+		want     any
+		got      any
+	}{
+		{
+			name:     "project page",
+			path:     "/simple/example-pkg/",
+			accept:   "application/vnd.pypi.simple.v1+json, application/vnd.pypi.simple.v1+html; q=0.1, text/html; q=0.01",
+			wantType: simpleJSONType,
+			want: &simplePage{
+				Meta: simpleMeta{APIVersion: "1.3"},
+				Name: "example-pkg",
+				Files: []*simpleFile{
+					{
+						Filename:   "example_pkg-1.0.0-py3-none-any.whl",
+						URL:        "/packages/example-pkg/1.0.0/example_pkg-1.0.0-py3-none-any.whl",
+						Hashes:     map[string]string{},
+						Size:       7,
+						UploadTime: "2025-01-02T03:04:05.000000Z",
+					},
+					{
+						Filename:   "example_pkg-1.1.0.tar.gz",
+						URL:        "/packages/example-pkg/1.1.0/example_pkg-1.1.0.tar.gz",
+						Hashes:     map[string]string{},
+						Size:       7,
+						UploadTime: "2025-01-02T03:04:05.000000Z",
+					},
+				},
+				Versions: []string{"1.0.0", "1.1.0"},
+			},
+			got: &simplePage{},
+		},
+		{
+			name:     "root page",
+			path:     "/simple/",
+			accept:   simpleJSONType,
+			wantType: simpleJSONType,
+			want:     &simpleRoot{Meta: simpleMeta{APIVersion: "1.0"}, Projects: []*simpleProject{{Name: "example-pkg"}}},
+			got:      &simpleRoot{},
+		},
+		{
+			name:     "html preferred",
+			path:     "/simple/example-pkg/",
+			accept:   "text/html, application/vnd.pypi.simple.v1+json; q=0.5",
+			wantType: "text/html",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			req.Header.Set("Accept", tc.accept)
+			resp := httptest.NewRecorder()
+			h.Mux().ServeHTTP(resp, req)
+
+			if got, want := resp.Code, http.StatusOK; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+			if got := resp.Header().Get("Content-Type"); !strings.HasPrefix(got, tc.wantType) {
+				t.Errorf("Content-Type = %q, want %q", got, tc.wantType)
+			}
+			if tc.want == nil {
+				return
+			}
+			if err := json.Unmarshal(resp.Body.Bytes(), tc.got); err != nil {
+				t.Fatalf("Failed to decode response %s: %v", resp.Body.String(), err)
+			}
+			sortFiles := cmpopts.SortSlices(func(a, b *simpleFile) bool { return a.Filename < b.Filename })
+			if diff := cmp.Diff(tc.want, tc.got, sortFiles); diff != "" {
+				t.Errorf("Response mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestVersionFromFilename(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		filename string
+		want     string
+	}{
+		{filename: "example_pkg-1.0.0-py3-none-any.whl", want: "1.0.0"},
+		{filename: "example_pkg-1.0.0-1-cp312-cp312-manylinux_2_17_x86_64.whl", want: "1.0.0"},
+		{filename: "example_pkg-1.0.0.tar.gz", want: "1.0.0"},
+		{filename: "example-pkg-1.0.0rc1.tar.gz", want: "1.0.0rc1"},
+		{filename: "example_pkg-1.0.0.zip", want: "1.0.0"},
+		{filename: "example_pkg-1.0.0-py2.7.egg", want: "1.0.0"},
+		{filename: "example_pkg.whl", want: ""},
+		{filename: "README.md", want: ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.filename, func(t *testing.T) {
+			t.Parallel()
+
+			if got := versionFromFilename(tc.filename); got != tc.want {
+				t.Errorf("versionFromFilename(%q) = %q, want %q", tc.filename, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSimpleIndex(t *testing.T) {
+	t.Parallel()
+
+	page := `<!DOCTYPE html>
+<html><body>
+<h1>Links for example-pkg</h1>
+<a href="../../files/example_pkg-1.0.0-py3-none-any.whl#sha256=abc" data-requires-python="&gt;=3.8">example_pkg-1.0.0-py3-none-any.whl</a><br/>
+<a href="https://files.example.com/example_pkg-1.1.0.tar.gz">
+  example_pkg-1.1.0.tar.gz
+</a>
+<a href="/unknown">not-a-distribution</a>
+</body></html>`
+
+	pageURL, err := url.Parse("https://pypi.example.com/simple/example-pkg/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parseSimpleIndex(strings.NewReader(page), pageURL)
+	if err != nil {
+		t.Fatalf("parseSimpleIndex() unexpected error: %v", err)
+	}
+
+	want := []*upstreamFile{
+		{
+			Name:    "example_pkg-1.0.0-py3-none-any.whl",
+			Version: "1.0.0",
+			URL:     "https://pypi.example.com/files/example_pkg-1.0.0-py3-none-any.whl",
+			SHA256:  "abc",
+		},
+		{
+			Name:    "example_pkg-1.1.0.tar.gz",
+			Version: "1.1.0",
+			URL:     "https://files.example.com/example_pkg-1.1.0.tar.gz",
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("parseSimpleIndex() mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+// remoteRegistry fails like a remote registry does for a missing repository,
+// with a 404 error response instead of errdef.ErrNotFound.
+type remoteRegistry struct {
+	*oci.FakeRegistry
+}
+
+func (r *remoteRegistry) ListTags(ctx context.Context, repo string) ([]string, error) {
+	tags, err := r.FakeRegistry.ListTags(ctx, repo)
+	if err == nil && len(tags) == 0 {
+		return nil, &errcode.ErrorResponse{StatusCode: http.StatusNotFound}
+	}
+	return tags, err //nolint:wrapcheck // Want passthrough error.
+}
+
+func (r *remoteRegistry) ListFiles(ctx context.Context, repo string) ([]*oci.RepoFile, error) {
+	files, err := r.FakeRegistry.ListFiles(ctx, repo)
+	if err == nil && len(files) == 0 {
+		return nil, &errcode.ErrorResponse{StatusCode: http.StatusNotFound}
+	}
+	return files, err //nolint:wrapcheck // Want passthrough error.
+}
+
+func TestUpstream(t *testing.T) {
+	t.Parallel()
+
+	const (
+		upstreamWheel   = "example_pkg-2.0.0-py3-none-any.whl"
+		upstreamContent = "upstream wheel"
+		localWheel      = "example_pkg-1.0.0-py3-none-any.whl"
+	)
+	upstreamDigest := fmt.Sprintf("%x", sha256.Sum256([]byte(upstreamContent)))
+
+	cases := []struct {
+		name           string
+		localShadowing bool
+		withLocal      bool
+		publishedAs    string // Name the local package is published with.
+		remote         bool
+		path           string
+		wantStatus     int
+		wantContains   []string
+		wantMissing    []string
+		wantBody       string
+		wantCached     string
+	}{
+		{
+			name:         "index merges local and upstream",
+			withLocal:    true,
+			path:         "/simple/example-pkg/",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{localWheel, "/packages/example-pkg/2.0.0/" + upstreamWheel + "#sha256=" + upstreamDigest},
+		},
+		{
+			name:         "index of upstream only package",
+			path:         "/simple/example-pkg/",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{upstreamWheel},
+		},
+		{
+			name:         "index of upstream only package on remote registry",
+			remote:       true,
+			path:         "/simple/example-pkg/",
+			wantStatus:   http.StatusOK,
+			wantContains: []string{upstreamWheel},
+		},
+		{
+			name:           "local package shadows upstream index",
+			localShadowing: true,
+			withLocal:      true,
+			path:           "/simple/example-pkg/",
+			wantStatus:     http.StatusOK,
+			wantContains:   []string{localWheel},
+			wantMissing:    []string{upstreamWheel},
+		},
+		{
+			name:           "local package published with another spelling shadows upstream index",
+			localShadowing: true,
+			publishedAs:    "Example_Pkg",
+			path:           "/simple/example-pkg/",
+			wantStatus:     http.StatusOK,
+			wantContains:   []string{localWheel},
+			wantMissing:    []string{upstreamWheel},
+		},
+		{
+			name:       "unknown package",
+			path:       "/simple/unknown/",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "download caches upstream file",
+			withLocal:  true,
+			path:       "/packages/example-pkg/2.0.0/" + upstreamWheel,
+			wantStatus: http.StatusOK,
+			wantBody:   upstreamContent,
+			wantCached: "upstream/example-pkg/2.0.0/" + upstreamWheel,
+		},
+		{
+			name:           "local package shadows upstream download",
+			localShadowing: true,
+			withLocal:      true,
+			path:           "/packages/example-pkg/2.0.0/" + upstreamWheel,
+			wantStatus:     http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/simple/example-pkg/":
+					fmt.Fprintf(w, `<a href="../../files/%s#sha256=%s">%s</a>`, upstreamWheel, upstreamDigest, upstreamWheel)
+				case "/files/" + upstreamWheel:
+					fmt.Fprint(w, upstreamContent)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			t.Cleanup(srv.Close)
+
+			upstream, err := handler.NewUpstream(srv.URL + "/simple")
+			if err != nil {
+				t.Fatalf("NewUpstream() unexpected error: %v", err)
+			}
+
+			registry := oci.NewFakeRegistry()
+			if tc.withLocal {
+				if _, err := registry.AddFile(context.Background(), &oci.RepoFile{
+					OwningRepo: "packages/example-pkg",
+					OwningTag:  "1.0.0",
+					Name:       localWheel,
+				}, strings.NewReader("local wheel")); err != nil {
+					t.Fatalf("Failed to set up file: %v", err)
+				}
+			}
+
+			opts := []Option{WithUpstream(upstream, time.Minute)}
+			if tc.localShadowing {
+				opts = append(opts, WithLocalShadowing())
+			}
+			var backend handler.Registry = registry
+			if tc.remote {
+				backend = &remoteRegistry{FakeRegistry: registry}
+			}
+			h, err := NewHandler(backend, opts...)
+			if err != nil {
+				t.Fatalf("NewHandler() unexpected error: %v", err)
+			}
+
+			if tc.publishedAs != "" {
+				var b bytes.Buffer
+				w := multipart.NewWriter(&b)
+				for _, f := range [][2]string{{"name", tc.publishedAs}, {"version", "1.0.0"}} {
+					if err := w.WriteField(f[0], f[1]); err != nil {
+						t.Fatalf("Failed to write field %q: %v", f[0], err)
+					}
+				}
+				fw, err := w.CreateFormFile("content", localWheel)
+				if err != nil {
+					t.Fatalf("Failed to create form file: %v", err)
+				}
+				if _, err := fw.Write([]byte("local wheel")); err != nil {
+					t.Fatalf("Failed to write content: %v", err)
+				}
+				if err := w.Close(); err != nil {
+					t.Fatalf("Failed to close multipart writer: %v", err)
+				}
+				req := httptest.NewRequest(http.MethodPut, "/", &b)
+				req.Header.Set("Content-Type", w.FormDataContentType())
+				resp := httptest.NewRecorder()
+				h.Mux().ServeHTTP(resp, req)
+				if resp.Code != http.StatusCreated {
+					t.Fatalf("Failed to publish: %d %s", resp.Code, resp.Body.String())
+				}
+			}
+
+			resp := httptest.NewRecorder()
+			h.Mux().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, tc.path, nil))
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+			body := resp.Body.String()
+			for _, want := range tc.wantContains {
+				if !strings.Contains(body, want) {
+					t.Errorf("Response body does not contain %q, got: %s", want, body)
+				}
+			}
+			for _, missing := range tc.wantMissing {
+				if strings.Contains(body, missing) {
+					t.Errorf("Response body contains %q, got: %s", missing, body)
+				}
+			}
+			if tc.wantBody != "" && body != tc.wantBody {
+				t.Errorf("Body = %q, want %q", body, tc.wantBody)
+			}
+			if tc.wantCached != "" {
+				if got, ok := registry.Files[tc.wantCached]; !ok || string(got) != tc.wantBody {
+					t.Errorf("Cached file %q = %q, want %q", tc.wantCached, got, tc.wantBody)
+				}
+			}
+		})
+	}
+}
+
+func TestPackageVersion(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		repo        string
+		tag         string
+		wantPackage string
+		wantVersion string
+		wantOK      bool
+	}{
+		{name: "version", repo: "packages/foo", tag: "1.0.0", wantPackage: "foo", wantVersion: "1.0.0", wantOK: true},
+		{name: "index", repo: "index", tag: "foo"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			pkg, version, ok := PackageVersion(tc.repo, tc.tag)
+			if pkg != tc.wantPackage || version != tc.wantVersion || ok != tc.wantOK {
+				t.Errorf("PackageVersion(%q, %q) = (%q, %q, %t), want (%q, %q, %t)",
+					tc.repo, tc.tag, pkg, version, ok, tc.wantPackage, tc.wantVersion, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestHandleDelete(t *testing.T) {
+	t.Parallel()
+
+	files := []*oci.RepoFile{
+		{OwningRepo: "packages/foo", OwningTag: "1.0.0", Name: "foo-1.0.0.tar.gz"},
+		{OwningRepo: "packages/foo", OwningTag: "1.0.0", Name: "foo-1.0.0-py3-none-any.whl"},
+		{OwningRepo: "packages/foo", OwningTag: "1.0.0", Name: "foo-1.0.0-py3-none-any.whl.provenance"},
+		{OwningRepo: "index", OwningTag: "foo", Name: "1.0.0"},
+		{OwningRepo: "packages/foo", OwningTag: "2.0.0", Name: "foo-2.0.0.tar.gz"},
+		{OwningRepo: "index", OwningTag: "foo", Name: "2.0.0"},
+		{OwningRepo: "packages/bar", OwningTag: "0.1.0", Name: "bar-0.1.0.tar.gz"},
+		{OwningRepo: "index", OwningTag: "bar", Name: "0.1.0"},
+	}
+
+	cases := []struct {
+		name        string
+		path        string
+		identity    *auth.Identity
+		wantStatus  int
+		wantDeleted []string
+		wantIndex   []string
+	}{
+		{
+			name:        "version",
+			path:        "/packages/foo/1.0.0/",
+			wantStatus:  http.StatusNoContent,
+			wantDeleted: []string{"index/foo/1.0.0", "packages/foo/1.0.0/foo-1.0.0-py3-none-any.whl", "packages/foo/1.0.0/foo-1.0.0-py3-none-any.whl.provenance", "packages/foo/1.0.0/foo-1.0.0.tar.gz"},
+			wantIndex:   []string{"bar", "foo"},
+		},
+		{
+			name:        "version without slash",
+			path:        "/packages/foo/2.0.0",
+			wantStatus:  http.StatusNoContent,
+			wantDeleted: []string{"index/foo/2.0.0", "packages/foo/2.0.0/foo-2.0.0.tar.gz"},
+			wantIndex:   []string{"bar", "foo"},
+		},
+		{
+			name:        "file with siblings",
+			path:        "/packages/foo/1.0.0/foo-1.0.0-py3-none-any.whl",
+			wantStatus:  http.StatusNoContent,
+			wantDeleted: []string{"packages/foo/1.0.0/foo-1.0.0-py3-none-any.whl", "packages/foo/1.0.0/foo-1.0.0-py3-none-any.whl.provenance"},
+			wantIndex:   []string{"bar", "foo"},
+		},
+		{
+			name:        "last file of version",
+			path:        "/packages/foo/2.0.0/foo-2.0.0.tar.gz",
+			wantStatus:  http.StatusNoContent,
+			wantDeleted: []string{"index/foo/2.0.0", "packages/foo/2.0.0/foo-2.0.0.tar.gz"},
+			wantIndex:   []string{"bar", "foo"},
+		},
+		{
+			name:        "last version of package",
+			path:        "/packages/bar/0.1.0/",
+			wantStatus:  http.StatusNoContent,
+			wantDeleted: []string{"index/bar/0.1.0", "packages/bar/0.1.0/bar-0.1.0.tar.gz"},
+			wantIndex:   []string{"foo"},
+		},
+		{
+			name:       "missing version",
+			path:       "/packages/foo/3.0.0/",
+			wantStatus: http.StatusNotFound,
+			wantIndex:  []string{"bar", "foo"},
+		},
+		{
+			name:       "identity without delete privilege",
+			path:       "/packages/foo/1.0.0/",
+			identity:   &auth.Identity{Subject: "yolocs/ocifactory"},
+			wantStatus: http.StatusForbidden,
+			wantIndex:  []string{"bar", "foo"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			registry := oci.NewFakeRegistry()
+			for _, f := range files {
+				if _, err := registry.AddFile(context.Background(), f, strings.NewReader("content")); err != nil {
+					t.Fatalf("Failed to set up file: %v", err)
+				}
+			}
+
+			h, err := NewHandler(registry)
+			if err != nil {
+				t.Fatalf("NewHandler() unexpected error: %v", err)
+			}
+
+			req := httptest.NewRequest(http.MethodDelete, tc.path, nil)
+			if tc.identity != nil {
+				req = req.WithContext(auth.WithIdentity(req.Context(), tc.identity))
+			}
+			w := httptest.NewRecorder()
+			h.Mux().ServeHTTP(w, req)
+
+			if got, want := w.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+
+			var gotDeleted []string
+			for _, f := range files {
+				key := f.OwningRepo + "/" + f.OwningTag + "/" + f.Name
+				if _, ok := registry.Files[key]; !ok {
+					gotDeleted = append(gotDeleted, key)
+				}
+			}
+			slices.Sort(gotDeleted)
+			if diff := cmp.Diff(tc.wantDeleted, gotDeleted); diff != "" {
+				t.Errorf("deleted files mismatch (-want, +got):\n%s", diff)
+			}
+			gotIndex := slices.Compact(slices.Sorted(slices.Values(registry.Tags["index"])))
+			if diff := cmp.Diff(tc.wantIndex, gotIndex); diff != "" {
+				t.Errorf("index packages mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	t.Parallel()
+
+	registry := oci.NewFakeRegistry()
+	if _, err := registry.AddFile(context.Background(), &oci.RepoFile{OwningRepo: "packages/example-pkg", OwningTag: "1.0.0", Name: "example_pkg-1.0.0-py3-none-any.whl"}, strings.NewReader("content")); err != nil {
+		t.Fatalf("Failed to set up file: %v", err)
+	}
+	h, err := NewHandler(registry)
+	if err != nil {
+		t.Fatalf("NewHandler() unexpected error: %v", err)
+	}
+	router := h.Mux()
+
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodPut, "/packages/example-pkg/1.0.0/-/referrers"+"?artifactType=application/vnd.dev.sigstore.bundle.v0.3%2Bjson", strings.NewReader("bundle")))
+	if got, want := resp.Code, http.StatusCreated; got != want {
+		t.Fatalf("Add status code = %d, want %d, body: %s", got, want, resp.Body.String())
+	}
+	var desc ocispec.Descriptor
+	if err := json.Unmarshal(resp.Body.Bytes(), &desc); err != nil {
+		t.Fatalf("Failed to decode descriptor: %v", err)
+	}
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/packages/example-pkg/1.0.0/-/referrers", nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("List status code = %d, want %d", got, want)
+	}
+	if !strings.Contains(resp.Body.String(), desc.Digest.String()) {
+		t.Errorf("List body = %s, want the referrer %s", resp.Body.String(), desc.Digest)
+	}
+
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/packages/example-pkg/1.0.0/-/referrers"+"/"+desc.Digest.String(), nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("Read status code = %d, want %d", got, want)
+	}
+	if got, want := resp.Body.String(), "bundle"; got != want {
+		t.Errorf("Read body = %q, want %q", got, want)
+	}
+}
@@ -1,23 +1,25 @@
 package python
 
 import (
+	"bytes"
 	"context"
 	"embed"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/abcxyz/pkg/cache"
 	"github.com/abcxyz/pkg/logging"
 	"github.com/abcxyz/pkg/renderer"
 	"github.com/gorilla/mux"
 	"github.com/yolocs/ocifactory/pkg/handler"
 	"github.com/yolocs/ocifactory/pkg/oci"
-	"oras.land/oras-go/v2/errdef"
 )
 
 const (
@@ -26,9 +28,15 @@ const (
 
 	maxPackageLength = 256
 	maxVersionLength = 128
+
+	defaultIndexTTL = 5 * time.Minute
 )
 
 var (
+	// SignedFiles are the files a handler.VerifyPolicy covers by default: the
+	// distributions, not their metadata.
+	SignedFiles = []string{"*.whl", "*.tar.gz", "*.zip"}
+
 	mimeTypes = map[string]string{
 		"whl":      "application/x-wheel+zip",
 		"gz":       "application/x-gzip",
@@ -37,12 +45,18 @@ var (
 		"py":       "text/x-python",
 		"egg":      "text/plain",
 		"egg-info": "text/plain",
+
+		// PEP 740 provenance objects.
+		"provenance": provenanceMediaType,
 	}
 
 	// pkgNameRegExp is the regex matcher for package names.
 	// Reference: https://packaging.python.org/specifications/core-metadata/#name.
 	pkgNameRegExp = regexp.MustCompile("(?i)^([A-Z0-9]|[A-Z0-9][A-Z0-9-_.]*[A-Z0-9])$")
 
+	// sha256RegExp is the regex matcher for the hex encoded sha256 digest of the uploaded file.
+	sha256RegExp = regexp.MustCompile("^[a-f0-9]{64}$")
+
 	//go:embed simple.html
 	fs embed.FS
 )
@@ -53,37 +67,84 @@ type index struct {
 }
 
 type fileResult struct {
-	FileName string
-	FileURL  *url.URL
-}
-
-type repoFile struct {
-	oci.RepoFile
-	Content io.ReadCloser
+	FileName      string
+	FileURL       *url.URL
+	ProvenanceURL *url.URL // PEP 740 provenance of the file. Could be nil.
+
+	// Only used by the JSON API.
+	Version    string
+	SHA256     string    // Hex digest. Could be empty.
+	Size       int64     // Zero if unknown.
+	UploadTime time.Time // Zero if unknown.
 }
 
 type Handler struct {
 	registry handler.Registry
 	renderer *renderer.Renderer
+
+	upstream       *handler.Upstream
+	indexCache     *cache.Cache[[]*upstreamFile]
+	localShadowing bool
+}
+
+// Option configures the Handler.
+type Option func(*Handler) error
+
+// WithUpstream merges the package index with the upstream simple index, e.g.
+// https://pypi.org/simple. Upstream files are downloaded and cached in the
+// backend on first download. Upstream index pages are cached in memory for
+// indexTTL. The default TTL is 5 minutes.
+func WithUpstream(upstream *handler.Upstream, indexTTL time.Duration) Option {
+	return func(h *Handler) error {
+		if indexTTL <= 0 {
+			indexTTL = defaultIndexTTL
+		}
+		h.upstream = upstream
+		h.indexCache = cache.New[[]*upstreamFile](indexTTL)
+		return nil
+	}
+}
+
+// WithLocalShadowing makes packages published locally shadow the upstream
+// packages with the same name. It protects against dependency confusion where
+// a malicious package with the same name is published upstream.
+func WithLocalShadowing() Option {
+	return func(h *Handler) error {
+		h.localShadowing = true
+		return nil
+	}
 }
 
 // NewHandler creates a new Handler.
-func NewHandler(registry handler.Registry) (*Handler, error) {
+func NewHandler(registry handler.Registry, opts ...Option) (*Handler, error) {
 	r, err := renderer.New(context.Background(), fs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create renderer: %w", err)
 	}
-	return &Handler{registry: registry, renderer: r}, nil
+	h := &Handler{registry: registry, renderer: r}
+	for _, o := range opts {
+		if err := o(h); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
 }
 
 // Mux returns a new ServeMux that handles the Python handler's routes.
 func (h *Handler) Mux() http.Handler {
 	router := mux.NewRouter()
+	router.Use(handler.RecordRoute)
 
 	// Handle both pip and twine operations
 	router.HandleFunc("/", h.handleFilePut).Methods("PUT", "POST")
 
+	router.HandleFunc("/packages/{package}/{version}"+handler.ReferrersPath, h.handleReferrers).Methods("GET", "HEAD", "PUT", "POST")
+	router.HandleFunc("/packages/{package}/{version}"+handler.ReferrersPath+"/{digest}", h.handleReferrerGet).Methods("GET", "HEAD")
+
 	router.HandleFunc("/packages/{package}/{version}/{filename}", h.handleFileGet).Methods("GET", "HEAD")
+	router.HandleFunc("/packages/{package}/{version}/{filename}", h.handleFileDelete).Methods("DELETE")
+	router.HandleFunc("/packages/{package}/{version}/", h.handleVersionDelete).Methods("DELETE")
+	router.HandleFunc("/packages/{package}/{version}", h.handleVersionDelete).Methods("DELETE")
 
 	router.HandleFunc("/simple/{package}/", h.handlePackageIndex).Methods("GET")
 	router.HandleFunc("/simple/{package}", h.handlePackageIndex).Methods("GET")
@@ -103,8 +164,8 @@ func (h *Handler) handleSimpleIndex(w http.ResponseWriter, req *http.Request) {
 	idx := index{Title: "Simple Index"}
 	tags, err := h.registry.ListTags(req.Context(), "index")
 	if err != nil {
-		if errors.Is(err, errdef.ErrNotFound) { // No index yet, so we just render an empty index
-			h.renderer.RenderHTML(w, "simple.html", idx)
+		if handler.IsNotFound(err) { // No index yet, so we just render an empty index
+			h.renderIndex(w, req, idx, rootJSON)
 			return
 		}
 		logger.ErrorContext(req.Context(), "failed to list package index", "error", err)
@@ -116,17 +177,18 @@ func (h *Handler) handleSimpleIndex(w http.ResponseWriter, req *http.Request) {
 		idx.Files = append(idx.Files, fileResult{FileName: tag, FileURL: &url.URL{
 			Scheme: req.URL.Scheme,
 			Host:   req.URL.Host,
-			Path:   fmt.Sprintf("/simple/%s/", tag),
+			Path:   fmt.Sprintf("%s/simple/%s/", handler.MountPrefix(req.Context()), tag),
 		}})
 	}
 
-	h.renderer.RenderHTML(w, "simple.html", idx)
+	h.renderIndex(w, req, idx, rootJSON)
 }
 
 // handleFilePut handles the file put request.
 func (h *Handler) handleFilePut(w http.ResponseWriter, req *http.Request) {
 	logger := logging.FromContext(req.Context())
-	var pkgName, versionNum, contentName string
+	var pkgName, versionNum, contentName, sha256Digest string
+	var attestations []byte
 
 	reader, err := req.MultipartReader()
 	if err != nil {
@@ -135,7 +197,7 @@ func (h *Handler) handleFilePut(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 		logger.ErrorContext(req.Context(), "failed to create multipart reader", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, "failed to read request", http.StatusInternalServerError)
 		return
 	}
 
@@ -169,6 +231,8 @@ func (h *Handler) handleFilePut(w http.ResponseWriter, req *http.Request) {
 				http.Error(w, "invalid package name", http.StatusBadRequest)
 				return
 			}
+			// Stored under the normalized name clients look up, see PEP 503.
+			pkgName = normalizeName(pkgName)
 		case "version":
 			versionBytes, err := io.ReadAll(io.LimitReader(p, maxVersionLength+1))
 			if err != nil {
@@ -182,6 +246,34 @@ func (h *Handler) handleFilePut(w http.ResponseWriter, req *http.Request) {
 				http.Error(w, "version is too long", http.StatusBadRequest)
 				return
 			}
+		case "sha256_digest":
+			// Clients send it before the content. It's used to cross check the
+			// content and skip uploading files the backend already has.
+			digestBytes, err := io.ReadAll(io.LimitReader(p, 65))
+			if err != nil {
+				logger.DebugContext(req.Context(), "failed to read sha256 digest", "error", err)
+				http.Error(w, "failed to read sha256 digest", http.StatusBadRequest)
+				return
+			}
+			sha256Digest = strings.ToLower(string(digestBytes))
+			if !sha256RegExp.MatchString(sha256Digest) {
+				logger.DebugContext(req.Context(), "invalid sha256 digest", "digest", sha256Digest)
+				http.Error(w, "invalid sha256 digest", http.StatusBadRequest)
+				return
+			}
+		case "attestations":
+			// PEP 740 attestations, sent before the content like the
+			// other fields.
+			attestations, err = io.ReadAll(io.LimitReader(p, maxAttestationsSize+1))
+			if err != nil {
+				logger.DebugContext(req.Context(), "failed to read attestations", "error", err)
+				http.Error(w, "failed to read attestations", http.StatusBadRequest)
+				return
+			}
+			if len(attestations) > maxAttestationsSize {
+				http.Error(w, "attestations are too large", http.StatusBadRequest)
+				return
+			}
 		case "content":
 			if versionNum == "" || pkgName == "" {
 				logger.DebugContext(req.Context(), "version or package name is not set")
@@ -189,29 +281,83 @@ func (h *Handler) handleFilePut(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 			contentName = p.FileName()
+			if strings.HasSuffix(contentName, provenanceSuffix) {
+				http.Error(w, fmt.Sprintf("file name must not end with %q", provenanceSuffix), http.StatusBadRequest)
+				return
+			}
 			// Every time we upload a file, we also write a new tag in the index repository.
 			// If the package/version already exists, it shouldn't cause a real write.
-			fs := []*repoFile{
-				{
-					RepoFile: oci.RepoFile{
-						OwningRepo: "packages/" + pkgName,
-						OwningTag:  versionNum,
-						Name:       contentName,
-						MediaType:  detectMediaType(contentName),
-					},
-					Content: p,
-				},
-				{
-					RepoFile: oci.RepoFile{
-						OwningRepo: "index",
-						OwningTag:  pkgName,
-						Name:       versionNum,
-						MediaType:  "text/plain",
+			// The package file goes first so the index never lists a version without files.
+			pkgFile := &oci.RepoFile{
+				OwningRepo: "packages/" + pkgName,
+				OwningTag:  versionNum,
+				Name:       contentName,
+				MediaType:  detectMediaType(contentName),
+			}
+			if sha256Digest != "" {
+				pkgFile.Digest = "sha256:" + sha256Digest
+			}
+			uploads := []*oci.FileUpload{{RepoFile: pkgFile, Content: p}}
+
+			// The provenance is stored next to the distribution and added
+			// with it. The attested digest is checked against the content.
+			if attestations != nil {
+				atts, attested, err := parseAttestations(attestations, contentName)
+				if err != nil {
+					logger.DebugContext(req.Context(), "invalid attestations", "error", err)
+					http.Error(w, "invalid attestations: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				if sha256Digest != "" && attested != sha256Digest {
+					http.Error(w, "attestations are not for the uploaded content", http.StatusBadRequest)
+					return
+				}
+				pkgFile.Digest = "sha256:" + attested
+				prov, err := newProvenance(atts, handler.Identity(req.Context()))
+				if err != nil {
+					logger.ErrorContext(req.Context(), "failed to create provenance", "error", err)
+					http.Error(w, "failed to create provenance", http.StatusInternalServerError)
+					return
+				}
+				uploads = append(uploads, &oci.FileUpload{
+					RepoFile: &oci.RepoFile{
+						OwningRepo: pkgFile.OwningRepo,
+						OwningTag:  pkgFile.OwningTag,
+						Name:       contentName + provenanceSuffix,
+						MediaType:  provenanceMediaType,
 					},
-					Content: io.NopCloser(strings.NewReader(versionNum)),
-				},
+					Content: bytes.NewReader(prov),
+				})
+			} else {
+				// Overwriting an attested file without attestations would
+				// leave the provenance of the old content.
+				_, r, err := h.registry.ReadFile(req.Context(), &oci.RepoFile{
+					OwningRepo: pkgFile.OwningRepo,
+					OwningTag:  pkgFile.OwningTag,
+					Name:       contentName + provenanceSuffix,
+				})
+				if err == nil {
+					r.Close()
+					http.Error(w, fmt.Sprintf("file %q has attestations, it can only be replaced with attestations", contentName), http.StatusConflict)
+					return
+				}
+				if !handler.IsNotFound(err) {
+					logger.ErrorContext(req.Context(), "failed to read provenance", "error", err)
+					http.Error(w, "failed to read provenance", http.StatusInternalServerError)
+					return
+				}
 			}
-			h.handlePut(req.Context(), w, fs)
+
+			uploads = append(uploads, &oci.FileUpload{
+				RepoFile: &oci.RepoFile{
+					OwningRepo: "index",
+					OwningTag:  pkgName,
+					Name:       versionNum,
+					MediaType:  "text/plain",
+				},
+				Content: strings.NewReader(versionNum),
+			})
+			handler.PutFiles(w, req, h.registry, handler.TextError, uploads...)
 		}
 	}
 
@@ -243,38 +389,159 @@ func (h *Handler) handleFileGet(w http.ResponseWriter, req *http.Request) {
 	h.handleGet(w, req, f)
 }
 
+// handleReferrers lists or attaches the signatures, attestations and SBOMs of
+// a version.
+func (h *Handler) handleReferrers(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	handler.ServeReferrers(w, req, h.registry, "packages/"+vars["package"], vars["version"], handler.TextError)
+}
+
+// handleReferrerGet serves the content of a referrer of a version.
+func (h *Handler) handleReferrerGet(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	handler.GetReferrer(w, req, h.registry, "packages/"+vars["package"], vars["version"], vars["digest"], handler.TextError)
+}
+
+// handleVersionDelete deletes all files of a version and its index entry.
+func (h *Handler) handleVersionDelete(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	pkg, version := vars["package"], vars["version"]
+
+	handler.DeleteFiles(w, req, handler.TextError, func(ctx context.Context) error {
+		return DeleteVersion(ctx, h.registry, "packages/"+pkg, version)
+	})
+}
+
+// DeleteVersion deletes the files of the version stored under the repository
+// and tag, and removes the version from the index.
+func DeleteVersion(ctx context.Context, reg handler.Registry, repo, tag string) error {
+	if err := reg.DeleteTagFiles(ctx, repo, tag); err != nil {
+		return err
+	}
+	return deleteIndexEntry(ctx, reg, strings.TrimPrefix(repo, "packages/"), tag)
+}
+
+// handleFileDelete deletes a single file of a version. The index entry is
+// deleted with the last file of the version.
+func (h *Handler) handleFileDelete(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	pkg, version, filename := vars["package"], vars["version"], vars["filename"]
+
+	handler.DeleteFiles(w, req, handler.TextError, func(ctx context.Context) error {
+		f := &oci.RepoFile{OwningRepo: "packages/" + pkg, OwningTag: version, Name: filename}
+		if err := h.registry.DeleteFile(ctx, f); err != nil {
+			return err
+		}
+		// The provenance of the file goes with it.
+		if !strings.HasSuffix(filename, provenanceSuffix) {
+			p := &oci.RepoFile{OwningRepo: f.OwningRepo, OwningTag: version, Name: filename + provenanceSuffix}
+			if err := h.registry.DeleteFile(ctx, p); err != nil && !handler.IsNotFound(err) {
+				return err
+			}
+		}
+
+		tags, err := h.registry.ListTags(ctx, "packages/"+pkg)
+		if err != nil && !handler.IsNotFound(err) {
+			return err
+		}
+		if slices.Contains(tags, version) {
+			return nil
+		}
+		return deleteIndexEntry(ctx, h.registry, pkg, version)
+	})
+}
+
+// deleteIndexEntry removes the version from the index. The package leaves the
+// index with its last version. A missing entry is not an error, e.g. when a
+// previous delete failed halfway.
+func deleteIndexEntry(ctx context.Context, reg handler.Registry, pkg, version string) error {
+	err := reg.DeleteFile(ctx, &oci.RepoFile{OwningRepo: "index", OwningTag: pkg, Name: version})
+	if err != nil && !handler.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
 func (h *Handler) handlePackageIndex(w http.ResponseWriter, req *http.Request) {
 	vars := mux.Vars(req)
-	pkg := vars["package"]
+	pkg := normalizeName(vars["package"])
 	if pkg == "" {
 		http.Error(w, "invalid path: missing package name", http.StatusBadRequest)
 		return
 	}
 
-	files, err := h.registry.ListFiles(req.Context(), "packages/"+pkg)
-	if err != nil {
-		if errors.Is(err, errdef.ErrNotFound) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		if oci.HasCode(err, http.StatusUnauthorized) {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-		if oci.HasCode(err, http.StatusForbidden) {
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	ctx := req.Context()
+	files, err := h.registry.ListFiles(ctx, "packages/"+pkg)
+	if err != nil && !(handler.IsNotFound(err) && h.upstream != nil) {
+		writeError(w, req, err)
 		return
 	}
 
 	idx := index{Title: pkg}
+	localNames := make(map[string]bool)
+	provenances := make(map[string]*oci.RepoFile)
 	for _, f := range files {
-		idx.Files = append(idx.Files, fileResult{FileName: f.Name, FileURL: repoFileURL(req, f)})
+		if name, ok := strings.CutSuffix(f.Name, provenanceSuffix); ok {
+			provenances[f.OwningTag+"/"+name] = f
+		}
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name, provenanceSuffix) {
+			continue
+		}
+		localNames[f.Name] = true
+		fr := fileResult{
+			FileName:   f.Name,
+			FileURL:    repoFileURL(req, f),
+			Version:    f.OwningTag,
+			SHA256:     strings.TrimPrefix(f.Digest, "sha256:"),
+			Size:       f.Size,
+			UploadTime: f.Created,
+		}
+		if p, ok := provenances[f.OwningTag+"/"+f.Name]; ok {
+			fr.ProvenanceURL = repoFileURL(req, p)
+			fr.ProvenanceURL.Fragment = ""
+		}
+		idx.Files = append(idx.Files, fr)
+	}
+
+	if h.upstream != nil && !(h.localShadowing && len(files) > 0) {
+		upstreamFiles, err := h.upstreamFiles(ctx, pkg)
+		switch {
+		case err == nil:
+		case len(files) == 0:
+			handler.WriteUpstreamError(w, req, err, handler.TextError)
+			return
+		default:
+			// Still serve the local files if the upstream is flaky.
+			logging.FromContext(ctx).WarnContext(ctx, "failed to fetch upstream index", "package", pkg, "error", err)
+		}
+		for _, uf := range upstreamFiles {
+			if localNames[uf.Name] {
+				continue // Local files win.
+			}
+			if !handler.AllowsUpstream(h.registry, uf.Name) {
+				continue
+			}
+			f := &oci.RepoFile{OwningRepo: "packages/" + pkg, OwningTag: uf.Version, Name: uf.Name}
+			if uf.SHA256 != "" {
+				f.Digest = "sha256:" + uf.SHA256
+			}
+			idx.Files = append(idx.Files, fileResult{FileName: uf.Name, FileURL: repoFileURL(req, f), Version: uf.Version, SHA256: uf.SHA256})
+		}
 	}
 
-	h.renderer.RenderHTML(w, "simple.html", idx)
+	h.renderIndex(w, req, idx, projectJSON)
+}
+
+// PackageVersion returns the package and version stored under the repository
+// and tag. The index repository doesn't store versions.
+func PackageVersion(repo, tag string) (string, string, bool) {
+	pkg, ok := strings.CutPrefix(repo, "packages/")
+	if !ok {
+		return "", "", false
+	}
+	return pkg, tag, true
 }
 
 func repoFileURL(req *http.Request, f *oci.RepoFile) *url.URL {
@@ -283,71 +550,22 @@ func repoFileURL(req *http.Request, f *oci.RepoFile) *url.URL {
 		Host:   req.URL.Host,
 		// Path should be /packages/{package_name_only}/{version}/{filename}
 		// f.OwningRepo is "packages/pkg", f.OwningTag is version, f.Name is filename
-		Path:     fmt.Sprintf("/%s/%s/%s", f.OwningRepo, f.OwningTag, f.Name),
+		Path:     fmt.Sprintf("%s/%s/%s/%s", handler.MountPrefix(req.Context()), f.OwningRepo, f.OwningTag, f.Name),
 		Fragment: fmt.Sprintf("sha256=%s", strings.TrimPrefix(f.Digest, "sha256:")),
 	}
 }
 
-func (h *Handler) handlePut(ctx context.Context, w http.ResponseWriter, fs []*repoFile) {
-	logger := logging.FromContext(ctx)
-
-	for _, f := range fs {
-		defer f.Content.Close()
-		desc, err := h.registry.AddFile(ctx, &f.RepoFile, f.Content)
-		if err != nil {
-			logger.DebugContext(ctx, "failed to add file", "error", err)
-			if oci.HasCode(err, http.StatusUnauthorized) {
-				http.Error(w, err.Error(), http.StatusUnauthorized)
-				return
-			}
-			if oci.HasCode(err, http.StatusForbidden) {
-				http.Error(w, err.Error(), http.StatusForbidden)
-				return
-			}
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		logger.DebugContext(ctx, "added file", "descriptor", desc)
-	}
-	w.WriteHeader(http.StatusCreated)
-}
-
 func (h *Handler) handleGet(w http.ResponseWriter, req *http.Request, f *oci.RepoFile) {
-	logger := logging.FromContext(req.Context())
-
-	desc, r, err := h.registry.ReadFile(req.Context(), f)
-	if err != nil {
-		logger.DebugContext(req.Context(), "failed to read file", "error", err)
-		if errors.Is(err, errdef.ErrNotFound) {
-			http.Error(w, err.Error(), http.StatusNotFound)
-			return
-		}
-		if oci.HasCode(err, http.StatusUnauthorized) {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			return
-		}
-		if oci.HasCode(err, http.StatusForbidden) {
-			http.Error(w, err.Error(), http.StatusForbidden)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer r.Close()
-	logger.DebugContext(req.Context(), "read file", "descriptor", desc)
-
-	w.Header().Set("Content-Type", f.MediaType)
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", desc.File.Size))
-	w.Header().Set("X-Checksum-Sha256", desc.File.Digest.String())
-	if req.Method == http.MethodHead {
-		return
+	var notFound func(http.ResponseWriter, *http.Request, *oci.RepoFile)
+	if h.upstream != nil {
+		notFound = h.handleUpstreamGet
 	}
+	handler.GetFile(w, req, h.registry, f, handler.TextError, notFound)
+}
 
-	if _, err := io.Copy(w, r); err != nil {
-		logger.DebugContext(req.Context(), "failed to write response", "error", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// writeError maps the registry error to the HTTP status.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	handler.WriteError(w, req, err, handler.TextError)
 }
 
 func detectMediaType(filename string) string {
@@ -0,0 +1,127 @@
+package python
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// simpleJSONType is the media type of the PEP 691 JSON simple API.
+	simpleJSONType = "application/vnd.pypi.simple.v1+json"
+
+	// uploadTimeFormat is the PEP 700 upload-time format.
+	uploadTimeFormat = "2006-01-02T15:04:05.000000Z"
+)
+
+type simpleMeta struct {
+	APIVersion string `json:"api-version"`
+}
+
+type simpleProject struct {
+	Name string `json:"name"`
+}
+
+type simpleRoot struct {
+	Meta     simpleMeta       `json:"meta"`
+	Projects []*simpleProject `json:"projects"`
+}
+
+type simpleFile struct {
+	Filename   string            `json:"filename"`
+	URL        string            `json:"url"`
+	Hashes     map[string]string `json:"hashes"`
+	Size       int64             `json:"size,omitempty"`
+	UploadTime string            `json:"upload-time,omitempty"`
+	Provenance *string           `json:"provenance,omitempty"`
+}
+
+type simplePage struct {
+	Meta     simpleMeta    `json:"meta"`
+	Name     string        `json:"name"`
+	Files    []*simpleFile `json:"files"`
+	Versions []string      `json:"versions"`
+}
+
+// renderIndex writes the index as JSON if the client prefers the PEP 691 JSON
+// API and as HTML otherwise.
+func (h *Handler) renderIndex(w http.ResponseWriter, req *http.Request, idx index, toJSON func(index) any) {
+	w.Header().Add("Vary", "Accept")
+	if !prefersJSON(req.Header.Get("Accept")) {
+		h.renderer.RenderHTML(w, "simple.html", idx)
+		return
+	}
+	w.Header().Set("Content-Type", simpleJSONType)
+	json.NewEncoder(w).Encode(toJSON(idx)) //nolint:errcheck // Nothing to do if the client is gone.
+}
+
+// prefersJSON returns true if the JSON API has a higher quality than the HTML
+// pages in the Accept header. Ties go to the first listed.
+func prefersJSON(accept string) bool {
+	jsonQ, htmlQ := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		switch mt {
+		case simpleJSONType:
+			if jsonQ < 0 {
+				jsonQ = q
+			}
+		case "application/vnd.pypi.simple.v1+html", "application/vnd.pypi.simple.latest+html", "text/html", "*/*":
+			if htmlQ < 0 {
+				htmlQ = q
+			}
+		}
+	}
+	return jsonQ > 0 && jsonQ > htmlQ
+}
+
+func rootJSON(idx index) any {
+	root := &simpleRoot{Meta: simpleMeta{APIVersion: "1.0"}, Projects: []*simpleProject{}}
+	for _, f := range idx.Files {
+		root.Projects = append(root.Projects, &simpleProject{Name: f.FileName})
+	}
+	return root
+}
+
+// projectJSON returns the PEP 691 project page with the PEP 700 fields and the
+// PEP 740 provenance URLs. The size and upload time of files only listed
+// upstream are unknown, so the page is version 1.0 if there are any.
+func projectJSON(idx index) any {
+	page := &simplePage{Meta: simpleMeta{APIVersion: "1.3"}, Name: idx.Title, Files: []*simpleFile{}, Versions: []string{}}
+	for _, f := range idx.Files {
+		u := *f.FileURL
+		u.Fragment = ""
+		sf := &simpleFile{Filename: f.FileName, URL: u.String(), Hashes: map[string]string{}, Size: f.Size}
+		if f.SHA256 != "" {
+			sf.Hashes["sha256"] = f.SHA256
+		}
+		if !f.UploadTime.IsZero() {
+			sf.UploadTime = f.UploadTime.UTC().Format(uploadTimeFormat)
+		}
+		if f.ProvenanceURL != nil {
+			u := f.ProvenanceURL.String()
+			sf.Provenance = &u
+		}
+		if f.Size == 0 {
+			page.Meta.APIVersion = "1.0"
+		}
+		page.Files = append(page.Files, sf)
+		if !slices.Contains(page.Versions, f.Version) {
+			page.Versions = append(page.Versions, f.Version)
+		}
+	}
+	slices.Sort(page.Versions)
+	return page
+}
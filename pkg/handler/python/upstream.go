@@ -0,0 +1,267 @@
+package python
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/handler"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"golang.org/x/net/html"
+	"oras.land/oras-go/v2/errdef"
+)
+
+const maxUpstreamIndexSize = 32 << 20
+
+var (
+	// normalizeRegExp matches the separators to collapse when normalizing a package name.
+	// Reference: https://packaging.python.org/en/latest/specifications/name-normalization/.
+	normalizeRegExp = regexp.MustCompile(`[-_.]+`)
+
+	sdistExts = []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tgz", ".tar", ".zip"}
+)
+
+// upstreamFile is a file listed in the upstream simple index of a package.
+type upstreamFile struct {
+	Name    string
+	Version string
+	URL     string // Absolute URL without fragment.
+	SHA256  string // Hex digest. Could be empty.
+}
+
+// upstreamRepo returns the repository that caches files fetched from the
+// upstream. It's separate from the published packages so cached files never
+// count as local packages when shadowing the upstream.
+func upstreamRepo(pkg string) string {
+	return "upstream/" + normalizeName(pkg)
+}
+
+func normalizeName(pkg string) string {
+	return strings.ToLower(normalizeRegExp.ReplaceAllString(pkg, "-"))
+}
+
+// isShadowed returns true if the upstream must not be consulted for the package
+// because it has been published locally.
+func (h *Handler) isShadowed(ctx context.Context, pkg string) (bool, error) {
+	if !h.localShadowing {
+		return false, nil
+	}
+	tags, err := h.registry.ListTags(ctx, "packages/"+normalizeName(pkg))
+	if err != nil {
+		if handler.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return len(tags) > 0, nil
+}
+
+// upstreamFiles returns the files of the package in the upstream simple index.
+func (h *Handler) upstreamFiles(ctx context.Context, pkg string) ([]*upstreamFile, error) {
+	name := normalizeName(pkg)
+	return h.indexCache.WriteThruLookup(name, func() ([]*upstreamFile, error) {
+		indexURL := h.upstream.URL(name + "/")
+		resp, err := h.upstream.Do(ctx, http.MethodGet, indexURL.String(), http.Header{"Accept": []string{"text/html"}})
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		return parseSimpleIndex(io.LimitReader(resp.Body, maxUpstreamIndexSize), resp.Request.URL)
+	})
+}
+
+// findUpstreamFile looks up a single file in the upstream simple index.
+func (h *Handler) findUpstreamFile(ctx context.Context, pkg, filename string) (*upstreamFile, error) {
+	files, err := h.upstreamFiles(ctx, pkg)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Name == filename {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("file %q not found in upstream index: %w", filename, errdef.ErrNotFound)
+}
+
+// handleUpstreamGet serves a file missing in the backend from the upstream
+// cache, or downloads it from the upstream and caches it on the way.
+func (h *Handler) handleUpstreamGet(w http.ResponseWriter, req *http.Request, f *oci.RepoFile) {
+	ctx := req.Context()
+	logger := logging.FromContext(ctx)
+	pkg := strings.TrimPrefix(f.OwningRepo, "packages/")
+
+	shadowed, err := h.isShadowed(ctx, pkg)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	if shadowed {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+
+	cached := *f
+	cached.OwningRepo = upstreamRepo(pkg)
+	desc, r, err := h.registry.ReadFile(ctx, &cached)
+	if err == nil {
+		handler.ServeFile(w, req, &cached, desc, r)
+		return
+	}
+	if !handler.IsNotFound(err) {
+		writeError(w, req, err)
+		return
+	}
+
+	uf, err := h.findUpstreamFile(ctx, pkg, f.Name)
+	if err != nil {
+		handler.WriteUpstreamError(w, req, err, handler.TextError)
+		return
+	}
+	if uf.SHA256 != "" {
+		cached.Digest = "sha256:" + uf.SHA256 // Verified when the file is persisted.
+		cached.TrustedDigest = true
+	}
+
+	// Keep downloading and persisting even if the client goes away so the
+	// next request is served from the backend.
+	dlCtx, cancel := handler.DetachedContext(ctx)
+	defer cancel()
+	resp, err := h.upstream.Do(dlCtx, req.Method, uf.URL, nil)
+	if err != nil {
+		handler.WriteUpstreamError(w, req, err, handler.TextError)
+		return
+	}
+	defer resp.Body.Close()
+
+	w.Header().Set("Content-Type", f.MediaType)
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	}
+	if uf.SHA256 != "" {
+		w.Header().Set("X-Checksum-Sha256", cached.Digest)
+	}
+	if req.Method == http.MethodHead {
+		return
+	}
+
+	copyErr, persistErr := handler.CopyAndPersist(w, resp.Body, func(r io.Reader) error {
+		desc, err := h.registry.AddFile(handler.WithUpstreamCache(dlCtx), &cached, r)
+		if err == nil {
+			logger.DebugContext(ctx, "cached upstream file", "descriptor", desc)
+		}
+		return err
+	})
+	if copyErr != nil {
+		logger.ErrorContext(ctx, "failed to copy upstream file", "url", uf.URL, "error", copyErr)
+	}
+	if persistErr != nil {
+		logger.ErrorContext(ctx, "failed to cache upstream file", "url", uf.URL, "error", persistErr)
+	}
+}
+
+// parseSimpleIndex parses the anchors of a PEP 503 simple index page. Relative
+// links are resolved against the page URL.
+func parseSimpleIndex(r io.Reader, pageURL *url.URL) ([]*upstreamFile, error) {
+	var files []*upstreamFile
+	z := html.NewTokenizer(r)
+	var href string
+	var inAnchor bool
+	var text strings.Builder
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if errors.Is(z.Err(), io.EOF) {
+				return files, nil
+			}
+			return nil, fmt.Errorf("failed to parse upstream index: %w", z.Err())
+		case html.StartTagToken:
+			tn, hasAttr := z.TagName()
+			if string(tn) != "a" {
+				continue
+			}
+			inAnchor, href = true, ""
+			text.Reset()
+			for hasAttr {
+				var k, v []byte
+				k, v, hasAttr = z.TagAttr()
+				if string(k) == "href" {
+					href = string(v)
+				}
+			}
+		case html.TextToken:
+			if inAnchor {
+				text.Write(z.Text())
+			}
+		case html.EndTagToken:
+			tn, _ := z.TagName()
+			if string(tn) != "a" || !inAnchor {
+				continue
+			}
+			inAnchor = false
+			if f := newUpstreamFile(strings.TrimSpace(text.String()), href, pageURL); f != nil {
+				files = append(files, f)
+			}
+		}
+	}
+}
+
+func newUpstreamFile(name, href string, pageURL *url.URL) *upstreamFile {
+	if name == "" || href == "" {
+		return nil
+	}
+	version := versionFromFilename(name)
+	if version == "" {
+		return nil
+	}
+	u, err := pageURL.Parse(href)
+	if err != nil {
+		return nil
+	}
+	f := &upstreamFile{Name: name, Version: version}
+	if algo, hash, ok := strings.Cut(u.Fragment, "="); ok && algo == "sha256" {
+		f.SHA256 = hash
+	}
+	u.Fragment = ""
+	f.URL = u.String()
+	return f
+}
+
+// versionFromFilename extracts the version from a wheel, egg or sdist file name.
+// Returns empty string if the file name is not recognized.
+func versionFromFilename(filename string) string {
+	if base, ok := strings.CutSuffix(filename, ".whl"); ok {
+		// {distribution}-{version}(-{build tag})?-{python tag}-{abi tag}-{platform tag}.whl
+		parts := strings.Split(base, "-")
+		if len(parts) < 5 {
+			return ""
+		}
+		return parts[1]
+	}
+	if base, ok := strings.CutSuffix(filename, ".egg"); ok {
+		// {distribution}-{version}(-{python tag})?.egg
+		parts := strings.Split(base, "-")
+		if len(parts) < 2 {
+			return ""
+		}
+		return parts[1]
+	}
+	for _, ext := range sdistExts {
+		if base, ok := strings.CutSuffix(filename, ext); ok {
+			// {distribution}-{version}.tar.gz, the distribution may contain dashes in legacy sdists.
+			i := strings.LastIndex(base, "-")
+			if i <= 0 || i == len(base)-1 {
+				return ""
+			}
+			return base[i+1:]
+		}
+	}
+	return ""
+}
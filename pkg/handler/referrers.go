@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"regexp"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/oci"
+)
+
+// ReferrersPath is appended to the path of a version to reach its referrers.
+const ReferrersPath = "/-/referrers"
+
+var (
+	// artifactTypeRegExp matches a media type without parameters.
+	artifactTypeRegExp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9!#$&^_.+-]*/[a-zA-Z0-9][a-zA-Z0-9!#$&^_.+-]*$`)
+
+	// referrerNameRegExp matches the file name of a referrer.
+	referrerNameRegExp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._+-]*$`)
+)
+
+// ReferrerRegistry is implemented by registries that can attach artifacts to
+// the manifest of a version as OCI referrers, e.g. signatures, attestations
+// and SBOMs. oci.Registry implements it.
+type ReferrerRegistry interface {
+	AddReferrer(ctx context.Context, f *oci.RepoFile, artifactType string, ro io.Reader) (*oci.FileDescriptor, error)
+	ListReferrers(ctx context.Context, repo, tag, artifactType string) ([]ocispec.Descriptor, error)
+	ReadReferrer(ctx context.Context, repo, tag, referrer string) (*oci.FileDescriptor, io.ReadCloser, error)
+}
+
+// ServeReferrers handles the referrers of the version stored under the
+// repository and tag:
+//
+//   - GET lists them as an OCI image index like the referrers API, filtered
+//     by the artifactType query parameter if set.
+//   - PUT or POST attaches the body as a referrer of the artifactType query
+//     parameter. The name query parameter is the file name of the content and
+//     Content-Type its media type. Responds with 201 and the descriptor of the
+//     referrer manifest.
+//
+// Registries without referrers support answer 501.
+func ServeReferrers(w http.ResponseWriter, req *http.Request, reg Registry, repo, tag string, ew ErrorWriter) {
+	ctx := req.Context()
+	rr, ok := reg.(ReferrerRegistry)
+	if !ok {
+		ew(w, "referrers are not supported", http.StatusNotImplemented)
+		return
+	}
+	artifactType := req.URL.Query().Get("artifactType")
+	if artifactType != "" && !artifactTypeRegExp.MatchString(artifactType) {
+		ew(w, "invalid artifact type", http.StatusBadRequest)
+		return
+	}
+
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		refs, err := rr.ListReferrers(ctx, repo, tag, artifactType)
+		if err != nil {
+			WriteError(w, req, err, ew)
+			return
+		}
+		if refs == nil {
+			refs = []ocispec.Descriptor{}
+		}
+		writeReferrersJSON(w, http.StatusOK, ocispec.MediaTypeImageIndex, &ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageIndex,
+			Manifests: refs,
+		})
+		return
+	}
+
+	defer req.Body.Close()
+	var desc *oci.FileDescriptor
+	var err error
+	if artifactType == "" {
+		ew(w, "missing artifactType query parameter", http.StatusBadRequest)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		name = path.Base(artifactType)
+	}
+	if !referrerNameRegExp.MatchString(name) {
+		ew(w, "invalid referrer name", http.StatusBadRequest)
+		return
+	}
+	f := &oci.RepoFile{OwningRepo: repo, OwningTag: tag, Name: name}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		if f.MediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			ew(w, "invalid content type", http.StatusBadRequest)
+			return
+		}
+	}
+	desc, err = rr.AddReferrer(ctx, f, artifactType, req.Body)
+	if err != nil {
+		WriteError(w, req, err, ew)
+		return
+	}
+	logging.FromContext(ctx).DebugContext(ctx, "added referrer", "descriptor", desc)
+	writeReferrersJSON(w, http.StatusCreated, "application/json", desc.Manifest)
+}
+
+// GetReferrer serves the content of a referrer of the version stored under the
+// repository and tag by the digest of the referrer manifest.
+func GetReferrer(w http.ResponseWriter, req *http.Request, reg Registry, repo, tag, referrer string, ew ErrorWriter) {
+	rr, ok := reg.(ReferrerRegistry)
+	if !ok {
+		ew(w, "referrers are not supported", http.StatusNotImplemented)
+		return
+	}
+	desc, r, err := rr.ReadReferrer(req.Context(), repo, tag, referrer)
+	if err != nil {
+		WriteError(w, req, err, ew)
+		return
+	}
+	f := &oci.RepoFile{OwningRepo: repo, OwningTag: tag, Name: desc.File.Annotations[oci.FileNameAnnotation]}
+	ServeFile(w, req, f, desc, r)
+}
+
+func writeReferrersJSON(w http.ResponseWriter, status int, contentType string, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to marshal response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(b) //nolint:errcheck // Nothing to do if the client is gone.
+}
@@ -0,0 +1,196 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/oci"
+)
+
+const bundleType = "application/vnd.dev.sigstore.bundle.v0.3+json"
+
+func TestServeReferrers(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name        string
+		reg         Registry
+		method      string
+		query       string
+		contentType string
+		body        string
+		wantStatus  int
+		wantTypes   []string
+	}{
+		{
+			name:       "list",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantTypes:  []string{bundleType, "application/spdx+json"},
+		},
+		{
+			name:       "list by type",
+			method:     http.MethodGet,
+			query:      "artifactType=application/spdx%2Bjson",
+			wantStatus: http.StatusOK,
+			wantTypes:  []string{"application/spdx+json"},
+		},
+		{
+			name:        "add",
+			method:      http.MethodPut,
+			query:       "artifactType=application/vnd.in-toto%2Bjson&name=provenance.intoto.jsonl",
+			contentType: "application/vnd.in-toto+json; charset=utf-8",
+			body:        `{"_type":"https://in-toto.io/Statement/v1"}`,
+			wantStatus:  http.StatusCreated,
+			wantTypes:   []string{"application/vnd.in-toto+json"},
+		},
+		{
+			name:       "add without type",
+			method:     http.MethodPost,
+			body:       "{}",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid type",
+			method:     http.MethodGet,
+			query:      "artifactType=not-a-type",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "invalid name",
+			method:     http.MethodPut,
+			query:      "artifactType=application/json&name=../x",
+			body:       "{}",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown version",
+			method:     http.MethodGet,
+			query:      "tag=2.0.0",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unsupported registry",
+			reg:        failingRegistry{},
+			method:     http.MethodGet,
+			wantStatus: http.StatusNotImplemented,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			reg := tc.reg
+			if reg == nil {
+				fake := oci.NewFakeRegistry()
+				fake.AddTag("app", "1.0.0")
+				for _, typ := range []string{bundleType, "application/spdx+json"} {
+					if _, err := fake.AddReferrer(context.Background(), &oci.RepoFile{OwningRepo: "app", OwningTag: "1.0.0", Name: "ref"}, typ, strings.NewReader(typ)); err != nil {
+						t.Fatalf("AddReferrer() unexpected error: %v", err)
+					}
+				}
+				reg = fake
+			}
+
+			req := httptest.NewRequest(tc.method, "/app/1.0.0/-/referrers?"+tc.query, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			tag := req.URL.Query().Get("tag")
+			if tag == "" {
+				tag = "1.0.0"
+			}
+			resp := httptest.NewRecorder()
+			ServeReferrers(resp, req, reg, "app", tag, TextError)
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Fatalf("Status code = %d, want %d, body: %s", got, want, resp.Body.String())
+			}
+
+			var gotTypes []string
+			switch tc.wantStatus {
+			case http.StatusOK:
+				var idx ocispec.Index
+				if err := json.Unmarshal(resp.Body.Bytes(), &idx); err != nil {
+					t.Fatalf("Failed to decode index: %v", err)
+				}
+				if idx.MediaType != ocispec.MediaTypeImageIndex || idx.SchemaVersion != 2 {
+					t.Errorf("Index = %+v, want an OCI image index", idx)
+				}
+				for _, m := range idx.Manifests {
+					gotTypes = append(gotTypes, m.ArtifactType)
+				}
+			case http.StatusCreated:
+				var desc ocispec.Descriptor
+				if err := json.Unmarshal(resp.Body.Bytes(), &desc); err != nil {
+					t.Fatalf("Failed to decode descriptor: %v", err)
+				}
+				gotTypes = append(gotTypes, desc.ArtifactType)
+
+				got, rc, err := reg.(ReferrerRegistry).ReadReferrer(context.Background(), "app", "1.0.0", desc.Digest.String())
+				if err != nil {
+					t.Fatalf("ReadReferrer() unexpected error: %v", err)
+				}
+				rc.Close()
+				if got.File.MediaType != "application/vnd.in-toto+json" {
+					t.Errorf("Referrer media type = %q, want the content type without parameters", got.File.MediaType)
+				}
+			}
+			if strings.Join(gotTypes, ",") != strings.Join(tc.wantTypes, ",") {
+				t.Errorf("Artifact types = %v, want %v", gotTypes, tc.wantTypes)
+			}
+		})
+	}
+}
+
+func TestGetReferrer(t *testing.T) {
+	t.Parallel()
+
+	reg := oci.NewFakeRegistry()
+	reg.AddTag("app", "1.0.0")
+	desc, err := reg.AddReferrer(context.Background(), &oci.RepoFile{OwningRepo: "app", OwningTag: "1.0.0", Name: "app.sigstore.json"}, bundleType, strings.NewReader("bundle"))
+	if err != nil {
+		t.Fatalf("AddReferrer() unexpected error: %v", err)
+	}
+
+	cases := []struct {
+		name       string
+		referrer   string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "found",
+			referrer:   desc.Manifest.Digest.String(),
+			wantStatus: http.StatusOK,
+			wantBody:   "bundle",
+		},
+		{
+			name:       "not found",
+			referrer:   "sha256:" + strings.Repeat("0", 64),
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := httptest.NewRecorder()
+			GetReferrer(resp, httptest.NewRequest(http.MethodGet, "/", nil), reg, "app", "1.0.0", tc.referrer, TextError)
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d", got, want)
+			}
+			if tc.wantBody != "" && resp.Body.String() != tc.wantBody {
+				t.Errorf("Body = %q, want %q", resp.Body.String(), tc.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// SwappableHandler is a handler whose underlying handler can be replaced at
+// runtime, e.g. when the config is reloaded. In-flight requests finish with
+// the handler they started with.
+type SwappableHandler struct {
+	h atomic.Pointer[http.Handler]
+}
+
+// NewSwappableHandler creates a new SwappableHandler that serves h.
+func NewSwappableHandler(h http.Handler) *SwappableHandler {
+	s := &SwappableHandler{}
+	s.Swap(h)
+	return s
+}
+
+// Swap replaces the underlying handler.
+func (s *SwappableHandler) Swap(h http.Handler) {
+	s.h.Store(&h)
+}
+
+func (s *SwappableHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*s.h.Load()).ServeHTTP(w, r)
+}
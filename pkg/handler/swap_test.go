@@ -0,0 +1,33 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSwappableHandler(t *testing.T) {
+	t.Parallel()
+
+	status := func(code int) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		})
+	}
+
+	h := NewSwappableHandler(status(http.StatusOK))
+
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got, want := resp.Code, http.StatusOK; got != want {
+		t.Errorf("Status code before swap = %d, want %d", got, want)
+	}
+
+	h.Swap(status(http.StatusTeapot))
+
+	resp = httptest.NewRecorder()
+	h.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got, want := resp.Code, http.StatusTeapot; got != want {
+		t.Errorf("Status code after swap = %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,47 @@
+package handler
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the request spans.
+const tracerName = "github.com/yolocs/ocifactory/pkg/handler"
+
+// Tracing is a middleware that starts a server span for each request. The
+// span continues the trace of the incoming trace context headers, if any. The
+// span is named after the route recorded with RecordRoute.
+func Tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, info := withRequestInfo(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := otel.Tracer(tracerName).Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+
+		rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		if info.route != "" {
+			span.SetName(r.Method + " " + info.route)
+			span.SetAttributes(semconv.HTTPRoute(info.route))
+		}
+		if info.repoType != "" {
+			span.SetAttributes(attribute.String("ocifactory.repo_type", info.repoType))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rw.status))
+		if rw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rw.status))
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+
+	// This is the only test of the package that sets the global tracer provider.
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	router := mux.NewRouter()
+	router.Use(RecordRoute)
+	router.HandleFunc("/packages/{name}/{version}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["version"] == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	h := Tracing(WithRepoType("test-tracing", router))
+
+	cases := []struct {
+		name        string
+		path        string
+		traceparent string
+		wantName    string
+		wantTraceID string
+		wantStatus  int
+		wantCode    codes.Code
+	}{
+		{
+			name:       "new trace",
+			path:       "/packages/foo/1.0.0",
+			wantName:   "GET /packages/{name}/{version}",
+			wantStatus: http.StatusOK,
+			wantCode:   codes.Unset,
+		},
+		{
+			name:        "propagated trace",
+			path:        "/packages/foo/1.0.0",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			wantName:    "GET /packages/{name}/{version}",
+			wantTraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+			wantStatus:  http.StatusOK,
+			wantCode:    codes.Unset,
+		},
+		{
+			name:       "server error",
+			path:       "/packages/foo/broken",
+			wantName:   "GET /packages/{name}/{version}",
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   codes.Error,
+		},
+		{
+			name:       "unmatched route",
+			path:       "/unknown",
+			wantName:   "GET",
+			wantStatus: http.StatusNotFound,
+			wantCode:   codes.Unset,
+		},
+	}
+
+	// Not parallel since the spans are recorded in order.
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.traceparent != "" {
+				req.Header.Set("traceparent", tc.traceparent)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			spans := sr.Ended()
+			if len(spans) == 0 {
+				t.Fatalf("no span recorded")
+			}
+			span := spans[len(spans)-1]
+
+			if got := span.Name(); got != tc.wantName {
+				t.Errorf("span name = %q, want %q", got, tc.wantName)
+			}
+			if tc.wantTraceID != "" {
+				if got := span.SpanContext().TraceID().String(); got != tc.wantTraceID {
+					t.Errorf("trace ID = %q, want %q", got, tc.wantTraceID)
+				}
+				if !span.Parent().IsRemote() {
+					t.Errorf("span parent is not the remote span")
+				}
+			}
+			if got := span.Status().Code; got != tc.wantCode {
+				t.Errorf("span status = %v, want %v", got, tc.wantCode)
+			}
+			attrs := make(map[attribute.Key]attribute.Value)
+			for _, kv := range span.Attributes() {
+				attrs[kv.Key] = kv.Value
+			}
+			if got := attrs[semconv.HTTPResponseStatusCodeKey].AsInt64(); got != int64(tc.wantStatus) {
+				t.Errorf("status code attribute = %d, want %d", got, tc.wantStatus)
+			}
+			if got := attrs["ocifactory.repo_type"].AsString(); got != "test-tracing" {
+				t.Errorf("repo type attribute = %q, want %q", got, "test-tracing")
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/oci"
+)
+
+// PutFiles adds the files to the registry in the given order and responds
+// with 201 once all of them are added. Consecutive files of the same
+// repository and tag are added together, so either all or none of them become
+// visible. It stops at the first file that fails and writes the error with ew.
+func PutFiles(w http.ResponseWriter, req *http.Request, reg Registry, ew ErrorWriter, uploads ...*oci.FileUpload) {
+	ctx := req.Context()
+	for len(uploads) > 0 {
+		n := 1
+		for n < len(uploads) && uploads[n].OwningRepo == uploads[0].OwningRepo && uploads[n].OwningTag == uploads[0].OwningTag {
+			n++
+		}
+		descs, err := reg.AddFiles(ctx, uploads[:n])
+		if err != nil {
+			WriteError(w, req, err, ew)
+			return
+		}
+		for _, desc := range descs {
+			logging.FromContext(ctx).DebugContext(ctx, "added file", "descriptor", desc)
+		}
+		uploads = uploads[n:]
+	}
+	w.WriteHeader(http.StatusCreated)
+}
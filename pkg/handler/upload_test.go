@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/yolocs/ocifactory/pkg/oci"
+)
+
+// batchRecorder records the files of each AddFiles call.
+type batchRecorder struct {
+	*oci.FakeRegistry
+	batches [][]string
+}
+
+func (r *batchRecorder) AddFiles(ctx context.Context, uploads []*oci.FileUpload) ([]*oci.FileDescriptor, error) {
+	var names []string
+	for _, u := range uploads {
+		names = append(names, u.OwningRepo+"/"+u.OwningTag+"/"+u.Name)
+	}
+	r.batches = append(r.batches, names)
+	return r.FakeRegistry.AddFiles(ctx, uploads) //nolint:wrapcheck // Want passthrough error.
+}
+
+func TestPutFiles(t *testing.T) {
+	t.Parallel()
+
+	upload := func(repo, tag, name, digest string) *oci.FileUpload {
+		return &oci.FileUpload{
+			RepoFile: &oci.RepoFile{OwningRepo: repo, OwningTag: tag, Name: name, Digest: digest},
+			Content:  strings.NewReader("content"),
+		}
+	}
+
+	cases := []struct {
+		name        string
+		uploads     func() []*oci.FileUpload
+		wantStatus  int
+		wantBatches [][]string
+		wantFiles   []string
+	}{
+		{
+			name: "same tag added together",
+			uploads: func() []*oci.FileUpload {
+				return []*oci.FileUpload{
+					upload("packages/foo", "1.0.0", "foo.whl", ""),
+					upload("packages/foo", "1.0.0", "foo.whl.provenance", ""),
+					upload("index", "foo", "1.0.0", ""),
+				}
+			},
+			wantStatus: http.StatusCreated,
+			wantBatches: [][]string{
+				{"packages/foo/1.0.0/foo.whl", "packages/foo/1.0.0/foo.whl.provenance"},
+				{"index/foo/1.0.0"},
+			},
+			wantFiles: []string{"index/foo/1.0.0", "packages/foo/1.0.0/foo.whl", "packages/foo/1.0.0/foo.whl.provenance"},
+		},
+		{
+			name: "stops at the first failure",
+			uploads: func() []*oci.FileUpload {
+				return []*oci.FileUpload{
+					upload("packages/foo", "1.0.0", "foo.whl", "sha256:0000000000000000000000000000000000000000000000000000000000000000"),
+					upload("index", "foo", "1.0.0", ""),
+				}
+			},
+			wantStatus: http.StatusBadRequest,
+			wantBatches: [][]string{
+				{"packages/foo/1.0.0/foo.whl"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			reg := &batchRecorder{FakeRegistry: oci.NewFakeRegistry()}
+			resp := httptest.NewRecorder()
+			PutFiles(resp, httptest.NewRequest(http.MethodPut, "/", nil), reg, TextError, tc.uploads()...)
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d, body: %s", got, want, resp.Body.String())
+			}
+			if diff := cmp.Diff(tc.wantBatches, reg.batches); diff != "" {
+				t.Errorf("AddFiles batches mismatch (-want, +got):\n%s", diff)
+			}
+			gotFiles := slices.Sorted(maps.Keys(reg.Files))
+			if diff := cmp.Diff(tc.wantFiles, gotFiles, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("Files mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
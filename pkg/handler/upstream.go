@@ -0,0 +1,160 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"oras.land/oras-go/v2/errdef"
+)
+
+// Upstream timeouts apply to connecting and waiting for the response headers
+// only. Reading the body is bounded by the request context since large files
+// can take a long time to download.
+const (
+	upstreamDialTimeout           = 30 * time.Second
+	upstreamTLSHandshakeTimeout   = 10 * time.Second
+	upstreamResponseHeaderTimeout = time.Minute
+
+	// upstreamDownloadTimeout bounds downloads that continue after the client
+	// went away, see DetachedContext.
+	upstreamDownloadTimeout = 30 * time.Minute
+)
+
+// UpstreamError is returned when the upstream responds with an unexpected status.
+// A 404 from the upstream also matches errdef.ErrNotFound.
+type UpstreamError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream %s responded with status %d", e.URL, e.StatusCode)
+}
+
+func (e *UpstreamError) Is(target error) bool {
+	return target == errdef.ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// Upstream is a remote repository that artifacts missing in the backend are
+// proxied from, e.g. Maven Central.
+type Upstream struct {
+	baseURL *url.URL
+	client  *http.Client
+}
+
+// NewUpstream creates a new Upstream with the given base URL.
+func NewUpstream(baseURL string) (*Upstream, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse upstream URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("upstream URL %q must be http or https", baseURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return &Upstream{
+		baseURL: u,
+		client:  &http.Client{Transport: newUpstreamTransport()},
+	}, nil
+}
+
+func newUpstreamTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone() //nolint:forcetypeassert // Always a *http.Transport.
+	t.DialContext = (&net.Dialer{
+		Timeout:   upstreamDialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	t.TLSHandshakeTimeout = upstreamTLSHandshakeTimeout
+	t.ResponseHeaderTimeout = upstreamResponseHeaderTimeout
+	return t
+}
+
+// URL returns the upstream URL of the path relative to the base URL.
+func (u *Upstream) URL(p string) *url.URL {
+	ref := *u.baseURL
+	ref.Path = ref.Path + "/" + strings.TrimPrefix(p, "/")
+	return &ref
+}
+
+// Get fetches the path relative to the base URL. The caller must close the
+// response body.
+func (u *Upstream) Get(ctx context.Context, method, p string) (*http.Response, error) {
+	return u.Do(ctx, method, u.URL(p).String(), nil)
+}
+
+// Do sends a request to an absolute upstream URL, e.g. a file URL found in an
+// upstream index page. Only 200 responses are returned without error. The
+// caller must close the response body.
+func (u *Upstream) Do(ctx context.Context, method, rawURL string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upstream request: %w", err)
+	}
+	for k, vs := range header {
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	req.Header.Set("User-Agent", "ocifactory")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch from upstream: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &UpstreamError{URL: rawURL, StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// DetachedContext returns a context to download an upstream file that is
+// cached while it's served. It isn't canceled when the client goes away, so
+// the file is still cached for the next request, but it times out eventually.
+func DetachedContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), upstreamDownloadTimeout)
+}
+
+// lenientWriter swallows write errors after the first one. It lets a download
+// continue to fill the cache when the client goes away, and vice versa.
+type lenientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (l *lenientWriter) Write(p []byte) (int, error) {
+	if l.err == nil {
+		_, l.err = l.w.Write(p)
+	}
+	return len(p), nil
+}
+
+// CopyAndPersist copies the upstream content to w and persists it with the
+// persist func at the same time. The content is only persisted if it's fully
+// read from the upstream. A failure to persist doesn't interrupt the copy to w.
+// Returns the error from reading the upstream and the error from persisting.
+func CopyAndPersist(w io.Writer, upstream io.Reader, persist func(r io.Reader) error) (copyErr, persistErr error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := persist(pr)
+		// Unblock the writer side if persist returned before reading everything.
+		pr.Close()
+		done <- err
+	}()
+
+	_, copyErr = io.Copy(io.MultiWriter(&lenientWriter{w: pw}, &lenientWriter{w: w}), upstream)
+	if copyErr != nil {
+		pw.CloseWithError(copyErr)
+	} else {
+		pw.Close()
+	}
+	persistErr = <-done
+	return copyErr, persistErr
+}
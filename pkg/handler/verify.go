@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/abcxyz/pkg/logging"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"github.com/yolocs/ocifactory/pkg/verify"
+)
+
+const (
+	// SignatureHeader carries the signatures of an uploaded file: the output
+	// of "cosign sign-blob --output-signature" as is, or a base64 encoded
+	// Sigstore bundle. Repeat it for several signatures.
+	SignatureHeader = "X-Ocifactory-Artifact-Signature"
+
+	// VerificationHeader tells whether a downloaded file is signed by a
+	// trusted key. See the Verification constants for its values.
+	VerificationHeader = "X-Ocifactory-Verification"
+
+	// VerificationVerified means a signature of a trusted key is valid.
+	VerificationVerified = "verified"
+
+	// VerificationUnsigned means the file has no signature.
+	VerificationUnsigned = "unsigned"
+
+	// VerificationInvalid means none of the signatures of the file is valid
+	// for a trusted key.
+	VerificationInvalid = "invalid"
+
+	// verificationAnnotation passes the verification state of a read file to
+	// ServeFile.
+	verificationAnnotation = "ocifactory.verification"
+
+	// maxSignatureSize limits the signature files read on downloads.
+	maxSignatureSize = 1 << 20
+
+	// upstreamCacheKey marks the context of writes that cache upstream files.
+	upstreamCacheKey = contextKey("upstreamCache")
+)
+
+// signatureSuffixes are appended to the name of a file to find its signature
+// files: a Sigstore bundle and a plain cosign signature.
+var signatureSuffixes = []string{".sigstore.json", ".sig"}
+
+// VerifyPolicy decides which files must be signed by the keys of the verifier
+// and when that is enforced.
+//
+// On publish, the signatures must be sent with the upload in SignatureHeader.
+// On download, the signatures are the signature files stored next to the file
+// (NAME.sigstore.json and NAME.sig) and the Sigstore bundles attached to the
+// version as referrers. The verification state of downloads is sent in
+// VerificationHeader even if it's not enforced.
+type VerifyPolicy struct {
+	Verifier *verify.Verifier
+
+	// Files are the glob patterns of the names of the files that must be
+	// signed. Signature files are never checked themselves.
+	Files []string
+
+	OnPublish  bool
+	OnDownload bool
+}
+
+// Applies returns true if the file with the name must be signed.
+func (p *VerifyPolicy) Applies(name string) bool {
+	for _, s := range signatureSuffixes {
+		if strings.HasSuffix(name, s) {
+			return false
+		}
+	}
+	for _, pattern := range p.Files {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckUpload verifies an uploaded file with the signatures sent with the
+// request if the policy is enforced on publish. It's an oci.UploadCheckFunc.
+func (p *VerifyPolicy) CheckUpload(ctx context.Context, f *oci.RepoFile, fileDesc ocispec.Descriptor) error {
+	if !p.OnPublish || !p.Applies(f.Name) || isUpstreamCache(ctx) {
+		return nil
+	}
+	return p.Verifier.Verify(fileDesc.Digest, verify.SignaturesFromContext(ctx)) //nolint:wrapcheck // Want passthrough error.
+}
+
+// WithUpstreamCache marks the context of a write that caches a file served
+// from the upstream. It skips the publish check of a VerifyPolicy since the
+// file isn't published to the repo, downloads are still checked.
+func WithUpstreamCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, upstreamCacheKey, true)
+}
+
+func isUpstreamCache(ctx context.Context) bool {
+	v, _ := ctx.Value(upstreamCacheKey).(bool)
+	return v
+}
+
+// AllowsUpstream returns true if the file missing in the registry may be
+// served from the upstream. Registries that verify downloads refuse the files
+// they would reject once cached.
+func AllowsUpstream(reg Registry, name string) bool {
+	f, ok := reg.(interface{ AllowsUpstream(name string) bool })
+	return !ok || f.AllowsUpstream(name)
+}
+
+// Middleware reads the signatures in SignatureHeader into the request context.
+// Malformed signatures are rejected with ew.
+func (p *VerifyPolicy) Middleware(ew ErrorWriter) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			values := r.Header.Values(SignatureHeader)
+			if len(values) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			sigs := make([]*verify.Signature, 0, len(values))
+			for _, v := range values {
+				sig, err := parseSignatureHeader(v)
+				if err != nil {
+					logging.FromContext(r.Context()).DebugContext(r.Context(), "invalid signature header", "error", err)
+					ew(w, "invalid "+SignatureHeader+" header", http.StatusBadRequest)
+					return
+				}
+				sigs = append(sigs, sig)
+			}
+			next.ServeHTTP(w, r.WithContext(verify.WithSignatures(r.Context(), sigs)))
+		})
+	}
+}
+
+// parseSignatureHeader parses a signature header, which is base64 encoded
+// either way: a cosign signature is already and a bundle is encoded to fit.
+func parseSignatureHeader(v string) (*verify.Signature, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signature: %w", err)
+	}
+	if strings.HasPrefix(string(b), "{") {
+		return verify.ParseSignature(b) //nolint:wrapcheck // Want passthrough error.
+	}
+	return &verify.Signature{Sig: b}, nil
+}
+
+// Registry wraps the registry to verify the files that are read. Files that
+// fail verification are rejected if the policy is enforced on download.
+func (p *VerifyPolicy) Registry(reg Registry) Registry {
+	return &verifyingRegistry{Registry: reg, policy: p}
+}
+
+type verifyingRegistry struct {
+	Registry
+	policy *VerifyPolicy
+}
+
+func (v *verifyingRegistry) ReadFile(ctx context.Context, f *oci.RepoFile) (*oci.FileDescriptor, io.ReadCloser, error) {
+	desc, r, err := v.Registry.ReadFile(ctx, f)
+	if err != nil || !v.policy.Applies(f.Name) {
+		return desc, r, err //nolint:wrapcheck // Want passthrough error.
+	}
+
+	state, err := v.verify(ctx, f, desc.File.Digest)
+	if err != nil {
+		if v.policy.OnDownload {
+			r.Close()
+			return nil, nil, fmt.Errorf("failed to verify %q: %w", f.Name, err)
+		}
+		logging.FromContext(ctx).DebugContext(ctx, "file is not verified", "file", f.Name, "error", err)
+	}
+	if state == "" {
+		return desc, r, nil
+	}
+
+	verified := *desc
+	verified.File.Annotations = maps.Clone(desc.File.Annotations)
+	if verified.File.Annotations == nil {
+		verified.File.Annotations = map[string]string{}
+	}
+	verified.File.Annotations[verificationAnnotation] = state
+	return &verified, r, nil
+}
+
+// AllowsUpstream refuses the files that are verified on download. The
+// upstream doesn't sign its files with the trusted keys, so they can't be
+// served without verification.
+func (v *verifyingRegistry) AllowsUpstream(name string) bool {
+	return !v.policy.OnDownload || !v.policy.Applies(name)
+}
+
+// verify verifies the file with its stored signatures. Returns the
+// verification state, which is empty if the signatures couldn't be read.
+func (v *verifyingRegistry) verify(ctx context.Context, f *oci.RepoFile, d digest.Digest) (string, error) {
+	sigs, err := v.signatures(ctx, f)
+	if err != nil {
+		return "", err
+	}
+	switch err := v.policy.Verifier.Verify(d, sigs); {
+	case err == nil:
+		return VerificationVerified, nil
+	case errors.Is(err, verify.ErrUnsigned):
+		return VerificationUnsigned, err
+	case errors.Is(err, verify.ErrInvalid):
+		return VerificationInvalid, err
+	default:
+		return "", err //nolint:wrapcheck // Want passthrough error.
+	}
+}
+
+// signatures reads the signature files of the file and the Sigstore bundles
+// attached to its version. Signatures that can't be parsed are skipped, they
+// can't make the file verified.
+func (v *verifyingRegistry) signatures(ctx context.Context, f *oci.RepoFile) ([]*verify.Signature, error) {
+	logger := logging.FromContext(ctx)
+	var sigs []*verify.Signature
+	add := func(name string, r io.ReadCloser) error {
+		defer r.Close()
+		b, err := io.ReadAll(io.LimitReader(r, maxSignatureSize))
+		if err != nil {
+			return fmt.Errorf("failed to read signature %q: %w", name, err)
+		}
+		sig, err := verify.ParseSignature(b)
+		if err != nil {
+			logger.DebugContext(ctx, "skipping invalid signature", "file", f.Name, "signature", name, "error", err)
+			return nil
+		}
+		sigs = append(sigs, sig)
+		return nil
+	}
+
+	for _, s := range signatureSuffixes {
+		sf := &oci.RepoFile{OwningRepo: f.OwningRepo, OwningTag: f.OwningTag, Name: f.Name + s}
+		_, r, err := v.Registry.ReadFile(ctx, sf)
+		if IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read signature %q: %w", sf.Name, err)
+		}
+		if err := add(sf.Name, r); err != nil {
+			return nil, err
+		}
+	}
+
+	rr, ok := v.Registry.(ReferrerRegistry)
+	if !ok {
+		return sigs, nil
+	}
+	refs, err := rr.ListReferrers(ctx, f.OwningRepo, f.OwningTag, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+	for _, ref := range refs {
+		if !strings.HasPrefix(ref.ArtifactType, verify.BundleTypePrefix) {
+			continue
+		}
+		_, r, err := rr.ReadReferrer(ctx, f.OwningRepo, f.OwningTag, ref.Digest.String())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read referrer %q: %w", ref.Digest, err)
+		}
+		if err := add(ref.Digest.String(), r); err != nil {
+			return nil, err
+		}
+	}
+	return sigs, nil
+}
+
+// AddReferrer, ListReferrers and ReadReferrer pass through to the wrapped
+// registry so referrers keep working behind the policy.
+
+func (v *verifyingRegistry) AddReferrer(ctx context.Context, f *oci.RepoFile, artifactType string, ro io.Reader) (*oci.FileDescriptor, error) {
+	rr, ok := v.Registry.(ReferrerRegistry)
+	if !ok {
+		return nil, fmt.Errorf("registry doesn't support referrers")
+	}
+	return rr.AddReferrer(ctx, f, artifactType, ro) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (v *verifyingRegistry) ListReferrers(ctx context.Context, repo, tag, artifactType string) ([]ocispec.Descriptor, error) {
+	rr, ok := v.Registry.(ReferrerRegistry)
+	if !ok {
+		return nil, fmt.Errorf("registry doesn't support referrers")
+	}
+	return rr.ListReferrers(ctx, repo, tag, artifactType) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (v *verifyingRegistry) ReadReferrer(ctx context.Context, repo, tag, referrer string) (*oci.FileDescriptor, io.ReadCloser, error) {
+	rr, ok := v.Registry.(ReferrerRegistry)
+	if !ok {
+		return nil, nil, fmt.Errorf("registry doesn't support referrers")
+	}
+	return rr.ReadReferrer(ctx, repo, tag, referrer) //nolint:wrapcheck // Want passthrough error.
+}
@@ -0,0 +1,365 @@
+package handler
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"github.com/yolocs/ocifactory/pkg/verify"
+)
+
+// testSigner signs artifacts like "cosign sign-blob" with a key the policy
+// trusts.
+type testSigner struct {
+	key    *ecdsa.PrivateKey
+	policy *VerifyPolicy
+}
+
+func newTestSigner(t *testing.T, onPublish, onDownload bool) *testSigner {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() error = %v", err)
+	}
+	v, err := verify.NewVerifier(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("NewVerifier() error = %v", err)
+	}
+	return &testSigner{
+		key:    key,
+		policy: &VerifyPolicy{Verifier: v, Files: []string{"*.whl"}, OnPublish: onPublish, OnDownload: onDownload},
+	}
+}
+
+// sign returns the signature file content of cosign.
+func (s *testSigner) sign(t *testing.T, content string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	sig, err := ecdsa.SignASN1(rand.Reader, s.key, sum[:])
+	if err != nil {
+		t.Fatalf("SignASN1() error = %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// bundle returns a Sigstore bundle of the content.
+func (s *testSigner) bundle(t *testing.T, content string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	sig, err := base64.StdEncoding.DecodeString(s.sign(t, content))
+	if err != nil {
+		t.Fatalf("DecodeString() error = %v", err)
+	}
+	b, err := json.Marshal(map[string]any{
+		"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+		"messageSignature": map[string]any{
+			"messageDigest": map[string]any{"algorithm": "SHA2_256", "digest": sum[:]},
+			"signature":     sig,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return string(b)
+}
+
+func TestVerifyPolicyApplies(t *testing.T) {
+	t.Parallel()
+
+	p := &VerifyPolicy{Files: []string{"*.whl", "*.tar.gz"}}
+	cases := map[string]bool{
+		"app-1.0.0-py3-none-any.whl":                true,
+		"app-1.0.0.tar.gz":                          true,
+		"app-1.0.0.zip":                             false,
+		"app-1.0.0-py3-none-any.whl.sig":            false,
+		"app-1.0.0-py3-none-any.whl.sigstore.json":  false,
+		"app-1.0.0-py3-none-any.whl.metadata":       false,
+		"nested/app-1.0.0-py3-none-any.whl.missing": false,
+	}
+	for name, want := range cases {
+		if got := p.Applies(name); got != want {
+			t.Errorf("Applies(%q) = %t, want %t", name, got, want)
+		}
+	}
+}
+
+func TestVerifyPolicyCheckUpload(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSigner(t, true, false)
+	other := newTestSigner(t, true, false)
+	fileDesc := ocispec.Descriptor{Digest: digest.FromString("wheel")}
+
+	cases := []struct {
+		name          string
+		policy        *VerifyPolicy
+		file          string
+		headers       []string
+		upstreamCache bool
+		wantErr       error
+	}{
+		{
+			name:    "signature",
+			file:    "app.whl",
+			headers: []string{s.sign(t, "wheel")},
+		},
+		{
+			name:    "bundle",
+			file:    "app.whl",
+			headers: []string{base64.StdEncoding.EncodeToString([]byte(s.bundle(t, "wheel")))},
+		},
+		{
+			name:    "unsigned",
+			file:    "app.whl",
+			wantErr: verify.ErrUnsigned,
+		},
+		{
+			name:    "untrusted key",
+			file:    "app.whl",
+			headers: []string{other.sign(t, "wheel")},
+			wantErr: verify.ErrInvalid,
+		},
+		{
+			name:          "upstream cache",
+			file:          "app.whl",
+			upstreamCache: true,
+		},
+		{
+			name: "file not covered",
+			file: "app.zip",
+		},
+		{
+			name:   "not enforced on publish",
+			policy: &VerifyPolicy{Verifier: s.policy.Verifier, Files: []string{"*"}, OnDownload: true},
+			file:   "app.whl",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			p := tc.policy
+			if p == nil {
+				p = s.policy
+			}
+			var gotErr error
+			h := p.Middleware(TextError)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctx := r.Context()
+				if tc.upstreamCache {
+					ctx = WithUpstreamCache(ctx)
+				}
+				gotErr = p.CheckUpload(ctx, &oci.RepoFile{Name: tc.file}, fileDesc)
+			}))
+			req := httptest.NewRequest(http.MethodPut, "/"+tc.file, nil)
+			for _, v := range tc.headers {
+				req.Header.Add(SignatureHeader, v)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !errors.Is(gotErr, tc.wantErr) {
+				t.Errorf("CheckUpload() error = %v, want %v", gotErr, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyingRegistryUpstream(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name       string
+		onDownload bool
+		file       string
+		wantStatus int
+	}{
+		{
+			name:       "verified on download",
+			onDownload: true,
+			file:       "app.whl",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "file not covered",
+			onDownload: true,
+			file:       "app.zip",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "not enforced on download",
+			file:       "app.whl",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			reg := newTestSigner(t, false, tc.onDownload).policy.Registry(oci.NewFakeRegistry())
+			if got, want := AllowsUpstream(reg, tc.file), tc.wantStatus == http.StatusOK; got != want {
+				t.Errorf("AllowsUpstream(%q) = %t, want %t", tc.file, got, want)
+			}
+
+			resp := httptest.NewRecorder()
+			GetFile(resp, httptest.NewRequest(http.MethodGet, "/"+tc.file, nil), reg, &oci.RepoFile{OwningRepo: "packages/app", OwningTag: "1.0.0", Name: tc.file}, TextError,
+				func(w http.ResponseWriter, _ *http.Request, _ *oci.RepoFile) {
+					w.WriteHeader(http.StatusOK)
+				})
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("GetFile() status = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestVerifyPolicyMiddlewareInvalidHeader(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSigner(t, true, false)
+	h := s.policy.Middleware(TextError)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Handler called with an invalid signature header")
+	}))
+	req := httptest.NewRequest(http.MethodPut, "/app.whl", nil)
+	req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString([]byte(`{"mediaType":"application/json"}`)))
+	resp := httptest.NewRecorder()
+	h.ServeHTTP(resp, req)
+
+	if got, want := resp.Code, http.StatusBadRequest; got != want {
+		t.Errorf("Status code = %d, want %d", got, want)
+	}
+}
+
+func TestVerifyingRegistry(t *testing.T) {
+	t.Parallel()
+
+	s := newTestSigner(t, false, true)
+	other := newTestSigner(t, false, true)
+
+	cases := []struct {
+		name       string
+		onDownload bool
+		file       string
+		sigFiles   map[string]string
+		bundle     string
+		wantStatus int
+		wantState  string
+	}{
+		{
+			name:       "signature file",
+			onDownload: true,
+			file:       "app.whl",
+			sigFiles:   map[string]string{"app.whl.sig": s.sign(t, "wheel")},
+			wantStatus: http.StatusOK,
+			wantState:  VerificationVerified,
+		},
+		{
+			name:       "bundle file",
+			onDownload: true,
+			file:       "app.whl",
+			sigFiles:   map[string]string{"app.whl.sigstore.json": s.bundle(t, "wheel")},
+			wantStatus: http.StatusOK,
+			wantState:  VerificationVerified,
+		},
+		{
+			name:       "bundle referrer",
+			onDownload: true,
+			file:       "app.whl",
+			bundle:     s.bundle(t, "wheel"),
+			wantStatus: http.StatusOK,
+			wantState:  VerificationVerified,
+		},
+		{
+			name:       "unsigned",
+			onDownload: true,
+			file:       "app.whl",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "untrusted key",
+			onDownload: true,
+			file:       "app.whl",
+			sigFiles:   map[string]string{"app.whl.sig": other.sign(t, "wheel")},
+			bundle:     other.bundle(t, "wheel"),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "unsigned not enforced",
+			file:       "app.whl",
+			wantStatus: http.StatusOK,
+			wantState:  VerificationUnsigned,
+		},
+		{
+			name:       "invalid not enforced",
+			file:       "app.whl",
+			sigFiles:   map[string]string{"app.whl.sig": other.sign(t, "wheel")},
+			wantStatus: http.StatusOK,
+			wantState:  VerificationInvalid,
+		},
+		{
+			name:       "file not covered",
+			onDownload: true,
+			file:       "app.zip",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			fake := oci.NewFakeRegistry()
+			add := func(name, content string) {
+				if _, err := fake.AddFile(ctx, &oci.RepoFile{OwningRepo: "app", OwningTag: "1.0.0", Name: name}, strings.NewReader(content)); err != nil {
+					t.Fatalf("AddFile() error = %v", err)
+				}
+			}
+			add(tc.file, "wheel")
+			for name, content := range tc.sigFiles {
+				add(name, content)
+			}
+			if tc.bundle != "" {
+				f := &oci.RepoFile{OwningRepo: "app", OwningTag: "1.0.0", Name: "bundle.json"}
+				if _, err := fake.AddReferrer(ctx, f, "application/vnd.dev.sigstore.bundle.v0.3+json", strings.NewReader(tc.bundle)); err != nil {
+					t.Fatalf("AddReferrer() error = %v", err)
+				}
+			}
+
+			p := *s.policy
+			p.OnDownload = tc.onDownload
+			reg := p.Registry(fake)
+
+			resp := httptest.NewRecorder()
+			GetFile(resp, httptest.NewRequest(http.MethodGet, "/", nil), reg, &oci.RepoFile{OwningRepo: "app", OwningTag: "1.0.0", Name: tc.file}, TextError, nil)
+
+			if got, want := resp.Code, tc.wantStatus; got != want {
+				t.Errorf("Status code = %d, want %d, body: %s", got, want, resp.Body.String())
+			}
+			if got, want := resp.Header().Get(VerificationHeader), tc.wantState; got != want {
+				t.Errorf("%s = %q, want %q", VerificationHeader, got, want)
+			}
+			if _, ok := reg.(ReferrerRegistry); !ok {
+				t.Errorf("Verifying registry doesn't pass referrers through")
+			}
+		})
+	}
+}
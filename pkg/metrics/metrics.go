@@ -0,0 +1,129 @@
+// Package metrics defines the Prometheus metrics of the server.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "ocifactory"
+
+// Latency buckets in seconds. They go up to minutes since artifact uploads
+// and downloads can be large.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// Registry holds all the metrics of the server. It's separate from the
+// default registry so only metrics of ocifactory are exposed.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// Requests counts the HTTP requests by repo type, route, method and status.
+	Requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by repo type, route, method and status.",
+	}, []string{"repo_type", "route", "method", "status"})
+
+	// RequestDuration observes the HTTP request latencies by repo type, route,
+	// method and status.
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by repo type, route, method and status.",
+		Buckets:   latencyBuckets,
+	}, []string{"repo_type", "route", "method", "status"})
+
+	// UploadedBytes counts the request body bytes by repo type.
+	UploadedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_uploaded_bytes_total",
+		Help:      "Number of request body bytes received by repo type.",
+	}, []string{"repo_type"})
+
+	// DownloadedBytes counts the response body bytes by repo type.
+	DownloadedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_downloaded_bytes_total",
+		Help:      "Number of response body bytes sent by repo type.",
+	}, []string{"repo_type"})
+
+	// BackendDuration observes the latencies of backend registry calls by
+	// operation, e.g. Resolve, Fetch, Push or Tag.
+	BackendDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "backend_request_duration_seconds",
+		Help:      "Latency of backend registry calls by operation.",
+		Buckets:   latencyBuckets,
+	}, []string{"operation"})
+
+	// BackendErrors counts the failed backend registry calls by operation.
+	// Lookups of missing content are not errors.
+	BackendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "backend_errors_total",
+		Help:      "Number of failed backend registry calls by operation.",
+	}, []string{"operation"})
+
+	// LandingBytes is the size of the files currently in the landing dir.
+	LandingBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "landing_dir_bytes",
+		Help:      "Size of the files currently in the landing dir.",
+	})
+
+	// LandingFiles is the number of files currently in the landing dir.
+	LandingFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "landing_dir_files",
+		Help:      "Number of files currently in the landing dir.",
+	})
+
+	// UploadsInFlight is the number of file uploads to the backend in progress.
+	UploadsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "uploads_in_flight",
+		Help:      "Number of file uploads to the backend registry in progress.",
+	})
+
+	// WebhookDeliveries counts the webhook deliveries by result: success,
+	// failure after all retries, or dropped because the queue was full.
+	WebhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_deliveries_total",
+		Help:      "Number of webhook deliveries by result.",
+	}, []string{"result"})
+
+	// RetentionDeletions counts the versions selected by retention rules by
+	// result: deleted, failed, or reported in a dry run.
+	RetentionDeletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "retention_deletions_total",
+		Help:      "Number of versions selected by retention rules by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Requests,
+		RequestDuration,
+		UploadedBytes,
+		DownloadedBytes,
+		BackendDuration,
+		BackendErrors,
+		LandingBytes,
+		LandingFiles,
+		UploadsInFlight,
+		WebhookDeliveries,
+		RetentionDeletions,
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,136 @@
+package oci
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// errChunkedUnsupported is returned when the backend rejects a chunked upload
+// before accepting any content, so the content can still be uploaded another way.
+var errChunkedUnsupported = errors.New("chunked upload is not supported")
+
+// chunkedUploader is implemented by backends that accept chunked blob uploads.
+type chunkedUploader interface {
+	// pushChunks uploads first and then the rest of the content in chunks of
+	// len(first) bytes. The buffer of first is reused for the following chunks.
+	pushChunks(ctx context.Context, f *RepoFile, first []byte, rest io.Reader) (ocispec.Descriptor, error)
+}
+
+// remoteRepo is a remote repository that also supports chunked blob uploads.
+// See https://github.com/opencontainers/distribution-spec/blob/main/spec.md#pushing-a-blob-in-chunks
+type remoteRepo struct {
+	*remote.Repository
+}
+
+func (r *remoteRepo) uploadChunks(ctx context.Context, f *RepoFile, first []byte, rest io.Reader) (ocispec.Descriptor, error) {
+	// Pushing usually requires both pull and push actions.
+	ctx = auth.AppendRepositoryScope(ctx, r.Reference, auth.ActionPull, auth.ActionPush)
+
+	scheme := "https"
+	if r.PlainHTTP {
+		scheme = "http"
+	}
+	startURL := fmt.Sprintf("%s://%s/v2/%s/blobs/uploads/", scheme, r.Reference.Host(), r.Reference.Repository)
+	resp, err := r.do(ctx, http.MethodPost, startURL, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to start blob upload: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return ocispec.Descriptor{}, fmt.Errorf("%w: start upload: %s", errChunkedUnsupported, resp.Status)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to get blob upload location: %w", err)
+	}
+
+	d := digest.Canonical.Digester()
+	var offset int64
+	chunk := first
+	for len(chunk) > 0 {
+		d.Hash().Write(chunk)
+		resp, err := r.do(ctx, http.MethodPatch, location.String(), chunk, func(req *http.Request) {
+			req.Header.Set("Content-Type", "application/octet-stream")
+			req.Header.Set("Content-Range", strconv.FormatInt(offset, 10)+"-"+strconv.FormatInt(offset+int64(len(chunk))-1, 10))
+		})
+		if err != nil {
+			r.cancelUpload(ctx, location.String())
+			return ocispec.Descriptor{}, fmt.Errorf("failed to upload blob chunk: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			r.cancelUpload(ctx, location.String())
+			if offset == 0 {
+				return ocispec.Descriptor{}, fmt.Errorf("%w: upload chunk: %s", errChunkedUnsupported, resp.Status)
+			}
+			return ocispec.Descriptor{}, fmt.Errorf("failed to upload blob chunk at offset %d: %s", offset, resp.Status)
+		}
+		if location, err = resp.Location(); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to get blob upload location: %w", err)
+		}
+		offset += int64(len(chunk))
+
+		n, err := io.ReadFull(rest, first)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			r.cancelUpload(ctx, location.String())
+			return ocispec.Descriptor{}, fmt.Errorf("failed to read file: %w", err)
+		}
+		chunk = first[:n]
+	}
+
+	// Cross check the digest before the blob is committed.
+	fileDesc := fileDescriptor(f, d.Digest(), offset)
+	if err := checkDigest(f, fileDesc); err != nil {
+		r.cancelUpload(ctx, location.String())
+		return ocispec.Descriptor{}, err
+	}
+
+	q := location.Query()
+	q.Set("digest", fileDesc.Digest.String())
+	location.RawQuery = q.Encode()
+	resp, err = r.do(ctx, http.MethodPut, location.String(), nil)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to complete blob upload: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to complete blob upload: %s", resp.Status)
+	}
+
+	return fileDesc, nil
+}
+
+// cancelUpload cancels the upload session. It's best effort since the
+// registry eventually expires abandoned sessions anyway.
+func (r *remoteRepo) cancelUpload(ctx context.Context, location string) {
+	if resp, err := r.do(context.WithoutCancel(ctx), http.MethodDelete, location, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+func (r *remoteRepo) do(ctx context.Context, method, url string, body []byte, mods ...func(*http.Request)) (*http.Response, error) {
+	// Requests with a bytes.Reader body can be replayed by the auth client.
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for _, m := range mods {
+		m(req)
+	}
+
+	client := r.Client
+	if client == nil {
+		client = auth.DefaultClient
+	}
+	return client.Do(req) //nolint:wrapcheck // Want passthrough error.
+}
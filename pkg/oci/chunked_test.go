@@ -0,0 +1,259 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/google/go-cmp/cmp"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// fakeUploadServer implements the blob upload endpoints of the distribution spec.
+type fakeUploadServer struct {
+	rejectChunks bool
+
+	mu        sync.Mutex
+	session   []byte
+	chunks    []string
+	cancelled bool
+	blobs     map[string][]byte
+}
+
+func (s *fakeUploadServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodPost:
+		s.session = []byte{}
+		w.Header().Set("Location", "/v2/foobar/blobs/uploads/session")
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPatch:
+		if s.rejectChunks {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		if want := fmt.Sprintf("%d-%d", len(s.session), len(s.session)+len(b)-1); r.Header.Get("Content-Range") != want {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		s.session = append(s.session, b...)
+		s.chunks = append(s.chunks, string(b))
+		w.Header().Set("Location", "/v2/foobar/blobs/uploads/session")
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		d := r.URL.Query().Get("digest")
+		if digest.FromBytes(s.session).String() != d {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if s.blobs == nil {
+			s.blobs = make(map[string][]byte)
+		}
+		s.blobs[d] = s.session
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		s.cancelled = true
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestPushChunks(t *testing.T) {
+	t.Parallel()
+
+	content := "0123456789"
+
+	tests := []struct {
+		name          string
+		rejectChunks  bool
+		fileDigest    string
+		wantChunks    []string
+		wantCancelled bool
+		wantErr       string
+	}{
+		{
+			name:       "success",
+			wantChunks: []string{"0123", "4567", "89"},
+		},
+		{
+			name:          "chunks rejected",
+			rejectChunks:  true,
+			wantCancelled: true,
+			wantErr:       errChunkedUnsupported.Error(),
+		},
+		{
+			name:          "digest mismatch",
+			fileDigest:    "sha256:0000",
+			wantChunks:    []string{"0123", "4567", "89"},
+			wantCancelled: true,
+			wantErr:       "file digest mismatch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := &fakeUploadServer{rejectChunks: tt.rejectChunks}
+			srv := httptest.NewServer(s)
+			t.Cleanup(srv.Close)
+
+			repo := &remoteRepo{Repository: &remote.Repository{
+				Reference: registry.Reference{Registry: strings.TrimPrefix(srv.URL, "http://"), Repository: "foobar"},
+				PlainHTTP: true,
+			}}
+
+			f := &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "file.txt", Digest: tt.fileDigest}
+			rest := strings.NewReader(content)
+			first := make([]byte, 4)
+			if _, err := io.ReadFull(rest, first); err != nil {
+				t.Fatal(err)
+			}
+
+			desc, err := repo.pushChunks(context.Background(), f, first, rest)
+			if diff := testutil.DiffErrString(err, tt.wantErr); diff != "" {
+				t.Fatalf("pushChunks() error diff: %s", diff)
+			}
+			if diff := cmp.Diff(tt.wantChunks, s.chunks); diff != "" {
+				t.Errorf("uploaded chunks diff (-want, +got): %s", diff)
+			}
+			if s.cancelled != tt.wantCancelled {
+				t.Errorf("upload cancelled = %t, want %t", s.cancelled, tt.wantCancelled)
+			}
+			if err != nil {
+				return
+			}
+
+			wantDesc := ocispec.Descriptor{
+				MediaType: "text/plain",
+				Digest:    digest.FromString(content),
+				Size:      int64(len(content)),
+				Annotations: map[string]string{
+					FileNameAnnotation:      "file.txt",
+					ocispec.AnnotationTitle: "file.txt",
+				},
+			}
+			if diff := cmp.Diff(wantDesc, desc); diff != "" {
+				t.Errorf("pushChunks() descriptor diff (-want, +got): %s", diff)
+			}
+			if got := string(s.blobs[desc.Digest.String()]); got != content {
+				t.Errorf("uploaded blob = %q, want %q", got, content)
+			}
+		})
+	}
+}
+
+// chunkedRepo records the chunked uploads and pushes them to the in memory
+// store, or rejects them as a backend without chunked upload support would.
+type chunkedRepo struct {
+	*inMemoryRepo
+	reject bool
+	calls  int
+}
+
+func (r *chunkedRepo) pushChunks(ctx context.Context, f *RepoFile, first []byte, rest io.Reader) (ocispec.Descriptor, error) {
+	r.calls++
+	if r.reject {
+		return ocispec.Descriptor{}, errChunkedUnsupported
+	}
+	b, err := io.ReadAll(rest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	b = append(append([]byte{}, first...), b...)
+	desc := fileDescriptor(f, digest.FromBytes(b), int64(len(b)))
+	if err := r.Push(ctx, desc, strings.NewReader(string(b))); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func TestAddFileChunked(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		content   string
+		reject    bool
+		wantCalls int
+	}{
+		{
+			name:      "streamed",
+			content:   "0123456789",
+			wantCalls: 1,
+		},
+		{
+			name:      "single chunk",
+			content:   "012",
+			wantCalls: 0,
+		},
+		{
+			name:      "fallback to landing zone",
+			content:   "0123456789",
+			reject:    true,
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithLandingDir(t.TempDir()), WithChunkedUpload(4))
+			if err != nil {
+				t.Fatalf("NewRegistry() error = %v", err)
+			}
+			backend := &chunkedRepo{
+				inMemoryRepo: &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}},
+				reject:       tt.reject,
+			}
+			r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+				return backend, nil
+			}
+
+			f := &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "file.txt"}
+			if _, err := r.AddFile(ctx, f, strings.NewReader(tt.content)); err != nil {
+				t.Fatalf("AddFile() unexpected error: %v", err)
+			}
+			if backend.calls != tt.wantCalls {
+				t.Errorf("pushChunks() called %d times, want %d", backend.calls, tt.wantCalls)
+			}
+
+			_, rc, err := r.ReadFile(ctx, f)
+			if err != nil {
+				t.Fatalf("ReadFile() unexpected error: %v", err)
+			}
+			defer rc.Close()
+			b, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(b); got != tt.content {
+				t.Errorf("ReadFile() = %q, want %q", got, tt.content)
+			}
+		})
+	}
+}
+
+func TestWithChunkedUpload(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithChunkedUpload(0))
+	if diff := testutil.DiffErrString(err, "chunk size must be positive"); diff != "" {
+		t.Errorf("NewRegistry() error diff: %s", diff)
+	}
+}
@@ -0,0 +1,56 @@
+package oci
+
+import (
+	"sync"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Number of blobs to remember the source repository of.
+const maxBlobSources = 10000
+
+// blobSources is shared by all registries in the process, so a blob seen in a
+// repository of any mount can be mounted into the others on the same host.
+var blobSources = &blobIndex{capacity: maxBlobSources}
+
+// blobSource is a repository known to have a blob.
+type blobSource struct {
+	repo string // Full repository path without the host.
+	size int64
+}
+
+// blobIndex remembers the repositories recently known to have a blob. The
+// oldest blobs are forgotten first once it's full.
+type blobIndex struct {
+	capacity int
+
+	mu      sync.Mutex
+	sources map[string]blobSource
+	order   []string
+}
+
+func (b *blobIndex) add(host, repo string, desc ocispec.Descriptor) {
+	key := host + "@" + desc.Digest.String()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.sources == nil {
+		b.sources = make(map[string]blobSource)
+	}
+	if _, ok := b.sources[key]; !ok {
+		if len(b.order) >= b.capacity {
+			delete(b.sources, b.order[0])
+			b.order = b.order[1:]
+		}
+		b.order = append(b.order, key)
+	}
+	b.sources[key] = blobSource{repo: repo, size: desc.Size}
+}
+
+func (b *blobIndex) get(host string, d digest.Digest) (blobSource, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.sources[host+"@"+d.String()]
+	return s, ok
+}
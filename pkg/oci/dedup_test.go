@@ -0,0 +1,226 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestBlobIndex(t *testing.T) {
+	t.Parallel()
+
+	b := &blobIndex{capacity: 2}
+	d1, d2, d3 := digest.FromString("1"), digest.FromString("2"), digest.FromString("3")
+	b.add("example.com", "a", ocispec.Descriptor{Digest: d1, Size: 1})
+	b.add("example.com", "b", ocispec.Descriptor{Digest: d2, Size: 1})
+	b.add("example.com", "c", ocispec.Descriptor{Digest: d2, Size: 1}) // Most recent repo wins.
+	b.add("example.com", "c", ocispec.Descriptor{Digest: d3, Size: 1}) // Forgets d1.
+
+	if _, ok := b.get("example.com", d1); ok {
+		t.Errorf("get(%q) found, want forgotten", d1)
+	}
+	if got, ok := b.get("example.com", d2); !ok || got.repo != "c" {
+		t.Errorf("get(%q) = %v, %t, want repo c", d2, got, ok)
+	}
+	if _, ok := b.get("other.com", d3); ok {
+		t.Errorf("get(%q) on another host found, want not found", d3)
+	}
+}
+
+// mountingRepo is an in memory repository that supports cross repository
+// mounts from the other repositories of the test.
+type mountingRepo struct {
+	*inMemoryRepo
+	siblings map[string]*mountingRepo
+	refuse   bool // Refuse all mounts.
+
+	mu     sync.Mutex
+	pushed map[digest.Digest]int
+	mounts []string
+}
+
+func (r *mountingRepo) Push(ctx context.Context, desc ocispec.Descriptor, content io.Reader) error {
+	r.mu.Lock()
+	r.pushed[desc.Digest]++
+	r.mu.Unlock()
+	return r.inMemoryRepo.Push(ctx, desc, content)
+}
+
+func (r *mountingRepo) Mount(ctx context.Context, desc ocispec.Descriptor, fromRepo string, _ func() (io.ReadCloser, error)) error {
+	r.mu.Lock()
+	r.mounts = append(r.mounts, fromRepo)
+	r.mu.Unlock()
+
+	if r.refuse {
+		return errors.New("mount refused")
+	}
+	src, ok := r.siblings[strings.TrimPrefix(fromRepo, "team/")]
+	if !ok {
+		return errors.New("unknown source repository")
+	}
+	rc, err := src.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return r.inMemoryRepo.Push(ctx, desc, rc)
+}
+
+// errReader fails the test if the content is read.
+type errReader struct{ t *testing.T }
+
+func (r errReader) Read([]byte) (int, error) {
+	r.t.Errorf("content read, want skipped")
+	return 0, errors.New("content must not be read")
+}
+
+func TestAddFileDedup(t *testing.T) {
+	t.Parallel()
+
+	content := "shared content"
+	contentDigest := digest.FromString(content)
+
+	setup := func(t *testing.T, host string) (*Registry, map[string]*mountingRepo) {
+		t.Helper()
+		r, err := NewRegistry(&url.URL{Scheme: "https", Host: host, Path: "/team"}, WithLandingDir(t.TempDir()))
+		if err != nil {
+			t.Fatalf("NewRegistry() error = %v", err)
+		}
+		repos := make(map[string]*mountingRepo)
+		for _, name := range []string{"a", "b"} {
+			repos[name] = &mountingRepo{
+				inMemoryRepo: &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}},
+				siblings:     repos,
+				pushed:       make(map[digest.Digest]int),
+			}
+		}
+		r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+			return repos[f.OwningRepo], nil
+		}
+		return r, repos
+	}
+
+	readFile := func(t *testing.T, r *Registry, f *RepoFile) string {
+		t.Helper()
+		_, rc, err := r.ReadFile(context.Background(), f)
+		if err != nil {
+			t.Fatalf("ReadFile() unexpected error: %v", err)
+		}
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	t.Run("existing blob is not pushed again", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		r, repos := setup(t, "existing.example.com")
+		for _, tag := range []string{"v0", "v1"} {
+			if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: "a", OwningTag: tag, Name: "file.txt"}, strings.NewReader(content)); err != nil {
+				t.Fatalf("AddFile(%s) unexpected error: %v", tag, err)
+			}
+		}
+		if got := repos["a"].pushed[contentDigest]; got != 1 {
+			t.Errorf("blob pushed %d times, want 1", got)
+		}
+	})
+
+	t.Run("mount from sibling repository", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		r, repos := setup(t, "mount.example.com")
+		for _, repo := range []string{"a", "b"} {
+			if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: repo, OwningTag: "v0", Name: "file.txt"}, strings.NewReader(content)); err != nil {
+				t.Fatalf("AddFile(%s) unexpected error: %v", repo, err)
+			}
+		}
+		if got := repos["b"].pushed[contentDigest]; got != 0 {
+			t.Errorf("blob pushed %d times, want mounted", got)
+		}
+		if diff := cmp.Diff([]string{"team/a"}, repos["b"].mounts); diff != "" {
+			t.Errorf("mounts diff (-want, +got): %s", diff)
+		}
+		if got := readFile(t, r, &RepoFile{OwningRepo: "b", OwningTag: "v0", Name: "file.txt"}); got != content {
+			t.Errorf("ReadFile() = %q, want %q", got, content)
+		}
+	})
+
+	t.Run("refused mount falls back to push", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		r, repos := setup(t, "refused.example.com")
+		repos["b"].refuse = true
+		for _, repo := range []string{"a", "b"} {
+			if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: repo, OwningTag: "v0", Name: "file.txt"}, strings.NewReader(content)); err != nil {
+				t.Fatalf("AddFile(%s) unexpected error: %v", repo, err)
+			}
+		}
+		if got := repos["b"].pushed[contentDigest]; got != 1 {
+			t.Errorf("blob pushed %d times, want 1", got)
+		}
+		if got := readFile(t, r, &RepoFile{OwningRepo: "b", OwningTag: "v0", Name: "file.txt"}); got != content {
+			t.Errorf("ReadFile() = %q, want %q", got, content)
+		}
+	})
+
+	t.Run("known trusted digest skips the content", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		r, _ := setup(t, "known.example.com")
+		if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: "a", OwningTag: "v0", Name: "file.txt"}, strings.NewReader(content)); err != nil {
+			t.Fatalf("AddFile() unexpected error: %v", err)
+		}
+
+		f := &RepoFile{OwningRepo: "b", OwningTag: "v0", Name: "file.txt", Digest: contentDigest.String(), TrustedDigest: true}
+		if _, err := r.AddFile(ctx, f, errReader{t}); err != nil {
+			t.Fatalf("AddFile() unexpected error: %v", err)
+		}
+		if got := readFile(t, r, f); got != content {
+			t.Errorf("ReadFile() = %q, want %q", got, content)
+		}
+	})
+
+	t.Run("known client digest is checked", func(t *testing.T) {
+		t.Parallel()
+
+		ctx := context.Background()
+		r, repos := setup(t, "client.example.com")
+		if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: "a", OwningTag: "v0", Name: "file.txt"}, strings.NewReader(content)); err != nil {
+			t.Fatalf("AddFile() unexpected error: %v", err)
+		}
+
+		f := &RepoFile{OwningRepo: "b", OwningTag: "v0", Name: "file.txt", Digest: contentDigest.String()}
+		if _, err := r.AddFile(ctx, f, strings.NewReader("other content")); !errors.Is(err, ErrDigestMismatch) {
+			t.Errorf("AddFile() error = %v, want %v", err, ErrDigestMismatch)
+		}
+		if len(repos["b"].mounts) != 0 {
+			t.Errorf("mounts = %v, want none", repos["b"].mounts)
+		}
+
+		if _, err := r.AddFile(ctx, f, strings.NewReader(content)); err != nil {
+			t.Fatalf("AddFile() unexpected error: %v", err)
+		}
+		if got := repos["b"].pushed[contentDigest]; got != 0 {
+			t.Errorf("blob pushed %d times, want mounted", got)
+		}
+		if got := readFile(t, r, f); got != content {
+			t.Errorf("ReadFile() = %q, want %q", got, content)
+		}
+	})
+}
@@ -6,6 +6,9 @@ import (
 	"oras.land/oras-go/v2/registry/remote/errcode"
 )
 
+// ErrDigestMismatch is returned when the file digest differs from the expected one.
+var ErrDigestMismatch = errors.New("file digest mismatch")
+
 // HasCode returns true if the error is an ErrorResponse and has the given code.
 // The code is the HTTP status code.
 func HasCode(err error, code int) bool {
@@ -6,7 +6,9 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
+	"time"
 
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -16,12 +18,25 @@ import (
 type FakeRegistry struct {
 	Files map[string][]byte
 	Tags  map[string][]string
+
+	// Created has the upload time of the files by the keys of Files. Tests
+	// may change it to get stable times.
+	Created map[string]time.Time
+
+	// referrers has the referrers of the tags by "repo/tag".
+	referrers map[string][]*fakeReferrer
+}
+
+type fakeReferrer struct {
+	desc    *FileDescriptor
+	content []byte
 }
 
 func NewFakeRegistry() *FakeRegistry {
 	return &FakeRegistry{
-		Files: make(map[string][]byte),
-		Tags:  make(map[string][]string),
+		Files:   make(map[string][]byte),
+		Tags:    make(map[string][]string),
+		Created: make(map[string]time.Time),
 	}
 }
 
@@ -38,18 +53,48 @@ func (r *FakeRegistry) AddFile(ctx context.Context, f *RepoFile, ro io.Reader) (
 		return nil, err
 	}
 
+	desc := generateDescriptor(content, f)
+	if err := checkDigest(f, desc); err != nil {
+		return nil, err
+	}
+
 	key := f.OwningRepo + "/" + f.OwningTag + "/" + f.Name
 	r.Files[key] = content
+	if r.Created == nil {
+		r.Created = make(map[string]time.Time)
+	}
+	r.Created[key] = time.Now().UTC().Truncate(time.Second)
+	desc.Annotations[ocispec.AnnotationCreated] = r.Created[key].Format(time.RFC3339)
 
 	r.AddTag(f.OwningRepo, f.OwningTag)
 
-	desc := generateDescriptor(content, f)
-
 	return &FileDescriptor{
 		File: desc,
 	}, nil
 }
 
+func (r *FakeRegistry) AddFiles(ctx context.Context, uploads []*FileUpload) ([]*FileDescriptor, error) {
+	// Read everything first so a failed read doesn't leave some files added.
+	contents := make([][]byte, 0, len(uploads))
+	for _, u := range uploads {
+		content, err := io.ReadAll(u.Content)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, content)
+	}
+
+	descs := make([]*FileDescriptor, 0, len(uploads))
+	for i, u := range uploads {
+		desc, err := r.AddFile(ctx, u.RepoFile, bytes.NewReader(contents[i]))
+		if err != nil {
+			return nil, err
+		}
+		descs = append(descs, desc)
+	}
+	return descs, nil
+}
+
 func generateDescriptor(content []byte, f *RepoFile) ocispec.Descriptor {
 	h := sha256.New()
 	h.Write(content)
@@ -73,6 +118,9 @@ func (r *FakeRegistry) ReadFile(ctx context.Context, f *RepoFile) (*FileDescript
 	}
 
 	desc := generateDescriptor(content, f)
+	if created, ok := r.Created[key]; ok {
+		desc.Annotations[ocispec.AnnotationCreated] = created.Format(time.RFC3339)
+	}
 
 	return &FileDescriptor{
 		File: desc,
@@ -98,7 +146,114 @@ func (r *FakeRegistry) ListFiles(ctx context.Context, repo string) ([]*RepoFile,
 		if rp != repo {
 			continue
 		}
-		filesList = append(filesList, &RepoFile{Name: fn, OwningRepo: rp, OwningTag: tag})
+		filesList = append(filesList, &RepoFile{
+			Name:       fn,
+			OwningRepo: rp,
+			OwningTag:  tag,
+			Size:       int64(len(r.Files[key])),
+			Created:    r.Created[key],
+		})
 	}
 	return filesList, nil
 }
+
+func (r *FakeRegistry) DeleteFile(ctx context.Context, f *RepoFile) error {
+	key := f.OwningRepo + "/" + f.OwningTag + "/" + f.Name
+	if _, ok := r.Files[key]; !ok {
+		return fmt.Errorf("file not found: %s: %w", key, errdef.ErrNotFound)
+	}
+	delete(r.Files, key)
+	delete(r.Created, key)
+
+	// Like the registry, the tag goes away with its last file.
+	prefix := f.OwningRepo + "/" + f.OwningTag + "/"
+	for k := range r.Files {
+		if strings.HasPrefix(k, prefix) && !strings.Contains(strings.TrimPrefix(k, prefix), "/") {
+			return nil
+		}
+	}
+	r.removeTag(f.OwningRepo, f.OwningTag)
+	return nil
+}
+
+func (r *FakeRegistry) DeleteTagFiles(ctx context.Context, repo, tag string) error {
+	if !slices.Contains(r.Tags[repo], tag) {
+		return fmt.Errorf("tag not found: %s:%s: %w", repo, tag, errdef.ErrNotFound)
+	}
+	prefix := repo + "/" + tag + "/"
+	for k := range r.Files {
+		if strings.HasPrefix(k, prefix) && !strings.Contains(strings.TrimPrefix(k, prefix), "/") {
+			delete(r.Files, k)
+			delete(r.Created, k)
+		}
+	}
+	r.removeTag(repo, tag)
+	return nil
+}
+
+func (r *FakeRegistry) DeleteRepoFiles(ctx context.Context, repo string) error {
+	tags, ok := r.Tags[repo]
+	if !ok {
+		return fmt.Errorf("repository not found: %s: %w", repo, errdef.ErrNotFound)
+	}
+	// Tags are added once per file, so they may repeat.
+	for _, tag := range slices.Compact(slices.Sorted(slices.Values(tags))) {
+		if err := r.DeleteTagFiles(ctx, repo, tag); err != nil {
+			return err
+		}
+	}
+	delete(r.Tags, repo)
+	return nil
+}
+
+func (r *FakeRegistry) AddReferrer(ctx context.Context, f *RepoFile, artifactType string, ro io.Reader) (*FileDescriptor, error) {
+	if !slices.Contains(r.Tags[f.OwningRepo], f.OwningTag) {
+		return nil, fmt.Errorf("tag not found: %s:%s: %w", f.OwningRepo, f.OwningTag, errdef.ErrNotFound)
+	}
+	content, err := io.ReadAll(ro)
+	if err != nil {
+		return nil, err
+	}
+
+	key := f.OwningRepo + "/" + f.OwningTag
+	desc := &FileDescriptor{
+		Manifest: ocispec.Descriptor{
+			MediaType:    ocispec.MediaTypeImageManifest,
+			ArtifactType: artifactType,
+			Digest:       digest.FromString(key + "/" + artifactType + "/" + f.Name + "/" + string(content)),
+		},
+		File: generateDescriptor(content, f),
+	}
+	if r.referrers == nil {
+		r.referrers = make(map[string][]*fakeReferrer)
+	}
+	r.referrers[key] = append(r.referrers[key], &fakeReferrer{desc: desc, content: content})
+	return desc, nil
+}
+
+func (r *FakeRegistry) ListReferrers(ctx context.Context, repo, tag, artifactType string) ([]ocispec.Descriptor, error) {
+	if !slices.Contains(r.Tags[repo], tag) {
+		return nil, fmt.Errorf("tag not found: %s:%s: %w", repo, tag, errdef.ErrNotFound)
+	}
+	var descs []ocispec.Descriptor
+	for _, ref := range r.referrers[repo+"/"+tag] {
+		if artifactType == "" || ref.desc.Manifest.ArtifactType == artifactType {
+			descs = append(descs, ref.desc.Manifest)
+		}
+	}
+	return descs, nil
+}
+
+func (r *FakeRegistry) ReadReferrer(ctx context.Context, repo, tag, referrer string) (*FileDescriptor, io.ReadCloser, error) {
+	for _, ref := range r.referrers[repo+"/"+tag] {
+		if ref.desc.Manifest.Digest.String() == referrer {
+			return ref.desc, io.NopCloser(bytes.NewReader(ref.content)), nil
+		}
+	}
+	return nil, nil, fmt.Errorf("referrer not found: %s: %w", referrer, errdef.ErrNotFound)
+}
+
+func (r *FakeRegistry) removeTag(repo, tag string) {
+	delete(r.referrers, repo+"/"+tag)
+	r.Tags[repo] = slices.DeleteFunc(r.Tags[repo], func(t string) bool { return t == tag })
+}
@@ -384,9 +384,9 @@ func TestFakeRegistry_ListFiles(t *testing.T) {
 				"other/repo/v1.0.0/file4.txt":   []byte("content4"),
 			},
 			want: []*RepoFile{
-				{Name: "file1.txt", OwningRepo: "example/repo", OwningTag: "v1.0.0"},
-				{Name: "file2.txt", OwningRepo: "example/repo", OwningTag: "v1.0.0"},
-				{Name: "file3.txt", OwningRepo: "example/repo", OwningTag: "v2.0.0"},
+				{Name: "file1.txt", OwningRepo: "example/repo", OwningTag: "v1.0.0", Size: 8},
+				{Name: "file2.txt", OwningRepo: "example/repo", OwningTag: "v1.0.0", Size: 8},
+				{Name: "file3.txt", OwningRepo: "example/repo", OwningTag: "v2.0.0", Size: 8},
 			},
 			wantErr: false,
 		},
@@ -0,0 +1,135 @@
+package oci
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// tracerName is the instrumentation scope of the spans of the package.
+const tracerName = "github.com/yolocs/ocifactory/pkg/oci"
+
+// Span attribute keys of the package.
+const (
+	attrRepo      = attribute.Key("oci.repo")
+	attrTag       = attribute.Key("oci.tag")
+	attrDigest    = attribute.Key("oci.digest")
+	attrFile      = attribute.Key("oci.file")
+	attrSize      = attribute.Key("oci.size")
+	attrReference = attribute.Key("oci.reference")
+)
+
+// startSpan starts a child span of the span in ctx. The tracer is looked up
+// each time so that it follows the global tracer provider.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...)) //nolint:spancheck // Ended by the caller.
+}
+
+// endSpan records the error, if any, and ends the span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// The remote repository calls are instrumented to tell apart slowness of the
+// backend registry from slowness of the server.
+
+// instrument starts a span of the backend call. The returned function ends the
+// span and records the latency and the error of the call. Lookups of missing
+// content are expected and not counted as errors.
+func (r *remoteRepo) instrument(ctx context.Context, op string, attrs ...attribute.KeyValue) (context.Context, func(error)) {
+	start := time.Now()
+	attrs = append(attrs, attrRepo.String(r.Reference.Repository))
+	ctx, span := startSpan(ctx, "backend."+op, append(attrs, attribute.String("oci.operation", op))...)
+	return ctx, func(err error) {
+		metrics.BackendDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+		if err != nil && !errors.Is(err, errdef.ErrNotFound) {
+			metrics.BackendErrors.WithLabelValues(op).Inc()
+			endSpan(span, err)
+			return
+		}
+		span.End()
+	}
+}
+
+func (r *remoteRepo) Resolve(ctx context.Context, reference string) (desc ocispec.Descriptor, err error) {
+	ctx, done := r.instrument(ctx, "Resolve", attrReference.String(reference))
+	defer func() { done(err) }()
+	return r.Repository.Resolve(ctx, reference) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (r *remoteRepo) Fetch(ctx context.Context, target ocispec.Descriptor) (rc io.ReadCloser, err error) {
+	ctx, done := r.instrument(ctx, "Fetch", attrDigest.String(target.Digest.String()), attrSize.Int64(target.Size))
+	defer func() { done(err) }()
+	return r.Repository.Fetch(ctx, target) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (r *remoteRepo) Exists(ctx context.Context, target ocispec.Descriptor) (ok bool, err error) {
+	ctx, done := r.instrument(ctx, "Exists", attrDigest.String(target.Digest.String()))
+	defer func() { done(err) }()
+	return r.Repository.Exists(ctx, target) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (r *remoteRepo) Push(ctx context.Context, expected ocispec.Descriptor, content io.Reader) (err error) {
+	ctx, done := r.instrument(ctx, "Push", attrDigest.String(expected.Digest.String()), attrSize.Int64(expected.Size))
+	defer func() { done(err) }()
+	return r.Repository.Push(ctx, expected, content) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (r *remoteRepo) Tag(ctx context.Context, desc ocispec.Descriptor, reference string) (err error) {
+	ctx, done := r.instrument(ctx, "Tag", attrDigest.String(desc.Digest.String()), attrReference.String(reference))
+	defer func() { done(err) }()
+	return r.Repository.Tag(ctx, desc, reference) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (r *remoteRepo) Tags(ctx context.Context, last string, fn func(tags []string) error) (err error) {
+	ctx, done := r.instrument(ctx, "Tags")
+	defer func() { done(err) }()
+	return r.Repository.Tags(ctx, last, fn) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (r *remoteRepo) Delete(ctx context.Context, target ocispec.Descriptor) (err error) {
+	ctx, done := r.instrument(ctx, "Delete", attrDigest.String(target.Digest.String()))
+	defer func() { done(err) }()
+	return r.Repository.Delete(ctx, target) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (r *remoteRepo) Mount(ctx context.Context, desc ocispec.Descriptor, fromRepo string, getContent func() (io.ReadCloser, error)) (err error) {
+	ctx, done := r.instrument(ctx, "Mount", attrDigest.String(desc.Digest.String()), attribute.String("oci.from_repo", fromRepo))
+	defer func() { done(err) }()
+	return r.Repository.Mount(ctx, desc, fromRepo, getContent) //nolint:wrapcheck // Want passthrough error.
+}
+
+func (r *remoteRepo) pushChunks(ctx context.Context, f *RepoFile, first []byte, rest io.Reader) (desc ocispec.Descriptor, err error) {
+	ctx, done := r.instrument(ctx, "PushChunks", attrFile.String(f.Name))
+	defer func() { done(err) }()
+	return r.uploadChunks(ctx, f, first, rest)
+}
+
+// landingUsage counts the bytes written to the landing dir.
+type landingUsage struct{}
+
+func (landingUsage) Write(p []byte) (int, error) {
+	metrics.LandingBytes.Add(float64(len(p)))
+	return len(p), nil
+}
+
+// removeLanded removes the landed file and releases its landing dir usage.
+func removeLanded(name string, size int64) {
+	os.Remove(name)
+	metrics.LandingFiles.Dec()
+	metrics.LandingBytes.Sub(float64(size))
+}
@@ -0,0 +1,145 @@
+package oci
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/yolocs/ocifactory/pkg/metrics"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func TestRemoteRepoInstrumented(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	t.Cleanup(srv.Close)
+
+	repo := &remoteRepo{Repository: &remote.Repository{
+		Reference: registry.Reference{Registry: strings.TrimPrefix(srv.URL, "http://"), Repository: "foobar"},
+		PlainHTTP: true,
+	}}
+
+	samples := func(op string) uint64 {
+		var m dto.Metric
+		if err := metrics.BackendDuration.WithLabelValues(op).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatalf("failed to read BackendDuration: %v", err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+	resolves, resolveErrs := samples("Resolve"), testutil.ToFloat64(metrics.BackendErrors.WithLabelValues("Resolve"))
+	deletes, deleteErrs := samples("Delete"), testutil.ToFloat64(metrics.BackendErrors.WithLabelValues("Delete"))
+
+	ctx := context.Background()
+	if _, err := repo.Resolve(ctx, "v0"); err == nil {
+		t.Errorf("Resolve() got nil error, want not found")
+	}
+	desc := ocispec.Descriptor{MediaType: "application/octet-stream", Digest: digest.FromString("hello"), Size: 5}
+	if err := repo.Delete(ctx, desc); err == nil {
+		t.Errorf("Delete() got nil error, want bad request")
+	}
+
+	if got, want := samples("Resolve")-resolves, uint64(1); got != want {
+		t.Errorf("Resolve samples = %d, want %d", got, want)
+	}
+	if got := testutil.ToFloat64(metrics.BackendErrors.WithLabelValues("Resolve")) - resolveErrs; got != 0 {
+		t.Errorf("Resolve errors = %v, want 0 for not found", got)
+	}
+	if got, want := samples("Delete")-deletes, uint64(1); got != want {
+		t.Errorf("Delete samples = %d, want %d", got, want)
+	}
+	if got, want := testutil.ToFloat64(metrics.BackendErrors.WithLabelValues("Delete"))-deleteErrs, 1.0; got != want {
+		t.Errorf("Delete errors = %v, want %v", got, want)
+	}
+}
+
+func TestRegistrySpans(t *testing.T) {
+	t.Parallel()
+
+	// This is the only test of the package that sets the global tracer
+	// provider. Spans of other tests are told apart by the trace ID.
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+
+	r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithLandingDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+	r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+		return memRepo, nil
+	}
+
+	ctx, root := otel.Tracer("test").Start(context.Background(), "publish")
+	f := &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "test.txt"}
+	if _, err := r.AddFile(ctx, f, strings.NewReader("hello")); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+	if _, rc, err := r.ReadFile(ctx, f); err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	} else {
+		rc.Close()
+	}
+	root.End()
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range sr.Ended() {
+		if s.SpanContext().TraceID() == root.SpanContext().TraceID() {
+			spans[s.Name()] = s
+		}
+	}
+
+	wantDigest := digest.FromString("hello").String()
+	cases := []struct {
+		span      string
+		wantAttrs map[attribute.Key]string
+	}{
+		{span: "oci.AddFiles", wantAttrs: map[attribute.Key]string{attrRepo: "foobar", attrTag: "v0"}},
+		{span: "oci.uploadFile", wantAttrs: map[attribute.Key]string{attrFile: "test.txt", attrDigest: wantDigest}},
+		{span: "oci.landFile", wantAttrs: map[attribute.Key]string{attrFile: "test.txt", attrDigest: wantDigest}},
+		{span: "oci.commitFiles", wantAttrs: map[attribute.Key]string{attrTag: "v0"}},
+		{span: "oci.manifestLayers"},
+		{span: "oci.ReadFile", wantAttrs: map[attribute.Key]string{attrRepo: "foobar", attrTag: "v0", attrFile: "test.txt"}},
+	}
+	for _, tc := range cases {
+		s, ok := spans[tc.span]
+		if !ok {
+			t.Errorf("span %q not recorded, got %v", tc.span, slices.Collect(maps.Keys(spans)))
+			continue
+		}
+		attrs := make(map[attribute.Key]string)
+		for _, kv := range s.Attributes() {
+			attrs[kv.Key] = kv.Value.Emit()
+		}
+		for k, want := range tc.wantAttrs {
+			if got := attrs[k]; got != want {
+				t.Errorf("span %q attribute %q = %q, want %q", tc.span, k, got, want)
+			}
+		}
+	}
+	if s, ok := spans["oci.uploadFile"]; ok && s.Parent().SpanID() != spans["oci.AddFiles"].SpanContext().SpanID() {
+		t.Errorf("span oci.uploadFile is not a child of oci.AddFiles")
+	}
+}
@@ -0,0 +1,46 @@
+package oci
+
+import "sync"
+
+// tagLocks is shared by all registries in the process, so mounts or group
+// members backed by the same repository still serialize their writes.
+var tagLocks = &keyedMutex{}
+
+// keyedMutex holds a mutex per key. Mutexes are dropped once nobody holds or
+// waits for them, so the map doesn't grow with every tag ever written.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*refMutex
+}
+
+type refMutex struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the key and returns the func to unlock it.
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*refMutex)
+	}
+	m, ok := k.locks[key]
+	if !ok {
+		m = &refMutex{}
+		k.locks[key] = m
+	}
+	m.refs++
+	k.mu.Unlock()
+
+	m.Lock()
+	return func() {
+		m.Unlock()
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		m.refs--
+		if m.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
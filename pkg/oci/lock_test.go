@@ -0,0 +1,32 @@
+package oci
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	t.Parallel()
+
+	k := &keyedMutex{}
+	var count int
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := k.lock("repo:tag")
+			defer unlock()
+			count++ // Would race without the lock.
+		}()
+	}
+	wg.Wait()
+
+	if count != 100 {
+		t.Errorf("count = %d, want 100", count)
+	}
+	if len(k.locks) != 0 {
+		t.Errorf("locks not released: %v", k.locks)
+	}
+}
@@ -0,0 +1,212 @@
+package oci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/audit"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry"
+)
+
+// referrersTagRegExp matches the tags of the referrers tag schema, which
+// backends without the referrers API use to index the referrers of a manifest.
+var referrersTagRegExp = regexp.MustCompile(`^sha256-[a-f0-9]{64}$`)
+
+// isReferrersTag returns true if the tag is a referrers index of the tag schema
+// rather than a tag that owns files.
+func isReferrersTag(tag string) bool {
+	return referrersTagRegExp.MatchString(tag)
+}
+
+// AddReferrer attaches the content to the manifest of the tag as an OCI
+// referrer of the artifact type, e.g. a signature, an attestation or an SBOM.
+// f names the tag of the subject and the file name of the content. Backends
+// without the referrers API get the tag schema fallback. Returns a not found
+// error if the tag doesn't exist.
+//
+// Adding or removing files of the tag later moves its referrers to the new
+// manifest.
+func (r *Registry) AddReferrer(ctx context.Context, f *RepoFile, artifactType string, ro io.Reader) (_ *FileDescriptor, err error) {
+	ctx, span := startSpan(ctx, "oci.AddReferrer", attrRepo.String(f.OwningRepo), attrTag.String(f.OwningTag), attrFile.String(f.Name))
+	defer func() { endSpan(span, err) }()
+
+	if artifactType == "" {
+		return nil, fmt.Errorf("artifact type is required")
+	}
+
+	backendRepo, err := r.newBackendFunc(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	fileDesc, err := r.uploadFile(ctx, backendRepo, &FileUpload{RepoFile: f, Content: ro})
+	if err != nil {
+		return nil, err
+	}
+	annotations := changeAnnotations(ctx, time.Now())
+	fileDesc.Annotations = maps.Clone(fileDesc.Annotations)
+	maps.Copy(fileDesc.Annotations, annotations)
+
+	// Files committed concurrently move the referrers of the manifest they
+	// replace, so the subject can't change while the referrer is pushed.
+	unlock := tagLocks.lock(r.baseURL.Host + r.baseURL.Path + "/" + f.OwningRepo + ":" + f.OwningTag)
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		subject, err := resolveTag(ctx, backendRepo, f.OwningTag)
+		if err != nil {
+			return nil, err
+		}
+		if subject.Digest == "" {
+			return nil, fmt.Errorf("tag %q not found: %w", f.OwningTag, errdef.ErrNotFound)
+		}
+
+		packOpts := oras.PackManifestOptions{
+			Subject:             &subject,
+			Layers:              []ocispec.Descriptor{fileDesc},
+			ManifestAnnotations: annotations,
+		}
+		referrerDesc, err := oras.PackManifest(ctx, backendRepo, oras.PackManifestVersion1_1, artifactType, packOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pack referrer manifest: %w", err)
+		}
+
+		// A writer in another process could have moved the tag before it saw
+		// the new referrer.
+		current, err := resolveTag(ctx, backendRepo, f.OwningTag)
+		if err != nil {
+			return nil, err
+		}
+		if current.Digest == subject.Digest {
+			blobSources.add(r.baseURL.Host, r.repoPath(f.OwningRepo), fileDesc)
+			audit.Record(ctx, &audit.Event{
+				Action:   audit.ActionPublish,
+				Repo:     f.OwningRepo,
+				Tag:      f.OwningTag,
+				File:     f.Name,
+				Digest:   fileDesc.Digest.String(),
+				Manifest: referrerDesc.Digest.String(),
+			})
+			return &FileDescriptor{Manifest: referrerDesc, File: fileDesc}, nil
+		}
+		if attempt == maxCommitAttempts {
+			return nil, fmt.Errorf("failed to add referrer %q to %s: tag %q kept changing after %d attempts", f.Name, f.OwningRepo, f.OwningTag, attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to add referrer %q to %s: %w", f.Name, f.OwningRepo, ctx.Err())
+		case <-time.After(time.Duration(attempt) * commitRetryDelay):
+		}
+	}
+}
+
+// ListReferrers lists the referrer manifests of the manifest of the tag. If
+// artifactType is set, only referrers of that type are listed. The descriptors
+// have the artifact type and the annotations of the referrers.
+func (r *Registry) ListReferrers(ctx context.Context, repo, tag, artifactType string) (_ []ocispec.Descriptor, err error) {
+	ctx, span := startSpan(ctx, "oci.ListReferrers", attrRepo.String(repo), attrTag.String(tag))
+	defer func() { endSpan(span, err) }()
+
+	backendRepo, err := r.newBackendFunc(ctx, &RepoFile{OwningRepo: repo})
+	if err != nil {
+		return nil, err
+	}
+	subject, err := backendRepo.Resolve(ctx, tag)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve manifest for tag %q: %w", tag, err)
+	}
+	refs, err := registry.Referrers(ctx, backendRepo, subject, artifactType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers of tag %q: %w", tag, err)
+	}
+	return refs, nil
+}
+
+// ReadReferrer reads the content of a referrer of the manifest of the tag by
+// the digest of the referrer manifest. The caller must close the reader.
+// Returns a not found error if the manifest of the tag doesn't have it.
+func (r *Registry) ReadReferrer(ctx context.Context, repo, tag, referrer string) (_ *FileDescriptor, _ io.ReadCloser, err error) {
+	ctx, span := startSpan(ctx, "oci.ReadReferrer", attrRepo.String(repo), attrTag.String(tag), attrDigest.String(referrer))
+	defer func() { endSpan(span, err) }()
+
+	refs, err := r.ListReferrers(ctx, repo, tag, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	backendRepo, err := r.newBackendFunc(ctx, &RepoFile{OwningRepo: repo})
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ref := range refs {
+		if ref.Digest != digest.Digest(referrer) {
+			continue
+		}
+		manifest, err := fetchManifest(ctx, backendRepo, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(manifest.Layers) == 0 {
+			return nil, nil, fmt.Errorf("referrer %q has no content: %w", referrer, errdef.ErrNotFound)
+		}
+		rc, err := backendRepo.Fetch(ctx, manifest.Layers[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch referrer content: %w", err)
+		}
+		return &FileDescriptor{Manifest: ref, File: manifest.Layers[0]}, rc, nil
+	}
+	return nil, nil, fmt.Errorf("referrer %q not found in tag %q: %w", referrer, tag, errdef.ErrNotFound)
+}
+
+// copyReferrers pushes a copy of the referrers of a manifest with the new
+// manifest as their subject. The referrers of the old manifest are kept like
+// the old manifest itself.
+func copyReferrers(ctx context.Context, backendRepo destRepo, from, to ocispec.Descriptor) (err error) {
+	ctx, span := startSpan(ctx, "oci.copyReferrers", attrDigest.String(from.Digest.String()))
+	defer func() { endSpan(span, err) }()
+
+	refs, err := registry.Referrers(ctx, backendRepo, from, "")
+	if err != nil {
+		return fmt.Errorf("failed to list referrers of manifest %q: %w", from.Digest, err)
+	}
+	for _, ref := range refs {
+		manifest, err := fetchManifest(ctx, backendRepo, ref)
+		if err != nil {
+			return err
+		}
+		manifest.Subject = &to
+		b, err := json.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("failed to marshal referrer manifest: %w", err)
+		}
+		if _, err := oras.PushBytes(ctx, backendRepo, manifest.MediaType, b); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return fmt.Errorf("failed to push referrer manifest: %w", err)
+		}
+	}
+	return nil
+}
+
+// deleteReferrers deletes the referrers of a manifest that is about to be
+// deleted.
+func deleteReferrers(ctx context.Context, backendRepo destRepo, subject ocispec.Descriptor) error {
+	refs, err := registry.Referrers(ctx, backendRepo, subject, "")
+	if err != nil {
+		return fmt.Errorf("failed to list referrers of manifest %q: %w", subject.Digest, err)
+	}
+	for _, ref := range refs {
+		if err := backendRepo.Delete(ctx, ref); err != nil {
+			return fmt.Errorf("failed to delete referrer %q: %w", ref.Digest, err)
+		}
+	}
+	return nil
+}
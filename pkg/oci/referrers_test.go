@@ -0,0 +1,164 @@
+package oci
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/google/go-cmp/cmp"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/yolocs/ocifactory/pkg/audit"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry"
+)
+
+const (
+	bundleType = "application/vnd.dev.sigstore.bundle.v0.3+json"
+	sbomType   = "application/spdx+json"
+)
+
+func TestIsReferrersTag(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		tag  string
+		want bool
+	}{
+		{tag: "sha256-" + strings.Repeat("a", 64), want: true},
+		{tag: "sha256-" + strings.Repeat("a", 63)},
+		{tag: "1.0.0"},
+		{tag: "sha256-latest"},
+	}
+
+	for _, tc := range cases {
+		if got := isReferrersTag(tc.tag); got != tc.want {
+			t.Errorf("isReferrersTag(%q) = %t, want %t", tc.tag, got, tc.want)
+		}
+	}
+}
+
+func TestReferrers(t *testing.T) {
+	t.Parallel()
+
+	ctx := audit.WithRequest(context.Background(), &audit.Request{Identity: "ci", UserAgent: "cosign/2.4"})
+	r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithLandingDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+	r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+		return memRepo, nil
+	}
+
+	if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v1", Name: "a.whl"}, strings.NewReader("a")); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+
+	t.Run("missing tag", func(t *testing.T) {
+		_, err := r.AddReferrer(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v2", Name: "a.sigstore.json"}, bundleType, strings.NewReader("{}"))
+		if diff := testutil.DiffErrString(err, `tag "v2" not found`); diff != "" {
+			t.Errorf("AddReferrer() error diff: %s", diff)
+		}
+	})
+
+	bundle := `{"mediaType":"` + bundleType + `"}`
+	desc, err := r.AddReferrer(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v1", Name: "a.sigstore.json"}, bundleType, strings.NewReader(bundle))
+	if err != nil {
+		t.Fatalf("AddReferrer() error = %v", err)
+	}
+	if _, err := r.AddReferrer(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v1", Name: "a.spdx.json"}, sbomType, strings.NewReader("{}")); err != nil {
+		t.Fatalf("AddReferrer() error = %v", err)
+	}
+
+	listTypes := func(t *testing.T, artifactType string) []string {
+		t.Helper()
+		refs, err := r.ListReferrers(ctx, "foobar", "v1", artifactType)
+		if err != nil {
+			t.Fatalf("ListReferrers() error = %v", err)
+		}
+		var types []string
+		for _, ref := range refs {
+			types = append(types, ref.ArtifactType)
+			if got := ref.Annotations[UploaderAnnotation]; got != "ci" {
+				t.Errorf("referrer uploader = %q, want %q", got, "ci")
+			}
+		}
+		return types
+	}
+	if diff := cmp.Diff([]string{bundleType}, listTypes(t, bundleType)); diff != "" {
+		t.Errorf("ListReferrers() by type mismatch (-want, +got):\n%s", diff)
+	}
+	if got := listTypes(t, ""); len(got) != 2 {
+		t.Errorf("ListReferrers() = %v, want both referrers", got)
+	}
+
+	// Adding a file makes a new manifest of the tag, which keeps the referrers.
+	if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v1", Name: "a.tar.gz"}, strings.NewReader("b")); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+	refs, err := r.ListReferrers(ctx, "foobar", "v1", bundleType)
+	if err != nil {
+		t.Fatalf("ListReferrers() error = %v", err)
+	}
+	if len(refs) != 1 {
+		t.Fatalf("ListReferrers() after adding a file = %v, want the bundle", refs)
+	}
+	if refs[0].Digest == desc.Manifest.Digest {
+		t.Errorf("referrer still has the old subject")
+	}
+
+	gotDesc, rc, err := r.ReadReferrer(ctx, "foobar", "v1", refs[0].Digest.String())
+	if err != nil {
+		t.Fatalf("ReadReferrer() error = %v", err)
+	}
+	got, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("ReadAll() error = %v", err)
+	}
+	if string(got) != bundle || gotDesc.File.Digest != desc.File.Digest {
+		t.Errorf("ReadReferrer() = %q with %v, want the bundle", got, gotDesc.File)
+	}
+
+	t.Run("read unknown referrer", func(t *testing.T) {
+		_, _, err := r.ReadReferrer(ctx, "foobar", "v1", digest.FromString("other").String())
+		if diff := testutil.DiffErrString(err, "not found"); diff != "" {
+			t.Errorf("ReadReferrer() error diff: %s", diff)
+		}
+	})
+
+	t.Run("referrers tags are not listed", func(t *testing.T) {
+		// Tagged like a backend without the referrers API indexes them.
+		memRepo.mu.Lock()
+		memRepo.allTags["sha256-"+strings.Repeat("a", 64)] = refs[0].Digest.String()
+		memRepo.mu.Unlock()
+
+		tags, err := r.ListTags(ctx, "foobar")
+		if err != nil {
+			t.Fatalf("ListTags() error = %v", err)
+		}
+		if diff := cmp.Diff([]string{"v1"}, tags); diff != "" {
+			t.Errorf("ListTags() mismatch (-want, +got):\n%s", diff)
+		}
+	})
+
+	t.Run("deleted with the tag", func(t *testing.T) {
+		subject, err := memRepo.Resolve(ctx, "v1")
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		if err := r.DeleteTagFiles(ctx, "foobar", "v1"); err != nil {
+			t.Fatalf("DeleteTagFiles() error = %v", err)
+		}
+		left, err := registry.Referrers(ctx, memRepo, subject, "")
+		if err != nil {
+			t.Fatalf("Referrers() error = %v", err)
+		}
+		if len(left) != 0 {
+			t.Errorf("Referrers() of deleted tag = %v, want none", left)
+		}
+	})
+}
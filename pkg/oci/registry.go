@@ -1,21 +1,30 @@
 package oci
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/abcxyz/pkg/logging"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/audit"
 	"github.com/yolocs/ocifactory/pkg/cred"
+	"github.com/yolocs/ocifactory/pkg/events"
+	"github.com/yolocs/ocifactory/pkg/metrics"
+	"go.opentelemetry.io/otel/attribute"
 	"oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content"
-	"oras.land/oras-go/v2/content/file"
 	"oras.land/oras-go/v2/errdef"
 	"oras.land/oras-go/v2/registry"
 	"oras.land/oras-go/v2/registry/remote"
@@ -26,6 +35,21 @@ import (
 const (
 	DefaultArtifactType = "application/vnd.ocifactory.generic"
 	FileNameAnnotation  = "ocifactory.file.title"
+
+	// UploaderAnnotation is the identity that uploaded a file, or that last
+	// changed the files of a manifest. Anonymous changes don't have it.
+	UploaderAnnotation = "ocifactory.uploader"
+	// ClientAnnotation is the user agent of the client that uploaded a file,
+	// or that last changed the files of a manifest.
+	ClientAnnotation = "ocifactory.client"
+	// ModifiedAnnotation is when the files of a manifest last changed. The
+	// created annotation of a file is its upload time, and the one of a
+	// manifest is when its tag was first created.
+	ModifiedAnnotation = "ocifactory.modified"
+
+	// Attempts to commit a file when the tag is concurrently modified.
+	maxCommitAttempts = 5
+	commitRetryDelay  = 100 * time.Millisecond
 )
 
 type destRepo interface {
@@ -33,6 +57,7 @@ type destRepo interface {
 	registry.TagLister
 	content.Tagger
 	content.Deleter
+	content.PredecessorFinder
 }
 
 type Registry struct {
@@ -40,6 +65,21 @@ type Registry struct {
 	landingDir   string
 	artifactType string
 
+	// If positive, file content is streamed to backends that support it in
+	// chunks of this size instead of being landed first.
+	chunkSize int64
+
+	// If fixedCred is true, cred is used instead of the credential in the
+	// request context. A nil cred means anonymous access.
+	fixedCred bool
+	cred      *cred.BasicCred
+
+	// Maps the repository and tag to the package version in events.
+	packageVersion PackageVersionFunc
+
+	// If set, uploaded files are only committed if it accepts them.
+	uploadCheck UploadCheckFunc
+
 	// Used in unit test to stub with in memory backend.
 	newBackendFunc func(ctx context.Context, f *RepoFile) (destRepo, error)
 }
@@ -62,6 +102,60 @@ func WithArtifactType(artifactType string) RegistryOption {
 	}
 }
 
+// WithChunkedUpload streams file content to the backend with chunked blob
+// uploads of the given size instead of copying it to the landing zone first.
+// Files that fit in a single chunk are pushed directly. Backends that reject
+// chunked uploads fall back to the landing zone.
+func WithChunkedUpload(chunkSize int64) RegistryOption {
+	return func(r *Registry) error {
+		if chunkSize <= 0 {
+			return fmt.Errorf("chunk size must be positive, got %d", chunkSize)
+		}
+		r.chunkSize = chunkSize
+		return nil
+	}
+}
+
+// WithCredential makes the registry always use the given credential instead
+// of the one passed through the request context. It's used for backends on
+// other hosts that must never see the caller's credential. A nil credential
+// means anonymous access.
+func WithCredential(c *cred.BasicCred) RegistryOption {
+	return func(r *Registry) error {
+		r.fixedCred = true
+		r.cred = c
+		return nil
+	}
+}
+
+// PackageVersionFunc returns the package and version stored under the
+// repository and tag, or false if the tag doesn't store a package version,
+// e.g. a metadata or index tag.
+type PackageVersionFunc func(repo, tag string) (pkg, version string, ok bool)
+
+// WithPackageVersions sets how repositories and tags map to the package
+// versions in published events. By default the repository is the package and
+// the tag is the version.
+func WithPackageVersions(f PackageVersionFunc) RegistryOption {
+	return func(r *Registry) error {
+		r.packageVersion = f
+		return nil
+	}
+}
+
+// UploadCheckFunc checks a file after its content is uploaded and before it
+// becomes visible. Returning an error rejects the upload.
+type UploadCheckFunc func(ctx context.Context, f *RepoFile, fileDesc ocispec.Descriptor) error
+
+// WithUploadCheck sets a check that every added file must pass, e.g. a
+// signature verification.
+func WithUploadCheck(f UploadCheckFunc) RegistryOption {
+	return func(r *Registry) error {
+		r.uploadCheck = f
+		return nil
+	}
+}
+
 // RepoFile represents a file in an OCI repository.
 type RepoFile struct {
 	OwningRepo string // Repository the owns the file. Usually what's right after the registy host.
@@ -70,6 +164,21 @@ type RepoFile struct {
 	Name       string // File name.
 	MediaType  string // Media type of the file. If not provided, it will be inferred from the file name.
 	Digest     string // Digest of the file. If provided, it will be used to cross check retrieved or calculated digest.
+
+	// TrustedDigest is set if the server worked out the Digest itself, e.g.
+	// from an upstream index, instead of taking it from a client. Only then
+	// the content is skipped if the blob is already known.
+	TrustedDigest bool
+
+	// Set when files are listed.
+	Size    int64
+	Created time.Time // Upload time of the file. Zero if unknown.
+}
+
+// FileUpload is a file to add with its content.
+type FileUpload struct {
+	*RepoFile
+	Content io.Reader
 }
 
 type FileDescriptor struct {
@@ -82,6 +191,9 @@ func NewRegistry(baseURL *url.URL, opt ...RegistryOption) (*Registry, error) {
 		baseURL:      baseURL,
 		landingDir:   os.TempDir(), // Default to the system tmp directory.
 		artifactType: DefaultArtifactType,
+		packageVersion: func(repo, tag string) (string, string, bool) {
+			return repo, tag, true
+		},
 	}
 	r.newBackendFunc = r.newBackend
 
@@ -102,7 +214,7 @@ func (r *Registry) DeleteTagFiles(ctx context.Context, repo string, tag string)
 		return err
 	}
 
-	return r.deleteTagFiles(ctx, backendRepo, tag)
+	return r.deleteTagFiles(ctx, backendRepo, repo, tag)
 }
 
 // DeleteRepoFiles deletes all files in a repository.
@@ -122,7 +234,7 @@ func (r *Registry) DeleteRepoFiles(ctx context.Context, repo string) error {
 		if strings.HasPrefix(tag, "ref_") {
 			continue // Ignore refs otherwise we'll get duplicated files.
 		}
-		if err := r.deleteTagFiles(ctx, backendRepo, tag); err != nil {
+		if err := r.deleteTagFiles(ctx, backendRepo, repo, tag); err != nil {
 			return err
 		}
 	}
@@ -130,18 +242,157 @@ func (r *Registry) DeleteRepoFiles(ctx context.Context, repo string) error {
 	return nil
 }
 
-func (r *Registry) deleteTagFiles(ctx context.Context, backendRepo destRepo, tag string) error {
+func (r *Registry) deleteTagFiles(ctx context.Context, backendRepo destRepo, repo, tag string) error {
 	manifestDesc, err := backendRepo.Resolve(ctx, tag)
 	if err != nil {
 		return fmt.Errorf("failed to resolve manifest for tag %q: %w", tag, err)
 	}
 
+	// The files are listed before the manifest is gone.
+	layers, err := manifestLayers(ctx, backendRepo, manifestDesc)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteReferrers(ctx, backendRepo, manifestDesc); err != nil {
+		return err
+	}
 	if err := backendRepo.Delete(ctx, manifestDesc); err != nil {
 		return fmt.Errorf("failed to delete manifest for tag %q: %w", tag, err)
 	}
+	audit.Record(ctx, &audit.Event{Action: audit.ActionDelete, Repo: repo, Tag: tag, Manifest: manifestDesc.Digest.String()})
+	r.publish(ctx, events.TypeDeleted, repo, tag, "", layers)
 	return nil
 }
 
+// DeleteFile removes a single file from its tag and keeps the other files of
+// the tag. The tag is deleted if it was the last file. Ref tags keep pointing
+// to the manifest they were added to. Returns a not found error if the tag
+// doesn't have the file.
+func (r *Registry) DeleteFile(ctx context.Context, f *RepoFile) (err error) {
+	ctx, span := startSpan(ctx, "oci.DeleteFile", attrRepo.String(f.OwningRepo), attrTag.String(f.OwningTag), attrFile.String(f.Name))
+	defer func() { endSpan(span, err) }()
+
+	backendRepo, err := r.newBackendFunc(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	unlock := tagLocks.lock(r.baseURL.Host + r.baseURL.Path + "/" + f.OwningRepo + ":" + f.OwningTag)
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		retry, err := r.removeFile(ctx, backendRepo, f)
+		if err != nil || !retry {
+			return err
+		}
+		if attempt == maxCommitAttempts {
+			return fmt.Errorf("failed to delete file %q from %s: tag %q kept changing after %d attempts", f.Name, f.OwningRepo, f.OwningTag, attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("failed to delete file %q from %s: %w", f.Name, f.OwningRepo, ctx.Err())
+		case <-time.After(time.Duration(attempt) * commitRetryDelay):
+		}
+	}
+}
+
+// removeFile moves the tag to a manifest without the file, or deletes the
+// manifest if the file is its only layer. Like commitFiles, it returns true if
+// the tag was concurrently modified and the removal must be retried.
+func (r *Registry) removeFile(ctx context.Context, backendRepo destRepo, f *RepoFile) (bool, error) {
+	manifestDesc, err := resolveTag(ctx, backendRepo, f.OwningTag)
+	if err != nil {
+		return false, err
+	}
+	if manifestDesc.Digest == "" {
+		return false, fmt.Errorf("tag %q not found: %w", f.OwningTag, errdef.ErrNotFound)
+	}
+	manifest, err := fetchManifest(ctx, backendRepo, manifestDesc)
+	if err != nil {
+		return false, err
+	}
+	layers := manifest.Layers
+
+	var removed ocispec.Descriptor
+	remaining := make([]ocispec.Descriptor, 0, len(layers))
+	for _, l := range layers {
+		if l.Annotations[FileNameAnnotation] == f.Name {
+			removed = l
+			continue
+		}
+		remaining = append(remaining, l)
+	}
+	if removed.Digest == "" {
+		return false, fmt.Errorf("file %q not found in tag %q: %w", f.Name, f.OwningTag, errdef.ErrNotFound)
+	}
+
+	var newManifest string
+	if len(remaining) == 0 {
+		if err := deleteReferrers(ctx, backendRepo, manifestDesc); err != nil {
+			return false, err
+		}
+		if err := backendRepo.Delete(ctx, manifestDesc); err != nil {
+			return false, fmt.Errorf("failed to delete manifest for tag %q: %w", f.OwningTag, err)
+		}
+	} else {
+		packOpts := oras.PackManifestOptions{
+			Layers:              remaining,
+			ManifestAnnotations: manifestAnnotations(ctx, manifest.Annotations, time.Now()),
+		}
+		newManifestDesc, err := oras.PackManifest(ctx, backendRepo, oras.PackManifestVersion1_1, r.artifactType, packOpts)
+		if err != nil {
+			return false, fmt.Errorf("failed to pack new manifest: %w", err)
+		}
+		if err := copyReferrers(ctx, backendRepo, manifestDesc, newManifestDesc); err != nil {
+			return false, err
+		}
+		current, err := resolveTag(ctx, backendRepo, f.OwningTag)
+		if err != nil {
+			return false, err
+		}
+		if current.Digest != manifestDesc.Digest {
+			return true, nil
+		}
+		if err := backendRepo.Tag(ctx, newManifestDesc, f.OwningTag); err != nil {
+			return false, fmt.Errorf("failed to tag new manifest: %w", err)
+		}
+		newManifest = newManifestDesc.Digest.String()
+	}
+
+	audit.Record(ctx, &audit.Event{
+		Action:   audit.ActionDelete,
+		Repo:     f.OwningRepo,
+		Tag:      f.OwningTag,
+		File:     f.Name,
+		Digest:   removed.Digest.String(),
+		Manifest: newManifest,
+	})
+	r.publish(ctx, events.TypeDeleted, f.OwningRepo, f.OwningTag, newManifest, []ocispec.Descriptor{removed})
+	return false, nil
+}
+
+// publish sends an event for the files of the package version stored under
+// the repository and tag. Tags that don't store a package version are skipped.
+func (r *Registry) publish(ctx context.Context, typ events.Type, repo, tag, manifest string, files []ocispec.Descriptor) {
+	pkg, version, ok := r.packageVersion(repo, tag)
+	if !ok {
+		return
+	}
+	e := &events.Event{
+		Type:     typ,
+		Repo:     repo,
+		Package:  pkg,
+		Version:  version,
+		Manifest: manifest,
+	}
+	for _, f := range files {
+		e.Files = append(e.Files, &events.File{Name: f.Annotations[FileNameAnnotation], Digest: f.Digest.String()})
+	}
+	events.Publish(ctx, e)
+}
+
 // AppendRefs appends tags to a manifest.
 // The canonical tag is the tag that points to the manifest.
 // The tags are the tags to append to the manifest.
@@ -162,76 +413,294 @@ func (r *Registry) AppendRefs(ctx context.Context, repo string, canonicalTag str
 		if err := backendRepo.Tag(ctx, manifestDesc, "ref_"+ref); err != nil {
 			return fmt.Errorf("failed to tag manifest for ref %q: %w", ref, err)
 		}
+		audit.Record(ctx, &audit.Event{Action: audit.ActionTag, Repo: repo, Tag: "ref_" + ref, Manifest: manifestDesc.Digest.String()})
 	}
 
 	return nil
 }
 
 // AddFile adds a file to the registry.
-// The file is first uploaded to the landing zone, then to the OCI store, and finally to the backend repository.
+// The file blob is hashed while it's uploaded, either streamed to the backend in chunks or through the landing zone.
 // If the file already exists in the backend repository, it will be updated if and only if the digest has changed.
+// Blobs that already exist in the backend repository are not pushed again, and blobs recently seen in another repository
+// on the same host are mounted from there.
+// Concurrent writes to the same tag are serialized within the process and retried if the tag is moved by another process.
 // Returns the updated manifest descriptor and the file descriptor.
 func (r *Registry) AddFile(ctx context.Context, f *RepoFile, ro io.Reader) (*FileDescriptor, error) {
-	if strings.HasPrefix(f.OwningTag, "ref_") {
-		return nil, fmt.Errorf("canonical tag cannot be prefixed with ref_; got %q", f.OwningTag)
-	}
-
-	// Load the file in the landing zone.
-	tmpFile, err := r.landFile(ro)
+	descs, err := r.AddFiles(ctx, []*FileUpload{{RepoFile: f, Content: ro}})
 	if err != nil {
 		return nil, err
 	}
-	defer os.Remove(tmpFile)
+	return descs[0], nil
+}
+
+// AddFiles adds several files of the same repository and tag in a single
+// manifest push, so either all or none of them become visible. It behaves like
+// AddFile otherwise. Returns the file descriptors in the order of the uploads.
+func (r *Registry) AddFiles(ctx context.Context, uploads []*FileUpload) (_ []*FileDescriptor, err error) {
+	if len(uploads) == 0 {
+		return nil, fmt.Errorf("no file to add")
+	}
+	repo, tag := uploads[0].OwningRepo, uploads[0].OwningTag
+	ctx, span := startSpan(ctx, "oci.AddFiles", attrRepo.String(repo), attrTag.String(tag), attribute.Int("oci.files", len(uploads)))
+	defer func() { endSpan(span, err) }()
 
-	// Load the file in the OCI store.
-	fs, fileDesc, err := r.loadFile(ctx, tmpFile, f)
+	if strings.HasPrefix(tag, "ref_") {
+		return nil, fmt.Errorf("canonical tag cannot be prefixed with ref_; got %q", tag)
+	}
+	names := make(map[string]bool)
+	for _, u := range uploads {
+		if u.OwningRepo != repo || u.OwningTag != tag {
+			return nil, fmt.Errorf("all files must be in %s:%s; got %s:%s", repo, tag, u.OwningRepo, u.OwningTag)
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("file %q is added more than once", u.Name)
+		}
+		names[u.Name] = true
+	}
+
+	metrics.UploadsInFlight.Inc()
+	defer metrics.UploadsInFlight.Dec()
+
+	// Create the backend repository for the files.
+	backendRepo, err := r.newBackendFunc(ctx, uploads[0].RepoFile)
 	if err != nil {
 		return nil, err
 	}
-	defer fs.Close()
 
-	// Create the backend repository for the file.
-	backendRepo, err := r.newBackendFunc(ctx, f)
+	// Upload the file blobs. They are not visible until the manifest is
+	// updated, so a failed upload doesn't add any file.
+	fileDescs := make([]ocispec.Descriptor, 0, len(uploads))
+	stamp := changeAnnotations(ctx, time.Now())
+	for _, u := range uploads {
+		fileDesc, err := r.uploadFile(ctx, backendRepo, u)
+		if err != nil {
+			return nil, err
+		}
+		if r.uploadCheck != nil {
+			if err := r.uploadCheck(ctx, u.RepoFile, fileDesc); err != nil {
+				return nil, fmt.Errorf("file %q is rejected: %w", u.Name, err)
+			}
+		}
+		fileDesc.Annotations = maps.Clone(fileDesc.Annotations)
+		maps.Copy(fileDesc.Annotations, stamp)
+		fileDescs = append(fileDescs, fileDesc)
+	}
+
+	// Serialize writes to the same tag within the process. Writers in other
+	// processes are handled by retrying when the tag moved under us.
+	unlock := tagLocks.lock(r.baseURL.Host + r.baseURL.Path + "/" + repo + ":" + tag)
+	defer unlock()
+
+	for attempt := 1; ; attempt++ {
+		manifestDesc, actions, retry, err := r.commitFiles(ctx, backendRepo, tag, fileDescs)
+		if err != nil {
+			return nil, err
+		}
+		if !retry {
+			descs := make([]*FileDescriptor, 0, len(fileDescs))
+			var changed []ocispec.Descriptor
+			typ := events.TypePublished
+			for _, fd := range fileDescs {
+				blobSources.add(r.baseURL.Host, r.repoPath(repo), fd)
+				descs = append(descs, &FileDescriptor{Manifest: manifestDesc, File: fd})
+
+				name := fd.Annotations[FileNameAnnotation]
+				if action, ok := actions[name]; ok {
+					changed = append(changed, fd)
+					if action == audit.ActionOverwrite {
+						typ = events.TypeOverwritten
+					}
+					audit.Record(ctx, &audit.Event{
+						Action:   action,
+						Repo:     repo,
+						Tag:      tag,
+						File:     name,
+						Digest:   fd.Digest.String(),
+						Manifest: manifestDesc.Digest.String(),
+					})
+				}
+			}
+			if len(changed) > 0 {
+				r.publish(ctx, typ, repo, tag, manifestDesc.Digest.String(), changed)
+			}
+			return descs, nil
+		}
+		if attempt == maxCommitAttempts {
+			return nil, fmt.Errorf("failed to add files to %s: tag %q kept changing after %d attempts", repo, tag, attempt)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed to add files to %s: %w", repo, ctx.Err())
+		case <-time.After(time.Duration(attempt) * commitRetryDelay):
+		}
+	}
+}
+
+// commitFiles upserts the file layers into the manifest the tag points to.
+// The tag is only moved if it still points to the manifest the update is based
+// on, and it's checked again after it has been moved. Returns the manifest
+// that has the files and whether each changed file was published or
+// overwritten, or true if the tag was concurrently modified and the commit
+// must be retried.
+func (r *Registry) commitFiles(ctx context.Context, backendRepo destRepo, tag string, fileDescs []ocispec.Descriptor) (_ ocispec.Descriptor, actions map[string]audit.Action, retry bool, err error) {
+	ctx, span := startSpan(ctx, "oci.commitFiles", attrTag.String(tag))
+	defer func() {
+		span.SetAttributes(attribute.Bool("oci.retry", retry))
+		endSpan(span, err)
+	}()
+
+	manifestDesc, err := resolveTag(ctx, backendRepo, tag)
 	if err != nil {
-		return nil, err
+		return ocispec.Descriptor{}, nil, false, err
 	}
 
-	manifestDesc, err := backendRepo.Resolve(ctx, f.OwningTag)
-	if err != nil && !errors.Is(err, errdef.ErrNotFound) {
-		return nil, fmt.Errorf("failed to resolve manifest for tag %q: %w", f.OwningTag, err)
+	var layers []ocispec.Descriptor
+	var previous map[string]string
+	if manifestDesc.Digest != "" {
+		manifest, err := fetchManifest(ctx, backendRepo, manifestDesc)
+		if err != nil {
+			return ocispec.Descriptor{}, nil, false, err
+		}
+		layers, previous = manifest.Layers, manifest.Annotations
 	}
+	actions = make(map[string]audit.Action)
+	for _, fd := range fileDescs {
+		name := fd.Annotations[FileNameAnnotation]
+		actions[name] = audit.ActionPublish
+		for _, l := range layers {
+			if l.Annotations[FileNameAnnotation] == name {
+				actions[name] = audit.ActionOverwrite
+			}
+		}
 
-	layers, err := manifestLayers(ctx, backendRepo, manifestDesc)
+		var u bool
+		if u, layers = upsertFileLayer(layers, fd); !u {
+			delete(actions, name)
+		}
+	}
+	if len(actions) == 0 { // No need to update the manifest if the files haven't changed.
+		return manifestDesc, nil, false, nil
+	}
+
+	// Pack and push the updated manifest without tagging it yet. The file
+	// blobs are already in the backend repository.
+	packOpts := oras.PackManifestOptions{
+		Layers:              layers,
+		ManifestAnnotations: manifestAnnotations(ctx, previous, time.Now()),
+	}
+	newManifestDesc, err := oras.PackManifest(ctx, backendRepo, oras.PackManifestVersion1_1, r.artifactType, packOpts)
 	if err != nil {
-		return nil, err
+		return ocispec.Descriptor{}, nil, false, fmt.Errorf("failed to pack new manifest: %w", err)
 	}
-	updated, layers := upsertFileLayer(layers, fileDesc)
-	if !updated { // No need to update the manifest if the file hasn't changed.
-		return &FileDescriptor{Manifest: manifestDesc, File: fileDesc}, nil
+	// The referrers must be in place before the tag moves to the new manifest.
+	if manifestDesc.Digest != "" {
+		if err := copyReferrers(ctx, backendRepo, manifestDesc, newManifestDesc); err != nil {
+			return ocispec.Descriptor{}, nil, false, err
+		}
 	}
 
-	// Pack the updated manifest
-	packOpts := oras.PackManifestOptions{Layers: layers}
-	newManifestDesc, err := oras.PackManifest(ctx, fs, oras.PackManifestVersion1_1, r.artifactType, packOpts)
+	// The registry has no compare-and-swap on tags. Checking right before and
+	// after moving the tag leaves a small window, but files are never reported
+	// as added while the tag points to a manifest without them.
+	current, err := resolveTag(ctx, backendRepo, tag)
 	if err != nil {
-		return nil, fmt.Errorf("failed to pack new manifest: %w", err)
+		return ocispec.Descriptor{}, nil, false, err
 	}
-	if err := fs.Tag(ctx, newManifestDesc, f.OwningTag); err != nil {
-		return nil, fmt.Errorf("failed to tag new manifest: %w", err)
+	if current.Digest != manifestDesc.Digest {
+		return ocispec.Descriptor{}, nil, true, nil
+	}
+	if err := backendRepo.Tag(ctx, newManifestDesc, tag); err != nil {
+		return ocispec.Descriptor{}, nil, false, fmt.Errorf("failed to tag new manifest: %w", err)
 	}
 
-	// Push the manifest and tag it
-	if _, err := oras.Copy(ctx, fs, f.OwningTag, backendRepo, f.OwningTag, oras.DefaultCopyOptions); err != nil {
-		return nil, fmt.Errorf("failed to copy manifest to backend repo: %w", err)
+	current, err = resolveTag(ctx, backendRepo, tag)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, false, err
+	}
+	if current.Digest != newManifestDesc.Digest {
+		currentLayers, err := manifestLayers(ctx, backendRepo, current)
+		if err != nil {
+			return ocispec.Descriptor{}, nil, false, err
+		}
+		for _, fd := range fileDescs {
+			if !hasLayer(currentLayers, fd) {
+				return ocispec.Descriptor{}, nil, true, nil
+			}
+		}
+		return current, actions, false, nil
 	}
 
-	return &FileDescriptor{Manifest: newManifestDesc, File: fileDesc}, nil
+	return newManifestDesc, actions, false, nil
+}
+
+// changeAnnotations records when, by whom and with which client a change is
+// made. The caller is taken from the request in ctx, if any.
+func changeAnnotations(ctx context.Context, now time.Time) map[string]string {
+	a := map[string]string{ocispec.AnnotationCreated: now.UTC().Format(time.RFC3339)}
+	if req, ok := audit.RequestFromContext(ctx); ok {
+		if req.Identity != "" {
+			a[UploaderAnnotation] = req.Identity
+		}
+		if req.UserAgent != "" {
+			a[ClientAnnotation] = req.UserAgent
+		}
+	}
+	return a
+}
+
+// manifestAnnotations returns the annotations of a manifest that replaces one
+// with the previous annotations. The creation time is kept.
+func manifestAnnotations(ctx context.Context, previous map[string]string, now time.Time) map[string]string {
+	a := changeAnnotations(ctx, now)
+	a[ModifiedAnnotation] = a[ocispec.AnnotationCreated]
+	if created, ok := previous[ocispec.AnnotationCreated]; ok {
+		a[ocispec.AnnotationCreated] = created
+	}
+	return a
+}
+
+// CreatedTime returns the time in the created annotation of the descriptor.
+// Zero if it's missing or invalid.
+func CreatedTime(desc ocispec.Descriptor) time.Time {
+	return annotationTime(desc.Annotations, ocispec.AnnotationCreated)
+}
+
+func annotationTime(annotations map[string]string, key string) time.Time {
+	t, err := time.Parse(time.RFC3339, annotations[key])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// resolveTag resolves the tag. A missing tag resolves to an empty descriptor.
+func resolveTag(ctx context.Context, backendRepo destRepo, tag string) (ocispec.Descriptor, error) {
+	desc, err := backendRepo.Resolve(ctx, tag)
+	if err != nil {
+		if errors.Is(err, errdef.ErrNotFound) {
+			return ocispec.Descriptor{}, nil
+		}
+		return ocispec.Descriptor{}, fmt.Errorf("failed to resolve manifest for tag %q: %w", tag, err)
+	}
+	return desc, nil
+}
+
+// hasLayer returns true if the layers contain the file with the same digest.
+func hasLayer(layers []ocispec.Descriptor, fileDesc ocispec.Descriptor) bool {
+	for _, l := range layers {
+		if l.Annotations[FileNameAnnotation] == fileDesc.Annotations[FileNameAnnotation] && l.Digest == fileDesc.Digest {
+			return true
+		}
+	}
+	return false
 }
 
 // ReadFile reads a file from the registry.
 // Returns the file descriptor and a reader for the file.
 // It's allowed to use a ref tag to read a file. Set it in the RepoFile.RefTag field.
-func (r *Registry) ReadFile(ctx context.Context, f *RepoFile) (*FileDescriptor, io.ReadCloser, error) {
+func (r *Registry) ReadFile(ctx context.Context, f *RepoFile) (_ *FileDescriptor, _ io.ReadCloser, err error) {
 	if f.OwningTag == "" && f.RefTag == "" {
 		return nil, nil, fmt.Errorf("either OwningTag or RefTag must be set")
 	}
@@ -240,6 +709,8 @@ func (r *Registry) ReadFile(ctx context.Context, f *RepoFile) (*FileDescriptor,
 	if t == "" {
 		t = "ref_" + f.RefTag
 	}
+	ctx, span := startSpan(ctx, "oci.ReadFile", attrRepo.String(f.OwningRepo), attrTag.String(t), attrFile.String(f.Name))
+	defer func() { endSpan(span, err) }()
 
 	backendRepo, err := r.newBackendFunc(ctx, f)
 	if err != nil {
@@ -258,13 +729,14 @@ func (r *Registry) ReadFile(ctx context.Context, f *RepoFile) (*FileDescriptor,
 
 	for _, l := range layers {
 		if l.Annotations[FileNameAnnotation] == f.Name {
-			if f.Digest != "" && string(l.Digest) != f.Digest {
-				return nil, nil, fmt.Errorf("file digest mismatch: %q != %q", l.Digest, f.Digest)
+			if err := checkDigest(f, l); err != nil {
+				return nil, nil, err
 			}
 			rc, err := backendRepo.Fetch(ctx, l)
 			if err != nil {
 				return nil, nil, fmt.Errorf("failed to fetch file: %w", err)
 			}
+			blobSources.add(r.baseURL.Host, r.repoPath(f.OwningRepo), l)
 			return &FileDescriptor{Manifest: manifestDesc, File: l}, rc, nil
 		}
 	}
@@ -288,9 +760,11 @@ func (r *Registry) listTags(ctx context.Context, backendRepo destRepo) ([]string
 		return nil, fmt.Errorf("failed to list tags: %w", err)
 	}
 
+	// Ref tags duplicate the canonical tags and referrers tags index the
+	// referrers of a manifest.
 	var excludeRefs []string
 	for _, tag := range tags {
-		if !strings.HasPrefix(tag, "ref_") {
+		if !strings.HasPrefix(tag, "ref_") && !isReferrersTag(tag) {
 			excludeRefs = append(excludeRefs, tag)
 		}
 	}
@@ -330,6 +804,8 @@ func (r *Registry) ListFiles(ctx context.Context, repo string) ([]*RepoFile, err
 					OwningRepo: repo,
 					OwningTag:  tag,
 					Digest:     string(l.Digest),
+					Size:       l.Size,
+					Created:    CreatedTime(l),
 				})
 			}
 		}
@@ -338,36 +814,272 @@ func (r *Registry) ListFiles(ctx context.Context, repo string) ([]*RepoFile, err
 	return files, nil
 }
 
-func (r *Registry) landFile(ro io.Reader) (string, error) {
+// TagInfo describes a tag that owns files.
+type TagInfo struct {
+	Tag string
+
+	// Created is when the tag was first created and Modified is when its files
+	// last changed. Manifests without the modified annotation were packed
+	// before it was recorded, so both are when the files last changed. Zero
+	// if the manifest doesn't say.
+	Created  time.Time
+	Modified time.Time
+}
+
+// ListTagInfo lists the tags of a repository with the time they last changed.
+// Ref and referrers tags are not included.
+func (r *Registry) ListTagInfo(ctx context.Context, repo string) (_ []*TagInfo, err error) {
+	ctx, span := startSpan(ctx, "oci.ListTagInfo", attrRepo.String(repo))
+	defer func() { endSpan(span, err) }()
+
+	backendRepo, err := r.newBackendFunc(ctx, &RepoFile{OwningRepo: repo})
+	if err != nil {
+		return nil, err
+	}
+
+	tags, err := r.listTags(ctx, backendRepo)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*TagInfo, 0, len(tags))
+	for _, tag := range tags {
+		manifestDesc, err := backendRepo.Resolve(ctx, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve manifest for tag %q: %w", tag, err)
+		}
+		manifest, err := fetchManifest(ctx, backendRepo, manifestDesc)
+		if err != nil {
+			return nil, err
+		}
+		info := &TagInfo{
+			Tag:      tag,
+			Created:  annotationTime(manifest.Annotations, ocispec.AnnotationCreated),
+			Modified: annotationTime(manifest.Annotations, ModifiedAnnotation),
+		}
+		if info.Modified.IsZero() {
+			info.Modified = info.Created
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// ListRepos lists the repositories under the base URL of the registry with
+// the catalog API. The names are relative to the base URL, like the repos
+// passed to the other methods. Not all registries support the catalog.
+func (r *Registry) ListRepos(ctx context.Context) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "oci.ListRepos")
+	defer func() { endSpan(span, err) }()
+
+	reg, err := remote.NewRegistry(r.baseURL.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create remote OCI registry: %w", err)
+	}
+	reg.PlainHTTP = r.baseURL.Scheme == "http"
+	if basic := r.credential(ctx); basic != nil {
+		reg.Client = r.client(basic)
+	}
+
+	prefix := r.repoPath("")
+	var repos []string
+	if err := reg.Repositories(ctx, "", func(names []string) error {
+		for _, name := range names {
+			if repo, ok := strings.CutPrefix(name, prefix); ok && repo != "" {
+				repos = append(repos, repo)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to list repositories: %w", err)
+	}
+	return repos, nil
+}
+
+// uploadFile pushes the file content to the backend repository and returns
+// the file descriptor. The content is streamed in chunks if the backend
+// supports it, otherwise it's landed first since a blob push needs the digest
+// and size upfront. Streamed content can only be deduplicated if the file
+// digest is known before the upload. A client given digest is never trusted
+// before the content is hashed, so a known blob can't be claimed without
+// having its content.
+func (r *Registry) uploadFile(ctx context.Context, backendRepo destRepo, u *FileUpload) (fileDesc ocispec.Descriptor, err error) {
+	ctx, span := startSpan(ctx, "oci.uploadFile", attrFile.String(u.Name))
+	defer func() {
+		span.SetAttributes(attrDigest.String(fileDesc.Digest.String()), attrSize.Int64(fileDesc.Size))
+		endSpan(span, err)
+	}()
+
+	// Skip reading the content at all if the blob can be reused. Otherwise a
+	// known blob is landed instead of streamed so it can be reused once the
+	// content is hashed.
+	known := false
+	if u.Digest != "" {
+		if src, ok := blobSources.get(r.baseURL.Host, digest.Digest(u.Digest)); ok {
+			fileDesc := fileDescriptor(u.RepoFile, digest.Digest(u.Digest), src.size)
+			if u.TrustedDigest && r.reuseBlob(ctx, backendRepo, u.OwningRepo, fileDesc) {
+				return fileDesc, nil
+			}
+			known = true
+		}
+	}
+
+	ro := u.Content
+	if cu, ok := backendRepo.(chunkedUploader); ok && r.chunkSize > 0 && !known {
+		buf := make([]byte, r.chunkSize)
+		n, err := io.ReadFull(u.Content, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The whole file fits in a single chunk.
+			fileDesc := fileDescriptor(u.RepoFile, digest.FromBytes(buf[:n]), int64(n))
+			if err := checkDigest(u.RepoFile, fileDesc); err != nil {
+				return ocispec.Descriptor{}, err
+			}
+			return fileDesc, r.pushBlob(ctx, backendRepo, u.OwningRepo, fileDesc, bytes.NewReader(buf[:n]))
+		}
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to read file: %w", err)
+		}
+
+		fileDesc, err := cu.pushChunks(ctx, u.RepoFile, buf, u.Content)
+		if !errors.Is(err, errChunkedUnsupported) {
+			return fileDesc, err
+		}
+		// Nothing was consumed by the backend, so land the content instead.
+		ro = io.MultiReader(bytes.NewReader(buf), u.Content)
+	}
+
+	tmpFile, fileDesc, err := r.landFile(ctx, u.RepoFile, ro)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer removeLanded(tmpFile, fileDesc.Size)
+
+	if err := checkDigest(u.RepoFile, fileDesc); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	landed, err := os.Open(tmpFile)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to open landed file: %w", err)
+	}
+	defer landed.Close()
+
+	return fileDesc, r.pushBlob(ctx, backendRepo, u.OwningRepo, fileDesc, landed)
+}
+
+// landFile copies the content to the landing zone and hashes it along the way.
+// Returns the landed file path and the file descriptor.
+func (r *Registry) landFile(ctx context.Context, f *RepoFile, ro io.Reader) (_ string, fileDesc ocispec.Descriptor, err error) {
+	_, span := startSpan(ctx, "oci.landFile", attrFile.String(f.Name))
+	defer func() {
+		span.SetAttributes(attrDigest.String(fileDesc.Digest.String()), attrSize.Int64(fileDesc.Size))
+		endSpan(span, err)
+	}()
+
 	tmpFile, err := os.CreateTemp(r.landingDir, "oci-upload-")
 	if err != nil {
-		return "", fmt.Errorf("failed to create temporary file in the landing zone: %w", err)
+		return "", ocispec.Descriptor{}, fmt.Errorf("failed to create temporary file in the landing zone: %w", err)
 	}
+	defer tmpFile.Close()
 
-	if _, err := io.Copy(tmpFile, ro); err != nil {
-		return "", fmt.Errorf("failed to copy reader to the landing zone: %w", err)
+	metrics.LandingFiles.Inc()
+	d := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(tmpFile, d.Hash(), landingUsage{}), ro)
+	if err != nil {
+		removeLanded(tmpFile.Name(), size)
+		return "", ocispec.Descriptor{}, fmt.Errorf("failed to copy reader to the landing zone: %w", err)
 	}
 
-	return tmpFile.Name(), nil
+	return tmpFile.Name(), fileDescriptor(f, d.Digest(), size), nil
 }
 
-func (r *Registry) loadFile(ctx context.Context, fileLanded string, f *RepoFile) (*file.Store, ocispec.Descriptor, error) {
-	fs, err := file.New(r.landingDir) // The OCI file store is not used for writing files.
+// pushBlob pushes the file blob unless the backend repository already has it
+// or it can be mounted from another repository. A failed mount falls back to
+// the push since the content is at hand.
+func (r *Registry) pushBlob(ctx context.Context, backendRepo destRepo, repo string, fileDesc ocispec.Descriptor, ro io.ReadSeeker) error {
+	exists, err := backendRepo.Exists(ctx, fileDesc)
 	if err != nil {
-		return nil, ocispec.Descriptor{}, fmt.Errorf("failed to create local OCI store: %w", err)
+		return fmt.Errorf("failed to check file existence: %w", err)
+	}
+	if exists {
+		return nil
 	}
 
-	fileDesc, err := fs.Add(ctx, fileLanded, detectFileMediaType(f), "")
+	// If the backend doesn't support mounts, it's pushed from the content.
+	mounted, err := r.mountBlob(ctx, backendRepo, repo, fileDesc, func() (io.ReadCloser, error) {
+		return io.NopCloser(ro), nil
+	})
+	if mounted {
+		return nil
+	}
 	if err != nil {
-		return nil, ocispec.Descriptor{}, fmt.Errorf("failed to add file to local OCI store: %w", err)
+		logging.FromContext(ctx).WarnContext(ctx, "failed to mount blob, pushing it instead", "digest", fileDesc.Digest, "error", err)
+		// The mount may have read some of the content.
+		if _, err := ro.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to rewind file: %w", err)
+		}
 	}
-	if f.Digest != "" && string(fileDesc.Digest) != f.Digest {
-		return nil, ocispec.Descriptor{}, fmt.Errorf("file digest mismatch: %q != %q", fileDesc.Digest, f.Digest)
+
+	if err := backendRepo.Push(ctx, fileDesc, ro); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return fmt.Errorf("failed to push file: %w", err)
+	}
+	return nil
+}
+
+// reuseBlob makes the blob available in the backend repository without the
+// file content. Any failure is left to the regular upload to handle.
+func (r *Registry) reuseBlob(ctx context.Context, backendRepo destRepo, repo string, fileDesc ocispec.Descriptor) bool {
+	if exists, err := backendRepo.Exists(ctx, fileDesc); err == nil && exists {
+		return true
+	}
+	// Without the content, the backend copies it from the source repository if
+	// it doesn't support mounts.
+	mounted, err := r.mountBlob(ctx, backendRepo, repo, fileDesc, nil)
+	return err == nil && mounted
+}
+
+// mountBlob mounts the blob from another repository on the same host known to
+// have it. Returns false if there is no such repository or the backend doesn't
+// support mounts.
+func (r *Registry) mountBlob(ctx context.Context, backendRepo destRepo, repo string, fileDesc ocispec.Descriptor, getContent func() (io.ReadCloser, error)) (bool, error) {
+	m, ok := backendRepo.(registry.Mounter)
+	if !ok {
+		return false, nil
+	}
+	src, ok := blobSources.get(r.baseURL.Host, fileDesc.Digest)
+	if !ok || src.repo == r.repoPath(repo) {
+		return false, nil
+	}
+	if err := m.Mount(ctx, fileDesc, src.repo, getContent); err != nil {
+		return false, fmt.Errorf("failed to mount file from %s: %w", src.repo, err)
+	}
+	return true, nil
+}
+
+// repoPath returns the full path of the repository in the backend registry.
+func (r *Registry) repoPath(repo string) string {
+	return strings.TrimPrefix(r.baseURL.Path+"/"+repo, "/")
+}
+
+// fileDescriptor creates the layer descriptor of the file.
+func fileDescriptor(f *RepoFile, d digest.Digest, size int64) ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType: detectFileMediaType(f),
+		Digest:    d,
+		Size:      size,
+		Annotations: map[string]string{
+			FileNameAnnotation:      f.Name,
+			ocispec.AnnotationTitle: f.Name,
+		},
 	}
-	fileDesc.Annotations[FileNameAnnotation] = f.Name
-	fileDesc.Annotations[ocispec.AnnotationTitle] = f.Name // The 'Add' method by default sets the title to the full path.
+}
 
-	return fs, fileDesc, nil
+// checkDigest cross checks the calculated digest if the file has one.
+func checkDigest(f *RepoFile, fileDesc ocispec.Descriptor) error {
+	if f.Digest != "" && string(fileDesc.Digest) != f.Digest {
+		return fmt.Errorf("%w: %q != %q", ErrDigestMismatch, fileDesc.Digest, f.Digest)
+	}
+	return nil
 }
 
 func (r *Registry) newBackend(ctx context.Context, f *RepoFile) (destRepo, error) {
@@ -376,19 +1088,71 @@ func (r *Registry) newBackend(ctx context.Context, f *RepoFile) (destRepo, error
 	if err != nil {
 		return nil, fmt.Errorf("failed to create remote OCI repo: %w", err)
 	}
+	repo.PlainHTTP = r.baseURL.Scheme == "http"
+	if basic := r.credential(ctx); basic != nil {
+		repo.Client = r.client(basic)
+	}
+
+	return &remoteRepo{Repository: repo}, nil
+}
+
+// credential returns the credential for the backend: the fixed one if set,
+// otherwise the one passed through the context. Could be nil.
+func (r *Registry) credential(ctx context.Context) *cred.BasicCred {
+	if !r.fixedCred {
+		if c, ok := cred.FromContext(ctx); ok {
+			return c.Basic
+		}
+	}
+	return r.cred
+}
+
+func (r *Registry) client(basic *cred.BasicCred) remote.Client {
+	return &auth.Client{
+		Client: retry.DefaultClient,
+		Credential: auth.StaticCredential(r.baseURL.Host, auth.Credential{
+			Username: basic.User,
+			Password: basic.Password,
+		}),
+	}
+}
+
+// Ping checks that the backend registry answers the /v2/ ping with the
+// credential newBackend would use. Without a credential, an unauthorized
+// response still means the registry is reachable.
+func (r *Registry) Ping(ctx context.Context) error {
+	reg, err := remote.NewRegistry(r.baseURL.Host)
+	if err != nil {
+		return fmt.Errorf("failed to create remote OCI registry: %w", err)
+	}
+	reg.PlainHTTP = r.baseURL.Scheme == "http"
+	// Without a credential, the challenge is the answer.
+	reg.Client = retry.DefaultClient
+	basic := r.credential(ctx)
+	if basic != nil {
+		reg.Client = r.client(basic)
+	}
 
-	c, ok := cred.FromContext(ctx)
-	if ok && c.Basic != nil {
-		repo.Client = &auth.Client{
-			Client: retry.DefaultClient,
-			Credential: auth.StaticCredential(r.baseURL.Host, auth.Credential{
-				Username: c.Basic.User,
-				Password: c.Basic.Password,
-			}),
+	if err := reg.Ping(ctx); err != nil {
+		if basic == nil && HasCode(err, http.StatusUnauthorized) {
+			return nil
 		}
+		return fmt.Errorf("failed to ping backend registry %s: %w", r.baseURL.Host, err)
 	}
+	return nil
+}
 
-	return repo, nil
+// CheckLandingDir checks that files can be landed in dir.
+func CheckLandingDir(dir string) error {
+	f, err := os.CreateTemp(dir, "oci-check-")
+	if err != nil {
+		return fmt.Errorf("failed to create file in the landing zone: %w", err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("failed to remove file from the landing zone: %w", err)
+	}
+	return nil
 }
 
 // upsertFileLayer updates the layers list with the provided file descriptor.
@@ -416,28 +1180,37 @@ func upsertFileLayer(layers []ocispec.Descriptor, fileDesc ocispec.Descriptor) (
 	return true, layers
 }
 
-func manifestLayers(ctx context.Context, repo oras.Target, manifestDesc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
-	var layers []ocispec.Descriptor
-	if manifestDesc.Digest != "" {
-		// Fetch the existing manifest
-		manifestReader, err := repo.Fetch(ctx, manifestDesc)
-		if err != nil {
-			return nil, fmt.Errorf("failed to fetch manifest: %w", err)
-		}
-		defer manifestReader.Close()
+func manifestLayers(ctx context.Context, repo oras.Target, manifestDesc ocispec.Descriptor) (_ []ocispec.Descriptor, err error) {
+	ctx, span := startSpan(ctx, "oci.manifestLayers", attrDigest.String(manifestDesc.Digest.String()))
+	defer func() { endSpan(span, err) }()
 
-		manifestBytes, err := io.ReadAll(manifestReader)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read manifest: %w", err)
-		}
+	if manifestDesc.Digest == "" {
+		return nil, nil
+	}
+	manifest, err := fetchManifest(ctx, repo, manifestDesc)
+	if err != nil {
+		return nil, err
+	}
+	return manifest.Layers, nil
+}
 
-		var manifest ocispec.Manifest
-		if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
-		}
-		layers = manifest.Layers
+func fetchManifest(ctx context.Context, repo oras.Target, manifestDesc ocispec.Descriptor) (*ocispec.Manifest, error) {
+	manifestReader, err := repo.Fetch(ctx, manifestDesc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %w", err)
+	}
+	defer manifestReader.Close()
+
+	manifestBytes, err := io.ReadAll(manifestReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal manifest: %w", err)
 	}
-	return layers, nil
+	return &manifest, nil
 }
 
 func detectFileMediaType(f *RepoFile) string {
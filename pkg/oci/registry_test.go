@@ -1,20 +1,34 @@
 package oci
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"maps"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/abcxyz/pkg/testutil"
 	"github.com/google/go-cmp/cmp"
+	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/yolocs/ocifactory/pkg/audit"
+	"github.com/yolocs/ocifactory/pkg/cred"
+	"github.com/yolocs/ocifactory/pkg/events"
+	"oras.land/oras-go/v2"
 	"oras.land/oras-go/v2/content/memory"
 	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote/auth"
 )
 
 func TestNewRegistry(t *testing.T) {
@@ -301,28 +315,54 @@ func TestUpsertFileLayer(t *testing.T) {
 type inMemoryRepo struct {
 	*memory.Store
 	allTags map[string]string
+	deleted map[digest.Digest]bool
+	mu      sync.Mutex
 }
 
 func (r *inMemoryRepo) Tags(_ context.Context, _ string, fn func(tags []string) error) error {
-	return fn(slices.Collect(maps.Keys(r.allTags)))
+	r.mu.Lock()
+	tags := slices.Collect(maps.Keys(r.allTags))
+	r.mu.Unlock()
+	return fn(tags)
 }
 
 func (r *inMemoryRepo) Tag(ctx context.Context, desc ocispec.Descriptor, reference string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.allTags[reference] = desc.Digest.String()
 	return r.Store.Tag(ctx, desc, reference)
 }
 
 func (r *inMemoryRepo) Delete(ctx context.Context, target ocispec.Descriptor) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	for tag, digest := range r.allTags {
 		if digest == target.Digest.String() {
 			delete(r.allTags, tag)
 		}
 	}
+	if r.deleted == nil {
+		r.deleted = make(map[digest.Digest]bool)
+	}
+	r.deleted[target.Digest] = true
 	return nil
 }
 
+// Predecessors skips the deleted manifests, which the memory store keeps.
+func (r *inMemoryRepo) Predecessors(ctx context.Context, node ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	preds, err := r.Store.Predecessors(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.DeleteFunc(preds, func(d ocispec.Descriptor) bool { return r.deleted[d.Digest] }), nil
+}
+
 // Intercept the Resolve call to return ErrNotFound if the target has been deleted.
 func (r *inMemoryRepo) Resolve(ctx context.Context, reference string) (ocispec.Descriptor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	target, err := r.Store.Resolve(ctx, reference)
 	if err != nil {
 		return ocispec.Descriptor{}, err
@@ -444,7 +484,13 @@ func TestAddReadRoundtrip(t *testing.T) {
 	})
 
 	t.Run("list files", func(t *testing.T) {
-		wantFiles := []*RepoFile{f0}
+		listed := *f0
+		listed.Size = int64(len(content))
+		listed.Created = CreatedTime(wantDesc.File)
+		if listed.Created.IsZero() {
+			t.Errorf("file %q has no created annotation", f0.Name)
+		}
+		wantFiles := []*RepoFile{&listed}
 		gotFiles, err := r.ListFiles(ctx, "foobar")
 		if diff := testutil.DiffErrString(err, ""); diff != "" {
 			t.Errorf("ListFiles() error diff: %s", diff)
@@ -469,3 +515,726 @@ func TestAddReadRoundtrip(t *testing.T) {
 		}
 	})
 }
+
+func TestNewBackendCredential(t *testing.T) {
+	t.Parallel()
+
+	ctxCred := &cred.BasicCred{User: "caller", Password: "caller-pwd"}
+	fixedCred := &cred.BasicCred{User: "robot", Password: "robot-pwd"}
+
+	tests := []struct {
+		name     string
+		opts     []RegistryOption
+		ctxCred  *cred.BasicCred
+		wantUser string
+	}{
+		{
+			name:     "context credential",
+			ctxCred:  ctxCred,
+			wantUser: "caller",
+		},
+		{
+			name: "no credential",
+		},
+		{
+			name:     "fixed credential wins",
+			opts:     []RegistryOption{WithCredential(fixedCred)},
+			ctxCred:  ctxCred,
+			wantUser: "robot",
+		},
+		{
+			name:    "fixed anonymous never sees the caller's credential",
+			opts:    []RegistryOption{WithCredential(nil)},
+			ctxCred: ctxCred,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, tt.opts...)
+			if err != nil {
+				t.Fatalf("NewRegistry() unexpected error: %v", err)
+			}
+
+			ctx := context.Background()
+			if tt.ctxCred != nil {
+				ctx = cred.WithCred(ctx, &cred.Cred{Basic: tt.ctxCred})
+			}
+			backend, err := r.newBackend(ctx, &RepoFile{OwningRepo: "repo"})
+			if err != nil {
+				t.Fatalf("newBackend() unexpected error: %v", err)
+			}
+
+			var gotUser string
+			if c, ok := backend.(*remoteRepo).Client.(*auth.Client); ok {
+				ac, err := c.Credential(ctx, "example.com")
+				if err != nil {
+					t.Fatal(err)
+				}
+				gotUser = ac.Username
+			}
+			if gotUser != tt.wantUser {
+				t.Errorf("backend user = %q, want %q", gotUser, tt.wantUser)
+			}
+		})
+	}
+}
+
+// racingRepo simulates a writer in another process that moves the tag right
+// after a manifest is pushed and before it's tagged.
+type racingRepo struct {
+	*inMemoryRepo
+	races int // Number of times to race. Negative means always.
+	race  func(ctx context.Context) error
+}
+
+func (r *racingRepo) Push(ctx context.Context, expected ocispec.Descriptor, content io.Reader) error {
+	if err := r.inMemoryRepo.Push(ctx, expected, content); err != nil {
+		return err
+	}
+	if expected.MediaType != ocispec.MediaTypeImageManifest || r.races == 0 {
+		return nil
+	}
+	r.races--
+	return r.race(ctx)
+}
+
+// addOtherFile adds a file to the tag of the repo the way another process would.
+func addOtherFile(ctx context.Context, repo *inMemoryRepo, tag, name, content string) error {
+	blob := []byte(content)
+	desc := ocispec.Descriptor{
+		MediaType:   "text/plain",
+		Digest:      digest.FromBytes(blob),
+		Size:        int64(len(blob)),
+		Annotations: map[string]string{FileNameAnnotation: name},
+	}
+	if err := repo.Push(ctx, desc, bytes.NewReader(blob)); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+
+	current, err := resolveTag(ctx, repo, tag)
+	if err != nil {
+		return err
+	}
+	layers, err := manifestLayers(ctx, repo, current)
+	if err != nil {
+		return err
+	}
+	_, layers = upsertFileLayer(layers, desc)
+	manifestDesc, err := oras.PackManifest(ctx, repo, oras.PackManifestVersion1_1, DefaultArtifactType, oras.PackManifestOptions{Layers: layers})
+	if err != nil {
+		return err
+	}
+	return repo.Tag(ctx, manifestDesc, tag)
+}
+
+func TestAddFileConcurrent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithLandingDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+	r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+		return memRepo, nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f := &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: fmt.Sprintf("file-%d.txt", i)}
+			if _, err := r.AddFile(ctx, f, strings.NewReader(f.Name)); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("AddFile() unexpected error: %v", err)
+	}
+
+	files, err := r.ListFiles(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("ListFiles() unexpected error: %v", err)
+	}
+	if got := len(files); got != n {
+		t.Errorf("ListFiles() got %d files, want %d: %v", got, n, files)
+	}
+}
+
+func TestAddFileTagMoved(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		races     int
+		wantErr   string
+		wantFiles []string
+	}{
+		{
+			name:      "retry once",
+			races:     1,
+			wantFiles: []string{"mine.txt", "other-0.txt"},
+		},
+		{
+			name:    "tag keeps changing",
+			races:   -1,
+			wantErr: `tag "v0" kept changing after 5 attempts`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com", Path: "/" + tt.name}, WithLandingDir(t.TempDir()))
+			if err != nil {
+				t.Fatalf("NewRegistry() error = %v", err)
+			}
+			memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+			raced := 0
+			repo := &racingRepo{inMemoryRepo: memRepo, races: tt.races}
+			repo.race = func(ctx context.Context) error {
+				name := fmt.Sprintf("other-%d.txt", raced)
+				raced++
+				return addOtherFile(ctx, memRepo, "v0", name, name)
+			}
+			r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+				return repo, nil
+			}
+
+			_, err = r.AddFile(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "mine.txt"}, strings.NewReader("mine"))
+			if diff := testutil.DiffErrString(err, tt.wantErr); diff != "" {
+				t.Fatalf("AddFile() error diff: %s", diff)
+			}
+			if err != nil {
+				return
+			}
+
+			files, err := r.ListFiles(ctx, "foobar")
+			if err != nil {
+				t.Fatalf("ListFiles() unexpected error: %v", err)
+			}
+			var got []string
+			for _, f := range files {
+				got = append(got, f.Name)
+			}
+			slices.Sort(got)
+			if diff := cmp.Diff(tt.wantFiles, got); diff != "" {
+				t.Errorf("ListFiles() names diff (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestAddFiles(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		uploads   []*FileUpload
+		check     UploadCheckFunc
+		wantErr   string
+		wantFiles []string
+	}{
+		{
+			name: "single manifest",
+			uploads: []*FileUpload{
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "project-1.0.0.jar"}, Content: strings.NewReader("jar")},
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "project-1.0.0.pom"}, Content: strings.NewReader("pom")},
+			},
+			wantFiles: []string{"project-1.0.0.jar", "project-1.0.0.pom"},
+		},
+		{
+			name:    "no file",
+			wantErr: "no file to add",
+		},
+		{
+			name: "different tags",
+			uploads: []*FileUpload{
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "a.txt"}, Content: strings.NewReader("a")},
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v1", Name: "b.txt"}, Content: strings.NewReader("b")},
+			},
+			wantErr: "all files must be in foobar:v0; got foobar:v1",
+		},
+		{
+			name: "duplicate names",
+			uploads: []*FileUpload{
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "a.txt"}, Content: strings.NewReader("a")},
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "a.txt"}, Content: strings.NewReader("b")},
+			},
+			wantErr: `file "a.txt" is added more than once`,
+		},
+		{
+			name: "digest mismatch adds nothing",
+			uploads: []*FileUpload{
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "a.txt"}, Content: strings.NewReader("a")},
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "b.txt", Digest: "sha256:0000"}, Content: strings.NewReader("b")},
+			},
+			wantErr: "file digest mismatch",
+		},
+		{
+			name: "rejected by check adds nothing",
+			uploads: []*FileUpload{
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "a.txt"}, Content: strings.NewReader("a")},
+				{RepoFile: &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "b.txt"}, Content: strings.NewReader("b")},
+			},
+			check: func(ctx context.Context, f *RepoFile, fileDesc ocispec.Descriptor) error {
+				if fileDesc.Digest == digest.FromString("b") {
+					return fmt.Errorf("not signed")
+				}
+				return nil
+			},
+			wantErr: `file "b.txt" is rejected: not signed`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			opts := []RegistryOption{WithLandingDir(t.TempDir())}
+			if tt.check != nil {
+				opts = append(opts, WithUploadCheck(tt.check))
+			}
+			r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, opts...)
+			if err != nil {
+				t.Fatalf("NewRegistry() error = %v", err)
+			}
+			memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+			r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+				return memRepo, nil
+			}
+
+			descs, err := r.AddFiles(ctx, tt.uploads)
+			if diff := testutil.DiffErrString(err, tt.wantErr); diff != "" {
+				t.Fatalf("AddFiles() error diff: %s", diff)
+			}
+			if err != nil {
+				if len(memRepo.allTags) != 0 {
+					t.Errorf("Tags pushed after a failed AddFiles(): %v", memRepo.allTags)
+				}
+				return
+			}
+
+			for _, d := range descs[1:] {
+				if d.Manifest.Digest != descs[0].Manifest.Digest {
+					t.Errorf("Files added in different manifests: %v and %v", descs[0].Manifest.Digest, d.Manifest.Digest)
+				}
+			}
+			files, err := r.ListFiles(ctx, "foobar")
+			if err != nil {
+				t.Fatalf("ListFiles() unexpected error: %v", err)
+			}
+			var got []string
+			for _, f := range files {
+				got = append(got, f.Name)
+			}
+			slices.Sort(got)
+			if diff := cmp.Diff(tt.wantFiles, got); diff != "" {
+				t.Errorf("ListFiles() names diff (-want, +got): %s", diff)
+			}
+		})
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithLandingDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+	r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+		return memRepo, nil
+	}
+
+	a := &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "a.txt"}
+	b := &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "b.txt"}
+	if _, err := r.AddFiles(ctx, []*FileUpload{
+		{RepoFile: a, Content: strings.NewReader("a")},
+		{RepoFile: b, Content: strings.NewReader("b")},
+	}); err != nil {
+		t.Fatalf("AddFiles() error = %v", err)
+	}
+
+	if err := r.DeleteFile(ctx, a); err != nil {
+		t.Fatalf("DeleteFile() error = %v", err)
+	}
+	if _, _, err := r.ReadFile(ctx, a); !errors.Is(err, errdef.ErrNotFound) {
+		t.Errorf("ReadFile() of deleted file error = %v, want not found", err)
+	}
+	_, rc, err := r.ReadFile(ctx, b)
+	if err != nil {
+		t.Fatalf("ReadFile() of sibling error = %v", err)
+	}
+	rc.Close()
+
+	if err := r.DeleteFile(ctx, a); !errors.Is(err, errdef.ErrNotFound) {
+		t.Errorf("DeleteFile() of deleted file error = %v, want not found", err)
+	}
+
+	// The tag goes away with its last file.
+	if err := r.DeleteFile(ctx, b); err != nil {
+		t.Fatalf("DeleteFile() error = %v", err)
+	}
+	tags, err := r.ListTags(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("ListTags() error = %v", err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("ListTags() = %v, want no tags", tags)
+	}
+	if err := r.DeleteFile(ctx, b); !errors.Is(err, errdef.ErrNotFound) {
+		t.Errorf("DeleteFile() of deleted tag error = %v, want not found", err)
+	}
+}
+
+func TestListTagInfo(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithLandingDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+	r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+		return memRepo, nil
+	}
+
+	before := time.Now().Add(-time.Second)
+	if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v1", RefTag: "latest", Name: "a.txt"}, strings.NewReader("a")); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+
+	infos, err := r.ListTagInfo(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("ListTagInfo() error = %v", err)
+	}
+	if len(infos) != 1 || infos[0].Tag != "v1" {
+		t.Fatalf("ListTagInfo() = %v, want only v1", infos)
+	}
+	if got := infos[0].Created; got.Before(before) || got.After(time.Now()) {
+		t.Errorf("ListTagInfo() created = %v, want around now", got)
+	}
+}
+
+func TestChangeAnnotations(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithLandingDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+	r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+		return memRepo, nil
+	}
+
+	manifestAnnotations := func(t *testing.T) map[string]string {
+		t.Helper()
+		desc, err := memRepo.Resolve(ctx, "v1")
+		if err != nil {
+			t.Fatalf("Resolve() error = %v", err)
+		}
+		manifest, err := fetchManifest(ctx, memRepo, desc)
+		if err != nil {
+			t.Fatalf("fetchManifest() error = %v", err)
+		}
+		return manifest.Annotations
+	}
+
+	aliceCtx := audit.WithRequest(ctx, &audit.Request{Identity: "alice", UserAgent: "pip/24.0"})
+	a := &RepoFile{OwningRepo: "foobar", OwningTag: "v1", Name: "a.txt"}
+	aDesc, err := r.AddFile(aliceCtx, a, strings.NewReader("a"))
+	if err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+	if got := aDesc.File.Annotations; got[UploaderAnnotation] != "alice" || got[ClientAnnotation] != "pip/24.0" || CreatedTime(aDesc.File).IsZero() {
+		t.Errorf("AddFile() file annotations = %v, want uploader, client and created", got)
+	}
+	first := manifestAnnotations(t)
+	if first[ocispec.AnnotationCreated] == "" || first[ocispec.AnnotationCreated] != first[ModifiedAnnotation] {
+		t.Errorf("first manifest annotations = %v, want the same created and modified", first)
+	}
+
+	// Annotations are recorded at second precision.
+	time.Sleep(time.Second)
+
+	// Anonymous changes don't record an uploader and keep the earlier files.
+	if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v1", Name: "b.txt"}, strings.NewReader("b")); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+	second := manifestAnnotations(t)
+	if got, want := second[ocispec.AnnotationCreated], first[ocispec.AnnotationCreated]; got != want {
+		t.Errorf("manifest created = %q, want kept %q", got, want)
+	}
+	if got := second[ModifiedAnnotation]; got == first[ModifiedAnnotation] {
+		t.Errorf("manifest modified = %q, want updated", got)
+	}
+	if _, ok := second[UploaderAnnotation]; ok {
+		t.Errorf("manifest annotations = %v, want no uploader of an anonymous change", second)
+	}
+
+	gotDesc, rc, err := r.ReadFile(ctx, a)
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	rc.Close()
+	if diff := cmp.Diff(aDesc.File.Annotations, gotDesc.File.Annotations); diff != "" {
+		t.Errorf("unchanged file annotations mismatch (-want, +got):\n%s", diff)
+	}
+
+	infos, err := r.ListTagInfo(ctx, "foobar")
+	if err != nil {
+		t.Fatalf("ListTagInfo() error = %v", err)
+	}
+	if len(infos) != 1 || !infos[0].Modified.After(infos[0].Created) {
+		t.Errorf("ListTagInfo() = %v, want modified after created", infos)
+	}
+}
+
+func TestListRepos(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/_catalog" {
+			t.Errorf("unexpected request path %q", r.URL.Path)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"repositories":["other/foo","team/maven/com/example/app","team/maven/com/example/lib","team/mavenx/foo"]}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL + "/team/maven")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRegistry(u)
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	got, err := r.ListRepos(context.Background())
+	if err != nil {
+		t.Fatalf("ListRepos() error = %v", err)
+	}
+	want := []string{"com/example/app", "com/example/lib"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("ListRepos() mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestRegistryAudit(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	ctx := audit.WithLogger(context.Background(), audit.NewLogger(&buf))
+
+	r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithLandingDir(t.TempDir()))
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+	r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+		return memRepo, nil
+	}
+
+	f := &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: "test.txt"}
+	var manifests []string
+	for _, content := range []string{"hello", "hello", "world"} {
+		desc, err := r.AddFile(ctx, f, strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("AddFile() error = %v", err)
+		}
+		manifests = append(manifests, desc.Manifest.Digest.String())
+	}
+	if err := r.AppendRefs(ctx, "foobar", "v0", "latest"); err != nil {
+		t.Fatalf("AppendRefs() error = %v", err)
+	}
+	if err := r.DeleteTagFiles(ctx, "foobar", "v0"); err != nil {
+		t.Fatalf("DeleteTagFiles() error = %v", err)
+	}
+
+	type entry struct {
+		Action   string `json:"action"`
+		Repo     string `json:"repo"`
+		Tag      string `json:"tag"`
+		File     string `json:"file"`
+		Digest   string `json:"digest"`
+		Manifest string `json:"manifest"`
+	}
+	var got []entry
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var e entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("failed to parse audit log: %v", err)
+		}
+		got = append(got, e)
+	}
+
+	// Adding the same content again is not a change.
+	want := []entry{
+		{Action: "publish", Repo: "foobar", Tag: "v0", File: "test.txt", Digest: digest.FromString("hello").String(), Manifest: manifests[0]},
+		{Action: "overwrite", Repo: "foobar", Tag: "v0", File: "test.txt", Digest: digest.FromString("world").String(), Manifest: manifests[2]},
+		{Action: "tag", Repo: "foobar", Tag: "ref_latest", Manifest: manifests[2]},
+		{Action: "delete", Repo: "foobar", Tag: "v0", Manifest: manifests[2]},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("audit log mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+// eventRecorder records the published events.
+type eventRecorder struct {
+	events []*events.Event
+}
+
+func (r *eventRecorder) Publish(_ context.Context, e *events.Event) {
+	r.events = append(r.events, e)
+}
+
+func TestRegistryEvents(t *testing.T) {
+	t.Parallel()
+
+	rec := &eventRecorder{}
+	ctx := events.WithPublisher(context.Background(), rec)
+
+	// Tags ending with -meta don't store a version.
+	r, err := NewRegistry(&url.URL{Scheme: "https", Host: "example.com"}, WithLandingDir(t.TempDir()),
+		WithPackageVersions(func(repo, tag string) (string, string, bool) {
+			return "pkg:" + repo, tag, !strings.HasSuffix(tag, "-meta")
+		}))
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	memRepo := &inMemoryRepo{Store: memory.New(), allTags: map[string]string{}}
+	r.newBackendFunc = func(ctx context.Context, f *RepoFile) (destRepo, error) {
+		return memRepo, nil
+	}
+
+	var manifests []string
+	for _, u := range []struct{ name, content string }{
+		{"a.txt", "hello"},
+		{"a.txt", "hello"},
+		{"a.txt", "world"},
+		{"b.txt", "other"},
+	} {
+		desc, err := r.AddFile(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v0", Name: u.name}, strings.NewReader(u.content))
+		if err != nil {
+			t.Fatalf("AddFile() error = %v", err)
+		}
+		manifests = append(manifests, desc.Manifest.Digest.String())
+	}
+	if _, err := r.AddFile(ctx, &RepoFile{OwningRepo: "foobar", OwningTag: "v0-meta", Name: "meta.txt"}, strings.NewReader("meta")); err != nil {
+		t.Fatalf("AddFile() error = %v", err)
+	}
+	if err := r.DeleteTagFiles(ctx, "foobar", "v0"); err != nil {
+		t.Fatalf("DeleteTagFiles() error = %v", err)
+	}
+
+	hello := &events.File{Name: "a.txt", Digest: digest.FromString("hello").String()}
+	world := &events.File{Name: "a.txt", Digest: digest.FromString("world").String()}
+	other := &events.File{Name: "b.txt", Digest: digest.FromString("other").String()}
+	// Adding the same content again is not a change.
+	want := []*events.Event{
+		{Type: events.TypePublished, Repo: "foobar", Package: "pkg:foobar", Version: "v0", Files: []*events.File{hello}, Manifest: manifests[0]},
+		{Type: events.TypeOverwritten, Repo: "foobar", Package: "pkg:foobar", Version: "v0", Files: []*events.File{world}, Manifest: manifests[2]},
+		{Type: events.TypePublished, Repo: "foobar", Package: "pkg:foobar", Version: "v0", Files: []*events.File{other}, Manifest: manifests[3]},
+		{Type: events.TypeDeleted, Repo: "foobar", Package: "pkg:foobar", Version: "v0", Files: []*events.File{world, other}},
+	}
+	if diff := cmp.Diff(want, rec.events); diff != "" {
+		t.Errorf("published events mismatch (-want, +got):\n%s", diff)
+	}
+}
+
+func TestPing(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		status  int
+		opts    []RegistryOption
+		wantErr string
+	}{
+		{
+			name:   "ok",
+			status: http.StatusOK,
+		},
+		{
+			name:   "unauthorized without credential",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:    "unauthorized with credential",
+			status:  http.StatusUnauthorized,
+			opts:    []RegistryOption{WithCredential(&cred.BasicCred{User: "robot", Password: "wrong"})},
+			wantErr: "failed to ping backend registry",
+		},
+		{
+			name:    "not a registry",
+			status:  http.StatusNotFound,
+			wantErr: "failed to ping backend registry",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v2/" {
+					t.Errorf("unexpected request path %q", r.URL.Path)
+				}
+				if tc.status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+				}
+				w.WriteHeader(tc.status)
+			}))
+			t.Cleanup(srv.Close)
+
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewRegistry(u, tc.opts...)
+			if err != nil {
+				t.Fatalf("NewRegistry() error = %v", err)
+			}
+			if diff := testutil.DiffErrString(r.Ping(context.Background()), tc.wantErr); diff != "" {
+				t.Errorf("Ping() returned unexpected error (-got, +want): %s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckLandingDir(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	if err := CheckLandingDir(dir); err != nil {
+		t.Errorf("CheckLandingDir() returned error: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("CheckLandingDir() left files behind: %v", entries)
+	}
+
+	if err := CheckLandingDir(dir + "/missing"); err == nil {
+		t.Errorf("CheckLandingDir() of missing dir returned nil error")
+	}
+}
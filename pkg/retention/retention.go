@@ -0,0 +1,302 @@
+// Package retention deletes package versions selected by rules, e.g. to keep
+// only the last SNAPSHOT builds of each artifact.
+package retention
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/abcxyz/pkg/logging"
+	"github.com/yolocs/ocifactory/pkg/metrics"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// snapshotSuffix marks the development builds of a Maven release.
+const snapshotSuffix = "-SNAPSHOT"
+
+// Store lists the versions of a repository. It's implemented by oci.Registry.
+type Store interface {
+	ListRepos(ctx context.Context) ([]string, error)
+	ListTagInfo(ctx context.Context, repo string) ([]*oci.TagInfo, error)
+}
+
+// DeleteFunc deletes the version stored under the repository and tag.
+type DeleteFunc func(ctx context.Context, repo, tag string) error
+
+// Rule selects versions to delete. A rule with KeepLast or MaxAge selects the
+// matching versions of each package that are not among the KeepLast newest
+// and are older than MaxAge. Versions of unknown age are only selected by
+// ReleasedSnapshots, which additionally selects matching SNAPSHOT versions
+// whose release exists.
+type Rule struct {
+	Packages string // path.Match pattern of package names, e.g. "com.example:*". Empty matches all.
+	Versions string // path.Match pattern of versions, e.g. "*-SNAPSHOT". Empty matches all.
+
+	KeepLast int           // The number of newest versions to keep. 0 keeps none by count.
+	MaxAge   time.Duration // The age after which versions are deleted. 0 doesn't keep any by age.
+
+	// ReleasedSnapshots deletes "X-SNAPSHOT" once "X" exists.
+	ReleasedSnapshots bool
+}
+
+// Validate checks that the rule is well formed and selects something.
+func (r *Rule) Validate() error {
+	var merr error
+	if _, err := path.Match(r.Packages, ""); err != nil {
+		merr = errors.Join(merr, fmt.Errorf("packages: invalid pattern %q: %w", r.Packages, err))
+	}
+	if _, err := path.Match(r.Versions, ""); err != nil {
+		merr = errors.Join(merr, fmt.Errorf("versions: invalid pattern %q: %w", r.Versions, err))
+	}
+	if r.KeepLast < 0 {
+		merr = errors.Join(merr, fmt.Errorf("keep_last: must not be negative"))
+	}
+	if r.MaxAge < 0 {
+		merr = errors.Join(merr, fmt.Errorf("max_age: must not be negative"))
+	}
+	if r.KeepLast == 0 && r.MaxAge == 0 && !r.ReleasedSnapshots {
+		merr = errors.Join(merr, fmt.Errorf("one of keep_last, max_age or released_snapshots is required"))
+	}
+	return merr
+}
+
+// matches reports whether the rule applies to the version.
+func (r *Rule) matches(v *Deletion) bool {
+	if r.Packages != "" {
+		if ok, _ := path.Match(r.Packages, v.Package); !ok {
+			return false
+		}
+	}
+	if r.Versions != "" {
+		if ok, _ := path.Match(r.Versions, v.Version); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Target is a repository to enforce the rules on.
+type Target struct {
+	Name           string // Identifies the target in reports, e.g. the mount prefix.
+	Store          Store
+	PackageVersion oci.PackageVersionFunc
+	Delete         DeleteFunc
+	Rules          []*Rule
+
+	// Exclude are the repositories of other mounts stored under the target,
+	// relative to it. They and the repositories under them are never
+	// cleaned up.
+	Exclude []string
+}
+
+// excluded reports whether the repository belongs to another mount.
+func (t *Target) excluded(repo string) bool {
+	for _, e := range t.Exclude {
+		if repo == e || strings.HasPrefix(repo, e+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Deletion is a version selected by the rules.
+type Deletion struct {
+	Target  string
+	Repo    string
+	Tag     string
+	Package string
+	Version string
+	Created time.Time // Zero if unknown.
+	Reason  string    // Why the rules selected the version.
+
+	// Err is why the version couldn't be deleted. Always nil in a dry run.
+	Err error
+}
+
+// Plan returns the versions of the target the rules select at now, ordered
+// by repository and tag. Nothing is deleted.
+func Plan(ctx context.Context, t *Target, now time.Time) ([]*Deletion, error) {
+	repos, err := t.Store.ListRepos(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list repositories of %s: %w", t.Name, err)
+	}
+
+	var deletions []*Deletion
+	for _, repo := range repos {
+		if t.excluded(repo) {
+			continue
+		}
+		infos, err := t.Store.ListTagInfo(ctx, repo)
+		if err != nil {
+			if errors.Is(err, errdef.ErrNotFound) || oci.HasCode(err, http.StatusNotFound) {
+				continue // Deleted since it was listed.
+			}
+			return nil, fmt.Errorf("failed to list versions of %s in %s: %w", repo, t.Name, err)
+		}
+
+		// Every repository stores a single package, but the package of each
+		// tag is checked in case the format says otherwise.
+		byPackage := make(map[string][]*Deletion)
+		for _, info := range infos {
+			pkg, version, ok := t.PackageVersion(repo, info.Tag)
+			if !ok {
+				continue
+			}
+			byPackage[pkg] = append(byPackage[pkg], &Deletion{
+				Target:  t.Name,
+				Repo:    repo,
+				Tag:     info.Tag,
+				Package: pkg,
+				Version: version,
+				Created: info.Created,
+			})
+		}
+		for _, versions := range byPackage {
+			deletions = append(deletions, selectVersions(t.Rules, versions, now)...)
+		}
+	}
+
+	slices.SortFunc(deletions, func(a, b *Deletion) int {
+		return cmp.Or(strings.Compare(a.Repo, b.Repo), strings.Compare(a.Tag, b.Tag))
+	})
+	return deletions, nil
+}
+
+// selectVersions returns the versions of a package the rules select. A
+// version selected by several rules is returned once with the reason of the
+// first rule. Versions of unknown age, e.g. published before upload times
+// were recorded, are never selected by KeepLast or MaxAge since they can't be
+// ordered. They don't count towards KeepLast either.
+func selectVersions(rules []*Rule, versions []*Deletion, now time.Time) []*Deletion {
+	// Newest first. Versions of unknown age sort last.
+	slices.SortStableFunc(versions, func(a, b *Deletion) int {
+		return b.Created.Compare(a.Created)
+	})
+	released := make(map[string]bool, len(versions))
+	for _, v := range versions {
+		released[v.Version] = true
+	}
+
+	reasons := make(map[*Deletion]string)
+	for _, r := range rules {
+		kept := 0
+		for _, v := range versions {
+			if !r.matches(v) {
+				continue
+			}
+			if reasons[v] != "" {
+				continue
+			}
+			if r.ReleasedSnapshots {
+				if release, ok := strings.CutSuffix(v.Version, snapshotSuffix); ok && released[release] {
+					reasons[v] = fmt.Sprintf("released as %s", release)
+					continue
+				}
+			}
+			if (r.KeepLast == 0 && r.MaxAge == 0) || v.Created.IsZero() {
+				continue
+			}
+			if kept < r.KeepLast {
+				kept++
+				continue
+			}
+			if r.MaxAge > 0 && now.Sub(v.Created) < r.MaxAge {
+				continue
+			}
+			reasons[v] = ageReason(r)
+		}
+	}
+
+	var selected []*Deletion
+	for _, v := range versions {
+		if reason := reasons[v]; reason != "" {
+			v.Reason = reason
+			selected = append(selected, v)
+		}
+	}
+	return selected
+}
+
+func ageReason(r *Rule) string {
+	switch {
+	case r.KeepLast > 0 && r.MaxAge > 0:
+		return fmt.Sprintf("not in the last %d and older than %s", r.KeepLast, r.MaxAge)
+	case r.KeepLast > 0:
+		return fmt.Sprintf("not in the last %d", r.KeepLast)
+	default:
+		return fmt.Sprintf("older than %s", r.MaxAge)
+	}
+}
+
+// Enforce deletes the versions the rules of the targets select. In a dry run
+// nothing is deleted. A failed deletion is reported in its Err and doesn't
+// stop the others. Targets that can't be listed are skipped and their errors
+// are returned together with the deletions of the other targets.
+func Enforce(ctx context.Context, targets []*Target, dryRun bool) ([]*Deletion, error) {
+	var merr error
+	var all []*Deletion
+	now := time.Now()
+	for _, t := range targets {
+		deletions, err := Plan(ctx, t, now)
+		if err != nil {
+			merr = errors.Join(merr, err)
+			continue
+		}
+		for _, d := range deletions {
+			if dryRun {
+				metrics.RetentionDeletions.WithLabelValues("dry_run").Inc()
+				continue
+			}
+			if d.Err = t.Delete(ctx, d.Repo, d.Tag); d.Err != nil {
+				metrics.RetentionDeletions.WithLabelValues("failed").Inc()
+			} else {
+				metrics.RetentionDeletions.WithLabelValues("deleted").Inc()
+			}
+		}
+		all = append(all, deletions...)
+	}
+	return all, merr
+}
+
+// Schedule enforces the rules every interval until ctx is done and logs the
+// deletions.
+func Schedule(ctx context.Context, interval time.Duration, dryRun bool, targets []*Target) {
+	logger := logging.FromContext(ctx)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deletions, err := Enforce(ctx, targets, dryRun)
+		if err != nil {
+			logger.ErrorContext(ctx, "failed to enforce retention rules", "error", err)
+		}
+		failed := 0
+		for _, d := range deletions {
+			attrs := []any{"target", d.Target, "package", d.Package, "version", d.Version, "reason", d.Reason}
+			switch {
+			case dryRun:
+				logger.InfoContext(ctx, "retention would delete version", attrs...)
+			case d.Err != nil:
+				failed++
+				logger.WarnContext(ctx, "retention failed to delete version", append(attrs, "error", d.Err)...)
+			default:
+				logger.InfoContext(ctx, "retention deleted version", attrs...)
+			}
+		}
+		logger.InfoContext(ctx, "enforced retention rules", "selected", len(deletions), "failed", failed, "dry_run", dryRun)
+	}
+}
@@ -0,0 +1,308 @@
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/yolocs/ocifactory/pkg/oci"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote/errcode"
+)
+
+var now = time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+// fakeStore has the tags of each repository with their age in days. The gone
+// repositories are listed but deleted since, the registry answers 404.
+type fakeStore struct {
+	repos   map[string]map[string]int
+	gone    []string
+	listErr error
+	deleted []string
+}
+
+func (s *fakeStore) ListRepos(ctx context.Context) ([]string, error) {
+	if s.listErr != nil {
+		return nil, s.listErr
+	}
+	repos := append(slices.Collect(maps.Keys(s.repos)), s.gone...)
+	slices.Sort(repos)
+	return repos, nil
+}
+
+func (s *fakeStore) ListTagInfo(ctx context.Context, repo string) ([]*oci.TagInfo, error) {
+	if slices.Contains(s.gone, repo) {
+		return nil, &errcode.ErrorResponse{StatusCode: http.StatusNotFound}
+	}
+	tags, ok := s.repos[repo]
+	if !ok {
+		return nil, fmt.Errorf("repo %q: %w", repo, errdef.ErrNotFound)
+	}
+	var infos []*oci.TagInfo
+	for _, tag := range slices.Sorted(maps.Keys(tags)) {
+		info := &oci.TagInfo{Tag: tag}
+		if days := tags[tag]; days >= 0 {
+			info.Created = now.AddDate(0, 0, -days)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (s *fakeStore) delete(ctx context.Context, repo, tag string) error {
+	if strings.HasPrefix(tag, "fail") {
+		return fmt.Errorf("failed to delete %s", tag)
+	}
+	s.deleted = append(s.deleted, repo+":"+tag)
+	return nil
+}
+
+// packageVersion skips the metadata tags like maven.PackageVersion.
+func packageVersion(repo, tag string) (string, string, bool) {
+	if tag == "metadata" {
+		return "", "", false
+	}
+	return repo, tag, true
+}
+
+func TestPlan(t *testing.T) {
+	t.Parallel()
+
+	day := 24 * time.Hour
+	cases := []struct {
+		name    string
+		repos   map[string]map[string]int
+		gone    []string
+		exclude []string
+		rules   []*Rule
+		want    []string
+	}{
+		{
+			name: "keep last",
+			repos: map[string]map[string]int{
+				"app": {"1.0-SNAPSHOT": 5, "1.1-SNAPSHOT": 3, "1.2-SNAPSHOT": 1, "1.0": 10, "metadata": 20},
+			},
+			rules: []*Rule{{Versions: "*-SNAPSHOT", KeepLast: 2}},
+			want:  []string{"app:1.0-SNAPSHOT not in the last 2"},
+		},
+		{
+			name: "max age",
+			repos: map[string]map[string]int{
+				"app": {"1.0.dev1": 40, "1.0.dev2": 20, "1.0": 50},
+				"lib": {"2.0.dev1": 31},
+			},
+			rules: []*Rule{{Versions: "*.dev*", MaxAge: 30 * day}},
+			want:  []string{"app:1.0.dev1 older than 720h0m0s", "lib:2.0.dev1 older than 720h0m0s"},
+		},
+		{
+			name: "keep last and max age",
+			repos: map[string]map[string]int{
+				"app": {"1": 40, "2": 35, "3": 20, "4": 10},
+			},
+			rules: []*Rule{{KeepLast: 1, MaxAge: 30 * day}},
+			want:  []string{"app:1 not in the last 1 and older than 720h0m0s", "app:2 not in the last 1 and older than 720h0m0s"},
+		},
+		{
+			name: "unknown age is never selected by age",
+			repos: map[string]map[string]int{
+				"app": {"1": -1, "2": 40, "3": 1},
+			},
+			rules: []*Rule{{MaxAge: 30 * day}, {KeepLast: 1}},
+			want:  []string{"app:2 older than 720h0m0s"},
+		},
+		{
+			name: "unknown age doesn't count towards keep last",
+			repos: map[string]map[string]int{
+				"app": {"1.0": -1, "1.1": -1, "2.0": 10, "2.1": 5, "2.2": 1},
+			},
+			rules: []*Rule{{KeepLast: 2}},
+			want:  []string{"app:2.0 not in the last 2"},
+		},
+		{
+			name: "unknown age released snapshot",
+			repos: map[string]map[string]int{
+				"app": {"1.0-SNAPSHOT": -1, "1.0": -1},
+			},
+			rules: []*Rule{{ReleasedSnapshots: true, KeepLast: 5}},
+			want:  []string{"app:1.0-SNAPSHOT released as 1.0"},
+		},
+		{
+			name: "released snapshots",
+			repos: map[string]map[string]int{
+				"app": {"1.0-SNAPSHOT": 5, "1.0": 1, "1.1-SNAPSHOT": 1},
+			},
+			rules: []*Rule{{ReleasedSnapshots: true}},
+			want:  []string{"app:1.0-SNAPSHOT released as 1.0"},
+		},
+		{
+			name: "package pattern",
+			repos: map[string]map[string]int{
+				"team/app": {"1": 40},
+				"other":    {"1": 40},
+			},
+			rules: []*Rule{{Packages: "team/*", MaxAge: day}},
+			want:  []string{"team/app:1 older than 24h0m0s"},
+		},
+		{
+			name: "first rule wins",
+			repos: map[string]map[string]int{
+				"app": {"1.0-SNAPSHOT": 5, "1.0": 1},
+			},
+			rules: []*Rule{{ReleasedSnapshots: true}, {MaxAge: day}},
+			want:  []string{"app:1.0 older than 24h0m0s", "app:1.0-SNAPSHOT released as 1.0"},
+		},
+		{
+			name: "repository deleted since listed",
+			repos: map[string]map[string]int{
+				"app": {"1": 40},
+			},
+			gone:  []string{"lib"},
+			rules: []*Rule{{MaxAge: day}},
+			want:  []string{"app:1 older than 24h0m0s"},
+		},
+		{
+			name: "repositories of other mounts",
+			repos: map[string]map[string]int{
+				"app":               {"1": 40},
+				"pypi/index":        {"foo": 40},
+				"pypi/packages/foo": {"1": 40},
+				"pypi-other/app":    {"1": 40},
+			},
+			exclude: []string{"pypi"},
+			rules:   []*Rule{{MaxAge: day}},
+			want:    []string{"app:1 older than 24h0m0s", "pypi-other/app:1 older than 24h0m0s"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			target := &Target{Name: "/maven/", Store: &fakeStore{repos: tc.repos, gone: tc.gone}, PackageVersion: packageVersion, Rules: tc.rules, Exclude: tc.exclude}
+			deletions, err := Plan(context.Background(), target, now)
+			if err != nil {
+				t.Fatalf("Plan() unexpected error: %v", err)
+			}
+			var got []string
+			for _, d := range deletions {
+				got = append(got, d.Repo+":"+d.Tag+" "+d.Reason)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Plan() mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEnforce(t *testing.T) {
+	t.Parallel()
+
+	rules := []*Rule{{KeepLast: 1}}
+	cases := []struct {
+		name        string
+		dryRun      bool
+		listErr     error
+		wantDeleted []string
+		wantFailed  []string
+		wantErr     string
+	}{
+		{
+			name:        "deletes",
+			wantDeleted: []string{"app:1"},
+			wantFailed:  []string{"fail-1"},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+		},
+		{
+			name:    "list error",
+			listErr: errors.New("catalog unsupported"),
+			wantErr: "failed to list repositories of /maven/: catalog unsupported",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			store := &fakeStore{
+				repos: map[string]map[string]int{
+					"app":   {"1": 2, "2": 1},
+					"other": {"fail-1": 2, "fail-2": 1},
+				},
+				listErr: tc.listErr,
+			}
+			target := &Target{Name: "/maven/", Store: store, PackageVersion: packageVersion, Delete: store.delete, Rules: rules}
+			deletions, err := Enforce(context.Background(), []*Target{target}, tc.dryRun)
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Fatalf("Enforce() returned unexpected error (-got, +want): %s", diff)
+			}
+
+			var failed []string
+			for _, d := range deletions {
+				if d.Err != nil {
+					failed = append(failed, d.Tag)
+				}
+			}
+			if diff := cmp.Diff(tc.wantDeleted, store.deleted, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("deleted versions mismatch (-want, +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.wantFailed, failed, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("failed deletions mismatch (-want, +got):\n%s", diff)
+			}
+			if tc.listErr == nil && len(deletions) != 2 {
+				t.Errorf("Enforce() returned %d deletions, want 2", len(deletions))
+			}
+		})
+	}
+}
+
+func TestRuleValidate(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		rule    *Rule
+		wantErr string
+	}{
+		{
+			name: "valid",
+			rule: &Rule{Packages: "com.example:*", Versions: "*-SNAPSHOT", KeepLast: 3},
+		},
+		{
+			name:    "nothing selected",
+			rule:    &Rule{Versions: "*-SNAPSHOT"},
+			wantErr: "one of keep_last, max_age or released_snapshots is required",
+		},
+		{
+			name:    "bad pattern",
+			rule:    &Rule{Versions: "[", ReleasedSnapshots: true},
+			wantErr: `versions: invalid pattern "["`,
+		},
+		{
+			name:    "negative",
+			rule:    &Rule{KeepLast: -1, MaxAge: -time.Hour},
+			wantErr: "keep_last: must not be negative\nmax_age: must not be negative",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if diff := testutil.DiffErrString(tc.rule.Validate(), tc.wantErr); diff != "" {
+				t.Errorf("Validate() returned unexpected error (-got, +want): %s", diff)
+			}
+		})
+	}
+}
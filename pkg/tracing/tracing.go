@@ -0,0 +1,73 @@
+// Package tracing sets up OpenTelemetry tracing for the server.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	// ExporterNone disables exporting spans. Trace context is still propagated.
+	ExporterNone = "none"
+	// ExporterStdout writes spans as JSON, which is useful for local debugging.
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans over OTLP/HTTP. It's configured with the
+	// standard OTEL_EXPORTER_OTLP_* environment variables.
+	ExporterOTLP = "otlp"
+)
+
+// Exporters are the supported exporter names.
+var Exporters = []string{ExporterNone, ExporterStdout, ExporterOTLP}
+
+// NewExporter creates the span exporter by name. The stdout exporter writes to
+// w. Returns nil for ExporterNone.
+func NewExporter(ctx context.Context, name string, w io.Writer) (sdktrace.SpanExporter, error) {
+	switch name {
+	case "", ExporterNone:
+		return nil, nil
+	case ExporterStdout:
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create stdout exporter: %w", err)
+		}
+		return exp, nil
+	case ExporterOTLP:
+		exp, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create otlp exporter: %w", err)
+		}
+		return exp, nil
+	default:
+		return nil, fmt.Errorf("trace exporter %q is not supported", name)
+	}
+}
+
+// Setup installs the W3C trace context and baggage propagators and, if exp is
+// not nil, a global tracer provider that exports spans with exp. Sampling
+// follows the parent span and can be changed with OTEL_TRACES_SAMPLER. Call
+// the returned function to flush the spans before exiting.
+func Setup(exp sdktrace.SpanExporter) func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if exp == nil {
+		return func(context.Context) error { return nil }
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("ocifactory"))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown
+}
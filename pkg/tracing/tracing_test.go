@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/abcxyz/pkg/testutil"
+	"go.opentelemetry.io/otel"
+)
+
+func TestNewExporter(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		want    bool
+		wantErr string
+	}{
+		{name: "", want: false},
+		{name: ExporterNone, want: false},
+		{name: ExporterStdout, want: true},
+		{name: ExporterOTLP, want: true},
+		{name: "zipkin", wantErr: `trace exporter "zipkin" is not supported`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			exp, err := NewExporter(context.Background(), tc.name, &bytes.Buffer{})
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Fatalf("NewExporter() returned unexpected error (-got, +want): %s", diff)
+			}
+			if got := exp != nil; got != tc.want {
+				t.Errorf("NewExporter() got exporter = %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetup(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	exp, err := NewExporter(context.Background(), ExporterStdout, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdown := Setup(exp)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "test span")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown() returned error: %v", err)
+	}
+
+	if got := buf.String(); !strings.Contains(got, `"Name":"test span"`) || !strings.Contains(got, `"Value":"ocifactory"`) {
+		t.Errorf("exported spans = %s, want test span of service ocifactory", got)
+	}
+}
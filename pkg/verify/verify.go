@@ -0,0 +1,213 @@
+// Package verify checks cosign and Sigstore signatures of artifacts against
+// configured public keys without contacting Sigstore services.
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// BundleTypePrefix is the prefix of the media types of Sigstore bundles, e.g.
+// application/vnd.dev.sigstore.bundle.v0.3+json.
+const BundleTypePrefix = "application/vnd.dev.sigstore.bundle"
+
+var (
+	// ErrUnsigned is returned when an artifact has no signature.
+	ErrUnsigned = errors.New("artifact is not signed")
+
+	// ErrInvalid is returned when no signature of an artifact is valid for
+	// any of the trusted keys.
+	ErrInvalid = errors.New("artifact signature is not valid for any trusted key")
+)
+
+// contextKey is a private string type to prevent collisions in the context map.
+type contextKey string
+
+// signaturesKey points to the value in the context where the signatures sent
+// with a request are stored.
+const signaturesKey = contextKey("signatures")
+
+// Signature is a signature of an artifact digest.
+type Signature struct {
+	// Digest is the artifact digest the signature claims to sign. Empty for
+	// plain cosign signatures, which don't carry it.
+	Digest digest.Digest
+	Sig    []byte
+}
+
+// bundle is the part of a Sigstore bundle that is verified offline. The
+// verification material is ignored since only the configured keys are trusted.
+type bundle struct {
+	MediaType        string `json:"mediaType"`
+	MessageSignature *struct {
+		MessageDigest struct {
+			Algorithm string `json:"algorithm"`
+			Digest    []byte `json:"digest"`
+		} `json:"messageDigest"`
+		Signature []byte `json:"signature"`
+	} `json:"messageSignature"`
+	DSSEEnvelope json.RawMessage `json:"dsseEnvelope"`
+}
+
+// ParseSignature parses a Sigstore bundle with a message signature, e.g. from
+// "cosign sign-blob --bundle", or the base64 encoded signature written by
+// "cosign sign-blob --output-signature".
+func ParseSignature(b []byte) (*Signature, error) {
+	b = bytes.TrimSpace(b)
+	if !bytes.HasPrefix(b, []byte("{")) {
+		sig, err := base64.StdEncoding.DecodeString(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode signature: %w", err)
+		}
+		return &Signature{Sig: sig}, nil
+	}
+
+	var bd bundle
+	if err := json.Unmarshal(b, &bd); err != nil {
+		return nil, fmt.Errorf("failed to parse bundle: %w", err)
+	}
+	if !strings.HasPrefix(bd.MediaType, BundleTypePrefix) {
+		return nil, fmt.Errorf("unsupported bundle media type %q", bd.MediaType)
+	}
+	if bd.MessageSignature == nil {
+		if len(bd.DSSEEnvelope) > 0 {
+			return nil, fmt.Errorf("bundles with a DSSE envelope are not supported")
+		}
+		return nil, fmt.Errorf("bundle has no message signature")
+	}
+	md := bd.MessageSignature.MessageDigest
+	if md.Algorithm != "SHA2_256" {
+		return nil, fmt.Errorf("unsupported digest algorithm %q", md.Algorithm)
+	}
+	return &Signature{
+		Digest: digest.NewDigestFromEncoded(digest.SHA256, hex.EncodeToString(md.Digest)),
+		Sig:    bd.MessageSignature.Signature,
+	}, nil
+}
+
+// WithSignatures adds the signatures sent with the request to the context.
+func WithSignatures(ctx context.Context, sigs []*Signature) context.Context {
+	return context.WithValue(ctx, signaturesKey, sigs)
+}
+
+// SignaturesFromContext returns the signatures sent with the request.
+func SignaturesFromContext(ctx context.Context) []*Signature {
+	sigs, _ := ctx.Value(signaturesKey).([]*Signature)
+	return sigs
+}
+
+// Verifier verifies signatures with a set of trusted public keys. Only keys
+// that sign the SHA-256 digest of the artifact are supported, which are the
+// ECDSA and RSA keys of "cosign generate-key-pair" and KMS keys.
+type Verifier struct {
+	keys []crypto.PublicKey
+}
+
+// NewVerifier creates a verifier that trusts the PEM encoded public keys.
+func NewVerifier(pems ...[]byte) (*Verifier, error) {
+	if len(pems) == 0 {
+		return nil, fmt.Errorf("at least one public key is required")
+	}
+	v := &Verifier{}
+	for i, b := range pems {
+		key, err := ParsePublicKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("key %d: %w", i, err)
+		}
+		v.keys = append(v.keys, key)
+	}
+	return v, nil
+}
+
+// LoadVerifier creates a verifier that trusts the PEM encoded public keys in
+// the files.
+func LoadVerifier(paths ...string) (*Verifier, error) {
+	pems := make([][]byte, 0, len(paths))
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read public key: %w", err)
+		}
+		pems = append(pems, b)
+	}
+	v, err := NewVerifier(pems...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load public keys %v: %w", paths, err)
+	}
+	return v, nil
+}
+
+// ParsePublicKey parses a PEM encoded PKIX public key, e.g. cosign.pub.
+func ParsePublicKey(b []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, only ECDSA and RSA keys are supported", key)
+	}
+}
+
+// Verify checks that at least one of the signatures is a valid signature of
+// the artifact digest by a trusted key. Signatures of other digests are
+// ignored. Returns ErrUnsigned if no signature is for the artifact and
+// ErrInvalid if none of them is valid.
+func (v *Verifier) Verify(d digest.Digest, sigs []*Signature) error {
+	if d.Algorithm() != digest.SHA256 {
+		return fmt.Errorf("unsupported artifact digest %q", d)
+	}
+	hashed, err := hex.DecodeString(d.Encoded())
+	if err != nil {
+		return fmt.Errorf("invalid artifact digest %q: %w", d, err)
+	}
+
+	candidates := 0
+	for _, sig := range sigs {
+		if sig.Digest != "" && sig.Digest != d {
+			continue
+		}
+		candidates++
+		for _, key := range v.keys {
+			if verifyDigest(key, hashed, sig.Sig) {
+				return nil
+			}
+		}
+	}
+	if candidates == 0 {
+		return ErrUnsigned
+	}
+	return ErrInvalid
+}
+
+func verifyDigest(key crypto.PublicKey, hashed, sig []byte) bool {
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, hashed, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hashed, sig) == nil ||
+			rsa.VerifyPSS(k, crypto.SHA256, hashed, sig, nil) == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,276 @@
+package verify
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/abcxyz/pkg/testutil"
+	"github.com/google/go-cmp/cmp"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func publicKeyPEM(t *testing.T, key crypto.PublicKey) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey() error = %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+func bundleJSON(t *testing.T, content string, sig []byte) []byte {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	b, err := json.Marshal(map[string]any{
+		"mediaType": "application/vnd.dev.sigstore.bundle.v0.3+json",
+		"messageSignature": map[string]any{
+			"messageDigest": map[string]any{"algorithm": "SHA2_256", "digest": sum[:]},
+			"signature":     sig,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	return b
+}
+
+func TestParseSignature(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		name    string
+		in      string
+		want    *Signature
+		wantErr string
+	}{
+		{
+			name: "cosign signature",
+			in:   base64.StdEncoding.EncodeToString([]byte("sig")) + "\n",
+			want: &Signature{Sig: []byte("sig")},
+		},
+		{
+			name: "bundle",
+			in:   string(bundleJSON(t, "content", []byte("sig"))),
+			want: &Signature{Digest: digest.FromString("content"), Sig: []byte("sig")},
+		},
+		{
+			name:    "not base64",
+			in:      "not a signature",
+			wantErr: "failed to decode signature",
+		},
+		{
+			name:    "not a bundle",
+			in:      `{"mediaType":"application/json"}`,
+			wantErr: `unsupported bundle media type "application/json"`,
+		},
+		{
+			name:    "dsse bundle",
+			in:      `{"mediaType":"application/vnd.dev.sigstore.bundle.v0.3+json","dsseEnvelope":{}}`,
+			wantErr: "DSSE envelope are not supported",
+		},
+		{
+			name:    "unsupported digest",
+			in:      `{"mediaType":"application/vnd.dev.sigstore.bundle.v0.3+json","messageSignature":{"messageDigest":{"algorithm":"SHA2_512"}}}`,
+			wantErr: `unsupported digest algorithm "SHA2_512"`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ParseSignature([]byte(tc.in))
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Errorf("ParseSignature() error diff: %s", diff)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ParseSignature() mismatch (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	sum := sha256.Sum256([]byte("content"))
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, sum[:])
+	if err != nil {
+		t.Fatalf("SignASN1() error = %v", err)
+	}
+	rsaSig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15() error = %v", err)
+	}
+	otherSig, err := ecdsa.SignASN1(rand.Reader, otherKey, sum[:])
+	if err != nil {
+		t.Fatalf("SignASN1() error = %v", err)
+	}
+
+	v, err := NewVerifier(publicKeyPEM(t, &ecKey.PublicKey), publicKeyPEM(t, &rsaKey.PublicKey))
+	if err != nil {
+		t.Fatalf("NewVerifier() error = %v", err)
+	}
+
+	d := digest.FromString("content")
+	cases := []struct {
+		name    string
+		digest  digest.Digest
+		sigs    []*Signature
+		wantErr error
+	}{
+		{
+			name:   "ecdsa",
+			digest: d,
+			sigs:   []*Signature{{Sig: ecSig}},
+		},
+		{
+			name:   "rsa bundle",
+			digest: d,
+			sigs:   []*Signature{{Digest: d, Sig: rsaSig}},
+		},
+		{
+			name:   "one of several",
+			digest: d,
+			sigs:   []*Signature{{Sig: otherSig}, {Sig: ecSig}},
+		},
+		{
+			name:    "unsigned",
+			digest:  d,
+			wantErr: ErrUnsigned,
+		},
+		{
+			name:    "bundle of another artifact",
+			digest:  d,
+			sigs:    []*Signature{{Digest: digest.FromString("other"), Sig: ecSig}},
+			wantErr: ErrUnsigned,
+		},
+		{
+			name:    "untrusted key",
+			digest:  d,
+			sigs:    []*Signature{{Sig: otherSig}},
+			wantErr: ErrInvalid,
+		},
+		{
+			name:    "signature of other content",
+			digest:  digest.FromString("tampered"),
+			sigs:    []*Signature{{Sig: ecSig}},
+			wantErr: ErrInvalid,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			if err := v.Verify(tc.digest, tc.sigs); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Verify() error = %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadVerifier(t *testing.T) {
+	t.Parallel()
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	edKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, b, 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		return p
+	}
+	ecPath := write("cosign.pub", publicKeyPEM(t, &ecKey.PublicKey))
+	edPath := write("ed25519.pub", publicKeyPEM(t, edKey))
+	garbagePath := write("garbage.pub", []byte("garbage"))
+
+	cases := []struct {
+		name    string
+		paths   []string
+		wantErr string
+	}{
+		{
+			name:  "ecdsa",
+			paths: []string{ecPath},
+		},
+		{
+			name:    "no keys",
+			wantErr: "at least one public key is required",
+		},
+		{
+			name:    "missing file",
+			paths:   []string{filepath.Join(dir, "missing.pub")},
+			wantErr: "failed to read public key",
+		},
+		{
+			name:    "not pem",
+			paths:   []string{ecPath, garbagePath},
+			wantErr: "key 1: no PEM block found",
+		},
+		{
+			name:    "ed25519",
+			paths:   []string{edPath},
+			wantErr: "unsupported key type ed25519.PublicKey",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := LoadVerifier(tc.paths...)
+			if diff := testutil.DiffErrString(err, tc.wantErr); diff != "" {
+				t.Errorf("LoadVerifier() error diff: %s", diff)
+			}
+		})
+	}
+}
+
+func TestSignaturesFromContext(t *testing.T) {
+	t.Parallel()
+
+	if got := SignaturesFromContext(context.Background()); got != nil {
+		t.Errorf("SignaturesFromContext() = %v, want nil", got)
+	}
+	sigs := []*Signature{{Sig: []byte("sig")}}
+	if diff := cmp.Diff(sigs, SignaturesFromContext(WithSignatures(context.Background(), sigs))); diff != "" {
+		t.Errorf("SignaturesFromContext() mismatch (-want, +got):\n%s", diff)
+	}
+}